@@ -0,0 +1,93 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/aifoundry-org/storage-manager/pkg/cache"
+	"github.com/aifoundry-org/storage-manager/pkg/cache/casdir"
+	"github.com/aifoundry-org/storage-manager/pkg/cache/ocidir"
+	"github.com/aifoundry-org/storage-manager/pkg/cache/s3"
+	"github.com/aifoundry-org/storage-manager/pkg/cache/tiered"
+	"github.com/aifoundry-org/storage-manager/pkg/config"
+	"github.com/aifoundry-org/storage-manager/pkg/quota"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// cache backends
+const (
+	// backendOCIDir an OCI image layout
+	backendOCIDir = "ocidir"
+	// backendCASDir a plain content-addressable directory, with names in an embedded database
+	backendCASDir = "casdir"
+	// backendS3 a bucket of an S3-compatible object store
+	backendS3 = "s3"
+)
+
+// defaultSharedGracePeriod how old unreferenced content in a shared tier directory must be
+// before GC removes it, when not configured
+const defaultSharedGracePeriod = time.Hour
+
+// openCache open the cache described by the settings; with a shared tier, a *tiered.Cache
+func openCache(cfg config.Cache, logger *log.Logger) (cache.Cache, error) {
+	if cfg.Backend == backendS3 {
+		// metadata is still kept in the cache directory
+		if err := os.MkdirAll(cfg.Dir, 0755); err != nil {
+			return nil, fmt.Errorf("could not create cache directory %s: %v", cfg.Dir, err)
+		}
+	}
+	// processes sharing the cache directory on this node see each other's protected keys, so
+	// GC of the local tier needs no grace period
+	local, err := openBackend(cfg.Backend, cfg.Dir, 0, cfg.S3)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Shared.Backend == "" {
+		return local, nil
+	}
+	if cfg.Backend == backendS3 {
+		return nil, fmt.Errorf("a cache with a shared tier must be in the cache directory, not %s", backendS3)
+	}
+	if cfg.Shared.Backend != backendS3 && cfg.Shared.Dir == "" {
+		return nil, fmt.Errorf("a shared tier with backend %s needs cache.shared.dir", cfg.Shared.Backend)
+	}
+	gracePeriod := cfg.Shared.GCGracePeriod
+	if gracePeriod == 0 {
+		gracePeriod = defaultSharedGracePeriod
+	}
+	shared, err := openBackend(cfg.Shared.Backend, cfg.Shared.Dir, gracePeriod, cfg.S3)
+	if err != nil {
+		return nil, fmt.Errorf("could not open shared tier: %v", err)
+	}
+	return tiered.New(local, shared, tiered.Mode(cfg.Shared.Write), logger)
+}
+
+// openBackend open a cache with the backend: in dir for ocidir and casdir, with the grace
+// period for GC, or in the object store for s3
+func openBackend(backend, dir string, gracePeriod time.Duration, s3cfg config.S3) (cache.Cache, error) {
+	switch backend {
+	case "", backendOCIDir:
+		return ocidir.New(dir, gracePeriod)
+	case backendCASDir:
+		return casdir.New(dir, gracePeriod)
+	case backendS3:
+		partSize, err := quota.ParseLimit(s3cfg.PartSize)
+		if err != nil || partSize.Percent != 0 {
+			return nil, fmt.Errorf("invalid cache.s3.partSize %s", s3cfg.PartSize)
+		}
+		return s3.New(s3.Config{
+			Endpoint:    s3cfg.Endpoint,
+			Bucket:      s3cfg.Bucket,
+			Prefix:      s3cfg.Prefix,
+			Region:      s3cfg.Region,
+			AccessKey:   s3cfg.AccessKey,
+			SecretKey:   s3cfg.SecretKey,
+			Insecure:    s3cfg.Insecure,
+			PartSize:    uint64(partSize.Bytes),
+			GracePeriod: s3cfg.GCGracePeriod,
+		})
+	}
+	return nil, fmt.Errorf("unknown cache backend %s, must be %s, %s or %s", backend, backendOCIDir, backendCASDir, backendS3)
+}
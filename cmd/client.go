@@ -0,0 +1,61 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/aifoundry-org/storage-manager/pkg/client"
+
+	"github.com/spf13/cobra"
+)
+
+const (
+	outputText = "text"
+	outputJSON = "json"
+)
+
+// addOutputFlag add the flag that selects the output format of a client command
+func addOutputFlag(cmd *cobra.Command) {
+	cmd.Flags().StringP("output", "o", outputText, "output format, one of: text, json")
+}
+
+// outputFormat get the selected output format of a client command
+func outputFormat(cmd *cobra.Command) (string, error) {
+	output, err := cmd.Flags().GetString("output")
+	if err != nil {
+		return "", err
+	}
+	switch output {
+	case outputText, outputJSON:
+		return output, nil
+	default:
+		return "", fmt.Errorf("unsupported output format %s", output)
+	}
+}
+
+// newClient get a client for the storage manager at the configured address
+func newClient(cmd *cobra.Command) (*client.Client, error) {
+	addr, err := cmd.Flags().GetString("address")
+	if err != nil {
+		return nil, err
+	}
+	return client.New(addr)
+}
+
+// printJSON write v as indented json
+func printJSON(w io.Writer, v any) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(v)
+}
+
+// isTerminal whether the file is an interactive terminal
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return info.Mode()&os.ModeCharDevice != 0
+}
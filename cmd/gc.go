@@ -0,0 +1,60 @@
+package cmd
+
+import (
+	"fmt"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+func gcCmd(_ *viper.Viper) (*cobra.Command, error) {
+	cmd := &cobra.Command{
+		Use:   "gc",
+		Short: "Clean up unreferenced content in the cache of a running storage manager",
+		Args:  cobra.NoArgs,
+		RunE: func(c *cobra.Command, args []string) error {
+			output, err := outputFormat(c)
+			if err != nil {
+				return err
+			}
+			dryRun, _ := c.Flags().GetBool("dry-run")
+			shared, _ := c.Flags().GetBool("shared")
+			cl, err := newClient(c)
+			if err != nil {
+				return err
+			}
+			if dryRun {
+				report, err := cl.GCDryRun(c.Context(), shared)
+				if err != nil {
+					return err
+				}
+				if output == outputJSON {
+					return printJSON(c.OutOrStdout(), report)
+				}
+				w := tabwriter.NewWriter(c.OutOrStdout(), 0, 4, 2, ' ', 0)
+				fmt.Fprintln(w, "DIGEST\tSIZE")
+				for _, blob := range report.Blobs {
+					fmt.Fprintf(w, "%s\t%s\n", blob.Digest, humanBytes(blob.Size))
+				}
+				if err := w.Flush(); err != nil {
+					return err
+				}
+				fmt.Fprintf(c.OutOrStdout(), "gc would free %s in %d blobs\n", humanBytes(report.Size), len(report.Blobs))
+				return nil
+			}
+			if err := cl.GC(c.Context(), shared); err != nil {
+				return err
+			}
+			if output == outputJSON {
+				return printJSON(c.OutOrStdout(), map[string]bool{"gc": true})
+			}
+			fmt.Fprintln(c.OutOrStdout(), "gc complete")
+			return nil
+		},
+	}
+	cmd.Flags().Bool("dry-run", false, "only report the content that would be cleaned up")
+	cmd.Flags().Bool("shared", false, "clean up the shared tier of the cache, used by every node, rather than the cache itself; only content older than cache.shared.gcGracePeriod is removed")
+	addOutputFlag(cmd)
+	return cmd, nil
+}
@@ -0,0 +1,69 @@
+package cmd
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+func inspectCmd(_ *viper.Viper) (*cobra.Command, error) {
+	cmd := &cobra.Command{
+		Use:   "inspect <url>",
+		Short: "Show the details of content in the cache of a running storage manager",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(c *cobra.Command, args []string) error {
+			output, err := outputFormat(c)
+			if err != nil {
+				return err
+			}
+			cl, err := newClient(c)
+			if err != nil {
+				return err
+			}
+			content, err := cl.Inspect(c.Context(), args[0])
+			if err != nil {
+				return err
+			}
+			if output == outputJSON {
+				return printJSON(c.OutOrStdout(), content)
+			}
+			w := c.OutOrStdout()
+			fmt.Fprintf(w, "URL:    %s\n", content.URL)
+			fmt.Fprintf(w, "Digest: %s\n", content.Digest)
+			if content.Path != "" {
+				fmt.Fprintf(w, "Path:   %s\n", content.Path)
+			}
+			if len(content.Pins) > 0 {
+				fmt.Fprintf(w, "Pins:   %s\n", strings.Join(content.Pins, ", "))
+			}
+			for _, l := range content.Leases {
+				fmt.Fprintf(w, "Lease:  %s until %s\n", l.ID, l.ExpiresAt.Format(time.RFC3339))
+			}
+			if content.ExpiresAt != nil {
+				fmt.Fprintf(w, "Expires: %s\n", content.ExpiresAt.Format(time.RFC3339))
+			}
+			if v := content.Verification; v != nil {
+				for _, sig := range v.Signatures {
+					fmt.Fprintf(w, "Signed: %s signature %s, verified with %s at %s\n", sig.Format, sig.Digest, sig.Key, v.VerifiedAt.Format(time.RFC3339))
+				}
+			}
+			if v := content.Validators; v != nil {
+				if v.ETag != "" {
+					fmt.Fprintf(w, "ETag:   %s\n", v.ETag)
+				}
+				if v.LastModified != "" {
+					fmt.Fprintf(w, "Last-Modified: %s\n", v.LastModified)
+				}
+			}
+			if content.DeletePending {
+				fmt.Fprintln(w, "Removed when its leases end")
+			}
+			return nil
+		},
+	}
+	addOutputFlag(cmd)
+	return cmd, nil
+}
@@ -0,0 +1,42 @@
+package cmd
+
+import (
+	"fmt"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+func lsCmd(_ *viper.Viper) (*cobra.Command, error) {
+	cmd := &cobra.Command{
+		Use:   "ls",
+		Short: "List the content in the cache of a running storage manager",
+		Args:  cobra.NoArgs,
+		RunE: func(c *cobra.Command, args []string) error {
+			output, err := outputFormat(c)
+			if err != nil {
+				return err
+			}
+			cl, err := newClient(c)
+			if err != nil {
+				return err
+			}
+			contents, err := cl.List(c.Context())
+			if err != nil {
+				return err
+			}
+			if output == outputJSON {
+				return printJSON(c.OutOrStdout(), contents)
+			}
+			w := tabwriter.NewWriter(c.OutOrStdout(), 0, 4, 2, ' ', 0)
+			fmt.Fprintln(w, "DIGEST\tURL")
+			for _, content := range contents {
+				fmt.Fprintf(w, "%s\t%s\n", content.Digest, content.URL)
+			}
+			return w.Flush()
+		},
+	}
+	addOutputFlag(cmd)
+	return cmd, nil
+}
@@ -0,0 +1,40 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+func pathCmd(_ *viper.Viper) (*cobra.Command, error) {
+	cmd := &cobra.Command{
+		Use:   "path <url>",
+		Short: "Print the local path of content in the cache of a running storage manager",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(c *cobra.Command, args []string) error {
+			output, err := outputFormat(c)
+			if err != nil {
+				return err
+			}
+			cl, err := newClient(c)
+			if err != nil {
+				return err
+			}
+			content, err := cl.Inspect(c.Context(), args[0])
+			if err != nil {
+				return err
+			}
+			if content.Path == "" {
+				return fmt.Errorf("no local path for %s", args[0])
+			}
+			if output == outputJSON {
+				return printJSON(c.OutOrStdout(), map[string]string{"url": content.URL, "path": content.Path})
+			}
+			fmt.Fprintln(c.OutOrStdout(), content.Path)
+			return nil
+		},
+	}
+	addOutputFlag(cmd)
+	return cmd, nil
+}
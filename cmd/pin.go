@@ -0,0 +1,39 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+func pinCmd(_ *viper.Viper) (*cobra.Command, error) {
+	cmd := &cobra.Command{
+		Use:   "pin <url>...",
+		Short: "Pin content in the cache of a running storage manager, protecting it from eviction and deletion",
+		Args:  cobra.MinimumNArgs(1),
+		RunE: func(c *cobra.Command, args []string) error {
+			remove, _ := c.Flags().GetBool("remove")
+			cl, err := newClient(c)
+			if err != nil {
+				return err
+			}
+			for _, u := range args {
+				if remove {
+					if err := cl.Unpin(c.Context(), u); err != nil {
+						return fmt.Errorf("could not unpin %s: %v", u, err)
+					}
+					fmt.Fprintf(c.OutOrStdout(), "unpinned %s\n", u)
+					continue
+				}
+				if err := cl.Pin(c.Context(), u); err != nil {
+					return fmt.Errorf("could not pin %s: %v", u, err)
+				}
+				fmt.Fprintf(c.OutOrStdout(), "pinned %s\n", u)
+			}
+			return nil
+		},
+	}
+	cmd.Flags().Bool("remove", false, "remove the pin instead")
+	return cmd, nil
+}
@@ -0,0 +1,125 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+
+	"github.com/aifoundry-org/storage-manager/pkg/api"
+)
+
+const progressBarWidth = 30
+
+// progressBars render progress bars for blobs to a terminal. Each finished blob gets its own
+// line; the blobs still being written share a line at the bottom, which is redrawn in place.
+type progressBars struct {
+	w      io.Writer
+	active []string
+	state  map[string]api.Progress
+	drawn  bool
+}
+
+func newProgressBars(w io.Writer) *progressBars {
+	return &progressBars{w: w, state: map[string]api.Progress{}}
+}
+
+// Update redraw the bars with the progress update
+func (p *progressBars) Update(progress api.Progress) {
+	// a blob whose key is only known once it is written reports an empty key until then
+	if _, ok := p.state[progress.Key]; !ok && progress.Done {
+		delete(p.state, "")
+		p.remove("")
+	}
+	if _, ok := p.state[progress.Key]; !ok && !progress.Done {
+		p.active = append(p.active, progress.Key)
+	}
+	if progress.Done {
+		delete(p.state, progress.Key)
+		p.remove(progress.Key)
+		fmt.Fprintf(p.w, "\r\033[K%s %s %s\n", shortKey(progress.Key), bar(progress), byteCount(progress))
+		p.drawn = false
+	} else {
+		p.state[progress.Key] = progress
+	}
+	p.draw()
+}
+
+// Finish end the bars
+func (p *progressBars) Finish() {
+	if p.drawn {
+		fmt.Fprintln(p.w)
+	}
+	p.active, p.state, p.drawn = nil, map[string]api.Progress{}, false
+}
+
+// draw the line for the blobs still being written
+func (p *progressBars) draw() {
+	switch len(p.active) {
+	case 0:
+		return
+	case 1:
+		progress := p.state[p.active[0]]
+		fmt.Fprintf(p.w, "\r\033[K%s %s %s", shortKey(progress.Key), bar(progress), byteCount(progress))
+	default:
+		// the total is only known if every size is
+		var total api.Progress
+		known := true
+		for _, key := range p.active {
+			progress := p.state[key]
+			total.Written += progress.Written
+			total.Size += progress.Size
+			known = known && progress.Size > 0
+		}
+		if !known {
+			total.Size = 0
+		}
+		fmt.Fprintf(p.w, "\r\033[K%d blobs %s %s", len(p.active), bar(total), byteCount(total))
+	}
+	p.drawn = true
+}
+
+func (p *progressBars) remove(key string) {
+	p.active = slices.DeleteFunc(p.active, func(k string) bool { return k == key })
+}
+
+func bar(progress api.Progress) string {
+	filled := 0
+	switch {
+	case progress.Done:
+		filled = progressBarWidth
+	case progress.Size > 0:
+		filled = int(progress.Written * progressBarWidth / progress.Size)
+		filled = min(filled, progressBarWidth)
+	}
+	return "[" + strings.Repeat("=", filled) + strings.Repeat(" ", progressBarWidth-filled) + "]"
+}
+
+func byteCount(progress api.Progress) string {
+	if progress.Size > 0 {
+		return fmt.Sprintf("%s/%s", humanBytes(progress.Written), humanBytes(progress.Size))
+	}
+	return humanBytes(progress.Written)
+}
+
+// shortKey shorten a digest for display
+func shortKey(key string) string {
+	if i := strings.Index(key, ":"); i >= 0 && len(key) > i+13 {
+		return key[:i+13]
+	}
+	return key
+}
+
+// humanBytes format a size in bytes with a binary unit suffix
+func humanBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,66 @@
+package cmd
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/aifoundry-org/storage-manager/pkg/api"
+)
+
+func TestProgressBars(t *testing.T) {
+	var out strings.Builder
+	p := newProgressBars(&out)
+	// the last line drawn, as a terminal shows it after carriage returns and clears
+	last := func() string {
+		s := out.String()
+		if i := strings.LastIndex(s, "\r\033[K"); i >= 0 {
+			s = s[i+len("\r\033[K"):]
+		}
+		return s
+	}
+
+	p.Update(api.Progress{Key: "sha256:0123456789abcdef", Size: 2048, Written: 1024})
+	if got, want := last(), "sha256:0123456789ab ["+strings.Repeat("=", 15)+strings.Repeat(" ", 15)+"] 1.0KiB/2.0KiB"; got != want {
+		t.Errorf("one blob: got %q, want %q", got, want)
+	}
+	// blobs being written share a line, and the total is unknown while any size is
+	p.Update(api.Progress{Key: "sha256:fedcba9876543210", Written: 512})
+	if got, want := last(), "2 blobs ["+strings.Repeat(" ", 30)+"] 1.5KiB"; got != want {
+		t.Errorf("two blobs: got %q, want %q", got, want)
+	}
+	// a finished blob gets a line of its own, and the other is drawn below it
+	p.Update(api.Progress{Key: "sha256:0123456789abcdef", Size: 2048, Written: 2048, Done: true})
+	if !strings.Contains(out.String(), "sha256:0123456789ab ["+strings.Repeat("=", 30)+"] 2.0KiB/2.0KiB\n") {
+		t.Errorf("finished blob has no line of its own: %q", out.String())
+	}
+	if got, want := last(), "sha256:fedcba987654 ["+strings.Repeat(" ", 30)+"] 512B"; got != want {
+		t.Errorf("remaining blob: got %q, want %q", got, want)
+	}
+	p.Finish()
+	if !strings.HasSuffix(out.String(), "512B\n") {
+		t.Errorf("finish does not end the line: %q", out.String())
+	}
+
+	// a blob whose key is only known once written replaces its unnamed bar
+	out.Reset()
+	p.Update(api.Progress{Written: 10})
+	p.Update(api.Progress{Key: "sha256:aaaaaaaaaaaaaaaa", Written: 20, Done: true})
+	if len(p.active) != 0 || len(p.state) != 0 {
+		t.Errorf("unnamed blob left behind: %v %v", p.active, p.state)
+	}
+}
+
+func TestHumanBytes(t *testing.T) {
+	for n, want := range map[int64]string{
+		0:               "0B",
+		1023:            "1023B",
+		1024:            "1.0KiB",
+		1536:            "1.5KiB",
+		5 * 1024 * 1024: "5.0MiB",
+		3 << 40:         "3.0TiB",
+	} {
+		if got := humanBytes(n); got != want {
+			t.Errorf("humanBytes(%d): got %q, want %q", n, got, want)
+		}
+	}
+}
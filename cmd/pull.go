@@ -0,0 +1,177 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/aifoundry-org/storage-manager/pkg/api"
+	"github.com/aifoundry-org/storage-manager/pkg/cache"
+	"github.com/aifoundry-org/storage-manager/pkg/cache/metadata"
+	"github.com/aifoundry-org/storage-manager/pkg/cache/tiered"
+	"github.com/aifoundry-org/storage-manager/pkg/config"
+	"github.com/aifoundry-org/storage-manager/pkg/download"
+	"github.com/aifoundry-org/storage-manager/pkg/pull"
+	"github.com/aifoundry-org/storage-manager/pkg/quota"
+
+	"github.com/opencontainers/go-digest"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+func pullCmd(v *viper.Viper) (*cobra.Command, error) {
+	cmd := &cobra.Command{
+		Use:   "pull <url>...",
+		Short: "Ensure content is in the cache of a running storage manager, or of a cache directory",
+		Long: `Ask a running storage manager to ensure the content at each URL is in its cache,
+downloading it if needed. Shows progress while downloading.
+
+If --cache-dir is given, no server is needed: the content is downloaded in-process directly
+into the cache directory. This takes the same lock as the storage manager, so it is safe to
+run while one is using the same directory, or before one is started.`,
+		Args: cobra.MinimumNArgs(1),
+		RunE: func(c *cobra.Command, args []string) error {
+			output, err := outputFormat(c)
+			if err != nil {
+				return err
+			}
+			creds, _ := c.Flags().GetString("credentials")
+			credsType, _ := c.Flags().GetString("credentials-type")
+			ttl, _ := c.Flags().GetDuration("ttl")
+			timeout, _ := c.Flags().GetDuration("timeout")
+			platform, _ := c.Flags().GetString("platform")
+			artifactType, _ := c.Flags().GetString("artifact-type")
+			expected, _ := c.Flags().GetString("digest")
+			if ttl != 0 && c.Flags().Changed("cache-dir") {
+				return fmt.Errorf("--ttl needs a running storage manager to remove the content when it expires")
+			}
+			pullFn, err := puller(c, v)
+			if err != nil {
+				return err
+			}
+			var contents []api.Content
+			for _, u := range args {
+				source := download.ContentSource{
+					URL:             u,
+					Credentials:     creds,
+					CredentialsType: credsType,
+					Platform:        platform,
+					ArtifactType:    artifactType,
+					Digest:          expected,
+				}
+				if ttl != 0 {
+					source.TTL = ttl.String()
+				}
+				var progress func(api.Progress)
+				bars := newProgressBars(os.Stderr)
+				if output == outputText && isTerminal(os.Stderr) {
+					progress = bars.Update
+				}
+				ctx, cancel := c.Context(), context.CancelFunc(func() {})
+				if timeout > 0 {
+					ctx, cancel = context.WithTimeout(ctx, timeout)
+				}
+				content, err := pullFn(ctx, source, progress)
+				cancel()
+				bars.Finish()
+				if err != nil {
+					return fmt.Errorf("could not pull %s: %v", u, err)
+				}
+				contents = append(contents, *content)
+				if output == outputText {
+					fmt.Fprintf(c.OutOrStdout(), "%s %s\n", content.Digest, content.URL)
+				}
+			}
+			if output == outputJSON {
+				return printJSON(c.OutOrStdout(), contents)
+			}
+			return nil
+		},
+	}
+	flags := cmd.Flags()
+	flags.String("credentials", "", "credentials to use when downloading the content")
+	flags.String("credentials-type", "", "type of the credentials, e.g. Bearer or Basic")
+	flags.Duration("ttl", 0, "remove the content from the cache this long after it is pulled, e.g. 24h")
+	flags.Duration("timeout", 0, "give up on each pull after this long, e.g. 10m; 0 waits for as long as it takes")
+	flags.String("platform", "", "platform of the manifest to pull from an OCI index, e.g. linux/arm64, or all; defaults to that of the storage manager")
+	flags.String("artifact-type", "", "only pull the manifests of an OCI index with this artifact type or media type")
+	flags.String("digest", "", "digest the content must have, e.g. sha256:<hex>; content with it already in the cache is not downloaded")
+	addOutputFlag(cmd)
+	return cmd, nil
+}
+
+// puller get the function to pull content: in-process into the cache directory if one was
+// given explicitly, else through a running storage manager
+func puller(cmd *cobra.Command, v *viper.Viper) (func(context.Context, download.ContentSource, func(api.Progress)) (*api.Content, error), error) {
+	if !cmd.Flags().Changed("cache-dir") {
+		cl, err := newClient(cmd)
+		if err != nil {
+			return nil, err
+		}
+		return cl.Pull, nil
+	}
+	// the cache and the downloaders are configured just as in the server
+	var cfg config.Config
+	if err := v.Unmarshal(&cfg); err != nil {
+		return nil, fmt.Errorf("invalid configuration: %v", err)
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid configuration: %v", err)
+	}
+	// nothing is left running to write back to a shared tier once the pull is done
+	cfg.Cache.Shared.Write = string(tiered.WriteThrough)
+	c, err := openCache(cfg.Cache, log.StandardLogger())
+	if err != nil {
+		return nil, err
+	}
+	// only the local tier of a tiered cache is limited by the quota
+	local := c
+	if t, ok := c.(*tiered.Cache); ok {
+		local = t.Local()
+	}
+	// record access and make room just as the server does, so that the server's quota
+	// considers the content pulled here too
+	meta, err := metadata.Open(filepath.Join(cfg.Cache.Dir, metadata.FileName))
+	if err != nil {
+		return nil, err
+	}
+	limit, err := quota.ParseLimit(cfg.Cache.MaxSize)
+	if err != nil {
+		return nil, fmt.Errorf("invalid maximum cache size: %v", err)
+	}
+	reserve, err := quota.ParseLimit(cfg.Cache.DiskReserve)
+	if err != nil {
+		return nil, fmt.Errorf("invalid disk reserve: %v", err)
+	}
+	policy, err := quota.New(local, meta, cfg.Cache.Dir, limit, nil, log.StandardLogger())
+	if err != nil {
+		return nil, err
+	}
+	policy.SetReserve(reserve)
+	p := pull.New(c, log.StandardLogger())
+	p.SetMetadata(meta)
+	p.SetQuota(policy)
+	p.SetOptions(cfg.DownloadOptions())
+	p.SetBlobConcurrency(cfg.Limits.MaxConcurrentBlobs)
+	p.SetTimeout(cfg.Limits.PullTimeout)
+	p.SetDigestAlgorithm(digest.Algorithm(cfg.Cache.DigestAlgorithm))
+	return func(ctx context.Context, source download.ContentSource, progress func(api.Progress)) (*api.Content, error) {
+		key, err := p.Pull(ctx, source, progress)
+		// access is only written now and then, and the process is about to exit
+		if err := meta.Flush(); err != nil {
+			log.Warnf("could not write metadata: %v", err)
+		}
+		if err != nil {
+			return nil, err
+		}
+		content := &api.Content{URL: source.URL, Digest: key}
+		if pather, ok := c.(cache.Pather); ok {
+			if path, err := pather.Path(key); err == nil {
+				content.Path = path
+			}
+		}
+		return content, nil
+	}, nil
+}
@@ -0,0 +1,54 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+func rmCmd(_ *viper.Viper) (*cobra.Command, error) {
+	cmd := &cobra.Command{
+		Use:   "rm <url>...",
+		Short: "Remove content from the cache of a running storage manager",
+		Args:  cobra.MinimumNArgs(1),
+		RunE: func(c *cobra.Command, args []string) error {
+			output, err := outputFormat(c)
+			if err != nil {
+				return err
+			}
+			cl, err := newClient(c)
+			if err != nil {
+				return err
+			}
+			shared, _ := c.Flags().GetBool("shared")
+			removed, deferred := []string{}, []string{}
+			for _, u := range args {
+				isDeferred, err := cl.Delete(c.Context(), u, shared)
+				if err != nil {
+					return fmt.Errorf("could not remove %s: %v", u, err)
+				}
+				if isDeferred {
+					deferred = append(deferred, u)
+				} else {
+					removed = append(removed, u)
+				}
+				if output != outputText {
+					continue
+				}
+				if isDeferred {
+					fmt.Fprintf(c.OutOrStdout(), "%s is leased, it will be removed when its leases end\n", u)
+				} else {
+					fmt.Fprintf(c.OutOrStdout(), "removed %s\n", u)
+				}
+			}
+			if output == outputJSON {
+				return printJSON(c.OutOrStdout(), map[string][]string{"removed": removed, "deferred": deferred})
+			}
+			return nil
+		},
+	}
+	cmd.Flags().Bool("shared", false, "also remove the content from the shared tier of the cache, for every node")
+	addOutputFlag(cmd)
+	return cmd, nil
+}
@@ -1,27 +1,51 @@
 package cmd
 
 import (
+	"context"
 	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
 	"strings"
+	"syscall"
 
-	"github.com/aifoundry-org/storage-manager/pkg/cache/ocidir"
+	"github.com/aifoundry-org/storage-manager/pkg/cache/metadata"
+	"github.com/aifoundry-org/storage-manager/pkg/cache/tiered"
+	"github.com/aifoundry-org/storage-manager/pkg/config"
+	"github.com/aifoundry-org/storage-manager/pkg/events"
+	"github.com/aifoundry-org/storage-manager/pkg/preload"
+	"github.com/aifoundry-org/storage-manager/pkg/pull"
+	"github.com/aifoundry-org/storage-manager/pkg/quota"
+	"github.com/aifoundry-org/storage-manager/pkg/retention"
 	"github.com/aifoundry-org/storage-manager/pkg/server"
 
+	"github.com/fsnotify/fsnotify"
+	"github.com/opencontainers/go-digest"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
 )
 
-type subCommand func() (*cobra.Command, error)
+// subCommand creates a subcommand; v is the configuration shared by all commands, populated
+// before the subcommand runs
+type subCommand func(v *viper.Viper) (*cobra.Command, error)
 
-var subCommands = []subCommand{}
+var subCommands = []subCommand{
+	pullCmd,
+	lsCmd,
+	inspectCmd,
+	rmCmd,
+	gcCmd,
+	pathCmd,
+	pinCmd,
+}
 
 func rootCmd() (*cobra.Command, error) {
 	var (
 		v      *viper.Viper
 		cmd    *cobra.Command
-		logger = log.New()
+		logger = log.StandardLogger()
 	)
 	cmd = &cobra.Command{
 		Use:   "storage-manager",
@@ -34,34 +58,124 @@ Run with --help for more information.
 		`,
 		Version: GetVersionString(),
 		PersistentPreRunE: func(c *cobra.Command, args []string) error {
-			bindFlags(cmd, v)
-			logLevel := v.GetInt("verbose")
-			switch logLevel {
-			case 0:
-				logger.SetLevel(log.InfoLevel)
-			case 1:
-				logger.SetLevel(log.DebugLevel)
-			case 2:
-				logger.SetLevel(log.TraceLevel)
+			if configFile, _ := c.Flags().GetString("config"); configFile != "" {
+				v.SetConfigFile(configFile)
+				if err := v.ReadInConfig(); err != nil {
+					return fmt.Errorf("could not read config file %s: %v", configFile, err)
+				}
 			}
+			bindFlags(c, v)
+			setLogLevel(logger, v.GetInt(configKey("verbose")))
 
 			return nil
 		},
 		RunE: func(c *cobra.Command, args []string) error {
-			addr := v.GetString("address")
+			var cfg config.Config
+			if err := v.Unmarshal(&cfg); err != nil {
+				return fmt.Errorf("invalid configuration: %v", err)
+			}
+			if err := cfg.Validate(); err != nil {
+				return fmt.Errorf("invalid configuration: %v", err)
+			}
+			addr := cfg.Server.Address
 			logger.Infof("Starting server on %s", addr)
-			cacheDir := v.GetString("cache-dir")
+			cacheDir := cfg.Cache.Dir
 			logger.Infof("Cache directory is %s", cacheDir)
 
 			// get a reference to the cache
-			cache, err := ocidir.New(cacheDir)
+			cache, err := openCache(cfg.Cache, logger)
+			if err != nil {
+				return err
+			}
+			// only the local tier of a tiered cache is limited by the quota
+			local := cache
+			if t, ok := cache.(*tiered.Cache); ok {
+				logger.Infof("Shared cache tier is %s", cfg.Cache.Shared.Backend)
+				local = t.Local()
+				go t.Run(c.Context())
+			}
+
+			meta, err := metadata.Open(filepath.Join(cacheDir, metadata.FileName))
 			if err != nil {
 				return err
 			}
+			bus := events.New()
+
+			puller := pull.New(cache, logger)
+			puller.SetMetadata(meta)
+			limit, err := quota.ParseLimit(cfg.Cache.MaxSize)
+			if err != nil {
+				return fmt.Errorf("invalid maximum cache size: %v", err)
+			}
+			policy, err := quota.New(local, meta, cacheDir, limit, bus, logger)
+			if err != nil {
+				return err
+			}
+			puller.SetQuota(policy)
+			if !limit.IsZero() {
+				logger.Infof("Maximum cache size is %s", cfg.Cache.MaxSize)
+			}
+			reserve, err := quota.ParseLimit(cfg.Cache.DiskReserve)
+			if err != nil {
+				return fmt.Errorf("invalid disk reserve: %v", err)
+			}
+			policy.SetReserve(reserve)
+			applyConfig(&cfg, logger, puller)
+
+			// pick up changes to the settings that are safe to change at runtime
+			if v.ConfigFileUsed() != "" {
+				v.OnConfigChange(func(e fsnotify.Event) {
+					var newCfg config.Config
+					err := v.Unmarshal(&newCfg)
+					if err == nil {
+						err = newCfg.Validate()
+					}
+					if err != nil {
+						logger.Errorf("invalid configuration in %s, keeping the previous one: %v", e.Name, err)
+						return
+					}
+					logger.Infof("configuration file %s changed, reloading", e.Name)
+					if newCfg.Server != cfg.Server || newCfg.Cache.Dir != cfg.Cache.Dir || newCfg.Cache.Backend != cfg.Cache.Backend || newCfg.Cache.S3 != cfg.Cache.S3 || newCfg.Cache.Shared != cfg.Cache.Shared || newCfg.Preload != cfg.Preload {
+						logger.Warnf("changes to server, cache directory, cache backend and tier, and preload settings require a restart")
+					}
+					applyConfig(&newCfg, logger, puller)
+					if limit, err := quota.ParseLimit(newCfg.Cache.MaxSize); err != nil {
+						logger.Errorf("invalid maximum cache size, keeping the previous one: %v", err)
+					} else {
+						policy.SetLimit(limit)
+					}
+					if reserve, err := quota.ParseLimit(newCfg.Cache.DiskReserve); err != nil {
+						logger.Errorf("invalid disk reserve, keeping the previous one: %v", err)
+					} else {
+						policy.SetReserve(reserve)
+					}
+				})
+				v.WatchConfig()
+			}
+
+			// protect pinned and leased content, and clean up leases as they expire
+			retain := retention.New(cache, meta, bus, logger)
+			go retain.Run(c.Context(), retention.ExpireInterval)
 
 			// Start the server
-			srv := server.New(addr, cache, logger)
-			if err := srv.Start(); err != nil {
+			srv := server.New(addr, cache, puller, logger)
+			srv.SetMetadata(meta)
+			srv.SetEvents(bus)
+			srv.SetRetention(retain)
+
+			// keep the cache in line with the preload manifest, if there is one
+			if preloadPath := cfg.Preload.Manifest; preloadPath != "" {
+				logger.Infof("Preload manifest is %s", preloadPath)
+				reconciler := preload.New(preloadPath, cache, puller, cfg.Preload.Prune, logger)
+				reconciler.SetMetadata(meta)
+				srv.SetPreload(reconciler)
+				go func() {
+					if err := reconciler.Run(c.Context()); err != nil {
+						logger.Errorf("preload manifest %s: %v", preloadPath, err)
+					}
+				}()
+			}
+			if err := srv.Start(c.Context()); err != nil {
 				return err
 			}
 			log.Info("exiting")
@@ -71,21 +185,36 @@ Run with --help for more information.
 
 	v = viper.New()
 	v.SetEnvPrefix("storage-manager")
-	v.SetEnvKeyReplacer(strings.NewReplacer("-", "_"))
+	v.SetEnvKeyReplacer(strings.NewReplacer("-", "_", ".", "_"))
 	v.AutomaticEnv()
 
 	// server hostname via CLI or env var
 	pflags := cmd.PersistentFlags()
-	pflags.String("address", "localhost:8050", "address and port for listening for API requests")
+	pflags.String("config", "", "yaml, toml or json configuration file; settings that are safe to change at runtime are reloaded when it changes")
+	pflags.String("address", "localhost:8050", "address and port, or Unix-domain socket, for listening for API requests, or for client commands to connect to")
 
 	// debug via CLI or env var or default
 	pflags.IntP("verbose", "v", 0, "set log level, 0 is info, 1 is debug, 2 is trace")
 
 	// which mode we are running in
 	pflags.String("cache-dir", "/var/lib/nekko/cache", "directory to store cached files")
+	pflags.String("cache-backend", backendOCIDir, "how the cache is kept: ocidir for an OCI image layout or casdir for plain content-addressable files in the cache directory, or s3 for the object store configured in cache.s3")
+
+	flags := cmd.Flags()
+	// how big the cache may grow before the least recently used content is evicted
+	flags.String("max-cache-size", "", "maximum size of the cache, e.g. 500G or 80% of the filesystem; least recently used unpinned content is evicted to stay within it")
+	// how much of the filesystem new content may not use
+	flags.String("disk-reserve", "", "free space to keep on the filesystem holding the cache, e.g. 10G or 5%; pulls that do not fit fail with 507, after evicting if there is a maximum cache size")
+
+	// content that must be in the cache
+	flags.String("preload", "", "yaml or json manifest of content that must be in the cache, reconciled at startup and whenever it changes")
+	flags.Bool("preload-prune", false, "remove content pulled for the preload manifest once it is no longer listed")
+
+	// registries without TLS, such as a local registry
+	flags.String("registry-insecure", "", "comma-separated OCI registry and mirror hosts, with their ports, to contact over plain HTTP rather than HTTPS")
 
 	for _, subCmd := range subCommands {
-		if sc, err := subCmd(); err != nil {
+		if sc, err := subCmd(v); err != nil {
 			return nil, err
 		} else {
 			cmd.AddCommand(sc)
@@ -95,27 +224,87 @@ Run with --help for more information.
 	return cmd, nil
 }
 
+// configKeys the keys in the config file of flags that live in a section of the file
+var configKeys = map[string]string{
+	"address":        "server.address",
+	"cache-dir":      "cache.dir",
+	"cache-backend":  "cache.backend",
+	"max-cache-size": "cache.maxSize",
+	"disk-reserve":   "cache.diskReserve",
+	"verbose":        "log.level",
+	"preload":        "preload.manifest",
+	"preload-prune":  "preload.prune",
+	// a comma-separated flag, which unmarshals into a list
+	"registry-insecure": "downloaders.oci.insecure",
+}
+
+// configKey the key of a flag in the config file
+func configKey(flag string) string {
+	if key, ok := configKeys[flag]; ok {
+		return key
+	}
+	return flag
+}
+
 // Bind each cobra flag to its associated viper configuration (config file and environment variable)
 func bindFlags(cmd *cobra.Command, v *viper.Viper) {
 	cmd.Flags().VisitAll(func(f *pflag.Flag) {
+		if f.Name == "config" {
+			return
+		}
 		// Determine the naming convention of the flags when represented in the config file
-		configName := f.Name
-		_ = v.BindPFlag(configName, f)
-		// Apply the viper config value to the flag when the flag is not set and viper has a value
+		configName := configKey(f.Name)
+		// the environment variable is always named after the flag, e.g. STORAGE_MANAGER_CACHE_DIR
+		_ = v.BindEnv(configName, "STORAGE_MANAGER_"+strings.ToUpper(strings.ReplaceAll(f.Name, "-", "_")))
+		// only a flag given on the command line wins over the config file; otherwise the flag
+		// only provides the default, so that reloading the config file picks up changes
+		if f.Changed {
+			_ = v.BindPFlag(configName, f)
+		} else {
+			v.SetDefault(configName, f.DefValue)
+		}
+		// Apply the viper config value to the flag when the flag is not set and viper has a value.
+		// This does not mark the flag as changed, so commands can still tell what was given explicitly.
 		if !f.Changed && v.IsSet(configName) {
 			val := v.Get(configName)
-			_ = cmd.Flags().Set(f.Name, fmt.Sprintf("%v", val))
+			_ = f.Value.Set(fmt.Sprintf("%v", val))
 		}
 	})
 }
 
+// applyConfig apply the settings that are safe to change at runtime
+func applyConfig(cfg *config.Config, logger *log.Logger, puller *pull.Puller) {
+	setLogLevel(logger, cfg.Log.Level)
+	puller.SetOptions(cfg.DownloadOptions())
+	puller.SetMaxConcurrent(cfg.Limits.MaxConcurrentPulls)
+	puller.SetBlobConcurrency(cfg.Limits.MaxConcurrentBlobs)
+	puller.SetTimeout(cfg.Limits.PullTimeout)
+	puller.SetDigestAlgorithm(digest.Algorithm(cfg.Cache.DigestAlgorithm))
+}
+
+// setLogLevel set the log level, 0 is info, 1 is debug, 2 is trace
+func setLogLevel(logger *log.Logger, level int) {
+	switch level {
+	case 0:
+		logger.SetLevel(log.InfoLevel)
+	case 1:
+		logger.SetLevel(log.DebugLevel)
+	case 2:
+		logger.SetLevel(log.TraceLevel)
+	}
+}
+
 // Execute primary function for cobra
 func Execute() {
 	rootCmd, err := rootCmd()
 	if err != nil {
 		log.Fatal(err)
 	}
-	if err := rootCmd.Execute(); err != nil {
+	// stopping cancels whatever is in progress, such as pulls, so that they clean up after
+	// themselves
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if err := rootCmd.ExecuteContext(ctx); err != nil {
 		log.Fatal(err)
 	}
 }
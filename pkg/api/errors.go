@@ -0,0 +1,53 @@
+package api
+
+// Error codes, which tell apart the kinds of failure that share a status code
+const (
+	// ErrorCodeInvalidRequest the request itself is malformed, e.g. its body is not valid json
+	ErrorCodeInvalidRequest = "invalidRequest"
+	// ErrorCodeInvalidSource the source of the content cannot be used, e.g. its scheme is not
+	// supported or its credentials are of the wrong type
+	ErrorCodeInvalidSource = "invalidSource"
+	// ErrorCodeNotFound the content, blob or lease is not in the cache
+	ErrorCodeNotFound = "notFound"
+	// ErrorCodeSourceNotFound the source does not have the content
+	ErrorCodeSourceNotFound = "sourceNotFound"
+	// ErrorCodeUnauthorized the source needs credentials, or did not accept those given
+	ErrorCodeUnauthorized = "unauthorized"
+	// ErrorCodeForbidden the credentials are not allowed to read the content from the source
+	ErrorCodeForbidden = "forbidden"
+	// ErrorCodeVerificationFailed the content is not signed by any of the trusted keys
+	ErrorCodeVerificationFailed = "verificationFailed"
+	// ErrorCodeDigestMismatch the source has content with a different digest than the one the
+	// request expects
+	ErrorCodeDigestMismatch = "digestMismatch"
+	// ErrorCodePinned the content is pinned, and cannot be removed until it is unpinned
+	ErrorCodePinned = "pinned"
+	// ErrorCodeSourceUnavailable the source kept failing, or responded with something that could
+	// not be used
+	ErrorCodeSourceUnavailable = "sourceUnavailable"
+	// ErrorCodeTimeout the pull took longer than allowed
+	ErrorCodeTimeout = "timeout"
+	// ErrorCodeCanceled the request was canceled, e.g. because the storage manager is stopping
+	ErrorCodeCanceled = "canceled"
+	// ErrorCodeInsufficientStorage there is not enough free space on the filesystem
+	ErrorCodeInsufficientStorage = "insufficientStorage"
+	// ErrorCodeQuotaExceeded the content does not fit within the maximum size of the cache
+	ErrorCodeQuotaExceeded = "quotaExceeded"
+	// ErrorCodeNotImplemented the storage manager does not support the request
+	ErrorCodeNotImplemented = "notImplemented"
+	// ErrorCodeInternal anything else
+	ErrorCodeInternal = "internal"
+)
+
+// Error the body of every error response, and the detail of a failed streamed pull
+type Error struct {
+	// Code what kind of failure it is, one of the ErrorCode constants
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	// Status the status code of the response, also set when the error ends a streamed pull
+	Status int `json:"status"`
+	// URL the source URL of the content the error is about, if any
+	URL string `json:"url,omitempty"`
+	// Retryable whether the same request may succeed if it is sent again later
+	Retryable bool `json:"retryable"`
+}
@@ -0,0 +1,135 @@
+package api
+
+import "time"
+
+// Content describes a piece of content, identified by its source URL, held in the cache.
+type Content struct {
+	URL    string `json:"url"`
+	Digest string `json:"digest"`
+	Path   string `json:"path,omitempty"`
+	// Pins who has pinned the content, protecting it from eviction and deletion
+	Pins []string `json:"pins,omitempty"`
+	// Leases the live leases protecting the content from eviction and deletion
+	Leases []Lease `json:"leases,omitempty"`
+	// DeletePending the content was deleted while leased, and is removed once its leases end
+	DeletePending bool `json:"deletePending,omitempty"`
+	// ExpiresAt when the content is removed from the cache, if it was pulled with a ttl
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+	// Verification the signatures that were verified before the content was cached, if its
+	// signatures are verified
+	Verification *Verification `json:"verification,omitempty"`
+	// Validators what identified the content at its source when it was last downloaded or
+	// checked, for sources that may change, such as http URLs
+	Validators *Validators `json:"validators,omitempty"`
+}
+
+// Validators what an http source said identifies the content it served, with which it can
+// tell whether the content changed since
+type Validators struct {
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"lastModified,omitempty"`
+	// ContentLength the size of the content, -1 if the source did not say
+	ContentLength int64 `json:"contentLength"`
+}
+
+// Empty whether the source gave nothing to tell whether the content changed by
+func (v Validators) Empty() bool {
+	return v.ETag == "" && v.LastModified == ""
+}
+
+// Verification the record of the signatures that were verified before content was cached
+type Verification struct {
+	// Digest what was signed, the root of the content
+	Digest     string      `json:"digest"`
+	Signatures []Signature `json:"signatures"`
+	VerifiedAt time.Time   `json:"verifiedAt"`
+}
+
+// Signature a signature that was verified
+type Signature struct {
+	// Format cosign or notation
+	Format string `json:"format"`
+	// Digest the manifest of the signature
+	Digest string `json:"digest"`
+	// Key the file of the public key that verified it
+	Key string `json:"key"`
+}
+
+// Lease temporary protection of content from eviction and deletion, which lasts until it
+// expires or is released, and may be renewed before it expires.
+type Lease struct {
+	ID        string    `json:"id"`
+	URL       string    `json:"url"`
+	Digest    string    `json:"digest"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// LeaseRequest the body of a request to take or renew a lease. TTL is a duration such as
+// 30s or 10m; empty for the default.
+type LeaseRequest struct {
+	TTL string `json:"ttl,omitempty"`
+}
+
+// Progress is a single progress update for a blob being written to the cache during a pull.
+// When streaming, the server sends a sequence of Progress updates, followed by a final
+// PullResult. Key is empty until the blob is done if it is only known once the blob is written.
+type Progress struct {
+	Key     string `json:"key"`
+	Size    int64  `json:"size,omitempty"`
+	Written int64  `json:"written"`
+	Done    bool   `json:"done,omitempty"`
+}
+
+// PullResult is a single line of a streamed pull response. Exactly one of Progress, Content
+// and Error is set; ErrorDetail accompanies Error.
+type PullResult struct {
+	Progress    *Progress `json:"progress,omitempty"`
+	Content     *Content  `json:"content,omitempty"`
+	Error       string    `json:"error,omitempty"`
+	ErrorDetail *Error    `json:"errorDetail,omitempty"`
+}
+
+// MediaTypeNDJSON is the media type requested by clients that want a streamed pull
+// response with progress updates.
+const MediaTypeNDJSON = "application/x-ndjson"
+
+// PreloadEntry the reconciliation status of a single entry of the preload manifest
+type PreloadEntry struct {
+	URL    string `json:"url"`
+	Pin    bool   `json:"pin,omitempty"`
+	State  string `json:"state"`
+	Digest string `json:"digest,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Preload entry states
+const (
+	PreloadStatePending = "pending"
+	PreloadStatePresent = "present"
+	PreloadStatePulled  = "pulled"
+	PreloadStateFailed  = "failed"
+)
+
+// PreloadStatus the status of reconciling the cache against the preload manifest
+type PreloadStatus struct {
+	Path           string         `json:"path"`
+	Generation     int64          `json:"generation"`
+	Reconciling    bool           `json:"reconciling"`
+	LastReconciled *time.Time     `json:"lastReconciled,omitempty"`
+	Error          string         `json:"error,omitempty"`
+	Entries        []PreloadEntry `json:"entries"`
+	Pruned         []string       `json:"pruned,omitempty"`
+}
+
+// GCBlob a blob that GC removes, as no content in the cache depends on it
+type GCBlob struct {
+	Digest string `json:"digest"`
+	Size   int64  `json:"size"`
+}
+
+// GCReport what GC would remove from the cache, reported without removing anything
+type GCReport struct {
+	Blobs []GCBlob `json:"blobs"`
+	// Size the total size in bytes of the blobs
+	Size int64 `json:"size"`
+}
@@ -0,0 +1,356 @@
+// Package cachetest checks that a cache backend behaves as the cache package describes, so that
+// every backend can be run through the same tests.
+package cachetest
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"slices"
+	"testing"
+
+	"github.com/aifoundry-org/storage-manager/pkg/cache"
+
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// NewFunc open an empty cache for a test, whose GC removes unreferenced blobs at once
+type NewFunc func(t *testing.T) cache.Cache
+
+// Run the conformance tests against caches opened with newCache. Put, Get, Name, Resolve,
+// Unname and GC are tested on every cache; Ingest, Protect and Unreferenced on those that
+// implement them.
+func Run(t *testing.T, newCache NewFunc) {
+	t.Run("PutGet", func(t *testing.T) { testPutGet(t, newCache(t)) })
+	t.Run("Names", func(t *testing.T) { testNames(t, newCache(t)) })
+	t.Run("GC", func(t *testing.T) { testGC(t, newCache(t)) })
+	t.Run("GCGraph", func(t *testing.T) { testGCGraph(t, newCache(t)) })
+	t.Run("Ingest", func(t *testing.T) { testIngest(t, newCache(t)) })
+	t.Run("Protect", func(t *testing.T) { testProtect(t, newCache(t)) })
+	t.Run("Unreferenced", func(t *testing.T) { testUnreferenced(t, newCache(t)) })
+}
+
+// put content under its key, returning the key
+func put(t *testing.T, c cache.Cache, content []byte) string {
+	t.Helper()
+	key := digest.FromBytes(content).String()
+	if err := c.Put(context.Background(), key, int64(len(content)), io.NopCloser(bytes.NewReader(content))); err != nil {
+		t.Fatalf("put %s: %v", key, err)
+	}
+	return key
+}
+
+// get the content for a key
+func get(t *testing.T, c cache.Cache, key string) []byte {
+	t.Helper()
+	rc, err := c.Get(context.Background(), key)
+	if err != nil {
+		t.Fatalf("get %s: %v", key, err)
+	}
+	defer rc.Close()
+	b, err := io.ReadAll(rc)
+	if err != nil {
+		t.Fatalf("read %s: %v", key, err)
+	}
+	return b
+}
+
+// exists whether the content for a key is in the cache
+func exists(t *testing.T, c cache.Cache, key string) bool {
+	t.Helper()
+	exists, err := c.Exists(context.Background(), key)
+	if err != nil {
+		t.Fatalf("exists %s: %v", key, err)
+	}
+	return exists
+}
+
+// gc run GC, failing the test if it fails
+func gc(t *testing.T, c cache.Cache) {
+	t.Helper()
+	if err := c.GC(context.Background()); err != nil {
+		t.Fatalf("gc: %v", err)
+	}
+}
+
+// isNotFound whether the error is a *cache.NotFoundError
+func isNotFound(err error) bool {
+	var notFound *cache.NotFoundError
+	return errors.As(err, &notFound)
+}
+
+func testPutGet(t *testing.T, c cache.Cache) {
+	ctx := context.Background()
+	content := []byte("hello, world")
+	key := put(t, c, content)
+	if !exists(t, c, key) {
+		t.Fatalf("%s does not exist after put", key)
+	}
+	if got := get(t, c, key); !bytes.Equal(got, content) {
+		t.Errorf("get %s = %q, want %q", key, got, content)
+	}
+	// putting the same content again is harmless
+	put(t, c, content)
+
+	wrong := digest.FromString("something else").String()
+	if err := c.Put(ctx, wrong, int64(len(content)), io.NopCloser(bytes.NewReader(content))); err == nil {
+		t.Errorf("put under the wrong key succeeded")
+	}
+	if exists(t, c, wrong) {
+		t.Errorf("content put under the wrong key exists")
+	}
+
+	missing := digest.FromString("missing").String()
+	if _, err := c.Get(ctx, missing); !isNotFound(err) {
+		t.Errorf("get of missing content = %v, want a not found error", err)
+	}
+}
+
+func testNames(t *testing.T, c cache.Cache) {
+	ctx := context.Background()
+	key := put(t, c, []byte("named content"))
+	const name = "oci://registry.example.com/repo/img:latest"
+	if _, err := c.Resolve(ctx, name); !isNotFound(err) {
+		t.Fatalf("resolve before name = %v, want a not found error", err)
+	}
+	if err := c.Name(ctx, key, name); err != nil {
+		t.Fatalf("name: %v", err)
+	}
+	resolved, err := c.Resolve(ctx, name)
+	if err != nil {
+		t.Fatalf("resolve: %v", err)
+	}
+	if resolved != key {
+		t.Errorf("resolve = %s, want %s", resolved, key)
+	}
+	if !exists(t, c, name) {
+		t.Errorf("%s does not exist once named", name)
+	}
+	if got := get(t, c, name); string(got) != "named content" {
+		t.Errorf("get by name = %q", got)
+	}
+	names, err := c.List(ctx)
+	if err != nil {
+		t.Fatalf("list: %v", err)
+	}
+	if !slices.Contains(names, name) {
+		t.Errorf("list = %v, want %s in it", names, name)
+	}
+
+	// naming again replaces the key
+	other := put(t, c, []byte("other content"))
+	if err := c.Name(ctx, other, name); err != nil {
+		t.Fatalf("rename: %v", err)
+	}
+	if resolved, err := c.Resolve(ctx, name); err != nil || resolved != other {
+		t.Errorf("resolve after rename = %s, %v, want %s", resolved, err, other)
+	}
+
+	if err := c.Unname(ctx, name); err != nil {
+		t.Fatalf("unname: %v", err)
+	}
+	if _, err := c.Resolve(ctx, name); !isNotFound(err) {
+		t.Errorf("resolve after unname = %v, want a not found error", err)
+	}
+	if err := c.Unname(ctx, name); err != nil && !isNotFound(err) {
+		t.Errorf("unname of a missing name: %v", err)
+	}
+}
+
+func testGC(t *testing.T, c cache.Cache) {
+	ctx := context.Background()
+	named := put(t, c, []byte("kept"))
+	stray := put(t, c, []byte("stray"))
+	const name = "hf://org/model/kept"
+	if err := c.Name(ctx, named, name); err != nil {
+		t.Fatalf("name: %v", err)
+	}
+	gc(t, c)
+	if !exists(t, c, named) {
+		t.Errorf("gc removed named content")
+	}
+	if exists(t, c, stray) {
+		t.Errorf("gc kept unnamed content")
+	}
+	if err := c.Unname(ctx, name); err != nil {
+		t.Fatalf("unname: %v", err)
+	}
+	gc(t, c)
+	if exists(t, c, named) {
+		t.Errorf("gc kept content once it was unnamed")
+	}
+}
+
+// Image put an OCI image of a config and a layer, returning the keys of its manifest, config
+// and layer
+func Image(t *testing.T, c cache.Cache, layer string) (manifest, config, layerKey string) {
+	t.Helper()
+	configContent := []byte("{}")
+	config = put(t, c, configContent)
+	layerKey = put(t, c, []byte(layer))
+	m := ocispec.Manifest{
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config: ocispec.Descriptor{
+			MediaType: ocispec.MediaTypeImageConfig,
+			Digest:    digest.Digest(config),
+			Size:      int64(len(configContent)),
+		},
+		Layers: []ocispec.Descriptor{{
+			MediaType: ocispec.MediaTypeImageLayer,
+			Digest:    digest.Digest(layerKey),
+			Size:      int64(len(layer)),
+		}},
+	}
+	m.SchemaVersion = 2
+	b, err := json.Marshal(m)
+	if err != nil {
+		t.Fatalf("marshal manifest: %v", err)
+	}
+	return put(t, c, b), config, layerKey
+}
+
+func testGCGraph(t *testing.T, c cache.Cache) {
+	ctx := context.Background()
+	first, config, firstLayer := Image(t, c, "first layer")
+	second, _, secondLayer := Image(t, c, "second layer")
+	if err := c.Name(ctx, first, "oci://registry.example.com/repo/img:first"); err != nil {
+		t.Fatalf("name first: %v", err)
+	}
+	if err := c.Name(ctx, second, "oci://registry.example.com/repo/img:second"); err != nil {
+		t.Fatalf("name second: %v", err)
+	}
+	gc(t, c)
+	for _, key := range []string{first, second, config, firstLayer, secondLayer} {
+		if !exists(t, c, key) {
+			t.Errorf("gc removed %s, which a named image depends on", key)
+		}
+	}
+
+	// removing one image only frees what the other does not use
+	if err := c.Unname(ctx, "oci://registry.example.com/repo/img:first"); err != nil {
+		t.Fatalf("unname: %v", err)
+	}
+	gc(t, c)
+	for _, key := range []string{first, firstLayer} {
+		if exists(t, c, key) {
+			t.Errorf("gc kept %s once its image was removed", key)
+		}
+	}
+	for _, key := range []string{second, config, secondLayer} {
+		if !exists(t, c, key) {
+			t.Errorf("gc removed %s, which the remaining image depends on", key)
+		}
+	}
+}
+
+func testIngest(t *testing.T, c cache.Cache) {
+	ingester, ok := c.(cache.Ingester)
+	if !ok {
+		t.Skip("the cache cannot ingest content")
+	}
+	content := []byte("ingested content")
+	key, size, release, err := ingester.Ingest(context.Background(), "", bytes.NewReader(content))
+	if err != nil {
+		t.Fatalf("ingest: %v", err)
+	}
+	if want := digest.FromBytes(content).String(); key != want {
+		t.Errorf("ingest key = %s, want %s", key, want)
+	}
+	if size != int64(len(content)) {
+		t.Errorf("ingest size = %d, want %d", size, len(content))
+	}
+	if got := get(t, c, key); !bytes.Equal(got, content) {
+		t.Errorf("get %s = %q, want %q", key, got, content)
+	}
+	gc(t, c)
+	if !exists(t, c, key) {
+		t.Errorf("gc removed ingested content before it was released")
+	}
+	release()
+	gc(t, c)
+	if exists(t, c, key) {
+		t.Errorf("gc kept unnamed ingested content once it was released")
+	}
+
+	if _, _, _, err := ingester.Ingest(context.Background(), "", bytes.NewReader(nil)); err == nil {
+		t.Errorf("ingest of no content succeeded")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, _, _, err := ingester.Ingest(ctx, "", bytes.NewReader(content)); !errors.Is(err, context.Canceled) {
+		t.Errorf("ingest with a canceled context = %v, want %v", err, context.Canceled)
+	}
+}
+
+func testProtect(t *testing.T, c cache.Cache) {
+	protector, ok := c.(cache.Protector)
+	if !ok {
+		t.Skip("the cache cannot protect content")
+	}
+	key := put(t, c, []byte("protected"))
+	release := protector.Protect(key)
+	// protecting a key twice keeps it until both are released
+	releaseAgain := protector.Protect(key)
+	gc(t, c)
+	if !exists(t, c, key) {
+		t.Fatalf("gc removed protected content")
+	}
+	release()
+	gc(t, c)
+	if !exists(t, c, key) {
+		t.Fatalf("gc removed content that is still protected once")
+	}
+	releaseAgain()
+	gc(t, c)
+	if exists(t, c, key) {
+		t.Errorf("gc kept content once it was released")
+	}
+}
+
+func testUnreferenced(t *testing.T, c cache.Cache) {
+	collector, ok := c.(cache.Collector)
+	if !ok {
+		t.Skip("the cache cannot report what gc would remove")
+	}
+	ctx := context.Background()
+	named := put(t, c, []byte("kept"))
+	if err := c.Name(ctx, named, "hf://org/model/kept"); err != nil {
+		t.Fatalf("name: %v", err)
+	}
+	stray := put(t, c, []byte("stray"))
+	blobs, err := collector.Unreferenced(ctx)
+	if err != nil {
+		t.Fatalf("unreferenced: %v", err)
+	}
+	want := []cache.Blob{{Key: stray, Size: int64(len("stray"))}}
+	if !slices.Equal(blobs, want) {
+		t.Errorf("unreferenced = %v, want %v", blobs, want)
+	}
+	if !exists(t, c, stray) {
+		t.Errorf("unreferenced removed %s", stray)
+	}
+}
+
+// RunGracePeriod test that GC keeps unreferenced blobs younger than the grace period of caches
+// opened with newCache, which must be longer than the test takes, as other nodes sharing the
+// cache may be about to name them
+func RunGracePeriod(t *testing.T, newCache NewFunc) {
+	c := newCache(t)
+	stray := put(t, c, []byte("just written"))
+	gc(t, c)
+	if !exists(t, c, stray) {
+		t.Errorf("gc removed unreferenced content within the grace period")
+	}
+	if collector, ok := c.(cache.Collector); ok {
+		blobs, err := collector.Unreferenced(context.Background())
+		if err != nil {
+			t.Fatalf("unreferenced: %v", err)
+		}
+		if len(blobs) != 0 {
+			t.Errorf("unreferenced = %v, want none within the grace period", blobs)
+		}
+	}
+}
@@ -0,0 +1,429 @@
+package casdir
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aifoundry-org/storage-manager/pkg/cache"
+
+	"github.com/opencontainers/go-digest"
+	bolt "go.etcd.io/bbolt"
+)
+
+// protectedDir the directory in the cache where every process lists the keys it protects
+const protectedDir = "protected"
+
+// algorithms the digest algorithms of keys, each with its own directory of blobs
+var algorithms = []digest.Algorithm{digest.SHA256, digest.SHA384, digest.SHA512}
+
+// cacheCASDir a plain content-addressable cache: every blob is a file at
+// <dir>/<algorithm>/<first two hex digits>/<hex>, so that no directory holds more than a
+// fraction of the blobs, and names are kept in an embedded database in the same directory.
+type cacheCASDir struct {
+	dir string
+
+	// mu serializes the use of the names database within this process; other processes are
+	// kept out by the lock the database takes on its file
+	mu sync.RWMutex
+
+	// protection keys that must survive GC although no name refers to them, in every process
+	protection *cache.Protection
+	// gracePeriod how old unreferenced blobs must be before GC removes them
+	gracePeriod time.Duration
+}
+
+var (
+	_ cache.Cache     = &cacheCASDir{}
+	_ cache.Pather    = &cacheCASDir{}
+	_ cache.Sizer     = &cacheCASDir{}
+	_ cache.Protector = &cacheCASDir{}
+	_ cache.Ingester  = &cacheCASDir{}
+	_ cache.Collector = &cacheCASDir{}
+)
+
+// New open the content-addressable cache at cacheDir, creating it if needed. Several processes
+// may use the same cache directory at once; blobs are written with atomic renames, and the
+// names database is only held open for the duration of each change. GC only removes
+// unreferenced blobs older than gracePeriod, for a directory that processes on other nodes
+// write to, which cannot see the keys this node protects; 0 to remove them at once.
+func New(cacheDir string, gracePeriod time.Duration) (*cacheCASDir, error) {
+	if err := os.MkdirAll(cacheDir, 0755); err != nil {
+		return nil, fmt.Errorf("could not create cache directory %s: %v", cacheDir, err)
+	}
+	c := &cacheCASDir{
+		dir:         cacheDir,
+		protection:  cache.NewProtection(filepath.Join(cacheDir, protectedDir)),
+		gracePeriod: gracePeriod,
+	}
+	if err := c.update(func(_, _ *bolt.Bucket) error { return nil }); err != nil {
+		return nil, fmt.Errorf("could not initialize cache at path %s: %v", cacheDir, err)
+	}
+	return c, nil
+}
+
+// blobPath where the blob for a digest is kept
+func (c *cacheCASDir) blobPath(d digest.Digest) string {
+	encoded := d.Encoded()
+	return filepath.Join(c.dir, d.Algorithm().String(), encoded[:2], encoded)
+}
+
+// parseKey the digest of a key, which must be a valid digest
+func parseKey(key string) (digest.Digest, error) {
+	d, err := digest.Parse(key)
+	if err != nil {
+		return "", fmt.Errorf("invalid key %s: %v", key, err)
+	}
+	return d, nil
+}
+
+// lookup the digest of a key, or of the key a name refers to
+func (c *cacheCASDir) lookup(ctx context.Context, key string) (digest.Digest, error) {
+	if d, err := digest.Parse(key); err == nil {
+		return d, nil
+	}
+	resolved, err := c.Resolve(ctx, key)
+	if err != nil {
+		return "", err
+	}
+	return parseKey(resolved)
+}
+
+// Get content from the cache
+func (c *cacheCASDir) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	d, err := c.lookup(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(c.blobPath(d))
+	if os.IsNotExist(err) {
+		return nil, &cache.NotFoundError{Key: key}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not open %s: %v", key, err)
+	}
+	return f, nil
+}
+
+// Exists check if content for a given key exists in the cache
+func (c *cacheCASDir) Exists(ctx context.Context, key string) (bool, error) {
+	d, err := c.lookup(ctx, key)
+	var notFound *cache.NotFoundError
+	if errors.As(err, &notFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	_, err = os.Stat(c.blobPath(d))
+	switch {
+	case os.IsNotExist(err):
+		return false, nil
+	case err != nil:
+		return false, fmt.Errorf("could not stat %s: %v", key, err)
+	}
+	return true, nil
+}
+
+// Delete content from the cache, and the name if the key is one
+func (c *cacheCASDir) Delete(ctx context.Context, key string) error {
+	d, err := c.lookup(ctx, key)
+	var notFound *cache.NotFoundError
+	if errors.As(err, &notFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(c.blobPath(d)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("could not delete %s: %v", key, err)
+	}
+	if d.String() != key {
+		return c.Unname(ctx, key)
+	}
+	return nil
+}
+
+// Put content in the cache. If the key is not provided it will be generated from the content.
+func (c *cacheCASDir) Put(ctx context.Context, key string, size int64, r io.ReadCloser) error {
+	defer r.Close()
+	_, _, release, err := c.ingest(ctx, key, "", size, r)
+	if err != nil {
+		if key == "" {
+			return fmt.Errorf("could not put content: %w", err)
+		}
+		return fmt.Errorf("could not put %s: %w", key, err)
+	}
+	// whoever puts content under a known key protects it themselves until it is named
+	release()
+	return nil
+}
+
+// Ingest write content whose key is not known ahead of time into the cache, returning its key,
+// its digest with the algorithm, and its size. The content is protected from GC until release
+// is called.
+func (c *cacheCASDir) Ingest(ctx context.Context, alg digest.Algorithm, r io.Reader) (key string, size int64, release func(), err error) {
+	d, size, release, err := c.ingest(ctx, "", alg, 0, r)
+	if err != nil {
+		return "", 0, nil, fmt.Errorf("could not put content: %w", err)
+	}
+	return d.String(), size, release, nil
+}
+
+// Name alias a key to a name, recording the keys of the blobs it refers to
+func (c *cacheCASDir) Name(ctx context.Context, key, name string) error {
+	exists, err := c.Exists(ctx, key)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return &cache.NotFoundError{Key: key}
+	}
+	children, err := cache.Children(ctx, c.Get, key)
+	if err != nil {
+		return err
+	}
+	return c.update(func(names, graphs *bolt.Bucket) error {
+		if err := names.Put([]byte(name), []byte(key)); err != nil {
+			return err
+		}
+		return graphs.Put([]byte(name), []byte(strings.Join(children, ",")))
+	})
+}
+
+// Unname remove the alias from a key
+func (c *cacheCASDir) Unname(ctx context.Context, name string) error {
+	return c.update(func(names, graphs *bolt.Bucket) error {
+		if err := names.Delete([]byte(name)); err != nil {
+			return err
+		}
+		return graphs.Delete([]byte(name))
+	})
+}
+
+// Resolve a name to a key
+func (c *cacheCASDir) Resolve(ctx context.Context, name string) (key string, err error) {
+	err = c.view(func(names, _ *bolt.Bucket) error {
+		v := names.Get([]byte(name))
+		if v == nil {
+			return &cache.NotFoundError{Key: name}
+		}
+		key = string(v)
+		return nil
+	})
+	return key, err
+}
+
+// List all of the names in the cache
+func (c *cacheCASDir) List(ctx context.Context) ([]string, error) {
+	var names []string
+	err := c.view(func(b, _ *bolt.Bucket) error {
+		return b.ForEach(func(k, _ []byte) error {
+			names = append(names, string(k))
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not list names: %v", err)
+	}
+	return names, nil
+}
+
+// GC clean up unreferenced keys: every blob that no name depends on and that is not protected
+func (c *cacheCASDir) GC(ctx context.Context) error {
+	_, err := c.collect(ctx, true)
+	return err
+}
+
+// Unreferenced the blobs that GC would remove now
+func (c *cacheCASDir) Unreferenced(ctx context.Context) ([]cache.Blob, error) {
+	return c.collect(ctx, false)
+}
+
+// collect find the blobs that no name depends on, that are not protected and that are older
+// than the grace period, and remove them if remove is set
+func (c *cacheCASDir) collect(ctx context.Context, remove bool) (garbage []cache.Blob, err error) {
+	cutoff := time.Now().Add(-c.gracePeriod)
+	keep, err := c.mark(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("could not collect garbage: %v", err)
+	}
+	var candidates []cache.Blob
+	err = c.walk(ctx, func(d digest.Digest, _ string, e fs.DirEntry) error {
+		if keep[d] {
+			return nil
+		}
+		info, err := e.Info()
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if info.ModTime().After(cutoff) {
+			return nil
+		}
+		candidates = append(candidates, cache.Blob{Key: d.String(), Size: info.Size()})
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not collect garbage: %v", err)
+	}
+	// other processes write and name content while the blobs are walked; a blob is protected
+	// before it is moved into place, so marking again catches any that was written meanwhile
+	keep, err = c.mark(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("could not collect garbage: %v", err)
+	}
+	for _, blob := range candidates {
+		d := digest.Digest(blob.Key)
+		if keep[d] {
+			continue
+		}
+		garbage = append(garbage, blob)
+		if !remove {
+			continue
+		}
+		if err := os.Remove(c.blobPath(d)); err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("could not remove %s: %v", d, err)
+		}
+	}
+	return garbage, nil
+}
+
+// mark the blobs to keep: every protected blob, and the key of every name with the keys
+// recorded when it was named. The graph of a name from before graphs were recorded is found
+// from its manifests.
+func (c *cacheCASDir) mark(ctx context.Context) (map[digest.Digest]bool, error) {
+	// protected keys are taken before the names, as content is named before it is released
+	protected, err := c.protection.Keys()
+	if err != nil {
+		return nil, err
+	}
+	keep := make(map[digest.Digest]bool, len(protected))
+	for key := range protected {
+		keep[digest.Digest(key)] = true
+	}
+	var unrecorded []string
+	err = c.view(func(names, graphs *bolt.Bucket) error {
+		return names.ForEach(func(k, v []byte) error {
+			keep[digest.Digest(v)] = true
+			recorded := graphs.Get(k)
+			if recorded == nil {
+				unrecorded = append(unrecorded, string(v))
+				return nil
+			}
+			if len(recorded) == 0 {
+				return nil
+			}
+			for _, child := range strings.Split(string(recorded), ",") {
+				keep[digest.Digest(child)] = true
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not read names: %v", err)
+	}
+	for _, key := range unrecorded {
+		children, err := cache.Children(ctx, c.Get, key)
+		var notFound *cache.NotFoundError
+		if err != nil && !errors.As(err, &notFound) {
+			return nil, err
+		}
+		for _, child := range children {
+			keep[digest.Digest(child)] = true
+		}
+	}
+	return keep, nil
+}
+
+// Protect the keys from GC, in every process using the cache, until the returned function is
+// called
+func (c *cacheCASDir) Protect(keys ...string) func() {
+	return c.protection.Protect(keys...)
+}
+
+// Path to the content for a key
+func (c *cacheCASDir) Path(key string) (string, error) {
+	d, err := parseKey(key)
+	if err != nil {
+		return "", err
+	}
+	p := c.blobPath(d)
+	if _, err := os.Stat(p); err != nil {
+		if os.IsNotExist(err) {
+			return "", &cache.NotFoundError{Key: key}
+		}
+		return "", fmt.Errorf("could not stat %s: %v", p, err)
+	}
+	return p, nil
+}
+
+// Usage total size in bytes of all of the blobs in the cache
+func (c *cacheCASDir) Usage() (int64, error) {
+	var total int64
+	err := c.walk(context.Background(), func(_ digest.Digest, _ string, e fs.DirEntry) error {
+		info, err := e.Info()
+		if err != nil {
+			// blobs may be removed while we walk
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		total += info.Size()
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("could not calculate cache usage: %v", err)
+	}
+	return total, nil
+}
+
+// walk call fn for every blob in the cache, with its digest and path. Anything in the
+// directories of blobs that is not named after its digest is skipped.
+func (c *cacheCASDir) walk(ctx context.Context, fn func(d digest.Digest, p string, e fs.DirEntry) error) error {
+	for _, alg := range algorithms {
+		shards, err := os.ReadDir(filepath.Join(c.dir, alg.String()))
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		for _, shard := range shards {
+			if !shard.IsDir() {
+				continue
+			}
+			shardPath := filepath.Join(c.dir, alg.String(), shard.Name())
+			entries, err := os.ReadDir(shardPath)
+			if errors.Is(err, fs.ErrNotExist) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			for _, e := range entries {
+				if err := ctx.Err(); err != nil {
+					return err
+				}
+				d := digest.NewDigestFromEncoded(alg, e.Name())
+				if e.IsDir() || d.Validate() != nil || e.Name()[:2] != shard.Name() {
+					continue
+				}
+				if err := fn(d, filepath.Join(shardPath, e.Name()), e); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,29 @@
+package casdir
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aifoundry-org/storage-manager/pkg/cache"
+	"github.com/aifoundry-org/storage-manager/pkg/cache/cachetest"
+)
+
+func TestConformance(t *testing.T) {
+	cachetest.Run(t, func(t *testing.T) cache.Cache {
+		c, err := New(t.TempDir(), 0)
+		if err != nil {
+			t.Fatalf("new: %v", err)
+		}
+		return c
+	})
+}
+
+func TestGracePeriod(t *testing.T) {
+	cachetest.RunGracePeriod(t, func(t *testing.T) cache.Cache {
+		c, err := New(t.TempDir(), time.Hour)
+		if err != nil {
+			t.Fatalf("new: %v", err)
+		}
+		return c
+	})
+}
@@ -0,0 +1,22 @@
+package casdir
+
+import (
+	"context"
+	"io"
+	"path/filepath"
+
+	"github.com/aifoundry-org/storage-manager/pkg/cache"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// ingestDir the directory in the cache where blobs are written before they are renamed into
+// place
+const ingestDir = "ingest"
+
+// ingest write the content to a temporary file in the cache directory, hashing it on the way,
+// and rename it into place, as cache.IngestFile does. The blob is protected from GC until
+// release is called, so it cannot be cleaned up before it is named.
+func (c *cacheCASDir) ingest(ctx context.Context, key string, alg digest.Algorithm, size int64, r io.Reader) (d digest.Digest, n int64, release func(), err error) {
+	return cache.IngestFile(ctx, c, filepath.Join(c.dir, ingestDir), c.blobPath, key, alg, size, r)
+}
@@ -0,0 +1,74 @@
+package casdir
+
+import (
+	"fmt"
+	"path/filepath"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// namesFile name of the database, in the cache directory, that maps names to keys
+const namesFile = "names.db"
+
+var (
+	// namesBucket the bucket of the database that maps names to keys
+	namesBucket = []byte("names")
+	// graphsBucket the bucket of the database that maps names to the keys of every blob their
+	// key refers to, separated by commas, for GC
+	graphsBucket = []byte("graphs")
+)
+
+// lockTimeout how long to wait for another process to finish with the names database, which
+// only holds it for a single transaction
+const lockTimeout = time.Minute
+
+// open the names database. It is opened for every transaction rather than once per cache, as
+// bbolt locks its file for as long as it is open, exclusively unless it is read-only: held
+// open, it would keep every other process using the cache directory, such as an offline pull
+// alongside the server, waiting until this one exits. Opening it maps the file and reads its
+// meta pages, which costs little next to writing the blobs that are named.
+func (c *cacheCASDir) open(readOnly bool) (*bolt.DB, error) {
+	p := filepath.Join(c.dir, namesFile)
+	db, err := bolt.Open(p, 0644, &bolt.Options{Timeout: lockTimeout, ReadOnly: readOnly})
+	if err != nil {
+		return nil, fmt.Errorf("could not open names database %s: %v", p, err)
+	}
+	return db, nil
+}
+
+// view run fn against the names and their graphs, for reading
+func (c *cacheCASDir) view(fn func(names, graphs *bolt.Bucket) error) error {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	db, err := c.open(true)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return db.View(func(tx *bolt.Tx) error {
+		return fn(tx.Bucket(namesBucket), tx.Bucket(graphsBucket))
+	})
+}
+
+// update run fn against the names and their graphs, committing its changes if it succeeds
+func (c *cacheCASDir) update(fn func(names, graphs *bolt.Bucket) error) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	db, err := c.open(false)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return db.Update(func(tx *bolt.Tx) error {
+		names, err := tx.CreateBucketIfNotExists(namesBucket)
+		if err != nil {
+			return fmt.Errorf("could not create names bucket: %v", err)
+		}
+		graphs, err := tx.CreateBucketIfNotExists(graphsBucket)
+		if err != nil {
+			return fmt.Errorf("could not create graphs bucket: %v", err)
+		}
+		return fn(names, graphs)
+	})
+}
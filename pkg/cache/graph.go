@@ -0,0 +1,127 @@
+package cache
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// MaxManifestSize the largest blob that is read to find the content it refers to; manifests
+// and indexes are much smaller
+const MaxManifestSize = 4 << 20
+
+// docker media types of manifests and manifest lists, which refer to other blobs just like
+// their OCI counterparts
+const (
+	mediaTypeDockerManifest     = "application/vnd.docker.distribution.manifest.v2+json"
+	mediaTypeDockerManifestList = "application/vnd.docker.distribution.manifest.list.v2+json"
+)
+
+// Manifest the parts of an OCI manifest or index, or of a docker manifest or manifest list,
+// that refer to other blobs
+type Manifest struct {
+	SchemaVersion int                  `json:"schemaVersion"`
+	MediaType     string               `json:"mediaType"`
+	Config        *ocispec.Descriptor  `json:"config"`
+	Layers        []ocispec.Descriptor `json:"layers"`
+	Manifests     []ocispec.Descriptor `json:"manifests"`
+}
+
+// References the keys of the blobs the manifest refers to: its config and layers, or the
+// manifests of an index
+func (m *Manifest) References() []string {
+	var keys []string
+	if m.Config != nil {
+		keys = append(keys, m.Config.Digest.String())
+	}
+	for _, desc := range append(m.Layers, m.Manifests...) {
+		keys = append(keys, desc.Digest.String())
+	}
+	return keys
+}
+
+// ReadManifest read content as a manifest or index, returning nil if it is anything else,
+// such as a layer or a file from HuggingFace. A manifest without a media type, which it
+// only should have, gets the OCI one it has the fields of.
+func ReadManifest(r io.Reader) (*Manifest, error) {
+	// only JSON objects can be manifests, which saves reading anything else
+	br := bufio.NewReader(io.LimitReader(r, MaxManifestSize+1))
+	if first, err := br.Peek(1); err != nil || first[0] != '{' {
+		return nil, nil
+	}
+	b, err := io.ReadAll(br)
+	if err != nil {
+		return nil, err
+	}
+	var m Manifest
+	if len(b) > MaxManifestSize || json.Unmarshal(b, &m) != nil {
+		return nil, nil
+	}
+	switch m.MediaType {
+	case ocispec.MediaTypeImageManifest, ocispec.MediaTypeImageIndex, mediaTypeDockerManifest, mediaTypeDockerManifestList:
+		return &m, nil
+	case "":
+		switch {
+		case m.SchemaVersion != 2:
+		case m.Manifests != nil:
+			m.MediaType = ocispec.MediaTypeImageIndex
+			return &m, nil
+		case m.Config != nil:
+			m.MediaType = ocispec.MediaTypeImageManifest
+			return &m, nil
+		}
+	}
+	return nil, nil
+}
+
+// GetFunc read the content for a key, returning a *NotFoundError if it is not there
+type GetFunc func(ctx context.Context, key string) (io.ReadCloser, error)
+
+// Children the keys of the blobs that the content for key depends on, found by following
+// the manifests and indexes from it, each once. Blobs that are not there are left out, as
+// only some of the manifests of an index may have been pulled, for one platform. The key
+// itself is not included.
+func Children(ctx context.Context, get GetFunc, key string) ([]string, error) {
+	seen := map[string]bool{key: true}
+	var children []string
+	var walk func(key string) error
+	walk = func(key string) error {
+		rc, err := get(ctx, key)
+		if err != nil {
+			return err
+		}
+		m, err := ReadManifest(rc)
+		rc.Close()
+		if err != nil {
+			return fmt.Errorf("could not read %s: %v", key, err)
+		}
+		if m == nil {
+			return nil
+		}
+		for _, child := range m.References() {
+			if seen[child] {
+				continue
+			}
+			seen[child] = true
+			err := walk(child)
+			var notFound *NotFoundError
+			if errors.As(err, &notFound) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			children = append(children, child)
+		}
+		return nil
+	}
+	if err := walk(key); err != nil {
+		return nil, err
+	}
+	return children, nil
+}
@@ -0,0 +1,115 @@
+package cache
+
+import (
+	"context"
+	// the algorithms of keys must be linked in to hash content with them
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// IngestAlgorithm the algorithm to hash content with: that of key if it is not empty, or else
+// alg, or the canonical algorithm if that is empty
+func IngestAlgorithm(key string, alg digest.Algorithm) (digest.Algorithm, error) {
+	if alg == "" {
+		alg = digest.Canonical
+	}
+	if key != "" {
+		expected, err := digest.Parse(key)
+		if err != nil {
+			return "", fmt.Errorf("invalid key %s: %v", key, err)
+		}
+		alg = expected.Algorithm()
+	}
+	if !alg.Available() {
+		return "", fmt.Errorf("unsupported digest algorithm %s", alg)
+	}
+	return alg, nil
+}
+
+// IngestFile write the content to a temporary file in tmpDir, hashing it on the way, and
+// rename it into place at the path target gives for its digest. If key is not empty the
+// content must match it, hashed with the algorithm of the key; otherwise it is hashed with
+// alg, or the canonical algorithm if that is empty. If size is positive the content must be
+// that long. The blob is protected from GC with p before it is renamed into place, until
+// release is called, so it cannot be cleaned up before it is named. If the write fails or the
+// context is canceled, nothing is left behind.
+func IngestFile(ctx context.Context, p Protector, tmpDir string, target func(digest.Digest) string, key string, alg digest.Algorithm, size int64, r io.Reader) (d digest.Digest, n int64, release func(), err error) {
+	alg, err = IngestAlgorithm(key, alg)
+	if err != nil {
+		return "", 0, nil, err
+	}
+	if err := os.MkdirAll(tmpDir, 0755); err != nil {
+		return "", 0, nil, fmt.Errorf("could not create ingest directory: %v", err)
+	}
+	f, err := os.CreateTemp(tmpDir, "blob-*")
+	if err != nil {
+		return "", 0, nil, fmt.Errorf("could not create temporary file: %v", err)
+	}
+	// once renamed into place, removing the temporary name fails harmlessly
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	digester := alg.Digester()
+	n, err = io.Copy(io.MultiWriter(digester.Hash(), f), NewContextReader(ctx, r))
+	if err != nil {
+		return "", 0, nil, fmt.Errorf("could not copy content: %w", err)
+	}
+	if n == 0 {
+		return "", 0, nil, fmt.Errorf("no content to copy")
+	}
+	if size > 0 && n != size {
+		return "", 0, nil, fmt.Errorf("size mismatch: got %d bytes, expected %d", n, size)
+	}
+	d = digester.Digest()
+	if key != "" && d.String() != key {
+		return "", 0, nil, fmt.Errorf("key mismatch: %s != %s", d, key)
+	}
+	// consumers read blobs directly through their path, possibly as another user
+	if err := f.Chmod(0644); err != nil {
+		return "", 0, nil, fmt.Errorf("could not write content: %v", err)
+	}
+	if err := f.Sync(); err != nil {
+		return "", 0, nil, fmt.Errorf("could not write content: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		return "", 0, nil, fmt.Errorf("could not write content: %v", err)
+	}
+
+	release = p.Protect(d.String())
+	path := target(d)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		release()
+		return "", 0, nil, fmt.Errorf("could not create blobs directory: %v", err)
+	}
+	// the blob may have been written in the meantime, in which case this is the same content
+	if err := os.Rename(f.Name(), path); err != nil {
+		release()
+		return "", 0, nil, fmt.Errorf("could not move %s into place: %v", d, err)
+	}
+	return d, n, release, nil
+}
+
+// NewContextReader a reader that stops reading once the context is done, so a canceled write
+// stops even if the reader it copies from does not watch the context
+func NewContextReader(ctx context.Context, r io.Reader) io.Reader {
+	return &contextReader{ctx: ctx, r: r}
+}
+
+// contextReader reads from r until ctx is done
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r *contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
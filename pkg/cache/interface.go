@@ -1,32 +1,110 @@
 package cache
 
 import (
+	"context"
 	"io"
+
+	"github.com/opencontainers/go-digest"
 )
 
 // Cache represents an implementation of a storage cache.
 // Cache has a few concepts: blobs (or content), which are referenced via a unique key, and names (or tags),
 // which are unique names that point to another name. Thus you can have 10 blobs each with its own key,
 // and then have a name that points to one of those keys. This allows you to build a hierarchy of content.
+// Every method takes a context, which cancels the operation, e.g. when the request for it goes away.
 type Cache interface {
 	// These methods provide direct control over content
 	// Get the content from the cache
-	Get(key string) (io.ReadCloser, error)
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
 	// Exists check if the content exists in the cache
-	Exists(key string) (bool, error)
+	Exists(ctx context.Context, key string) (bool, error)
 	// Delete the content from the cache
-	Delete(key string) error
+	Delete(ctx context.Context, key string) error
 	// Put the content in the cache
-	Put(key string, size int64, r io.ReadCloser) error
+	Put(ctx context.Context, key string, size int64, r io.ReadCloser) error
 
 	// These methods provide control over aliases or names
-	// Name alias a key to a name, will replace if already there
-	Name(key, name string) error
+	// Name alias a key to a name, will replace if already there. The name depends on the key
+	// and on every blob the key refers to, which GC keeps.
+	Name(ctx context.Context, key, name string) error
 	// Unname remove the alias from a key
-	Unname(name string) error
-	// Resolve a name to a key
-	Resolve(name string) (string, error)
+	Unname(ctx context.Context, name string) error
+	// Resolve a name to a key, returning a *NotFoundError if the name is not in the cache
+	Resolve(ctx context.Context, name string) (string, error)
+	// List all of the names in the cache
+	List(ctx context.Context) ([]string, error)
 
 	// This method is used to clean up unreferenced keys
-	GC() error
+	GC(ctx context.Context) error
+}
+
+// Pather is implemented by caches that keep content on the local filesystem, and can report
+// where the content for a key can be found.
+type Pather interface {
+	// Path to the content for a key
+	Path(key string) (string, error)
+}
+
+// Sizer is implemented by caches that can report how much storage their content uses.
+type Sizer interface {
+	// Usage total size in bytes of all of the content in the cache
+	Usage() (int64, error)
+}
+
+// Protector is implemented by caches that can protect keys from GC before they are reachable
+// from a name, e.g. while the blobs of a pull are being written.
+type Protector interface {
+	// Protect the keys from GC until the returned function is called
+	Protect(keys ...string) (release func())
+}
+
+// Ingester is implemented by caches that can write content whose key is not known ahead of
+// time, hashing it while it is written, so it does not need to be staged elsewhere first.
+type Ingester interface {
+	// Ingest write the content into the cache, returning its key, the digest of the content
+	// with the algorithm, and its size. The content is protected from GC until release is
+	// called.
+	Ingest(ctx context.Context, alg digest.Algorithm, r io.Reader) (key string, size int64, release func(), err error)
+}
+
+// Blob a blob in the cache, with its size in bytes
+type Blob struct {
+	Key  string
+	Size int64
+}
+
+// Collector is implemented by caches that can report what GC would remove, without removing
+// anything. GC marks every blob that a name depends on, through the graph of content recorded
+// when it was named, and every protected blob, and removes the rest.
+type Collector interface {
+	// Unreferenced the blobs that GC would remove now
+	Unreferenced(ctx context.Context) ([]Blob, error)
+}
+
+// Promoter is implemented by caches that hold content they cannot give a path to until it is
+// copied closer, such as a cache in front of a shared tier.
+type Promoter interface {
+	// Promote copy the content for a name, and every blob it refers to, to where it has a path
+	Promote(ctx context.Context, name string) error
+}
+
+// Promote the content for a name, if the cache needs to
+func Promote(ctx context.Context, c Cache, name string) error {
+	if promoter, ok := c.(Promoter); ok {
+		return promoter.Promote(ctx, name)
+	}
+	return nil
+}
+
+// SharedTier is implemented by caches in front of a shared tier that other nodes use too.
+// GC and removing names only change the cache on this node; these change the shared tier,
+// on request.
+type SharedTier interface {
+	// GCShared clean up unreferenced keys in the shared tier, that are older than its grace
+	// period, as other nodes may be about to name them
+	GCShared(ctx context.Context) error
+	// UnreferencedShared the blobs that GCShared would remove now
+	UnreferencedShared(ctx context.Context) ([]Blob, error)
+	// UnnameShared remove the alias from a key in the shared tier
+	UnnameShared(ctx context.Context, name string) error
 }
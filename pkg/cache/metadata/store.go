@@ -0,0 +1,265 @@
+package metadata
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/aifoundry-org/storage-manager/pkg/api"
+)
+
+// FileName name of the metadata file, kept in the cache directory next to the OCI index
+const FileName = "metadata.json"
+
+// touchFlushInterval how often changes that only record access are written to disk. Losing
+// the most recent accesses on a crash is harmless, so they are not written on every access.
+const touchFlushInterval = 10 * time.Second
+
+// Entry the metadata about a single name in the cache
+type Entry struct {
+	// LastAccess when the content was last requested or read
+	LastAccess time.Time `json:"lastAccess,omitempty"`
+	// Pins who has pinned the content, which protects it from eviction and deletion
+	Pins []string `json:"pins,omitempty"`
+	// Leases temporary protection of the content from eviction and deletion
+	Leases []Lease `json:"leases,omitempty"`
+	// DeletePending the content was deleted while under lease, and is removed once the last
+	// lease ends
+	DeletePending bool `json:"deletePending,omitempty"`
+	// ExpiresAt when the content is removed from the cache; zero if it does not expire
+	ExpiresAt time.Time `json:"expiresAt,omitempty"`
+	// Selections which manifests of an OCI index were pulled, by platform and artifact type;
+	// empty if not known, in which case all of them are assumed to be
+	Selections []string `json:"selections,omitempty"`
+	// CheckedAt when the source was last checked for changes to the content, by pulling it or
+	// by a refresh
+	CheckedAt time.Time `json:"checkedAt,omitempty"`
+	// Verification the signatures that were verified before the content was cached
+	Verification *api.Verification `json:"verification,omitempty"`
+	// Validators what identified the content at its source when it was last downloaded or
+	// checked, with which the source is asked whether it changed
+	Validators *api.Validators `json:"validators,omitempty"`
+	// PulledBy who pulled the content into the cache on their own account, such as the preload
+	// manifest, and may remove it again once they no longer need it; empty if it was pulled
+	// through the API
+	PulledBy []string `json:"pulledBy,omitempty"`
+}
+
+// Lease protects content from eviction and deletion until it expires or is released
+type Lease struct {
+	ID string `json:"id"`
+	// Key the content the name resolved to when the lease was taken, which stays protected even
+	// if the name later points elsewhere
+	Key       string    `json:"key"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// Pinned whether anyone has pinned the content
+func (e Entry) Pinned() bool {
+	return len(e.Pins) > 0
+}
+
+// LiveLeases the leases that have not expired at the given time
+func (e Entry) LiveLeases(now time.Time) []Lease {
+	var live []Lease
+	for _, l := range e.Leases {
+		if l.ExpiresAt.After(now) {
+			live = append(live, l)
+		}
+	}
+	return live
+}
+
+// Expired whether the content has outlived its expiry at the given time
+func (e Entry) Expired(now time.Time) bool {
+	return !e.ExpiresAt.IsZero() && !e.ExpiresAt.After(now)
+}
+
+// Protected whether the content may not be evicted or deleted at the given time
+func (e Entry) Protected(now time.Time) bool {
+	return e.Pinned() || len(e.LiveLeases(now)) > 0
+}
+
+// Store persistent metadata about the names in a cache, kept as a json file. It is safe for
+// concurrent use.
+type Store struct {
+	path string
+
+	mu        sync.Mutex
+	entries   map[string]*Entry
+	dirty     bool
+	lastFlush time.Time
+	// loaded when the store was loaded, which stands in for the access time of names that
+	// have never been accessed through this store
+	loaded time.Time
+}
+
+// Open the metadata store at path, creating it if it does not exist
+func Open(path string) (*Store, error) {
+	s := &Store{
+		path:    path,
+		entries: map[string]*Entry{},
+		loaded:  time.Now(),
+	}
+	b, err := os.ReadFile(path)
+	switch {
+	case os.IsNotExist(err):
+		return s, nil
+	case err != nil:
+		return nil, fmt.Errorf("could not read metadata %s: %v", path, err)
+	}
+	if err := json.Unmarshal(b, &s.entries); err != nil {
+		return nil, fmt.Errorf("could not parse metadata %s: %v", path, err)
+	}
+	return s, nil
+}
+
+// Get the metadata for a name
+func (s *Store) Get(name string) (Entry, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.entries[name]
+	if !ok {
+		return Entry{}, false
+	}
+	return e.clone(), true
+}
+
+// All get the metadata for every name
+func (s *Store) All() map[string]Entry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	all := make(map[string]Entry, len(s.entries))
+	for name, e := range s.entries {
+		all[name] = e.clone()
+	}
+	return all
+}
+
+// LastAccess when the name was last accessed. Names that have never been accessed count as
+// accessed when the store was opened.
+func (s *Store) LastAccess(name string) time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if e, ok := s.entries[name]; ok && !e.LastAccess.IsZero() {
+		return e.LastAccess
+	}
+	return s.loaded
+}
+
+// Touch record that the name was accessed now
+func (s *Store) Touch(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.entry(name).LastAccess = time.Now()
+	s.dirty = true
+	if time.Since(s.lastFlush) < touchFlushInterval {
+		return nil
+	}
+	return s.flush()
+}
+
+// Update change the metadata for a name, and write it to disk
+func (s *Store) Update(name string, fn func(e *Entry)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fn(s.entry(name))
+	s.dirty = true
+	return s.flush()
+}
+
+// Pin pin the name on behalf of owner
+func (s *Store) Pin(name, owner string) error {
+	return s.Update(name, func(e *Entry) {
+		if !slices.Contains(e.Pins, owner) {
+			e.Pins = append(e.Pins, owner)
+		}
+	})
+}
+
+// PulledBy record that owner pulled the name into the cache
+func (s *Store) PulledBy(name, owner string) error {
+	return s.Update(name, func(e *Entry) {
+		if !slices.Contains(e.PulledBy, owner) {
+			e.PulledBy = append(e.PulledBy, owner)
+		}
+	})
+}
+
+// Unpin remove the pin of owner from the name
+func (s *Store) Unpin(name, owner string) error {
+	return s.Update(name, func(e *Entry) {
+		e.Pins = slices.DeleteFunc(e.Pins, func(p string) bool { return p == owner })
+	})
+}
+
+// Delete remove all metadata for a name
+func (s *Store) Delete(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.entries[name]; !ok {
+		return nil
+	}
+	delete(s.entries, name)
+	s.dirty = true
+	return s.flush()
+}
+
+// Flush write any pending changes to disk
+func (s *Store) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.flush()
+}
+
+// entry get the entry for a name, creating it if needed. Must be called with the lock held.
+func (s *Store) entry(name string) *Entry {
+	e, ok := s.entries[name]
+	if !ok {
+		e = &Entry{}
+		s.entries[name] = e
+	}
+	return e
+}
+
+// flush write the metadata to disk atomically, if it changed. Must be called with the lock held.
+func (s *Store) flush() error {
+	if !s.dirty {
+		return nil
+	}
+	b, err := json.Marshal(s.entries)
+	if err != nil {
+		return fmt.Errorf("could not marshal metadata: %v", err)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*")
+	if err != nil {
+		return fmt.Errorf("could not create metadata file: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return fmt.Errorf("could not write metadata: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("could not write metadata: %v", err)
+	}
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		return fmt.Errorf("could not replace metadata %s: %v", s.path, err)
+	}
+	s.dirty = false
+	s.lastFlush = time.Now()
+	return nil
+}
+
+func (e *Entry) clone() Entry {
+	c := *e
+	c.Pins = slices.Clone(e.Pins)
+	c.Leases = slices.Clone(e.Leases)
+	c.Selections = slices.Clone(e.Selections)
+	c.PulledBy = slices.Clone(e.PulledBy)
+	return c
+}
@@ -2,11 +2,15 @@ package ocidir
 
 import (
 	"context"
-	"crypto/sha256"
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/aifoundry-org/storage-manager/pkg/cache"
 
@@ -16,152 +20,554 @@ import (
 	oraserrdefs "oras.land/oras-go/v2/errdef"
 )
 
+const (
+	// protectedDir the directory in the cache where every process lists the keys it protects
+	protectedDir = "protected"
+	// mediaTypeBlob the media type names of content other than manifests are tagged with,
+	// such as a file from HuggingFace
+	mediaTypeBlob = "application/octet-stream"
+	// childrenAnnotation the annotation on the tag of a name that records the keys of every
+	// blob the name refers to besides its key, separated by commas, for GC
+	childrenAnnotation = "org.aifoundry.storage-manager.children"
+)
+
 type cacheOCIDir struct {
-	dir   string
+	dir  string
+	lock *fileLock
+
+	// mu protects cache and index, which are replaced when another process changes the index
+	mu    sync.Mutex
 	cache *oci.Store
+	index os.FileInfo
+	// protection keys that must survive GC although no name refers to them, in every process
+	protection *cache.Protection
+	// gracePeriod how old unreferenced blobs must be before GC removes them
+	gracePeriod time.Duration
 }
 
-var _ cache.Cache = &cacheOCIDir{}
+var (
+	_ cache.Cache     = &cacheOCIDir{}
+	_ cache.Pather    = &cacheOCIDir{}
+	_ cache.Sizer     = &cacheOCIDir{}
+	_ cache.Protector = &cacheOCIDir{}
+	_ cache.Ingester  = &cacheOCIDir{}
+	_ cache.Collector = &cacheOCIDir{}
+)
 
-func New(cacheDir string) (*cacheOCIDir, error) {
-	p, err := oci.New(cacheDir)
-	if err != nil {
+// New open the OCI layout cache at cacheDir, creating it if needed. Several processes may use
+// the same cache directory at once; changes to the index are serialized with a file lock in
+// the directory, and each process picks up the changes made by the others. GC only removes
+// unreferenced blobs older than gracePeriod, for a directory that processes on other nodes
+// write to, which cannot see the keys this node protects; 0 to remove them at once.
+func New(cacheDir string, gracePeriod time.Duration) (*cacheOCIDir, error) {
+	if err := os.MkdirAll(cacheDir, 0755); err != nil {
+		return nil, fmt.Errorf("could not create cache directory %s: %v", cacheDir, err)
+	}
+	c := &cacheOCIDir{
+		dir:         cacheDir,
+		lock:        newFileLock(filepath.Join(cacheDir, lockFile)),
+		protection:  cache.NewProtection(filepath.Join(cacheDir, protectedDir)),
+		gracePeriod: gracePeriod,
+	}
+	if err := c.write(func(*oci.Store) error { return nil }); err != nil {
 		return nil, fmt.Errorf("could not initialize cache at path %s: %v", cacheDir, err)
 	}
-	return &cacheOCIDir{
-		cache: p,
-		dir:   cacheDir,
-	}, nil
+	return c, nil
 }
 
-// Get content from the cache
-func (c *cacheOCIDir) Get(key string) (io.ReadCloser, error) {
-	ctx := context.Background()
-	desc, err := c.cache.Resolve(ctx, key)
+// read run fn with the cache locked for reading, against an up to date view of the index
+func (c *cacheOCIDir) read(fn func(store *oci.Store) error) error {
+	unlock, err := c.lock.RLock()
 	if err != nil {
-		return nil, fmt.Errorf("could not resolve %s: %v", key, err)
+		return err
 	}
-	return c.cache.Fetch(ctx, desc)
+	defer unlock()
+	store, err := c.store()
+	if err != nil {
+		return err
+	}
+	return fn(store)
 }
 
-// Exists check if content for a given key exists in the cache
-func (c *cacheOCIDir) Exists(key string) (bool, error) {
-	ctx := context.Background()
-	desc, err := c.cache.Resolve(ctx, key)
-	if err != nil && errors.Is(err, oraserrdefs.ErrNotFound) {
-		return false, nil
+// write run fn with the cache locked for writing, against an up to date view of the index,
+// saving the index afterwards
+func (c *cacheOCIDir) write(fn func(store *oci.Store) error) error {
+	unlock, err := c.lock.Lock()
+	if err != nil {
+		return err
 	}
+	defer unlock()
+	store, err := c.store()
 	if err != nil {
-		return false, fmt.Errorf("could not resolve %s: %v", key, err)
+		return err
+	}
+	fnErr := fn(store)
+	if err := store.SaveIndex(); err != nil && fnErr == nil {
+		fnErr = fmt.Errorf("could not save index: %v", err)
 	}
-	return c.cache.Exists(ctx, desc)
+	c.mu.Lock()
+	c.index, _ = os.Stat(c.indexPath())
+	c.mu.Unlock()
+	return fnErr
 }
 
-// Delete content from the cache
-func (c *cacheOCIDir) Delete(key string) error {
-	ctx := context.Background()
-	desc, err := c.cache.Resolve(ctx, key)
-	if err != nil && errors.Is(err, oraserrdefs.ErrNotFound) {
+// store get the oci store, reloading it if the index was changed by another process.
+// Must be called with the lock held.
+func (c *cacheOCIDir) store() (*oci.Store, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	info, err := os.Stat(c.indexPath())
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("could not stat index: %v", err)
+	}
+	if c.cache != nil && sameFile(c.index, info) {
+		return c.cache, nil
+	}
+	p, err := oci.New(c.dir)
+	if err != nil {
+		return nil, err
+	}
+	// the index is saved once at the end of every write, so other processes never see a
+	// partial change
+	p.AutoSaveIndex = false
+	// the blobs a manifest refers to may be shared with other names, which only GC knows of
+	p.AutoGC = false
+	c.cache = p
+	c.index = info
+	return p, nil
+}
+
+func (c *cacheOCIDir) indexPath() string {
+	return filepath.Join(c.dir, ocispec.ImageIndexFile)
+}
+
+// sameFile whether the two stats describe the same unchanged file
+func sameFile(a, b os.FileInfo) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Size() == b.Size() && a.ModTime().Equal(b.ModTime())
+}
+
+// Get content from the cache
+func (c *cacheOCIDir) Get(ctx context.Context, key string) (rc io.ReadCloser, err error) {
+	err = c.read(func(store *oci.Store) error {
+		desc, err := store.Resolve(ctx, key)
+		if err == nil {
+			rc, err = store.Fetch(ctx, desc)
+		}
+		if errors.Is(err, oraserrdefs.ErrNotFound) {
+			return &cache.NotFoundError{Key: key}
+		}
+		if err != nil {
+			return fmt.Errorf("could not get %s: %v", key, err)
+		}
 		return nil
+	})
+	return rc, err
+}
+
+// Exists check if content for a given key exists in the cache
+func (c *cacheOCIDir) Exists(ctx context.Context, key string) (exists bool, err error) {
+	err = c.read(func(store *oci.Store) error {
+		desc, err := store.Resolve(ctx, key)
+		if err != nil && errors.Is(err, oraserrdefs.ErrNotFound) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("could not resolve %s: %v", key, err)
+		}
+		exists, err = store.Exists(ctx, desc)
+		return err
+	})
+	return exists, err
+}
+
+// Delete content from the cache
+func (c *cacheOCIDir) Delete(ctx context.Context, key string) error {
+	return c.write(func(store *oci.Store) error {
+		desc, err := store.Resolve(ctx, key)
+		if err != nil && errors.Is(err, oraserrdefs.ErrNotFound) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("could not resolve %s: %v", key, err)
+		}
+		exists, err := store.Exists(ctx, desc)
+		// if it does not exist, just remove the tag
+		if (err != nil && errors.Is(err, oraserrdefs.ErrNotFound)) || !exists {
+			return store.Untag(ctx, key)
+		}
+		if err := store.Delete(ctx, desc); err != nil {
+			return fmt.Errorf("could not delete %s: %v", key, err)
+		}
+		return store.Untag(ctx, key)
+	})
+}
+
+// Put content in the cache. If the key is not provided it will be generated from the content.
+func (c *cacheOCIDir) Put(ctx context.Context, key string, size int64, r io.ReadCloser) error {
+	defer r.Close()
+	_, release, err := c.put(ctx, key, "", size, r)
+	if err != nil {
+		return err
 	}
+	// whoever puts content under a known key protects it themselves until it is named
+	release()
+	return nil
+}
+
+// Ingest write content whose key is not known ahead of time into the cache, returning its key,
+// its digest with the algorithm, and its size. The content is protected from GC until release
+// is called.
+func (c *cacheOCIDir) Ingest(ctx context.Context, alg digest.Algorithm, r io.Reader) (key string, size int64, release func(), err error) {
+	desc, release, err := c.put(ctx, "", alg, 0, r)
 	if err != nil {
-		return fmt.Errorf("could not resolve %s: %v", key, err)
+		return "", 0, nil, err
 	}
-	defer c.cache.SaveIndex()
-	exists, err := c.cache.Exists(ctx, desc)
-	// if it does not exist, just remove the tag
-	if (err != nil && errors.Is(err, oraserrdefs.ErrNotFound)) || !exists {
-		return c.cache.Untag(ctx, key)
+	return desc.Digest.String(), desc.Size, release, nil
+}
+
+// put write the content into the blobs directory and tag it with its key, or its digest with
+// alg if it has none, returning it protected from GC until release is called
+func (c *cacheOCIDir) put(ctx context.Context, key string, alg digest.Algorithm, size int64, r io.Reader) (ocispec.Descriptor, func(), error) {
+	// the blob is written to a temporary file and renamed into place, so it does not need
+	// the lock; only tagging it changes the index
+	desc, release, err := c.ingest(ctx, key, alg, size, r)
+	if err != nil {
+		if key == "" {
+			return desc, nil, fmt.Errorf("could not put content: %w", err)
+		}
+		return desc, nil, fmt.Errorf("could not put %s: %w", key, err)
 	}
-	if err := c.cache.Delete(ctx, desc); err != nil {
-		return fmt.Errorf("could not delete %s: %v", key, err)
+	if err := c.write(func(store *oci.Store) error {
+		return store.Tag(ctx, desc, desc.Digest.String())
+	}); err != nil {
+		release()
+		return desc, nil, fmt.Errorf("could not put %s: %v", desc.Digest, err)
 	}
-	return c.cache.Untag(ctx, key)
+	return desc, release, nil
 }
 
-// Put content in the cache. If the key is not provided it will be generated from the content.
-func (c *cacheOCIDir) Put(key string, size int64, r io.ReadCloser) error {
-	ctx := context.Background()
+// Name alias a key to a name, recording the keys of the blobs it refers to
+func (c *cacheOCIDir) Name(ctx context.Context, key, name string) error {
+	desc, err := c.describe(ctx, key)
+	if err != nil {
+		return err
+	}
+	return c.write(func(store *oci.Store) error {
+		return store.Tag(ctx, desc, name)
+	})
+}
+
+// describe the descriptor that names of a key are tagged with: a manifest or index has its
+// own media type, so that OCI tools can follow it, and anything else is a plain blob. The
+// descriptor records the keys of every blob the key refers to, for GC.
+func (c *cacheOCIDir) describe(ctx context.Context, key string) (ocispec.Descriptor, error) {
 	var desc ocispec.Descriptor
-	if key == "" || size <= 0 {
-		// we need a temporary directory to store the content
-		tmpDir, err := os.MkdirTemp(c.dir, "content")
+	dgst, err := digest.Parse(key)
+	if err != nil {
+		return desc, fmt.Errorf("invalid key %s: %v", key, err)
+	}
+	rc, err := c.open(ctx, key)
+	if err != nil {
+		return desc, err
+	}
+	defer rc.Close()
+	info, err := rc.Stat()
+	if err != nil {
+		return desc, fmt.Errorf("could not stat %s: %v", key, err)
+	}
+	m, err := cache.ReadManifest(rc)
+	if err != nil {
+		return desc, fmt.Errorf("could not read %s: %v", key, err)
+	}
+	children, err := cache.Children(ctx, c.get, key)
+	if err != nil {
+		return desc, err
+	}
+	desc = ocispec.Descriptor{
+		MediaType:   mediaTypeBlob,
+		Digest:      dgst,
+		Size:        info.Size(),
+		Annotations: map[string]string{childrenAnnotation: strings.Join(children, ",")},
+	}
+	if m != nil {
+		desc.MediaType = m.MediaType
+	}
+	return desc, nil
+}
+
+// open the blob for a key. Blobs are renamed into place whole, so they are read without
+// the lock.
+func (c *cacheOCIDir) open(_ context.Context, key string) (*os.File, error) {
+	p, err := c.Path(key)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, fmt.Errorf("could not open %s: %v", key, err)
+	}
+	return f, nil
+}
+
+// get the blob for a key, as a cache.GetFunc
+func (c *cacheOCIDir) get(ctx context.Context, key string) (io.ReadCloser, error) {
+	return c.open(ctx, key)
+}
+
+// Unname remove the alias from a key
+func (c *cacheOCIDir) Unname(ctx context.Context, name string) error {
+	return c.write(func(store *oci.Store) error {
+		err := store.Untag(ctx, name)
+		if errors.Is(err, oraserrdefs.ErrNotFound) {
+			return &cache.NotFoundError{Key: name}
+		}
+		return err
+	})
+}
+
+// Resolve a name to a key
+func (c *cacheOCIDir) Resolve(ctx context.Context, name string) (key string, err error) {
+	err = c.read(func(store *oci.Store) error {
+		desc, err := store.Resolve(ctx, name)
+		if err != nil && errors.Is(err, oraserrdefs.ErrNotFound) {
+			return &cache.NotFoundError{Key: name}
+		}
 		if err != nil {
-			return fmt.Errorf("could not create temporary directory: %v", err)
+			return fmt.Errorf("could not resolve %s: %v", name, err)
 		}
-		defer os.RemoveAll(tmpDir)
-		digester := sha256.New()
-		fileName := fmt.Sprintf("%s/%s", tmpDir, "content")
-		f, err := os.Create(fileName)
+		key = desc.Digest.String()
+		return nil
+	})
+	return key, err
+}
+
+// GC clean up unreferenced keys: every blob that no name depends on and that is not protected
+func (c *cacheOCIDir) GC(ctx context.Context) error {
+	_, err := c.collect(ctx, true)
+	return err
+}
+
+// Unreferenced the blobs that GC would remove now
+func (c *cacheOCIDir) Unreferenced(ctx context.Context) ([]cache.Blob, error) {
+	return c.collect(ctx, false)
+}
+
+// collect find the blobs that no name depends on, that are not protected and that are older
+// than the grace period, and remove them, with the tags of their keys, if remove is set
+func (c *cacheOCIDir) collect(ctx context.Context, remove bool) (garbage []cache.Blob, err error) {
+	cutoff := time.Now().Add(-c.gracePeriod)
+	locked := c.read
+	if remove {
+		locked = c.write
+	}
+	// names cannot change while the lock is held, but blobs are written without it
+	err = locked(func(store *oci.Store) error {
+		keep, err := c.mark(ctx, store)
 		if err != nil {
-			return fmt.Errorf("could not create temporary file: %v", err)
+			return err
 		}
-		defer f.Close()
-		multi := io.MultiWriter(digester, f)
-		n, err := io.Copy(multi, r)
+		var candidates []cache.Blob
+		err = c.walk(ctx, func(d digest.Digest, _ string, e fs.DirEntry) error {
+			if keep[d] {
+				return nil
+			}
+			info, err := e.Info()
+			if os.IsNotExist(err) {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if info.ModTime().After(cutoff) {
+				return nil
+			}
+			candidates = append(candidates, cache.Blob{Key: d.String(), Size: info.Size()})
+			return nil
+		})
 		if err != nil {
-			return fmt.Errorf("could not copy content: %v", err)
+			return err
 		}
-		if n == 0 {
-			return fmt.Errorf("no content to copy")
+		// a blob is protected before it is moved into place, so any that was written since
+		// the protected keys were read is protected by now
+		protected, err := c.protection.Keys()
+		if err != nil {
+			return err
 		}
-		newKey := digest.NewDigestFromEncoded(digest.SHA256, fmt.Sprintf("%x", digester.Sum(nil))).String()
-		if newKey != key {
-			return fmt.Errorf("key mismatch: %s != %s", newKey, key)
+		for _, blob := range candidates {
+			if protected[blob.Key] {
+				continue
+			}
+			garbage = append(garbage, blob)
+			if !remove {
+				continue
+			}
+			// deleting through the store also drops the tag of the key
+			desc, err := store.Resolve(ctx, blob.Key)
+			if err == nil {
+				err = store.Delete(ctx, desc)
+			}
+			if err != nil && !errors.Is(err, oraserrdefs.ErrNotFound) {
+				return fmt.Errorf("could not remove %s: %v", blob.Key, err)
+			}
 		}
-		desc = ocispec.Descriptor{
-			Digest: digest.Digest(key),
-			Size:   n,
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not collect garbage: %v", err)
+	}
+	return garbage, nil
+}
+
+// mark the blobs to keep: every protected blob, and the key of every name with the keys
+// recorded when it was named. The graph of a name tagged before it was recorded is found
+// from its manifests. Must be called with the lock held.
+func (c *cacheOCIDir) mark(ctx context.Context, store *oci.Store) (map[digest.Digest]bool, error) {
+	// protected keys are taken before the names, as content is named before it is released
+	protected, err := c.protection.Keys()
+	if err != nil {
+		return nil, err
+	}
+	keep := make(map[digest.Digest]bool, len(protected))
+	for key := range protected {
+		keep[digest.Digest(key)] = true
+	}
+	names, err := c.names(ctx, store)
+	if err != nil {
+		return nil, fmt.Errorf("could not list names: %v", err)
+	}
+	for _, name := range names {
+		desc, err := store.Resolve(ctx, name)
+		if err != nil {
+			return nil, fmt.Errorf("could not resolve %s: %v", name, err)
 		}
-		if _, err := f.Seek(0, 0); err != nil {
-			return fmt.Errorf("could not seek to the beginning of the file: %v", err)
+		keep[desc.Digest] = true
+		recorded, ok := desc.Annotations[childrenAnnotation]
+		var children []string
+		switch {
+		case ok && recorded != "":
+			children = strings.Split(recorded, ",")
+		case !ok:
+			children, err = cache.Children(ctx, c.get, desc.Digest.String())
+			var notFound *cache.NotFoundError
+			if err != nil && !errors.As(err, &notFound) {
+				return nil, err
+			}
 		}
-		r = f
-	} else {
-		desc = ocispec.Descriptor{
-			Digest: digest.Digest(key),
-			Size:   size,
+		for _, child := range children {
+			keep[digest.Digest(child)] = true
 		}
-		defer r.Close()
-	}
-	if err := c.cache.Push(ctx, desc, r); err != nil {
-		return fmt.Errorf("could not put %s: %v", key, err)
 	}
-	defer c.cache.SaveIndex()
-	return c.cache.Tag(ctx, desc, key)
+	return keep, nil
 }
 
-// Name alias a key to a name
-func (c *cacheOCIDir) Name(key, name string) error {
-	ctx := context.Background()
-	desc := ocispec.Descriptor{
-		MediaType: ocispec.MediaTypeImageConfig,
-		Digest:    digest.Digest(key),
+// Protect the keys from GC, in every process using the cache, until the returned function is
+// called
+func (c *cacheOCIDir) Protect(keys ...string) func() {
+	return c.protection.Protect(keys...)
+}
+
+// List all of the names in the cache
+func (c *cacheOCIDir) List(ctx context.Context) (names []string, err error) {
+	if err := c.read(func(store *oci.Store) error {
+		names, err = c.names(ctx, store)
+		return err
+	}); err != nil {
+		return nil, fmt.Errorf("could not list names: %v", err)
 	}
-	return c.cache.Tag(ctx, desc, name)
+	return names, nil
 }
 
-// Unname remove the alias from a key
-func (c *cacheOCIDir) Unname(name string) error {
-	ctx := context.Background()
-	return c.cache.Untag(ctx, name)
+// names the tags of the index that are names. Must be called with the lock held.
+func (c *cacheOCIDir) names(ctx context.Context, store *oci.Store) ([]string, error) {
+	var names []string
+	err := store.Tags(ctx, "", func(tags []string) error {
+		for _, tag := range tags {
+			// keys are tagged with themselves, those are not names
+			if _, err := digest.Parse(tag); err == nil {
+				continue
+			}
+			names = append(names, tag)
+		}
+		return nil
+	})
+	return names, err
 }
 
-// Resolve a name to a key
-func (c *cacheOCIDir) Resolve(name string) (string, error) {
-	ctx := context.Background()
-	desc, err := c.cache.Resolve(ctx, name)
+// Path to the content for a key in the OCI layout
+func (c *cacheOCIDir) Path(key string) (string, error) {
+	dgst, err := digest.Parse(key)
 	if err != nil {
-		return "", fmt.Errorf("could not resolve %s: %v", name, err)
+		return "", fmt.Errorf("invalid key %s: %v", key, err)
+	}
+	p := c.blobPath(dgst)
+	if _, err := os.Stat(p); err != nil {
+		if os.IsNotExist(err) {
+			return "", &cache.NotFoundError{Key: key}
+		}
+		return "", fmt.Errorf("could not stat %s: %v", p, err)
 	}
-	return desc.Digest.String(), nil
+	return p, nil
 }
 
-// GC clean up unreferenced keys
-func (c *cacheOCIDir) GC() error {
-	ctx := context.Background()
-	if err := c.cache.SaveIndex(); err != nil {
-		return fmt.Errorf("could not save index: %v", err)
+// Usage total size in bytes of all of the blobs in the cache
+func (c *cacheOCIDir) Usage() (int64, error) {
+	var total int64
+	err := c.walk(context.Background(), func(_ digest.Digest, _ string, e fs.DirEntry) error {
+		info, err := e.Info()
+		if err != nil {
+			// blobs may be removed while we walk
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		total += info.Size()
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("could not calculate cache usage: %v", err)
+	}
+	return total, nil
+}
+
+// walk call fn for every blob in the cache, with its digest and path. Anything in the
+// directories of blobs that is not named after its digest is skipped.
+func (c *cacheOCIDir) walk(ctx context.Context, fn func(d digest.Digest, p string, e fs.DirEntry) error) error {
+	root := filepath.Join(c.dir, ocispec.ImageBlobsDir)
+	algs, err := os.ReadDir(root)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, alg := range algs {
+		if !alg.IsDir() {
+			continue
+		}
+		algPath := filepath.Join(root, alg.Name())
+		entries, err := os.ReadDir(algPath)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			d := digest.NewDigestFromEncoded(digest.Algorithm(alg.Name()), e.Name())
+			if e.IsDir() || d.Validate() != nil {
+				continue
+			}
+			if err := fn(d, filepath.Join(algPath, e.Name()), e); err != nil {
+				return err
+			}
+		}
 	}
-	return c.cache.GC(ctx)
+	return nil
 }
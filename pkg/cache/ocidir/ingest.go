@@ -0,0 +1,33 @@
+package ocidir
+
+import (
+	"context"
+	"io"
+	"path/filepath"
+
+	"github.com/aifoundry-org/storage-manager/pkg/cache"
+
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// ingestDir the directory in the cache where blobs are written before they are renamed into
+// place, the same one the oci store uses for pushes
+const ingestDir = "ingest"
+
+// ingest write the content to a temporary file in the cache directory, hashing it on the way,
+// and rename it into place in the blobs directory, under blobs/<algorithm>/<hex>, as
+// cache.IngestFile does. The blob is protected from GC until release is called, so it cannot
+// be cleaned up before it is tagged or named.
+func (c *cacheOCIDir) ingest(ctx context.Context, key string, alg digest.Algorithm, size int64, r io.Reader) (desc ocispec.Descriptor, release func(), err error) {
+	d, n, release, err := cache.IngestFile(ctx, c, filepath.Join(c.dir, ingestDir), c.blobPath, key, alg, size, r)
+	if err != nil {
+		return desc, nil, err
+	}
+	return ocispec.Descriptor{Digest: d, Size: n}, release, nil
+}
+
+// blobPath where the blob for a digest is kept
+func (c *cacheOCIDir) blobPath(d digest.Digest) string {
+	return filepath.Join(c.dir, ocispec.ImageBlobsDir, d.Algorithm().String(), d.Encoded())
+}
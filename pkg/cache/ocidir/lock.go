@@ -0,0 +1,65 @@
+package ocidir
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"syscall"
+)
+
+// lockFile name of the file, in the cache directory, that is locked by every process using the cache
+const lockFile = ".lock"
+
+// fileLock a reader/writer lock that is shared between goroutines of this process and,
+// through flock on a file in the cache directory, with other processes using the same cache.
+type fileLock struct {
+	path string
+	mu   sync.RWMutex
+}
+
+func newFileLock(path string) *fileLock {
+	return &fileLock{path: path}
+}
+
+// Lock take the lock exclusively, returning a function to release it
+func (l *fileLock) Lock() (func(), error) {
+	l.mu.Lock()
+	unlock, err := l.flock(syscall.LOCK_EX)
+	if err != nil {
+		l.mu.Unlock()
+		return nil, err
+	}
+	return func() {
+		unlock()
+		l.mu.Unlock()
+	}, nil
+}
+
+// RLock take the lock shared, returning a function to release it
+func (l *fileLock) RLock() (func(), error) {
+	l.mu.RLock()
+	unlock, err := l.flock(syscall.LOCK_SH)
+	if err != nil {
+		l.mu.RUnlock()
+		return nil, err
+	}
+	return func() {
+		unlock()
+		l.mu.RUnlock()
+	}, nil
+}
+
+func (l *fileLock) flock(how int) (func(), error) {
+	f, err := os.OpenFile(l.path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("could not open lock file %s: %v", l.path, err)
+	}
+	if err := syscall.Flock(int(f.Fd()), how); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("could not lock %s: %v", l.path, err)
+	}
+	return func() {
+		_ = syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		f.Close()
+	}, nil
+}
@@ -0,0 +1,183 @@
+package cache
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+const (
+	// protectedLockExt the extension of the file each process holds locked while it protects keys
+	protectedLockExt = ".lock"
+	// protectedKeysExt the extension of the file that lists the keys a process protects
+	protectedKeysExt = ".keys"
+)
+
+// Protection keys protected from GC, shared with every process using the same cache directory,
+// such as an offline pull alongside the server. Each process lists the keys it protects in a
+// file of its own in dir, next to a file it holds locked for as long as it runs, so that GC in
+// any process keeps them, and drops the files of processes that are gone.
+type Protection struct {
+	dir string
+
+	mu sync.Mutex
+	// counts how many times each key is protected
+	counts map[string]int
+	// id names the files of this process, once it protected anything
+	id string
+	// lock the file held locked by this process
+	lock *os.File
+}
+
+// NewProtection keep the protected keys of the cache in dir
+func NewProtection(dir string) *Protection {
+	return &Protection{dir: dir, counts: map[string]int{}}
+}
+
+// Protect the keys from GC, in every process, until the returned function is called. If the
+// keys cannot be written down, they are still protected from GC in this process.
+func (p *Protection) Protect(keys ...string) func() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, key := range keys {
+		p.counts[key]++
+	}
+	_ = p.save()
+	return func() {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		for _, key := range keys {
+			if p.counts[key]--; p.counts[key] <= 0 {
+				delete(p.counts, key)
+			}
+		}
+		_ = p.save()
+	}
+}
+
+// save write down the keys protected by this process. Must be called with mu held.
+func (p *Protection) save() error {
+	if p.lock == nil {
+		if err := p.open(); err != nil {
+			return err
+		}
+	}
+	keys := make([]string, 0, len(p.counts))
+	for key := range p.counts {
+		keys = append(keys, key)
+	}
+	tmp := filepath.Join(p.dir, "."+p.id+protectedKeysExt)
+	if err := os.WriteFile(tmp, []byte(strings.Join(keys, "\n")), 0644); err != nil {
+		return fmt.Errorf("could not write protected keys: %v", err)
+	}
+	if err := os.Rename(tmp, filepath.Join(p.dir, p.id+protectedKeysExt)); err != nil {
+		return fmt.Errorf("could not write protected keys: %v", err)
+	}
+	return nil
+}
+
+// open create and lock the lock file of this process. It is locked before it is renamed into
+// place, so no other process ever sees it unlocked. Must be called with mu held.
+func (p *Protection) open() error {
+	if err := os.MkdirAll(p.dir, 0755); err != nil {
+		return fmt.Errorf("could not create protection directory: %v", err)
+	}
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Errorf("could not generate protection id: %v", err)
+	}
+	id := hex.EncodeToString(b)
+	tmp := filepath.Join(p.dir, "."+id+protectedLockExt)
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return fmt.Errorf("could not create protection lock: %v", err)
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return fmt.Errorf("could not lock protection lock: %v", err)
+	}
+	if err := os.Rename(tmp, filepath.Join(p.dir, id+protectedLockExt)); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return fmt.Errorf("could not create protection lock: %v", err)
+	}
+	p.id, p.lock = id, f
+	return nil
+}
+
+// Keys every key protected by any process using the cache. The files of processes that are
+// gone, whose lock is free, are removed.
+func (p *Protection) Keys() (map[string]bool, error) {
+	p.mu.Lock()
+	keys := make(map[string]bool, len(p.counts))
+	for key := range p.counts {
+		keys[key] = true
+	}
+	own := p.id
+	p.mu.Unlock()
+
+	entries, err := os.ReadDir(p.dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return keys, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not read protected keys: %v", err)
+	}
+	for _, e := range entries {
+		id, ok := strings.CutSuffix(e.Name(), protectedLockExt)
+		if !ok || strings.HasPrefix(id, ".") || id == own {
+			continue
+		}
+		alive, err := p.alive(id)
+		if err != nil {
+			return nil, err
+		}
+		if !alive {
+			continue
+		}
+		b, err := os.ReadFile(filepath.Join(p.dir, id+protectedKeysExt))
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("could not read protected keys: %v", err)
+		}
+		for _, key := range strings.Split(string(b), "\n") {
+			if key != "" {
+				keys[key] = true
+			}
+		}
+	}
+	return keys, nil
+}
+
+// alive whether the process with the id still holds its lock, removing its files if not
+func (p *Protection) alive(id string) (bool, error) {
+	lockPath := filepath.Join(p.dir, id+protectedLockExt)
+	f, err := os.Open(lockPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("could not open protection lock: %v", err)
+	}
+	defer f.Close()
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return true, nil
+		}
+		return false, fmt.Errorf("could not check protection lock: %v", err)
+	}
+	// the keys go first, so that none are left behind without a lock file to tell they are stale
+	os.Remove(filepath.Join(p.dir, id+protectedKeysExt))
+	os.Remove(lockPath)
+	return false, nil
+}
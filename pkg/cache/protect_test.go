@@ -0,0 +1,56 @@
+package cache
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestProtectionShared(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "protected")
+	// each has its own lock file, as another process would
+	server, pull := NewProtection(dir), NewProtection(dir)
+
+	release := pull.Protect("sha256:aaaa", "sha256:bbbb")
+	keys, err := server.Keys()
+	if err != nil {
+		t.Fatalf("keys: %v", err)
+	}
+	if !keys["sha256:aaaa"] || !keys["sha256:bbbb"] {
+		t.Errorf("keys = %v, want the keys protected by the other", keys)
+	}
+
+	release()
+	keys, err = server.Keys()
+	if err != nil {
+		t.Fatalf("keys: %v", err)
+	}
+	if len(keys) != 0 {
+		t.Errorf("keys = %v after release, want none", keys)
+	}
+}
+
+func TestProtectionStale(t *testing.T) {
+	dir := t.TempDir()
+	// the files of a process that exited without releasing its keys: its lock file is not held
+	if err := os.WriteFile(filepath.Join(dir, "gone"+protectedLockExt), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "gone"+protectedKeysExt), []byte("sha256:aaaa"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := NewProtection(dir).Keys()
+	if err != nil {
+		t.Fatalf("keys: %v", err)
+	}
+	if len(keys) != 0 {
+		t.Errorf("keys = %v, want none from a process that is gone", keys)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("%d files left behind by a process that is gone", len(entries))
+	}
+}
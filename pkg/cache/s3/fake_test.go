@@ -0,0 +1,409 @@
+package s3
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeBucket the bucket served by fakeS3
+const fakeBucket = "cache"
+
+// fakeObject an object held by fakeS3
+type fakeObject struct {
+	data     []byte
+	etag     string
+	modified time.Time
+}
+
+// fakeUpload a multipart upload in progress in fakeS3
+type fakeUpload struct {
+	key       string
+	parts     map[int][]byte
+	initiated time.Time
+}
+
+// fakeS3 an in-process object store serving a single bucket, implementing the subset of the
+// S3 API that minio-go uses for the cache: objects with conditional and copying writes,
+// listings, and multipart uploads. Requests are not authenticated.
+type fakeS3 struct {
+	mu      sync.Mutex
+	objects map[string]*fakeObject
+	uploads map[string]*fakeUpload
+	nextID  int
+	// beforePut is called, if set, with the key of every object about to be written, before
+	// its conditions are checked
+	beforePut func(key string)
+	// conflicts how many conditional writes failed
+	conflicts int
+}
+
+// newFakeS3 start a fake object store, stopped when the test ends, returning it with its
+// endpoint
+func newFakeS3(t *testing.T) (*fakeS3, string) {
+	f := &fakeS3{objects: map[string]*fakeObject{}, uploads: map[string]*fakeUpload{}}
+	server := httptest.NewServer(f)
+	t.Cleanup(server.Close)
+	return f, strings.TrimPrefix(server.URL, "http://")
+}
+
+// age make every object and upload older by d, as if it was written d earlier
+func (f *fakeS3) age(d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, obj := range f.objects {
+		obj.modified = obj.modified.Add(-d)
+	}
+	for _, upload := range f.uploads {
+		upload.initiated = upload.initiated.Add(-d)
+	}
+}
+
+// keys the keys of every object under the prefix
+func (f *fakeS3) keys(prefix string) []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var keys []string
+	for key := range f.objects {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// etag the ETag of content, as S3 gives it for a single part
+func etag(data []byte) string {
+	sum := md5.Sum(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// isoTime the time as it is given in listings
+func isoTime(t time.Time) string {
+	return t.UTC().Format("2006-01-02T15:04:05.000Z")
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if bucket != fakeBucket {
+		fakeError(w, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+	query := r.URL.Query()
+	body, err := readBody(r)
+	if err != nil {
+		fakeError(w, http.StatusBadRequest, "IncompleteBody")
+		return
+	}
+	switch {
+	case key == "" && (r.Method == http.MethodGet || r.Method == http.MethodHead):
+		f.serveBucket(w, r, query)
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		f.serveObject(w, r, key)
+	case r.Method == http.MethodPut && query.Has("partNumber"):
+		f.putPart(w, r, key, query, body)
+	case r.Method == http.MethodPut:
+		f.putObject(w, r, key, body)
+	case r.Method == http.MethodPost && query.Has("uploads"):
+		f.initiateUpload(w, key)
+	case r.Method == http.MethodPost && query.Has("uploadId"):
+		f.completeUpload(w, key, query.Get("uploadId"))
+	case r.Method == http.MethodDelete:
+		f.mu.Lock()
+		if query.Has("uploadId") {
+			delete(f.uploads, query.Get("uploadId"))
+		} else {
+			delete(f.objects, key)
+		}
+		f.mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		fakeError(w, http.StatusNotImplemented, "NotImplemented")
+	}
+}
+
+// readBody read the body of a request, decoding the chunks of a streaming signature
+func readBody(r *http.Request) ([]byte, error) {
+	data, err := io.ReadAll(r.Body)
+	if err != nil || !strings.HasPrefix(r.Header.Get("x-amz-content-sha256"), "STREAMING-") {
+		return data, err
+	}
+	var decoded []byte
+	br := bufio.NewReader(bytes.NewReader(data))
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		size, err := strconv.ParseInt(strings.TrimSpace(strings.Split(line, ";")[0]), 16, 64)
+		if err != nil {
+			return nil, err
+		}
+		// anything after the last chunk is trailers, such as checksums
+		if size == 0 {
+			return decoded, nil
+		}
+		chunk := make([]byte, size)
+		if _, err := io.ReadFull(br, chunk); err != nil {
+			return nil, err
+		}
+		decoded = append(decoded, chunk...)
+		if _, err := br.ReadString('\n'); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// fakeError send an S3 error
+func fakeError(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?><Error><Code>%s</Code><Message>%s</Message></Error>`, code, code)
+}
+
+// sendXML send a response as XML
+func sendXML(w http.ResponseWriter, v any) {
+	b, err := xml.Marshal(v)
+	if err != nil {
+		fakeError(w, http.StatusInternalServerError, "InternalError")
+		return
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	w.Write([]byte(xml.Header))
+	w.Write(b)
+}
+
+type listContents struct {
+	Key          string
+	LastModified string
+	ETag         string
+	Size         int
+}
+
+type listBucketResult struct {
+	XMLName     xml.Name `xml:"ListBucketResult"`
+	Name        string
+	Prefix      string
+	KeyCount    int
+	MaxKeys     int
+	IsTruncated bool
+	Contents    []listContents
+}
+
+type listUpload struct {
+	Key       string
+	UploadID  string `xml:"UploadId"`
+	Initiated string
+}
+
+type listUploadsResult struct {
+	XMLName     xml.Name `xml:"ListMultipartUploadsResult"`
+	Bucket      string
+	IsTruncated bool
+	Uploads     []listUpload `xml:"Upload"`
+}
+
+// serveBucket the requests on the bucket itself: its location, listings of objects and of
+// uploads, and whether it exists
+func (f *fakeS3) serveBucket(w http.ResponseWriter, r *http.Request, query url.Values) {
+	prefix := query.Get("prefix")
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch {
+	case query.Has("location"):
+		sendXML(w, struct {
+			XMLName xml.Name `xml:"LocationConstraint"`
+		}{})
+	case query.Has("uploads"):
+		result := listUploadsResult{Bucket: fakeBucket}
+		for id, upload := range f.uploads {
+			if strings.HasPrefix(upload.key, prefix) {
+				result.Uploads = append(result.Uploads, listUpload{Key: upload.key, UploadID: id, Initiated: isoTime(upload.initiated)})
+			}
+		}
+		sendXML(w, result)
+	case query.Get("list-type") == "2":
+		result := listBucketResult{Name: fakeBucket, Prefix: prefix, MaxKeys: 1000}
+		for key, obj := range f.objects {
+			if strings.HasPrefix(key, prefix) {
+				result.Contents = append(result.Contents, listContents{Key: key, LastModified: isoTime(obj.modified), ETag: `"` + obj.etag + `"`, Size: len(obj.data)})
+			}
+		}
+		sort.Slice(result.Contents, func(i, j int) bool { return result.Contents[i].Key < result.Contents[j].Key })
+		result.KeyCount = len(result.Contents)
+		sendXML(w, result)
+	case r.Method == http.MethodHead:
+		w.WriteHeader(http.StatusOK)
+	default:
+		fakeError(w, http.StatusNotImplemented, "NotImplemented")
+	}
+}
+
+// serveObject the content of an object, or a range of it
+func (f *fakeS3) serveObject(w http.ResponseWriter, r *http.Request, key string) {
+	f.mu.Lock()
+	obj, ok := f.objects[key]
+	f.mu.Unlock()
+	if !ok {
+		fakeError(w, http.StatusNotFound, "NoSuchKey")
+		return
+	}
+	w.Header().Set("ETag", `"`+obj.etag+`"`)
+	w.Header().Set("Content-Type", "application/octet-stream")
+	http.ServeContent(w, r, "", obj.modified, bytes.NewReader(obj.data))
+}
+
+// source the content of the object a copy reads from
+func (f *fakeS3) source(r *http.Request) ([]byte, bool) {
+	src, err := url.PathUnescape(r.Header.Get("x-amz-copy-source"))
+	if err != nil {
+		return nil, false
+	}
+	_, key, _ := strings.Cut(strings.TrimPrefix(src, "/"), "/")
+	obj, ok := f.objects[key]
+	if !ok {
+		return nil, false
+	}
+	return obj.data, true
+}
+
+// putObject write an object, with its content or by copying another, if its conditions hold
+func (f *fakeS3) putObject(w http.ResponseWriter, r *http.Request, key string, body []byte) {
+	if f.beforePut != nil {
+		f.beforePut(key)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	current, exists := f.objects[key]
+	if match := r.Header.Get("If-None-Match"); match == "*" && exists {
+		f.conflicts++
+		fakeError(w, http.StatusPreconditionFailed, "PreconditionFailed")
+		return
+	}
+	if match := r.Header.Get("If-Match"); match != "" && (!exists || strings.Trim(match, `"`) != current.etag) {
+		f.conflicts++
+		fakeError(w, http.StatusPreconditionFailed, "PreconditionFailed")
+		return
+	}
+	copied := r.Header.Get("x-amz-copy-source") != ""
+	if copied {
+		data, ok := f.source(r)
+		if !ok {
+			fakeError(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		body = data
+	}
+	obj := &fakeObject{data: body, etag: etag(body), modified: time.Now()}
+	f.objects[key] = obj
+	if copied {
+		sendXML(w, struct {
+			XMLName      xml.Name `xml:"CopyObjectResult"`
+			ETag         string
+			LastModified string
+		}{ETag: `"` + obj.etag + `"`, LastModified: isoTime(obj.modified)})
+		return
+	}
+	w.Header().Set("ETag", `"`+obj.etag+`"`)
+}
+
+// initiateUpload start a multipart upload
+func (f *fakeS3) initiateUpload(w http.ResponseWriter, key string) {
+	f.mu.Lock()
+	f.nextID++
+	id := strconv.Itoa(f.nextID)
+	f.uploads[id] = &fakeUpload{key: key, parts: map[int][]byte{}, initiated: time.Now()}
+	f.mu.Unlock()
+	sendXML(w, struct {
+		XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+		Bucket   string
+		Key      string
+		UploadID string `xml:"UploadId"`
+	}{Bucket: fakeBucket, Key: key, UploadID: id})
+}
+
+// putPart write a part of a multipart upload, with its content or by copying another object
+func (f *fakeS3) putPart(w http.ResponseWriter, r *http.Request, key string, query url.Values, body []byte) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	upload, ok := f.uploads[query.Get("uploadId")]
+	if !ok || upload.key != key {
+		fakeError(w, http.StatusNotFound, "NoSuchUpload")
+		return
+	}
+	n, err := strconv.Atoi(query.Get("partNumber"))
+	if err != nil {
+		fakeError(w, http.StatusBadRequest, "InvalidArgument")
+		return
+	}
+	copied := r.Header.Get("x-amz-copy-source") != ""
+	if copied {
+		data, ok := f.source(r)
+		if !ok {
+			fakeError(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		if rng := r.Header.Get("x-amz-copy-source-range"); rng != "" {
+			var start, end int
+			if _, err := fmt.Sscanf(rng, "bytes=%d-%d", &start, &end); err != nil || end >= len(data) {
+				fakeError(w, http.StatusBadRequest, "InvalidRange")
+				return
+			}
+			data = data[start : end+1]
+		}
+		body = data
+	}
+	upload.parts[n] = body
+	if copied {
+		sendXML(w, struct {
+			XMLName      xml.Name `xml:"CopyPartResult"`
+			ETag         string
+			LastModified string
+		}{ETag: `"` + etag(body) + `"`, LastModified: isoTime(time.Now())})
+		return
+	}
+	w.Header().Set("ETag", `"`+etag(body)+`"`)
+}
+
+// completeUpload join the parts of a multipart upload into its object
+func (f *fakeS3) completeUpload(w http.ResponseWriter, key, id string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	upload, ok := f.uploads[id]
+	if !ok || upload.key != key {
+		fakeError(w, http.StatusNotFound, "NoSuchUpload")
+		return
+	}
+	delete(f.uploads, id)
+	numbers := make([]int, 0, len(upload.parts))
+	for n := range upload.parts {
+		numbers = append(numbers, n)
+	}
+	sort.Ints(numbers)
+	var data []byte
+	for _, n := range numbers {
+		data = append(data, upload.parts[n]...)
+	}
+	obj := &fakeObject{data: data, etag: fmt.Sprintf("%s-%d", etag(data), len(numbers)), modified: time.Now()}
+	f.objects[key] = obj
+	sendXML(w, struct {
+		XMLName xml.Name `xml:"CompleteMultipartUploadResult"`
+		Bucket  string
+		Key     string
+		ETag    string
+	}{Bucket: fakeBucket, Key: key, ETag: `"` + obj.etag + `"`})
+}
@@ -0,0 +1,115 @@
+package s3
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/aifoundry-org/storage-manager/pkg/cache"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/opencontainers/go-digest"
+)
+
+// ingest upload the content to a temporary object, hashing it on the way, and copy it into
+// place. If key is not empty the content must match it, hashed with the algorithm of the key;
+// otherwise it is hashed with alg, or the canonical algorithm if that is empty. If size is
+// positive the content must be that long, and is uploaded in parts as needed; otherwise parts
+// are uploaded as they are read. The blob is protected from GC until release is called, so it
+// cannot be cleaned up before it is named. If the upload fails or the context is canceled, the
+// temporary object is removed.
+func (c *cacheS3) ingest(ctx context.Context, key string, alg digest.Algorithm, size int64, r io.Reader) (d digest.Digest, n int64, release func(), err error) {
+	alg, err = cache.IngestAlgorithm(key, alg)
+	if err != nil {
+		return "", 0, nil, err
+	}
+	suffix := make([]byte, 16)
+	if _, err := rand.Read(suffix); err != nil {
+		return "", 0, nil, fmt.Errorf("could not name temporary object: %v", err)
+	}
+	temp := c.prefix + ingestPrefix + "blob-" + hex.EncodeToString(suffix)
+	// once copied into place, or if it was never written, removing it fails harmlessly
+	defer c.client.RemoveObject(context.WithoutCancel(ctx), c.bucket, temp, minio.RemoveObjectOptions{})
+
+	digester := alg.Digester()
+	counter := &countingReader{r: io.TeeReader(cache.NewContextReader(ctx, r), digester.Hash())}
+	length := int64(-1)
+	if size > 0 {
+		length = size
+	}
+	_, err = c.client.PutObject(ctx, c.bucket, temp, counter, length, minio.PutObjectOptions{
+		ContentType: "application/octet-stream",
+		PartSize:    c.partSize,
+	})
+	if err != nil {
+		return "", 0, nil, fmt.Errorf("could not upload content: %w", err)
+	}
+	n = counter.n
+	if n == 0 {
+		return "", 0, nil, fmt.Errorf("no content to copy")
+	}
+	if size > 0 && n != size {
+		return "", 0, nil, fmt.Errorf("size mismatch: got %d bytes, expected %d", n, size)
+	}
+	d = digester.Digest()
+	if key != "" && d.String() != key {
+		return "", 0, nil, fmt.Errorf("key mismatch: %s != %s", d, key)
+	}
+
+	release = c.Protect(d.String())
+	// the blob may have been written in the meantime, in which case this is the same content;
+	// composing copies in parts on the server when the blob is too large for a single copy
+	_, err = c.client.ComposeObject(ctx,
+		minio.CopyDestOptions{Bucket: c.bucket, Object: c.blobObject(d)},
+		minio.CopySrcOptions{Bucket: c.bucket, Object: temp},
+	)
+	if err != nil {
+		release()
+		return "", 0, nil, fmt.Errorf("could not move %s into place: %v", d, err)
+	}
+	return d, n, release, nil
+}
+
+// cleanIngest remove temporary objects and unfinished multipart uploads from before cutoff,
+// left behind by nodes that stopped while uploading
+func (c *cacheS3) cleanIngest(ctx context.Context, cutoff time.Time) error {
+	prefix := c.prefix + ingestPrefix
+	for info := range c.client.ListObjects(ctx, c.bucket, minio.ListObjectsOptions{Prefix: prefix, Recursive: true}) {
+		if info.Err != nil {
+			return fmt.Errorf("could not list uploads: %v", info.Err)
+		}
+		if info.LastModified.After(cutoff) {
+			continue
+		}
+		if err := c.client.RemoveObject(ctx, c.bucket, info.Key, minio.RemoveObjectOptions{}); err != nil {
+			return fmt.Errorf("could not remove %s: %v", info.Key, err)
+		}
+	}
+	for upload := range c.client.ListIncompleteUploads(ctx, c.bucket, prefix, true) {
+		if upload.Err != nil {
+			return fmt.Errorf("could not list uploads: %v", upload.Err)
+		}
+		if upload.Initiated.After(cutoff) {
+			continue
+		}
+		if err := c.client.RemoveIncompleteUpload(ctx, c.bucket, upload.Key); err != nil {
+			return fmt.Errorf("could not remove upload %s: %v", upload.Key, err)
+		}
+	}
+	return ctx.Err()
+}
+
+// countingReader counts the bytes read through it
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.n += int64(n)
+	return n, err
+}
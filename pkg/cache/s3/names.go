@@ -0,0 +1,194 @@
+package s3
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/aifoundry-org/storage-manager/pkg/cache"
+
+	"github.com/minio/minio-go/v7"
+)
+
+const (
+	// maxNameAttempts how many times a name is written when other nodes keep changing it
+	maxNameAttempts = 10
+	// nameBackoff the longest wait before writing a name again, chosen at random so that nodes
+	// naming at once do not keep colliding
+	nameBackoff = 100 * time.Millisecond
+	// maxNameSize the largest name object that is read, which holds the keys of every blob of
+	// the content it names
+	maxNameSize = 1 << 20
+)
+
+// nameRecord the object holding a name. The name is kept in it as well as, encoded, in the
+// object name, so that the bucket can be read without decoding. Children are the keys of every
+// blob the key refers to, for GC; they are nil for names written before they were recorded,
+// and empty for a key that refers to nothing.
+type nameRecord struct {
+	Name     string   `json:"name"`
+	Key      string   `json:"key"`
+	Children []string `json:"children"`
+}
+
+// nameObject the object holding a name; names may hold any characters, so they are encoded
+func (c *cacheS3) nameObject(name string) string {
+	return c.prefix + namesPrefix + base64.RawURLEncoding.EncodeToString([]byte(name))
+}
+
+// readName read the object holding a name, returning it with its ETag, or a
+// *cache.NotFoundError if there is none
+func (c *cacheS3) readName(ctx context.Context, name string) (nameRecord, string, error) {
+	var record nameRecord
+	obj, err := c.client.GetObject(ctx, c.bucket, c.nameObject(name), minio.GetObjectOptions{})
+	if err != nil {
+		return record, "", fmt.Errorf("could not read name %s: %v", name, err)
+	}
+	defer obj.Close()
+	info, err := obj.Stat()
+	if isNotFound(err) {
+		return record, "", &cache.NotFoundError{Key: name}
+	}
+	if err != nil {
+		return record, "", fmt.Errorf("could not read name %s: %v", name, err)
+	}
+	b, err := io.ReadAll(io.LimitReader(obj, maxNameSize))
+	if err != nil {
+		return record, "", fmt.Errorf("could not read name %s: %v", name, err)
+	}
+	if err := json.Unmarshal(b, &record); err != nil {
+		return record, "", fmt.Errorf("invalid name %s: %v", name, err)
+	}
+	return record, info.ETag, nil
+}
+
+// isConflict whether a conditional write failed because the object changed in the meantime
+func isConflict(err error) bool {
+	switch minio.ToErrorResponse(err).Code {
+	case "PreconditionFailed", "ConditionalRequestConflict":
+		return true
+	}
+	return false
+}
+
+// Name alias a key to a name, recording the keys of the blobs it refers to. The name is only
+// replaced if it did not change since it was read, so that of several nodes naming at once,
+// each sees the name it replaces.
+func (c *cacheS3) Name(ctx context.Context, key, name string) error {
+	exists, err := c.Exists(ctx, key)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return &cache.NotFoundError{Key: key}
+	}
+	children, err := cache.Children(ctx, c.Get, key)
+	if err != nil {
+		return err
+	}
+	if children == nil {
+		children = []string{}
+	}
+	b, err := json.Marshal(nameRecord{Name: name, Key: key, Children: children})
+	if err != nil {
+		return fmt.Errorf("could not write name %s: %v", name, err)
+	}
+	for attempt := 1; ; attempt++ {
+		current, etag, err := c.readName(ctx, name)
+		var notFound *cache.NotFoundError
+		switch {
+		case errors.As(err, &notFound):
+			etag = ""
+		case err != nil:
+			return err
+		case current.Key == key && slices.Equal(current.Children, children):
+			return nil
+		}
+		opts := minio.PutObjectOptions{ContentType: "application/json", DisableMultipart: true}
+		if etag == "" {
+			opts.SetMatchETagExcept("*")
+		} else {
+			opts.SetMatchETag(etag)
+		}
+		_, err = c.client.PutObject(ctx, c.bucket, c.nameObject(name), bytes.NewReader(b), int64(len(b)), opts)
+		if isConflict(err) && attempt < maxNameAttempts {
+			select {
+			case <-time.After(rand.N(nameBackoff)):
+				continue
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("could not write name %s: %v", name, err)
+		}
+		return nil
+	}
+}
+
+// Unname remove the alias from a key
+func (c *cacheS3) Unname(ctx context.Context, name string) error {
+	if err := c.client.RemoveObject(ctx, c.bucket, c.nameObject(name), minio.RemoveObjectOptions{}); err != nil {
+		return fmt.Errorf("could not remove name %s: %v", name, err)
+	}
+	return nil
+}
+
+// Resolve a name to a key
+func (c *cacheS3) Resolve(ctx context.Context, name string) (string, error) {
+	record, _, err := c.readName(ctx, name)
+	if err != nil {
+		return "", err
+	}
+	return record.Key, nil
+}
+
+// List all of the names in the cache
+func (c *cacheS3) List(ctx context.Context) ([]string, error) {
+	var names []string
+	prefix := c.prefix + namesPrefix
+	for info := range c.client.ListObjects(ctx, c.bucket, minio.ListObjectsOptions{Prefix: prefix, Recursive: true}) {
+		if info.Err != nil {
+			return nil, fmt.Errorf("could not list names: %v", info.Err)
+		}
+		name, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(info.Key, prefix))
+		if err != nil {
+			continue
+		}
+		names = append(names, string(name))
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, fmt.Errorf("could not list names: %v", err)
+	}
+	return names, nil
+}
+
+// names read every name in the cache with the key it refers to
+func (c *cacheS3) names(ctx context.Context) ([]nameRecord, error) {
+	names, err := c.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	records := make([]nameRecord, 0, len(names))
+	for _, name := range names {
+		record, _, err := c.readName(ctx, name)
+		var notFound *cache.NotFoundError
+		if errors.As(err, &notFound) {
+			// removed since it was listed
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
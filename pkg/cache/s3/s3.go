@@ -0,0 +1,383 @@
+package s3
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aifoundry-org/storage-manager/pkg/cache"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/opencontainers/go-digest"
+)
+
+const (
+	// blobsPrefix where blobs are kept in the bucket, as <algorithm>/<hex>
+	blobsPrefix = "blobs/"
+	// namesPrefix where names are kept in the bucket, each as a small JSON object
+	namesPrefix = "names/"
+	// ingestPrefix where blobs are uploaded before they are copied into place
+	ingestPrefix = "ingest/"
+
+	// DefaultPartSize the size of the parts of multipart uploads, when not configured. Content
+	// whose size is not known ahead of time is uploaded one part at a time, held in memory, in
+	// up to 10000 parts.
+	DefaultPartSize = 64 << 20
+	// DefaultGracePeriod how old unreferenced objects must be before GC removes them, when not
+	// configured
+	DefaultGracePeriod = time.Hour
+)
+
+// Config where the cache is kept in an S3-compatible object store
+type Config struct {
+	// Endpoint host and port of the object store, e.g. s3.amazonaws.com or minio:9000
+	Endpoint string
+	// Bucket the bucket holding the cache, which must exist
+	Bucket string
+	// Prefix of every object of the cache in the bucket, e.g. cache/, so that several caches
+	// may share a bucket; empty for the root of the bucket
+	Prefix string
+	// Region of the bucket; empty to look it up
+	Region string
+	// AccessKey and SecretKey the credentials; empty to take them from the environment, as
+	// AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY, or the AWS credentials file
+	AccessKey string
+	SecretKey string
+	// Insecure use plain HTTP rather than HTTPS
+	Insecure bool
+	// PartSize the size in bytes of the parts of multipart uploads; 0 for DefaultPartSize
+	PartSize uint64
+	// GracePeriod how old unreferenced blobs and uploads must be before GC removes them, as
+	// other nodes sharing the bucket may be about to name them; 0 for DefaultGracePeriod
+	GracePeriod time.Duration
+}
+
+// cacheS3 a content-addressable cache in a bucket of an S3-compatible object store, which may
+// be shared by several nodes. Blobs are objects under blobs/<algorithm>/<hex>, and names are
+// small JSON objects under names/, updated with conditional writes.
+type cacheS3 struct {
+	client      *minio.Client
+	bucket      string
+	prefix      string
+	partSize    uint64
+	gracePeriod time.Duration
+
+	// protectedMu protects protected
+	protectedMu sync.Mutex
+	// protected keys that must survive GC although no name refers to them, with a count of
+	// how many times each is protected
+	protected map[string]int
+}
+
+var (
+	_ cache.Cache     = &cacheS3{}
+	_ cache.Sizer     = &cacheS3{}
+	_ cache.Protector = &cacheS3{}
+	_ cache.Ingester  = &cacheS3{}
+	_ cache.Collector = &cacheS3{}
+)
+
+// New open the cache in the bucket described by cfg, checking that the bucket exists
+func New(cfg Config) (*cacheS3, error) {
+	if cfg.Endpoint == "" || cfg.Bucket == "" {
+		return nil, fmt.Errorf("an endpoint and a bucket are required for an S3 cache")
+	}
+	creds := credentials.NewChainCredentials([]credentials.Provider{
+		&credentials.EnvAWS{},
+		&credentials.EnvMinio{},
+		&credentials.FileAWSCredentials{},
+	})
+	if cfg.AccessKey != "" {
+		creds = credentials.NewStaticV4(cfg.AccessKey, cfg.SecretKey, "")
+	}
+	client, err := minio.New(cfg.Endpoint, &minio.Options{
+		Creds:  creds,
+		Secure: !cfg.Insecure,
+		Region: cfg.Region,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not create S3 client for %s: %v", cfg.Endpoint, err)
+	}
+	exists, err := client.BucketExists(context.Background(), cfg.Bucket)
+	if err != nil {
+		return nil, fmt.Errorf("could not check bucket %s at %s: %v", cfg.Bucket, cfg.Endpoint, err)
+	}
+	if !exists {
+		return nil, fmt.Errorf("bucket %s does not exist at %s", cfg.Bucket, cfg.Endpoint)
+	}
+	c := &cacheS3{
+		client:      client,
+		bucket:      cfg.Bucket,
+		prefix:      cfg.Prefix,
+		partSize:    cfg.PartSize,
+		gracePeriod: cfg.GracePeriod,
+		protected:   map[string]int{},
+	}
+	if c.partSize == 0 {
+		c.partSize = DefaultPartSize
+	}
+	if c.gracePeriod == 0 {
+		c.gracePeriod = DefaultGracePeriod
+	}
+	return c, nil
+}
+
+// blobObject the object holding the blob for a digest
+func (c *cacheS3) blobObject(d digest.Digest) string {
+	return c.prefix + blobsPrefix + d.Algorithm().String() + "/" + d.Encoded()
+}
+
+// parseKey the digest of a key, which must be a valid digest
+func parseKey(key string) (digest.Digest, error) {
+	d, err := digest.Parse(key)
+	if err != nil {
+		return "", fmt.Errorf("invalid key %s: %v", key, err)
+	}
+	return d, nil
+}
+
+// lookup the digest of a key, or of the key a name refers to
+func (c *cacheS3) lookup(ctx context.Context, key string) (digest.Digest, error) {
+	if d, err := digest.Parse(key); err == nil {
+		return d, nil
+	}
+	resolved, err := c.Resolve(ctx, key)
+	if err != nil {
+		return "", err
+	}
+	return parseKey(resolved)
+}
+
+// isNotFound whether the object store reported that an object does not exist
+func isNotFound(err error) bool {
+	return minio.ToErrorResponse(err).Code == "NoSuchKey"
+}
+
+// Get content from the cache
+func (c *cacheS3) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	d, err := c.lookup(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	obj, err := c.client.GetObject(ctx, c.bucket, c.blobObject(d), minio.GetObjectOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("could not get %s: %v", key, err)
+	}
+	// the object is only requested once it is used, so that it is not found is only known then
+	if _, err := obj.Stat(); err != nil {
+		obj.Close()
+		if isNotFound(err) {
+			return nil, &cache.NotFoundError{Key: key}
+		}
+		return nil, fmt.Errorf("could not get %s: %v", key, err)
+	}
+	return obj, nil
+}
+
+// Exists check if content for a given key exists in the cache
+func (c *cacheS3) Exists(ctx context.Context, key string) (bool, error) {
+	d, err := c.lookup(ctx, key)
+	var notFound *cache.NotFoundError
+	if errors.As(err, &notFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	_, err = c.client.StatObject(ctx, c.bucket, c.blobObject(d), minio.StatObjectOptions{})
+	switch {
+	case isNotFound(err):
+		return false, nil
+	case err != nil:
+		return false, fmt.Errorf("could not stat %s: %v", key, err)
+	}
+	return true, nil
+}
+
+// Delete content from the cache, and the name if the key is one
+func (c *cacheS3) Delete(ctx context.Context, key string) error {
+	d, err := c.lookup(ctx, key)
+	var notFound *cache.NotFoundError
+	if errors.As(err, &notFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := c.client.RemoveObject(ctx, c.bucket, c.blobObject(d), minio.RemoveObjectOptions{}); err != nil {
+		return fmt.Errorf("could not delete %s: %v", key, err)
+	}
+	if d.String() != key {
+		return c.Unname(ctx, key)
+	}
+	return nil
+}
+
+// Put content in the cache. If the key is not provided it will be generated from the content.
+func (c *cacheS3) Put(ctx context.Context, key string, size int64, r io.ReadCloser) error {
+	defer r.Close()
+	if key != "" {
+		// content is only ever written under its digest, so a blob that is there is this one
+		if exists, err := c.Exists(ctx, key); err == nil && exists {
+			return nil
+		}
+	}
+	_, _, release, err := c.ingest(ctx, key, "", size, r)
+	if err != nil {
+		if key == "" {
+			return fmt.Errorf("could not put content: %w", err)
+		}
+		return fmt.Errorf("could not put %s: %w", key, err)
+	}
+	// whoever puts content under a known key protects it themselves until it is named
+	release()
+	return nil
+}
+
+// Ingest write content whose key is not known ahead of time into the cache, returning its key,
+// its digest with the algorithm, and its size. The content is protected from GC until release
+// is called.
+func (c *cacheS3) Ingest(ctx context.Context, alg digest.Algorithm, r io.Reader) (key string, size int64, release func(), err error) {
+	d, size, release, err := c.ingest(ctx, "", alg, 0, r)
+	if err != nil {
+		return "", 0, nil, fmt.Errorf("could not put content: %w", err)
+	}
+	return d.String(), size, release, nil
+}
+
+// GC clean up unreferenced keys: every blob that no name depends on and that is not protected,
+// and uploads that were never finished. Only what is older than the grace period is removed,
+// as other nodes sharing the bucket may be about to name it.
+func (c *cacheS3) GC(ctx context.Context) error {
+	cutoff := time.Now().Add(-c.gracePeriod)
+	if _, err := c.collect(ctx, cutoff, true); err != nil {
+		return err
+	}
+	return c.cleanIngest(ctx, cutoff)
+}
+
+// Unreferenced the blobs that GC would remove now
+func (c *cacheS3) Unreferenced(ctx context.Context) ([]cache.Blob, error) {
+	return c.collect(ctx, time.Now().Add(-c.gracePeriod), false)
+}
+
+// collect find the blobs that no name depends on, that are not protected, and that were
+// written before cutoff, and remove them if remove is set
+func (c *cacheS3) collect(ctx context.Context, cutoff time.Time, remove bool) (garbage []cache.Blob, err error) {
+	keep, err := c.mark(ctx)
+	if err != nil {
+		return nil, err
+	}
+	err = c.walk(ctx, func(d digest.Digest, info minio.ObjectInfo) error {
+		if keep[d] || info.LastModified.After(cutoff) {
+			return nil
+		}
+		garbage = append(garbage, cache.Blob{Key: d.String(), Size: info.Size})
+		if !remove {
+			return nil
+		}
+		if err := c.client.RemoveObject(ctx, c.bucket, info.Key, minio.RemoveObjectOptions{}); err != nil {
+			return fmt.Errorf("could not remove %s: %v", d, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return garbage, nil
+}
+
+// mark the blobs to keep: every protected blob, and the key of every name with the keys
+// recorded when it was named. The graph of a name from before graphs were recorded is found
+// from its manifests.
+func (c *cacheS3) mark(ctx context.Context) (map[digest.Digest]bool, error) {
+	// protected keys are taken before the names, as content is named before it is released
+	c.protectedMu.Lock()
+	keep := make(map[digest.Digest]bool, len(c.protected))
+	for key := range c.protected {
+		keep[digest.Digest(key)] = true
+	}
+	c.protectedMu.Unlock()
+	records, err := c.names(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("could not read names: %v", err)
+	}
+	for _, record := range records {
+		keep[digest.Digest(record.Key)] = true
+		children := record.Children
+		if children == nil {
+			children, err = cache.Children(ctx, c.Get, record.Key)
+			var notFound *cache.NotFoundError
+			if err != nil && !errors.As(err, &notFound) {
+				return nil, err
+			}
+		}
+		for _, child := range children {
+			keep[digest.Digest(child)] = true
+		}
+	}
+	return keep, nil
+}
+
+// Protect the keys from GC until the returned function is called. Keys are only protected
+// from GC by this process; other nodes sharing the bucket rely on the grace period.
+func (c *cacheS3) Protect(keys ...string) func() {
+	c.protectedMu.Lock()
+	defer c.protectedMu.Unlock()
+	for _, key := range keys {
+		c.protected[key]++
+	}
+	return func() {
+		c.protectedMu.Lock()
+		defer c.protectedMu.Unlock()
+		for _, key := range keys {
+			if c.protected[key]--; c.protected[key] <= 0 {
+				delete(c.protected, key)
+			}
+		}
+	}
+}
+
+// Usage total size in bytes of all of the blobs in the cache
+func (c *cacheS3) Usage() (int64, error) {
+	var total int64
+	err := c.walk(context.Background(), func(_ digest.Digest, info minio.ObjectInfo) error {
+		total += info.Size
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("could not calculate cache usage: %v", err)
+	}
+	return total, nil
+}
+
+// walk call fn for every blob in the cache, with its digest and object. Anything under the
+// blobs prefix that is not named after its digest is skipped.
+func (c *cacheS3) walk(ctx context.Context, fn func(d digest.Digest, info minio.ObjectInfo) error) error {
+	// stop listing when we stop early
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	prefix := c.prefix + blobsPrefix
+	for info := range c.client.ListObjects(ctx, c.bucket, minio.ListObjectsOptions{Prefix: prefix, Recursive: true}) {
+		if info.Err != nil {
+			return fmt.Errorf("could not list blobs: %v", info.Err)
+		}
+		alg, encoded, ok := strings.Cut(strings.TrimPrefix(info.Key, prefix), "/")
+		if !ok {
+			continue
+		}
+		d := digest.NewDigestFromEncoded(digest.Algorithm(alg), encoded)
+		if d.Validate() != nil {
+			continue
+		}
+		if err := fn(d, info); err != nil {
+			return err
+		}
+	}
+	return ctx.Err()
+}
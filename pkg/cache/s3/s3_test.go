@@ -0,0 +1,168 @@
+package s3
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aifoundry-org/storage-manager/pkg/cache"
+	"github.com/aifoundry-org/storage-manager/pkg/cache/cachetest"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/opencontainers/go-digest"
+)
+
+// newTestCache open a cache in a fake object store with the grace period
+func newTestCache(t *testing.T, endpoint string, gracePeriod time.Duration) *cacheS3 {
+	c, err := New(Config{
+		Endpoint:    endpoint,
+		Bucket:      fakeBucket,
+		Prefix:      "cache/",
+		Region:      "us-east-1",
+		AccessKey:   "access",
+		SecretKey:   "secret",
+		Insecure:    true,
+		GracePeriod: gracePeriod,
+	})
+	if err != nil {
+		t.Fatalf("new: %v", err)
+	}
+	return c
+}
+
+// putBlob put content in the cache, returning its key
+func putBlob(t *testing.T, c *cacheS3, content string) string {
+	t.Helper()
+	key := digest.FromString(content).String()
+	if err := c.Put(context.Background(), key, int64(len(content)), io.NopCloser(strings.NewReader(content))); err != nil {
+		t.Fatalf("put: %v", err)
+	}
+	return key
+}
+
+func TestConformance(t *testing.T) {
+	cachetest.Run(t, func(t *testing.T) cache.Cache {
+		_, endpoint := newFakeS3(t)
+		// the shortest grace period, as the suite expects GC to remove content at once
+		return newTestCache(t, endpoint, time.Nanosecond)
+	})
+}
+
+func TestGracePeriod(t *testing.T) {
+	cachetest.RunGracePeriod(t, func(t *testing.T) cache.Cache {
+		_, endpoint := newFakeS3(t)
+		return newTestCache(t, endpoint, time.Hour)
+	})
+}
+
+func TestGCAfterGracePeriod(t *testing.T) {
+	ctx := context.Background()
+	fake, endpoint := newFakeS3(t)
+	c := newTestCache(t, endpoint, time.Hour)
+	named := putBlob(t, c, "named")
+	if err := c.Name(ctx, named, "hf://org/model/named"); err != nil {
+		t.Fatalf("name: %v", err)
+	}
+	stray := putBlob(t, c, "stray")
+	// left behind by a node that stopped while uploading
+	if _, err := c.client.PutObject(ctx, fakeBucket, "cache/"+ingestPrefix+"blob-left", bytes.NewReader([]byte("partial")), 7, minio.PutObjectOptions{}); err != nil {
+		t.Fatalf("put upload: %v", err)
+	}
+
+	fake.age(2 * time.Hour)
+	// written by another node since, which may be about to name it
+	fresh := putBlob(t, c, "fresh")
+	if err := c.GC(ctx); err != nil {
+		t.Fatalf("gc: %v", err)
+	}
+	for key, want := range map[string]bool{named: true, stray: false, fresh: true} {
+		exists, err := c.Exists(ctx, key)
+		if err != nil {
+			t.Fatalf("exists: %v", err)
+		}
+		if exists != want {
+			t.Errorf("exists %s = %v after gc, want %v", key, exists, want)
+		}
+	}
+	if uploads := fake.keys("cache/" + ingestPrefix); len(uploads) != 0 {
+		t.Errorf("gc left uploads %v", uploads)
+	}
+}
+
+func TestNameConditional(t *testing.T) {
+	ctx := context.Background()
+	fake, endpoint := newFakeS3(t)
+	// two nodes sharing the bucket
+	first := newTestCache(t, endpoint, time.Hour)
+	second := newTestCache(t, endpoint, time.Hour)
+	const name = "oci://registry.example.com/repo/img:latest"
+	firstKey := putBlob(t, first, "first")
+	secondKey := putBlob(t, second, "second")
+
+	// the second node names it between the first reading the name and writing it, both when
+	// there is no name yet and when there is one
+	for _, existing := range []bool{false, true} {
+		if existing {
+			if err := first.Name(ctx, firstKey, name); err != nil {
+				t.Fatalf("name: %v", err)
+			}
+			firstKey, secondKey = putBlob(t, first, "first again"), putBlob(t, second, "second again")
+		}
+		raced := false
+		fake.beforePut = func(key string) {
+			if raced || key != first.nameObject(name) {
+				return
+			}
+			raced = true
+			if err := second.Name(ctx, secondKey, name); err != nil {
+				t.Errorf("name from the second node: %v", err)
+			}
+		}
+		conflicts := fake.conflicts
+		if err := first.Name(ctx, firstKey, name); err != nil {
+			t.Fatalf("name from the first node: %v", err)
+		}
+		fake.beforePut = nil
+		if fake.conflicts == conflicts {
+			t.Errorf("existing %v: the write of the first node did not conflict with the second", existing)
+		}
+		key, err := second.Resolve(ctx, name)
+		if err != nil {
+			t.Fatalf("resolve: %v", err)
+		}
+		if key != firstKey {
+			t.Errorf("existing %v: resolve = %s, want the key of the last write %s", existing, key, firstKey)
+		}
+	}
+}
+
+func TestIngestMultipart(t *testing.T) {
+	_, endpoint := newFakeS3(t)
+	c := newTestCache(t, endpoint, time.Hour)
+	c.partSize = 5 << 20
+	// content of unknown size is uploaded a part at a time
+	content := bytes.Repeat([]byte("0123456789abcdef"), int(c.partSize*2)/16+1)
+	key, size, release, err := c.Ingest(context.Background(), "", bytes.NewReader(content))
+	if err != nil {
+		t.Fatalf("ingest: %v", err)
+	}
+	defer release()
+	if want := digest.FromBytes(content).String(); key != want || size != int64(len(content)) {
+		t.Errorf("ingest = %s, %d, want %s, %d", key, size, want, len(content))
+	}
+	rc, err := c.Get(context.Background(), key)
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	defer rc.Close()
+	got, err := io.ReadAll(rc)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if !bytes.Equal(got, content) {
+		t.Errorf("get returned %d bytes that differ from the %d ingested", len(got), len(content))
+	}
+}
@@ -0,0 +1,84 @@
+package tiered
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/aifoundry-org/storage-manager/pkg/cache"
+)
+
+// copyBlob copy a single blob from one tier to the other, unless it is already there
+func (c *Cache) copyBlob(ctx context.Context, from, to cache.Cache, key string) error {
+	exists, err := to.Exists(ctx, key)
+	if err != nil || exists {
+		return err
+	}
+	rc, err := from.Get(ctx, key)
+	if err != nil {
+		return err
+	}
+	// Put closes the content
+	if err := to.Put(ctx, key, 0, rc); err != nil {
+		return fmt.Errorf("could not copy %s: %v", key, err)
+	}
+	return nil
+}
+
+// copyTree copy a blob from one tier to the other, and, if it is an OCI manifest or index,
+// the blobs it refers to that are in either tier, recursively. Every blob is protected from
+// GC in the destination until release is called, so that the root can be named before any of
+// it is cleaned up.
+func (c *Cache) copyTree(ctx context.Context, from, to cache.Cache, key string) (release func(), err error) {
+	seen := map[string]bool{}
+	var releases []func()
+	release = func() {
+		for _, release := range releases {
+			release()
+		}
+	}
+	var walk func(key string) error
+	walk = func(key string) error {
+		if seen[key] {
+			return nil
+		}
+		seen[key] = true
+		releases = append(releases, c.protect(to, key))
+		if err := c.copyBlob(ctx, from, to, key); err != nil {
+			return err
+		}
+		children, err := c.children(ctx, to, key)
+		if err != nil {
+			return err
+		}
+		for _, child := range children {
+			// only some of the manifests of an index may have been pulled, for one platform
+			if err := walk(child); err != nil && !isNotFound(err) {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := walk(key); err != nil {
+		release()
+		return nil, err
+	}
+	return release, nil
+}
+
+// children the keys of the blobs an OCI manifest or index in a tier refers to; none for any
+// other blob
+func (c *Cache) children(ctx context.Context, tier cache.Cache, key string) ([]string, error) {
+	rc, err := tier.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	m, err := cache.ReadManifest(rc)
+	if err != nil {
+		return nil, fmt.Errorf("could not read %s: %v", key, err)
+	}
+	if m == nil {
+		return nil, nil
+	}
+	return m.References(), nil
+}
@@ -0,0 +1,356 @@
+package tiered
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/aifoundry-org/storage-manager/pkg/cache"
+
+	"github.com/opencontainers/go-digest"
+	log "github.com/sirupsen/logrus"
+)
+
+// Mode how content written to the cache reaches the shared tier
+type Mode string
+
+const (
+	// WriteThrough write content to the shared tier before the write returns
+	WriteThrough Mode = "through"
+	// WriteBack write content to the shared tier in the background, once it is named
+	WriteBack Mode = "back"
+)
+
+// Local what the local tier must be able to do: keep content on the local filesystem, and
+// ingest content whose key is not known ahead of time
+type Local interface {
+	cache.Cache
+	cache.Pather
+	cache.Ingester
+}
+
+// Cache a cache of two tiers: a fast local tier, such as a directory on the node's disk, in
+// front of a slower shared tier, such as a directory on NFS or an object store, that holds
+// the full catalogue. Reads fall through to the shared tier and populate the local tier, and
+// writes go to both, through or back depending on the mode. Removing content, GC and evicting
+// content only change the local tier, as other nodes use the shared tier; it is changed by
+// GCShared and UnnameShared alone.
+type Cache struct {
+	local  Local
+	shared cache.Cache
+	mode   Mode
+	logger *log.Logger
+
+	// pendingMu protects pending
+	pendingMu sync.Mutex
+	// pending names to write back to the shared tier, oldest first
+	pending []pendingName
+	// wake tells Run there is something pending
+	wake chan struct{}
+	// minRetry and maxRetry the backoff of names that could not be written back
+	minRetry time.Duration
+	maxRetry time.Duration
+}
+
+var (
+	_ cache.Cache      = &Cache{}
+	_ cache.Pather     = &Cache{}
+	_ cache.Protector  = &Cache{}
+	_ cache.Ingester   = &Cache{}
+	_ cache.Collector  = &Cache{}
+	_ cache.Promoter   = &Cache{}
+	_ cache.SharedTier = &Cache{}
+)
+
+// New create a cache of the local tier in front of the shared tier. With WriteBack, Run must
+// be running for content to reach the shared tier.
+func New(local, shared cache.Cache, mode Mode, logger *log.Logger) (*Cache, error) {
+	l, ok := local.(Local)
+	if !ok {
+		return nil, fmt.Errorf("the local tier of a cache must keep its content on the local filesystem")
+	}
+	switch mode {
+	case "":
+		mode = WriteThrough
+	case WriteThrough, WriteBack:
+	default:
+		return nil, fmt.Errorf("unknown write mode %s, must be %s or %s", mode, WriteThrough, WriteBack)
+	}
+	if logger == nil {
+		logger = log.New()
+	}
+	return &Cache{
+		local:    l,
+		shared:   shared,
+		mode:     mode,
+		logger:   logger,
+		wake:     make(chan struct{}, 1),
+		minRetry: writeBackMinRetry,
+		maxRetry: writeBackMaxRetry,
+	}, nil
+}
+
+// Local the local tier, whose size is limited by evicting content from it alone
+func (c *Cache) Local() cache.Cache {
+	return c.local
+}
+
+// isKey whether a key is the digest of a blob, rather than a name
+func isKey(key string) bool {
+	_, err := digest.Parse(key)
+	return err == nil
+}
+
+// isNotFound whether the error is a *cache.NotFoundError
+func isNotFound(err error) bool {
+	var notFound *cache.NotFoundError
+	return errors.As(err, &notFound)
+}
+
+// Get content from the cache, copying it from the shared tier first if it is not local
+func (c *Cache) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	rc, err := c.local.Get(ctx, key)
+	if !isNotFound(err) {
+		return rc, err
+	}
+	if isKey(key) {
+		release := c.protect(c.local, key)
+		defer release()
+		err = c.copyBlob(ctx, c.shared, c.local, key)
+	} else {
+		err = c.promote(ctx, key)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return c.local.Get(ctx, key)
+}
+
+// Exists check if content for a given key exists in either tier
+func (c *Cache) Exists(ctx context.Context, key string) (bool, error) {
+	exists, err := c.local.Exists(ctx, key)
+	if err != nil || exists {
+		return exists, err
+	}
+	return c.shared.Exists(ctx, key)
+}
+
+// Delete content from the local tier
+func (c *Cache) Delete(ctx context.Context, key string) error {
+	return c.local.Delete(ctx, key)
+}
+
+// Put content in the local tier, and in the shared tier with WriteThrough. If the key is not
+// provided it will be generated from the content.
+func (c *Cache) Put(ctx context.Context, key string, size int64, r io.ReadCloser) error {
+	if key == "" {
+		defer r.Close()
+		_, _, release, err := c.Ingest(ctx, "", r)
+		if err != nil {
+			return err
+		}
+		release()
+		return nil
+	}
+	if err := c.local.Put(ctx, key, size, r); err != nil {
+		return err
+	}
+	return c.writeThrough(ctx, key)
+}
+
+// Ingest write content whose key is not known ahead of time into the local tier, and into the
+// shared tier with WriteThrough, returning its key, its digest with the algorithm, and its
+// size. The content is protected from GC until release is called.
+func (c *Cache) Ingest(ctx context.Context, alg digest.Algorithm, r io.Reader) (key string, size int64, release func(), err error) {
+	key, size, release, err = c.local.Ingest(ctx, alg, r)
+	if err != nil {
+		return "", 0, nil, err
+	}
+	if err := c.writeThrough(ctx, key); err != nil {
+		release()
+		return "", 0, nil, err
+	}
+	return key, size, release, nil
+}
+
+// writeThrough copy a blob that was just written to the local tier to the shared tier, with
+// WriteThrough. Only the blob itself is copied, as what it refers to may not be written yet.
+func (c *Cache) writeThrough(ctx context.Context, key string) error {
+	if c.mode != WriteThrough {
+		return nil
+	}
+	if err := c.copyBlob(ctx, c.local, c.shared, key); err != nil {
+		return fmt.Errorf("could not write %s through to the shared tier: %v", key, err)
+	}
+	return nil
+}
+
+// Name alias a key to a name in both tiers, with the content it refers to. With WriteBack the
+// name is written to the shared tier in the background.
+func (c *Cache) Name(ctx context.Context, key, name string) error {
+	// the content may only be in the shared tier, such as when it was found there by digest
+	release, err := c.copyTree(ctx, c.shared, c.local, key)
+	if err != nil {
+		return err
+	}
+	if err := c.local.Name(ctx, key, name); err != nil {
+		release()
+		return err
+	}
+	if c.mode == WriteBack {
+		// the content stays protected until it is written back, even if it is removed
+		c.enqueue(key, name, release)
+		return nil
+	}
+	defer release()
+	return c.nameShared(ctx, key, name)
+}
+
+// nameShared copy a key and the content it refers to from the local tier to the shared tier,
+// and name it there
+func (c *Cache) nameShared(ctx context.Context, key, name string) error {
+	release, err := c.copyTree(ctx, c.local, c.shared, key)
+	if err != nil {
+		return fmt.Errorf("could not write %s to the shared tier: %v", name, err)
+	}
+	defer release()
+	if err := c.shared.Name(ctx, key, name); err != nil {
+		return fmt.Errorf("could not name %s in the shared tier: %v", name, err)
+	}
+	return nil
+}
+
+// Promote copy a name that is only in the shared tier, and the content it refers to, to the
+// local tier, as it is about to be used
+func (c *Cache) Promote(ctx context.Context, name string) error {
+	exists, err := c.local.Exists(ctx, name)
+	if err != nil || exists {
+		return err
+	}
+	return c.promote(ctx, name)
+}
+
+// promote copy a name that is only in the shared tier, and the content it refers to, to the
+// local tier
+func (c *Cache) promote(ctx context.Context, name string) error {
+	key, err := c.shared.Resolve(ctx, name)
+	if err != nil {
+		return err
+	}
+	release, err := c.copyTree(ctx, c.shared, c.local, key)
+	if err != nil {
+		return fmt.Errorf("could not copy %s from the shared tier: %v", name, err)
+	}
+	defer release()
+	if err := c.local.Name(ctx, key, name); err != nil {
+		return err
+	}
+	c.logger.Debugf("copied %s (%s) from the shared tier", name, key)
+	return nil
+}
+
+// Unname remove the alias from a key in the local tier. A name that is still to be written
+// back to the shared tier is written back all the same, as the content is kept until it is.
+func (c *Cache) Unname(ctx context.Context, name string) error {
+	if err := c.local.Unname(ctx, name); err != nil && !isNotFound(err) {
+		return err
+	}
+	return nil
+}
+
+// UnnameShared remove the alias from a key in the shared tier, for every node, and drop it
+// from the names to write back
+func (c *Cache) UnnameShared(ctx context.Context, name string) error {
+	c.dequeue(name)
+	if err := c.shared.Unname(ctx, name); err != nil && !isNotFound(err) {
+		return err
+	}
+	return nil
+}
+
+// Resolve a name to a key, in the local tier or else the shared tier
+func (c *Cache) Resolve(ctx context.Context, name string) (string, error) {
+	key, err := c.local.Resolve(ctx, name)
+	if !isNotFound(err) {
+		return key, err
+	}
+	return c.shared.Resolve(ctx, name)
+}
+
+// List all of the names in either tier
+func (c *Cache) List(ctx context.Context) ([]string, error) {
+	names, err := c.local.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	shared, err := c.shared.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool, len(names))
+	for _, name := range names {
+		seen[name] = true
+	}
+	for _, name := range shared {
+		if !seen[name] {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+// GC clean up unreferenced keys in the local tier
+func (c *Cache) GC(ctx context.Context) error {
+	return c.local.GC(ctx)
+}
+
+// Unreferenced the blobs that GC would remove now from the local tier
+func (c *Cache) Unreferenced(ctx context.Context) ([]cache.Blob, error) {
+	return unreferenced(ctx, c.local)
+}
+
+// GCShared clean up unreferenced keys in the shared tier, that are older than its grace period
+func (c *Cache) GCShared(ctx context.Context) error {
+	return c.shared.GC(ctx)
+}
+
+// UnreferencedShared the blobs that GCShared would remove now
+func (c *Cache) UnreferencedShared(ctx context.Context) ([]cache.Blob, error) {
+	return unreferenced(ctx, c.shared)
+}
+
+// unreferenced the blobs that GC would remove now from a tier
+func unreferenced(ctx context.Context, tier cache.Cache) ([]cache.Blob, error) {
+	collector, ok := tier.(cache.Collector)
+	if !ok {
+		return nil, fmt.Errorf("the cache cannot report what gc would remove")
+	}
+	return collector.Unreferenced(ctx)
+}
+
+// Protect the keys from GC in both tiers until the returned function is called
+func (c *Cache) Protect(keys ...string) func() {
+	releaseLocal := c.protect(c.local, keys...)
+	releaseShared := c.protect(c.shared, keys...)
+	return func() {
+		releaseLocal()
+		releaseShared()
+	}
+}
+
+// protect the keys from GC in a tier, if it can
+func (c *Cache) protect(tier cache.Cache, keys ...string) func() {
+	if protector, ok := tier.(cache.Protector); ok {
+		return protector.Protect(keys...)
+	}
+	return func() {}
+}
+
+// Path to the content for a key in the local tier. Content that is only in the shared tier
+// has no path until it is read, or its name is pulled, which copies it to the local tier.
+func (c *Cache) Path(key string) (string, error) {
+	return c.local.Path(key)
+}
@@ -0,0 +1,331 @@
+package tiered
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aifoundry-org/storage-manager/pkg/cache"
+	"github.com/aifoundry-org/storage-manager/pkg/cache/cachetest"
+	"github.com/aifoundry-org/storage-manager/pkg/cache/ocidir"
+
+	"github.com/opencontainers/go-digest"
+	log "github.com/sirupsen/logrus"
+)
+
+const name = "oci://registry.example.com/repo/img:latest"
+
+// errUnavailable the error of a shared tier that is down
+var errUnavailable = errors.New("shared tier unavailable")
+
+// flakyCache a shared tier that fails every write while it is down
+type flakyCache struct {
+	cache.Cache
+	down atomic.Bool
+}
+
+func (f *flakyCache) Put(ctx context.Context, key string, size int64, r io.ReadCloser) error {
+	if f.down.Load() {
+		r.Close()
+		return errUnavailable
+	}
+	return f.Cache.Put(ctx, key, size, r)
+}
+
+func (f *flakyCache) Unreferenced(ctx context.Context) ([]cache.Blob, error) {
+	return f.Cache.(cache.Collector).Unreferenced(ctx)
+}
+
+func (f *flakyCache) Name(ctx context.Context, key, name string) error {
+	if f.down.Load() {
+		return errUnavailable
+	}
+	return f.Cache.Name(ctx, key, name)
+}
+
+// newTiers create the two tiers of a cache, as directories
+func newTiers(t *testing.T) (local Local, shared *flakyCache) {
+	t.Helper()
+	local, err := ocidir.New(t.TempDir(), 0)
+	if err != nil {
+		t.Fatalf("new local tier: %v", err)
+	}
+	sharedDir, err := ocidir.New(t.TempDir(), 0)
+	if err != nil {
+		t.Fatalf("new shared tier: %v", err)
+	}
+	return local, &flakyCache{Cache: sharedDir}
+}
+
+// newTestCache create a tiered cache of the tiers with the write mode
+func newTestCache(t *testing.T, local, shared cache.Cache, mode Mode) *Cache {
+	t.Helper()
+	logger := log.New()
+	logger.SetOutput(io.Discard)
+	c, err := New(local, shared, mode, logger)
+	if err != nil {
+		t.Fatalf("new: %v", err)
+	}
+	c.minRetry, c.maxRetry = 10*time.Millisecond, 50*time.Millisecond
+	return c
+}
+
+// exists whether each of the keys or names is in the tier
+func exists(t *testing.T, tier cache.Cache, keys ...string) bool {
+	t.Helper()
+	for _, key := range keys {
+		var err error
+		if isKey(key) {
+			var ok bool
+			if ok, err = tier.Exists(context.Background(), key); err == nil && !ok {
+				return false
+			}
+		} else {
+			_, err = tier.Resolve(context.Background(), key)
+			if isNotFound(err) {
+				return false
+			}
+		}
+		if err != nil {
+			t.Fatalf("look up %s: %v", key, err)
+		}
+	}
+	return true
+}
+
+// run write names back until the test is done
+func run(t *testing.T, c *Cache) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		c.Run(ctx)
+		close(done)
+	}()
+	// stop before the directories of the tiers are removed
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+}
+
+// eventually wait for cond to hold, failing the test if it does not soon
+func eventually(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting until %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestReadFallsThrough(t *testing.T) {
+	ctx := context.Background()
+	local, shared := newTiers(t)
+	// written by another node
+	manifest, config, layer := cachetest.Image(t, shared, "layer")
+	if err := shared.Name(ctx, manifest, name); err != nil {
+		t.Fatalf("name: %v", err)
+	}
+	c := newTestCache(t, local, shared, WriteThrough)
+
+	// looking does not copy anything
+	if !exists(t, c, name, manifest, layer) {
+		t.Fatalf("the content of the shared tier is not in the cache")
+	}
+	if key, err := c.Resolve(ctx, name); err != nil || key != manifest {
+		t.Errorf("resolve = %s, %v, want %s", key, err, manifest)
+	}
+	if exists(t, local, manifest) {
+		t.Fatalf("looking up content copied it to the local tier")
+	}
+
+	// reading a blob copies only that blob
+	rc, err := c.Get(ctx, config)
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	rc.Close()
+	if !exists(t, local, config) || exists(t, local, manifest) {
+		t.Errorf("reading the config did not copy exactly it to the local tier")
+	}
+
+	// promoting a name copies it with everything it refers to
+	if err := c.Promote(ctx, name); err != nil {
+		t.Fatalf("promote: %v", err)
+	}
+	if !exists(t, local, name, manifest, config, layer) {
+		t.Errorf("promote did not copy the image to the local tier")
+	}
+	if _, err := c.Path(layer); err != nil {
+		t.Errorf("path of a promoted layer: %v", err)
+	}
+}
+
+func TestWriteThrough(t *testing.T) {
+	ctx := context.Background()
+	local, shared := newTiers(t)
+	c := newTestCache(t, local, shared, WriteThrough)
+	manifest, config, layer := cachetest.Image(t, c, "layer")
+	if err := c.Name(ctx, manifest, name); err != nil {
+		t.Fatalf("name: %v", err)
+	}
+	for tier, tierName := range map[cache.Cache]string{local: "local", shared: "shared"} {
+		if !exists(t, tier, name, manifest, config, layer) {
+			t.Errorf("the image is not in the %s tier", tierName)
+		}
+	}
+
+	// a write fails while the shared tier is down
+	shared.down.Store(true)
+	if err := c.Put(ctx, digest.FromString("more").String(), 4, io.NopCloser(strings.NewReader("more"))); err == nil || !strings.Contains(err.Error(), errUnavailable.Error()) {
+		t.Errorf("put with the shared tier down = %v, want it to fail", err)
+	}
+}
+
+func TestWriteBack(t *testing.T) {
+	ctx := context.Background()
+	local, shared := newTiers(t)
+	c := newTestCache(t, local, shared, WriteBack)
+	manifest, config, layer := cachetest.Image(t, c, "layer")
+	if err := c.Name(ctx, manifest, name); err != nil {
+		t.Fatalf("name: %v", err)
+	}
+	if !exists(t, local, name, manifest, config, layer) {
+		t.Fatalf("the image is not in the local tier")
+	}
+	if exists(t, shared, manifest) || exists(t, shared, name) {
+		t.Fatalf("the image was written to the shared tier before it was written back")
+	}
+	// GC of the local tier keeps content that is still to be written back
+	if err := c.local.Unname(ctx, name); err != nil {
+		t.Fatalf("unname: %v", err)
+	}
+	if err := c.GC(ctx); err != nil {
+		t.Fatalf("gc: %v", err)
+	}
+	if !exists(t, local, manifest) {
+		t.Fatalf("gc removed content that was not written back yet")
+	}
+
+	run(t, c)
+	eventually(t, "the image is written back", func() bool {
+		return exists(t, shared, name, manifest, config, layer)
+	})
+}
+
+func TestWriteBackRetries(t *testing.T) {
+	ctx := context.Background()
+	local, shared := newTiers(t)
+	c := newTestCache(t, local, shared, WriteBack)
+	manifest, _, _ := cachetest.Image(t, c, "layer")
+	shared.down.Store(true)
+	if err := c.Name(ctx, manifest, name); err != nil {
+		t.Fatalf("name: %v", err)
+	}
+	run(t, c)
+
+	// the name stays pending while the shared tier is down
+	eventually(t, "writing back fails", func() bool {
+		c.pendingMu.Lock()
+		defer c.pendingMu.Unlock()
+		return len(c.pending) == 1 && c.pending[0].failures > 1
+	})
+	if exists(t, shared, name) {
+		t.Fatalf("the name was written back while the shared tier was down")
+	}
+	shared.down.Store(false)
+	eventually(t, "the name is written back once the shared tier is up", func() bool {
+		return exists(t, shared, name, manifest)
+	})
+	eventually(t, "nothing is pending", func() bool {
+		c.pendingMu.Lock()
+		defer c.pendingMu.Unlock()
+		return len(c.pending) == 0
+	})
+}
+
+func TestUnnameShared(t *testing.T) {
+	ctx := context.Background()
+	local, shared := newTiers(t)
+	c := newTestCache(t, local, shared, WriteThrough)
+	manifest, _, _ := cachetest.Image(t, c, "layer")
+	if err := c.Name(ctx, manifest, name); err != nil {
+		t.Fatalf("name: %v", err)
+	}
+	// removing only touches the local tier
+	if err := c.Unname(ctx, name); err != nil {
+		t.Fatalf("unname: %v", err)
+	}
+	if exists(t, local, name) || !exists(t, shared, name) {
+		t.Fatalf("unname did not remove the name from the local tier alone")
+	}
+	if err := c.UnnameShared(ctx, name); err != nil {
+		t.Fatalf("unname shared: %v", err)
+	}
+	if exists(t, c, name) {
+		t.Errorf("the name is still in the cache after it was removed from the shared tier")
+	}
+	if err := c.UnnameShared(ctx, name); err != nil {
+		t.Errorf("unname shared of a missing name: %v", err)
+	}
+
+	// a name that is pending is not written back once it is removed
+	back := newTestCache(t, local, shared, WriteBack)
+	if err := back.Name(ctx, manifest, name); err != nil {
+		t.Fatalf("name: %v", err)
+	}
+	if err := back.UnnameShared(ctx, name); err != nil {
+		t.Fatalf("unname shared: %v", err)
+	}
+	if _, _, ok := back.next(time.Now()); ok {
+		t.Errorf("the name is still pending after it was removed from the shared tier")
+	}
+}
+
+func TestGCShared(t *testing.T) {
+	ctx := context.Background()
+	local, shared := newTiers(t)
+	c := newTestCache(t, local, shared, WriteThrough)
+	manifest, config, layer := cachetest.Image(t, c, "layer")
+	if err := c.Name(ctx, manifest, name); err != nil {
+		t.Fatalf("name: %v", err)
+	}
+	if err := c.Unname(ctx, name); err != nil {
+		t.Fatalf("unname: %v", err)
+	}
+	// GC only cleans up the local tier
+	if err := c.GC(ctx); err != nil {
+		t.Fatalf("gc: %v", err)
+	}
+	if exists(t, local, manifest) {
+		t.Errorf("gc kept unnamed content in the local tier")
+	}
+	if !exists(t, shared, name, manifest, config, layer) {
+		t.Fatalf("gc removed content from the shared tier")
+	}
+
+	if err := c.UnnameShared(ctx, name); err != nil {
+		t.Fatalf("unname shared: %v", err)
+	}
+	unreferenced, err := c.UnreferencedShared(ctx)
+	if err != nil {
+		t.Fatalf("unreferenced shared: %v", err)
+	}
+	if len(unreferenced) != 3 {
+		t.Errorf("unreferenced shared = %v, want the 3 blobs of the image", unreferenced)
+	}
+	if err := c.GCShared(ctx); err != nil {
+		t.Fatalf("gc shared: %v", err)
+	}
+	for _, key := range []string{manifest, config, layer} {
+		if exists(t, shared, key) {
+			t.Errorf("gc shared kept %s", key)
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package tiered
+
+import (
+	"context"
+	"time"
+)
+
+const (
+	// writeBackMinRetry how long to wait before writing back a name again after it failed
+	// the first time; each failure waits twice as long as the previous one
+	writeBackMinRetry = time.Second
+	// writeBackMaxRetry the longest wait before writing back a name again
+	writeBackMaxRetry = 5 * time.Minute
+)
+
+// pendingName a name to write back to the shared tier. The key, and the content it refers to,
+// are protected from GC in the local tier until it is written back.
+type pendingName struct {
+	key     string
+	name    string
+	release func()
+	// failures how many times writing it back failed in a row
+	failures int
+	// retryAt when to write it back again after it failed
+	retryAt time.Time
+}
+
+// enqueue a name to write back to the shared tier, replacing one for the same name that was
+// not written back yet. release releases the protection of its content in the local tier.
+func (c *Cache) enqueue(key, name string, release func()) {
+	c.dequeue(name)
+	c.pendingMu.Lock()
+	c.pending = append(c.pending, pendingName{key: key, name: name, release: release})
+	c.pendingMu.Unlock()
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+}
+
+// dequeue drop a name that was not written back yet
+func (c *Cache) dequeue(name string) {
+	c.pendingMu.Lock()
+	defer c.pendingMu.Unlock()
+	for i, p := range c.pending {
+		if p.name == name {
+			p.release()
+			c.pending = append(c.pending[:i], c.pending[i+1:]...)
+			return
+		}
+	}
+}
+
+// next the oldest name to write back that is not waiting to be tried again, leaving it pending
+// so that it can still be dequeued. If there is none, wait is how long until one is to be
+// tried again, 0 if none is pending.
+func (c *Cache) next(now time.Time) (p pendingName, wait time.Duration, ok bool) {
+	c.pendingMu.Lock()
+	defer c.pendingMu.Unlock()
+	for _, p := range c.pending {
+		if !p.retryAt.After(now) {
+			return p, 0, true
+		}
+		if d := p.retryAt.Sub(now); wait == 0 || d < wait {
+			wait = d
+		}
+	}
+	return pendingName{}, wait, false
+}
+
+// done drop a name once it is written back, returning whether it was removed from the shared
+// tier while it was being written back, rather than still pending or named again
+func (c *Cache) done(p pendingName) (removed bool) {
+	c.pendingMu.Lock()
+	defer c.pendingMu.Unlock()
+	for i, other := range c.pending {
+		if other.name != p.name {
+			continue
+		}
+		if other.key == p.key {
+			other.release()
+			c.pending = append(c.pending[:i], c.pending[i+1:]...)
+		}
+		return false
+	}
+	return true
+}
+
+// failed keep a name that could not be written back pending, to be tried again after a
+// backoff, returning how long that is, or false if it is no longer pending
+func (c *Cache) failed(p pendingName, now time.Time) (time.Duration, bool) {
+	c.pendingMu.Lock()
+	defer c.pendingMu.Unlock()
+	for i := range c.pending {
+		other := &c.pending[i]
+		if other.name != p.name || other.key != p.key {
+			continue
+		}
+		other.failures++
+		wait := c.minRetry
+		for n := 1; n < other.failures && wait < c.maxRetry; n++ {
+			wait *= 2
+		}
+		wait = min(wait, c.maxRetry)
+		other.retryAt = now.Add(wait)
+		return wait, true
+	}
+	return 0, false
+}
+
+// Run write names back to the shared tier, with their content, as they are named in the local
+// tier, until the context is done. Names that could not be written back, such as while the
+// shared tier is unavailable, are logged and tried again later, waiting longer after every
+// failure. Only needed with WriteBack.
+func (c *Cache) Run(ctx context.Context) {
+	for {
+		p, wait, ok := c.next(time.Now())
+		if ok && ctx.Err() == nil {
+			c.writeBack(ctx, p)
+			continue
+		}
+		// names that failed are tried again once they have waited
+		var (
+			timer *time.Timer
+			retry <-chan time.Time
+		)
+		if !ok && wait > 0 {
+			timer = time.NewTimer(wait)
+			retry = timer.C
+		}
+		select {
+		case <-c.wake:
+		case <-retry:
+		case <-ctx.Done():
+			c.pendingMu.Lock()
+			if n := len(c.pending); n > 0 {
+				c.logger.Warnf("%d names were not written back to the shared tier", n)
+			}
+			c.pendingMu.Unlock()
+			return
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
+
+// writeBack write a pending name back to the shared tier
+func (c *Cache) writeBack(ctx context.Context, p pendingName) {
+	if err := c.nameShared(ctx, p.key, p.name); err != nil {
+		if ctx.Err() != nil {
+			return
+		}
+		if wait, ok := c.failed(p, time.Now()); ok {
+			c.logger.Errorf("could not write back %s, trying again in %s: %v", p.name, wait, err)
+		} else {
+			c.logger.Errorf("could not write back %s: %v", p.name, err)
+		}
+		return
+	}
+	c.logger.Debugf("wrote back %s (%s) to the shared tier", p.name, p.key)
+	if c.done(p) {
+		if err := c.shared.Unname(ctx, p.name); err != nil {
+			c.logger.Errorf("could not remove %s from the shared tier: %v", p.name, err)
+		}
+	}
+}
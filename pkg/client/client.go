@@ -0,0 +1,256 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/aifoundry-org/storage-manager/pkg/api"
+	"github.com/aifoundry-org/storage-manager/pkg/download"
+)
+
+const unixPrefix = "unix://"
+
+// Client talks to the API of a running storage manager
+type Client struct {
+	base   string
+	client *http.Client
+}
+
+// New create a new client for the storage manager listening on addr, which is either a
+// host:port, a http:// URL, or a Unix-domain socket given as unix:///path/to/socket or an
+// absolute path.
+func New(addr string) (*Client, error) {
+	switch {
+	case strings.HasPrefix(addr, unixPrefix), strings.HasPrefix(addr, "/"):
+		socket := strings.TrimPrefix(addr, unixPrefix)
+		transport := &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", socket)
+			},
+		}
+		// the host is ignored when dialing the socket, but must be valid
+		return &Client{base: "http://storage-manager", client: &http.Client{Transport: transport}}, nil
+	case strings.HasPrefix(addr, "http://"), strings.HasPrefix(addr, "https://"):
+		return &Client{base: strings.TrimRight(addr, "/"), client: &http.Client{}}, nil
+	case addr == "":
+		return nil, fmt.Errorf("no address provided")
+	default:
+		return &Client{base: "http://" + addr, client: &http.Client{}}, nil
+	}
+}
+
+// Pull ensure the content is in the cache of the storage manager, downloading it if needed.
+// If progress is not nil, it is called with updates as the content is written. Canceling the
+// context also cancels the pull in the storage manager.
+func (c *Client) Pull(ctx context.Context, source download.ContentSource, progress func(api.Progress)) (*api.Content, error) {
+	body, err := json.Marshal(source)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.base+"/content/", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", api.MediaTypeNDJSON)
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, responseError(resp)
+	}
+	// servers that do not stream just send the content
+	if !strings.HasPrefix(resp.Header.Get("Content-Type"), api.MediaTypeNDJSON) {
+		var content api.Content
+		if err := json.NewDecoder(resp.Body).Decode(&content); err != nil {
+			return nil, fmt.Errorf("could not decode response: %v", err)
+		}
+		return &content, nil
+	}
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		var result api.PullResult
+		if err := json.Unmarshal(scanner.Bytes(), &result); err != nil {
+			return nil, fmt.Errorf("could not decode response: %v", err)
+		}
+		switch {
+		case result.ErrorDetail != nil:
+			return nil, apiError(*result.ErrorDetail)
+		case result.Error != "":
+			return nil, errors.New(result.Error)
+		case result.Content != nil:
+			return result.Content, nil
+		case result.Progress != nil && progress != nil:
+			progress(*result.Progress)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("could not read response: %v", err)
+	}
+	return nil, fmt.Errorf("response ended without a result")
+}
+
+// List all of the content in the cache
+func (c *Client) List(ctx context.Context) ([]api.Content, error) {
+	var contents []api.Content
+	if err := c.do(ctx, http.MethodGet, c.base+"/content/", nil, &contents); err != nil {
+		return nil, err
+	}
+	return contents, nil
+}
+
+// Inspect get the details of the content for a URL in the cache
+func (c *Client) Inspect(ctx context.Context, url string) (*api.Content, error) {
+	var content api.Content
+	if err := c.do(ctx, http.MethodGet, c.contentURL(url), nil, &content); err != nil {
+		return nil, err
+	}
+	return &content, nil
+}
+
+// Delete remove the content for a URL from the cache, and with shared, from its shared tier
+// for every node. If the content is leased, it is removed from the cache once its leases end,
+// and deferred is true.
+func (c *Client) Delete(ctx context.Context, url string, shared bool) (deferred bool, err error) {
+	u := c.contentURL(url)
+	if shared {
+		u += "?shared=true"
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, u, nil)
+	if err != nil {
+		return false, err
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= http.StatusMultipleChoices {
+		return false, responseError(resp)
+	}
+	return resp.StatusCode == http.StatusAccepted, nil
+}
+
+// Pin pin the content for a URL, protecting it from eviction and deletion until unpinned
+func (c *Client) Pin(ctx context.Context, url string) error {
+	return c.do(ctx, http.MethodPut, c.contentURL(url)+"/pin", nil, nil)
+}
+
+// Unpin remove the pin from the content for a URL
+func (c *Client) Unpin(ctx context.Context, url string) error {
+	return c.do(ctx, http.MethodDelete, c.contentURL(url)+"/pin", nil, nil)
+}
+
+// Lease take a lease on the content for a URL, protecting it from eviction and deletion until
+// it expires after ttl, or the server default if ttl is 0
+func (c *Client) Lease(ctx context.Context, url string, ttl time.Duration) (*api.Lease, error) {
+	var lease api.Lease
+	if err := c.do(ctx, http.MethodPost, c.contentURL(url)+"/leases", leaseRequest(ttl), &lease); err != nil {
+		return nil, err
+	}
+	return &lease, nil
+}
+
+// RenewLease extend a lease to expire after ttl from now, or the server default if ttl is 0
+func (c *Client) RenewLease(ctx context.Context, url, id string, ttl time.Duration) (*api.Lease, error) {
+	var lease api.Lease
+	if err := c.do(ctx, http.MethodPut, c.contentURL(url)+"/leases/"+id, leaseRequest(ttl), &lease); err != nil {
+		return nil, err
+	}
+	return &lease, nil
+}
+
+// ReleaseLease end a lease early
+func (c *Client) ReleaseLease(ctx context.Context, url, id string) error {
+	return c.do(ctx, http.MethodDelete, c.contentURL(url)+"/leases/"+id, nil, nil)
+}
+
+// GC clean up any unreferenced content in the cache, or with shared, in its shared tier
+func (c *Client) GC(ctx context.Context, shared bool) error {
+	return c.do(ctx, http.MethodPost, gcURL(c.base, shared, false), nil, nil)
+}
+
+// GCDryRun report what GC would remove from the cache, or with shared, from its shared tier,
+// without removing anything
+func (c *Client) GCDryRun(ctx context.Context, shared bool) (*api.GCReport, error) {
+	var report api.GCReport
+	if err := c.do(ctx, http.MethodPost, gcURL(c.base, shared, true), nil, &report); err != nil {
+		return nil, err
+	}
+	return &report, nil
+}
+
+// gcURL the URL to POST to for GC
+func gcURL(base string, shared, dryRun bool) string {
+	query := url.Values{}
+	if shared {
+		query.Set("shared", "true")
+	}
+	if dryRun {
+		query.Set("dryRun", "true")
+	}
+	if len(query) == 0 {
+		return base + "/gc"
+	}
+	return base + "/gc?" + query.Encode()
+}
+
+// do send a request with an optional json body, decoding the json response into out if it
+// is not nil
+func (c *Client) do(ctx context.Context, method, url string, in, out any) error {
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(b)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
+	if err != nil {
+		return err
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= http.StatusMultipleChoices {
+		return responseError(resp)
+	}
+	if out == nil {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("could not decode response: %v", err)
+	}
+	return nil
+}
+
+func leaseRequest(ttl time.Duration) api.LeaseRequest {
+	if ttl <= 0 {
+		return api.LeaseRequest{}
+	}
+	return api.LeaseRequest{TTL: ttl.String()}
+}
+
+func (c *Client) contentURL(url string) string {
+	return fmt.Sprintf("%s/content/%s", c.base, base64.URLEncoding.EncodeToString([]byte(url)))
+}
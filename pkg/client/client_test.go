@@ -0,0 +1,163 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/aifoundry-org/storage-manager/pkg/api"
+	"github.com/aifoundry-org/storage-manager/pkg/download"
+)
+
+const testURL = "https://example.com/model.gguf"
+
+// pullServer a server that answers a pull with the given status, content type and body,
+// after checking the request
+func pullServer(t *testing.T, status int, contentType, body string) *Client {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/content/" {
+			t.Errorf("got %s %s, want POST /content/", r.Method, r.URL.Path)
+		}
+		if accept := r.Header.Get("Accept"); accept != api.MediaTypeNDJSON {
+			t.Errorf("accept: got %q, want %q", accept, api.MediaTypeNDJSON)
+		}
+		var source download.ContentSource
+		if err := json.NewDecoder(r.Body).Decode(&source); err != nil || source.URL != testURL {
+			t.Errorf("request body: got %+v, %v", source, err)
+		}
+		if contentType != "" {
+			w.Header().Set("Content-Type", contentType)
+		}
+		w.WriteHeader(status)
+		io.WriteString(w, body)
+	}))
+	t.Cleanup(srv.Close)
+	c, err := New(srv.URL)
+	if err != nil {
+		t.Fatalf("new client: %v", err)
+	}
+	return c
+}
+
+// lines join json values into a newline-delimited stream
+func lines(t *testing.T, values ...any) string {
+	t.Helper()
+	var b strings.Builder
+	for _, v := range values {
+		line, err := json.Marshal(v)
+		if err != nil {
+			t.Fatalf("marshal: %v", err)
+		}
+		b.Write(line)
+		b.WriteByte('\n')
+	}
+	return b.String()
+}
+
+func TestPullStream(t *testing.T) {
+	content := api.Content{URL: testURL, Digest: "sha256:abcd"}
+	updates := []api.Progress{
+		{Key: "sha256:1111", Size: 10, Written: 4},
+		{Key: "sha256:2222", Written: 7},
+		{Key: "sha256:1111", Size: 10, Written: 10, Done: true},
+	}
+	var results []any
+	for i := range updates {
+		results = append(results, api.PullResult{Progress: &updates[i]})
+	}
+	results = append(results, api.PullResult{Content: &content})
+	c := pullServer(t, http.StatusOK, api.MediaTypeNDJSON, lines(t, results...))
+
+	var got []api.Progress
+	result, err := c.Pull(context.Background(), download.ContentSource{URL: testURL}, func(p api.Progress) {
+		got = append(got, p)
+	})
+	if err != nil {
+		t.Fatalf("pull: %v", err)
+	}
+	if !reflect.DeepEqual(*result, content) {
+		t.Errorf("content: got %+v, want %+v", *result, content)
+	}
+	if !reflect.DeepEqual(got, updates) {
+		t.Errorf("progress: got %+v, want %+v", got, updates)
+	}
+
+	// progress is optional
+	if _, err := c.Pull(context.Background(), download.ContentSource{URL: testURL}, nil); err != nil {
+		t.Fatalf("pull without progress: %v", err)
+	}
+}
+
+func TestPullErrors(t *testing.T) {
+	progress := api.PullResult{Progress: &api.Progress{Key: "sha256:1111", Written: 1}}
+	detail := api.Error{Code: api.ErrorCodeSourceUnavailable, Message: "registry kept failing", Status: http.StatusBadGateway, URL: testURL, Retryable: true}
+	tests := []struct {
+		name        string
+		status      int
+		contentType string
+		body        string
+		want        *APIError
+		err         string
+	}{
+		{"error in stream", http.StatusOK, api.MediaTypeNDJSON, lines(t, progress, api.PullResult{Error: detail.Message, ErrorDetail: &detail}),
+			&APIError{StatusCode: http.StatusBadGateway, Code: api.ErrorCodeSourceUnavailable, Message: "registry kept failing", URL: testURL, Retryable: true}, ""},
+		{"plain error in stream", http.StatusOK, api.MediaTypeNDJSON, lines(t, api.PullResult{Error: "something broke"}), nil, "something broke"},
+		{"json error status", http.StatusInsufficientStorage, "application/json",
+			lines(t, api.Error{Code: "insufficientStorage", Message: "no room", Status: http.StatusInsufficientStorage, URL: testURL}),
+			&APIError{StatusCode: http.StatusInsufficientStorage, Code: "insufficientStorage", Message: "no room", URL: testURL}, ""},
+		{"plain text error status", http.StatusNotFound, "text/plain", "not found\n",
+			&APIError{StatusCode: http.StatusNotFound, Message: "not found"}, ""},
+		{"json without code", http.StatusBadRequest, "application/json", `{"message":"bad"}`,
+			&APIError{StatusCode: http.StatusBadRequest, Message: `{"message":"bad"}`}, ""},
+		{"stream without result", http.StatusOK, api.MediaTypeNDJSON, lines(t, progress), nil, "ended without a result"},
+		{"invalid line", http.StatusOK, api.MediaTypeNDJSON, lines(t, progress) + "{not json\n", nil, "could not decode response"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := pullServer(t, tt.status, tt.contentType, tt.body)
+			result, err := c.Pull(context.Background(), download.ContentSource{URL: testURL}, nil)
+			if err == nil {
+				t.Fatalf("got %+v, want an error", result)
+			}
+			var apiErr *APIError
+			isAPIErr := errors.As(err, &apiErr)
+			if tt.want == nil {
+				if isAPIErr {
+					t.Errorf("got API error %+v, want a plain error", apiErr)
+				}
+				if !strings.Contains(err.Error(), tt.err) {
+					t.Errorf("got error %v, want one containing %q", err, tt.err)
+				}
+				return
+			}
+			if !isAPIErr {
+				t.Fatalf("got %v, want an *APIError", err)
+			}
+			if !reflect.DeepEqual(apiErr, tt.want) {
+				t.Errorf("got %+v, want %+v", apiErr, tt.want)
+			}
+		})
+	}
+}
+
+func TestPullWithoutStream(t *testing.T) {
+	// a server that does not stream just sends the content
+	content := api.Content{URL: testURL, Digest: "sha256:abcd"}
+	c := pullServer(t, http.StatusOK, "application/json", lines(t, content))
+	result, err := c.Pull(context.Background(), download.ContentSource{URL: testURL}, func(api.Progress) {
+		t.Errorf("progress reported without a stream")
+	})
+	if err != nil {
+		t.Fatalf("pull: %v", err)
+	}
+	if !reflect.DeepEqual(*result, content) {
+		t.Errorf("content: got %+v, want %+v", *result, content)
+	}
+}
@@ -0,0 +1,46 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/aifoundry-org/storage-manager/pkg/api"
+)
+
+var _ error = &APIError{}
+
+// APIError an error response returned by the storage manager
+type APIError struct {
+	StatusCode int
+	// Code what kind of failure it is, one of the api.ErrorCode constants; empty if the
+	// storage manager did not say
+	Code    string
+	Message string
+	// URL the source URL of the content the error is about, if any
+	URL string
+	// Retryable whether the same request may succeed if it is sent again later
+	Retryable bool
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("%d %s: %s", e.StatusCode, http.StatusText(e.StatusCode), e.Message)
+}
+
+// apiError the error described by the body of an error response
+func apiError(e api.Error) *APIError {
+	return &APIError{StatusCode: e.Status, Code: e.Code, Message: e.Message, URL: e.URL, Retryable: e.Retryable}
+}
+
+func responseError(resp *http.Response) error {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	// older storage managers, and anything in between, may send plain text
+	var e api.Error
+	if strings.HasPrefix(resp.Header.Get("Content-Type"), "application/json") && json.Unmarshal(body, &e) == nil && e.Code != "" {
+		e.Status = resp.StatusCode
+		return apiError(e)
+	}
+	return &APIError{StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(body))}
+}
@@ -0,0 +1,283 @@
+package config
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/aifoundry-org/storage-manager/pkg/cache/tiered"
+	"github.com/aifoundry-org/storage-manager/pkg/credentials"
+	"github.com/aifoundry-org/storage-manager/pkg/download"
+	"github.com/aifoundry-org/storage-manager/pkg/download/retry"
+	"github.com/aifoundry-org/storage-manager/pkg/verify"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// Config the structure of the configuration file. Every setting that also has a flag is
+// documented by the flag; the flag, when given, wins over the file.
+type Config struct {
+	Server      Server       `mapstructure:"server"`
+	Cache       Cache        `mapstructure:"cache"`
+	Log         Log          `mapstructure:"log"`
+	Preload     Preload      `mapstructure:"preload"`
+	Downloaders Downloaders  `mapstructure:"downloaders"`
+	Credentials []Credential `mapstructure:"credentials"`
+	// CredentialStore other places to find credentials for sources
+	CredentialStore CredentialStore `mapstructure:"credentialStore"`
+	Limits          Limits          `mapstructure:"limits"`
+}
+
+// Server settings for the API server. Changes require a restart.
+type Server struct {
+	Address string `mapstructure:"address"`
+}
+
+// Cache settings for the cache. Changes to the directory, backends and tiers require a restart;
+// changes to the maximum size, disk reserve and digest algorithm are applied at runtime.
+type Cache struct {
+	Dir string `mapstructure:"dir"`
+	// Backend how the directory is laid out: ocidir for an OCI image layout, or casdir for
+	// plain content-addressable files; or s3 to keep content in an S3-compatible object store,
+	// with only metadata in the directory. Empty for ocidir.
+	Backend string `mapstructure:"backend"`
+	// S3 the object store, for the s3 backend
+	S3 S3 `mapstructure:"s3"`
+	// Shared a shared tier behind the cache, which must then be in a directory
+	Shared Shared `mapstructure:"shared"`
+	// MaxSize maximum size of the cache, as a size such as 500G or a percentage of the
+	// filesystem such as 80%; empty for no limit
+	MaxSize string `mapstructure:"maxSize"`
+	// DiskReserve free space to keep on the filesystem holding the cache, as a size such as
+	// 10G or a percentage of the filesystem such as 5%; empty to use all of it
+	DiskReserve string `mapstructure:"diskReserve"`
+	// DigestAlgorithm the algorithm of the keys of content whose key is not known ahead of
+	// time, such as files downloaded over http: sha256, sha384 or sha512; empty for sha256
+	DigestAlgorithm string `mapstructure:"digestAlgorithm"`
+}
+
+// S3 settings for a cache in a bucket of an S3-compatible object store, which several nodes
+// may share
+type S3 struct {
+	// Endpoint host and port of the object store, e.g. s3.amazonaws.com or minio:9000
+	Endpoint string `mapstructure:"endpoint"`
+	// Bucket the bucket holding the cache, which must exist
+	Bucket string `mapstructure:"bucket"`
+	// Prefix of every object of the cache in the bucket, e.g. cache/; empty for the root
+	Prefix string `mapstructure:"prefix"`
+	// Region of the bucket; empty to look it up
+	Region string `mapstructure:"region"`
+	// AccessKey and SecretKey the credentials; empty to take them from the environment or the
+	// AWS credentials file
+	AccessKey string `mapstructure:"accessKey"`
+	SecretKey string `mapstructure:"secretKey"`
+	// Insecure use plain HTTP rather than HTTPS
+	Insecure bool `mapstructure:"insecure"`
+	// PartSize the size of the parts of multipart uploads, e.g. 64M; empty for 64M
+	PartSize string `mapstructure:"partSize"`
+	// GCGracePeriod how old unreferenced content must be before GC removes it, as other nodes
+	// may be about to name it, e.g. 1h; 0 for 1h
+	GCGracePeriod time.Duration `mapstructure:"gcGracePeriod"`
+}
+
+// Shared settings for a shared tier behind the cache, such as a directory on NFS or an object
+// store, which holds the full catalogue while the cache directory holds what this node uses
+type Shared struct {
+	// Backend how the shared tier is kept: ocidir or casdir in Dir, or s3 for the object store
+	// in cache.s3; empty for no shared tier
+	Backend string `mapstructure:"backend"`
+	// Dir the directory of the shared tier, for ocidir and casdir
+	Dir string `mapstructure:"dir"`
+	// Write through to write content to the shared tier before a pull finishes, or back to
+	// write it in the background after; empty for through
+	Write string `mapstructure:"write"`
+	// GCGracePeriod how old unreferenced content in Dir must be before gc --shared removes it,
+	// as other nodes may be about to name it, e.g. 1h; 0 for 1h. The s3 backend uses
+	// cache.s3.gcGracePeriod.
+	GCGracePeriod time.Duration `mapstructure:"gcGracePeriod"`
+}
+
+// Log settings for logging. Changes are applied at runtime.
+type Log struct {
+	// Level 0 is info, 1 is debug, 2 is trace
+	Level int `mapstructure:"level"`
+}
+
+// Preload settings for the preload manifest. Changes require a restart; the manifest itself
+// is watched for changes.
+type Preload struct {
+	Manifest string `mapstructure:"manifest"`
+	Prune    bool   `mapstructure:"prune"`
+}
+
+// Downloaders settings for the individual downloaders. Changes are applied at runtime.
+type Downloaders struct {
+	HuggingFace HuggingFace `mapstructure:"huggingface"`
+	OCI         OCI         `mapstructure:"oci"`
+	HTTP        HTTP        `mapstructure:"http"`
+	Retry       Retry       `mapstructure:"retry"`
+}
+
+// HuggingFace settings for the HuggingFace downloader
+type HuggingFace struct {
+	// Endpoint base URL of the HuggingFace hub or a mirror of it
+	Endpoint string `mapstructure:"endpoint"`
+}
+
+// OCI settings for the OCI downloader
+type OCI struct {
+	// Mirrors for each registry host, the mirror hosts to try first, in order
+	Mirrors map[string][]string `mapstructure:"mirrors"`
+	// Insecure registry and mirror hosts to contact over plain HTTP rather than HTTPS
+	Insecure []string `mapstructure:"insecure"`
+	// Platform the platform of the manifest to pull from an index, as os/arch[/variant], or all
+	// for every manifest; empty for the platform of the host. Requests may ask for another.
+	Platform string `mapstructure:"platform"`
+	// ArtifactType only pull the manifests of an index with this artifact type or media type;
+	// empty for any. Requests may ask for another.
+	ArtifactType string `mapstructure:"artifactType"`
+	// Verify which content must be signed before it is cached
+	Verify Verify `mapstructure:"verify"`
+	// Refresh when images in the cache are checked for changes to their tags
+	Refresh Refresh `mapstructure:"refresh"`
+}
+
+// HTTP settings for the http downloader
+type HTTP struct {
+	// Refresh when files in the cache are checked for changes at the server
+	Refresh Refresh `mapstructure:"refresh"`
+}
+
+// Refresh settings for checking whether content in the cache changed at its source, such as
+// a tag of an image that points elsewhere at the registry, in which case the content is pulled
+// again when it is requested. Images pinned to a digest are never checked.
+type Refresh struct {
+	// Policy never, always, or if-older-than; empty for never
+	Policy string `mapstructure:"policy"`
+	// MaxAge how long ago the source may have been checked, for if-older-than, e.g. 1h
+	MaxAge time.Duration `mapstructure:"maxAge"`
+}
+
+// Verify settings for verifying the signatures of OCI content before it is cached
+type Verify struct {
+	// PublicKeys PEM files of the public keys, or certificates, that may sign content; empty
+	// to not verify anything
+	PublicKeys []string `mapstructure:"publicKeys"`
+	// Prefixes only content whose URL starts with one of these must be signed; empty for all
+	// OCI content
+	Prefixes []string `mapstructure:"prefixes"`
+}
+
+// Retry settings for retrying requests to sources that fail transiently, shared by all
+// downloaders
+type Retry struct {
+	// MaxAttempts how many times a request is tried, including the first, 0 for the default
+	// of 5; 1 does not retry
+	MaxAttempts int `mapstructure:"maxAttempts"`
+	// InitialBackoff how long to wait before the first retry, doubling for each one after, 0
+	// for the default of 1s
+	InitialBackoff time.Duration `mapstructure:"initialBackoff"`
+	// MaxBackoff the longest wait between retries, 0 for the default of 30s
+	MaxBackoff time.Duration `mapstructure:"maxBackoff"`
+}
+
+// Credential default credentials for all sources whose URL starts with Prefix, or whose host
+// is Host. The longest matching prefix wins, and any prefix wins over a host. Changes are
+// applied at runtime.
+type Credential struct {
+	Prefix          string `mapstructure:"prefix"`
+	Host            string `mapstructure:"host"`
+	Credentials     string `mapstructure:"credentials"`
+	CredentialsType string `mapstructure:"credentialsType"`
+}
+
+// CredentialStore other places to find credentials for sources that do not give their own,
+// tried after the credentials in the configuration file. Changes are applied at runtime; the
+// files are read on every pull.
+type CredentialStore struct {
+	// DockerConfig path of a docker config.json, for OCI registries; empty for
+	// $DOCKER_CONFIG/config.json or ~/.docker/config.json
+	DockerConfig string `mapstructure:"dockerConfig"`
+	// HuggingFaceToken path of a file holding a HuggingFace token; empty for $HF_TOKEN_PATH,
+	// $HF_HOME/token or ~/.cache/huggingface/token
+	HuggingFaceToken string `mapstructure:"huggingFaceToken"`
+	// SecretDirs directories holding credentials, such as mounted Kubernetes secrets
+	SecretDirs []string `mapstructure:"secretDirs"`
+}
+
+// Limits limits on the work done by the storage manager. Changes are applied at runtime.
+type Limits struct {
+	// MaxConcurrentPulls how many pulls may download at the same time, 0 for no limit
+	MaxConcurrentPulls int `mapstructure:"maxConcurrentPulls"`
+	// MaxConcurrentBlobs how many blobs of a single pull are downloaded at the same time, 0
+	// for the default of 4
+	MaxConcurrentBlobs int `mapstructure:"maxConcurrentBlobs"`
+	// PullTimeout how long a single pull may take, including waiting for a free slot, e.g.
+	// 30m, 0 for no limit
+	PullTimeout time.Duration `mapstructure:"pullTimeout"`
+}
+
+// Validate check the settings that are not checked when they are applied
+func (c *Config) Validate() error {
+	switch alg := digest.Algorithm(c.Cache.DigestAlgorithm); alg {
+	case "", digest.SHA256, digest.SHA384, digest.SHA512:
+	default:
+		return fmt.Errorf("invalid cache.digestAlgorithm: unsupported digest algorithm %s, must be %s, %s or %s", alg, digest.SHA256, digest.SHA384, digest.SHA512)
+	}
+	switch mode := tiered.Mode(c.Cache.Shared.Write); mode {
+	case "", tiered.WriteThrough, tiered.WriteBack:
+	default:
+		return fmt.Errorf("invalid cache.shared.write: unknown write mode %s, must be %s or %s", mode, tiered.WriteThrough, tiered.WriteBack)
+	}
+	opts := c.DownloadOptions()
+	if err := opts.Refresh.Validate(); err != nil {
+		return fmt.Errorf("invalid downloaders.oci.refresh: %v", err)
+	}
+	if err := opts.HTTPRefresh.Validate(); err != nil {
+		return fmt.Errorf("invalid downloaders.http.refresh: %v", err)
+	}
+	return nil
+}
+
+// DownloadOptions the options for the downloaders described by the configuration
+func (c *Config) DownloadOptions() download.Options {
+	opts := download.Options{
+		HuggingFaceEndpoint: c.Downloaders.HuggingFace.Endpoint,
+		RegistryMirrors:     c.Downloaders.OCI.Mirrors,
+		RegistryInsecure:    c.Downloaders.OCI.Insecure,
+		Platform:            c.Downloaders.OCI.Platform,
+		ArtifactType:        c.Downloaders.OCI.ArtifactType,
+		Refresh: download.RefreshPolicy{
+			Policy: c.Downloaders.OCI.Refresh.Policy,
+			MaxAge: c.Downloaders.OCI.Refresh.MaxAge,
+		},
+		HTTPRefresh: download.RefreshPolicy{
+			Policy: c.Downloaders.HTTP.Refresh.Policy,
+			MaxAge: c.Downloaders.HTTP.Refresh.MaxAge,
+		},
+		Verify: verify.Policy{
+			PublicKeys: c.Downloaders.OCI.Verify.PublicKeys,
+			Prefixes:   c.Downloaders.OCI.Verify.Prefixes,
+		},
+		Retry: retry.Policy{
+			MaxAttempts:    c.Downloaders.Retry.MaxAttempts,
+			InitialBackoff: c.Downloaders.Retry.InitialBackoff,
+			MaxBackoff:     c.Downloaders.Retry.MaxBackoff,
+		},
+	}
+	store := credentials.Config{
+		SecretDirs:          c.CredentialStore.SecretDirs,
+		DockerConfig:        c.CredentialStore.DockerConfig,
+		HuggingFaceToken:    c.CredentialStore.HuggingFaceToken,
+		HuggingFaceEndpoint: c.Downloaders.HuggingFace.Endpoint,
+	}
+	for _, cred := range c.Credentials {
+		store.Entries = append(store.Entries, credentials.Entry{
+			Prefix:          cred.Prefix,
+			Host:            cred.Host,
+			Credentials:     cred.Credentials,
+			CredentialsType: cred.CredentialsType,
+		})
+	}
+	opts.Credentials = credentials.New(store)
+	return opts
+}
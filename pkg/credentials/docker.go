@@ -0,0 +1,179 @@
+package credentials
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/aifoundry-org/storage-manager/pkg/download"
+)
+
+const (
+	// dockerHubServer the name under which docker stores the credentials for Docker Hub
+	dockerHubServer = "https://index.docker.io/v1/"
+	// helperTimeout how long a credential helper may take to answer
+	helperTimeout = 10 * time.Second
+	// identityTokenUser the user name a credential helper returns with an identity token
+	// instead of a password
+	identityTokenUser = "<token>"
+)
+
+// dockerHubHosts the hosts that all mean Docker Hub
+var dockerHubHosts = map[string]bool{
+	"docker.io":            true,
+	"index.docker.io":      true,
+	"registry-1.docker.io": true,
+}
+
+// dockerConfigFile the parts of a docker config.json that hold credentials
+type dockerConfigFile struct {
+	Auths map[string]struct {
+		Auth          string `json:"auth"`
+		Username      string `json:"username"`
+		Password      string `json:"password"`
+		IdentityToken string `json:"identitytoken"`
+		RegistryToken string `json:"registrytoken"`
+	} `json:"auths"`
+	CredHelpers map[string]string `json:"credHelpers"`
+	CredsStore  string            `json:"credsStore"`
+}
+
+// dockerConfig the credentials in a docker config.json, for OCI registries
+type dockerConfig string
+
+func (d dockerConfig) lookup(ctx context.Context, u *url.URL) (download.Credential, bool, error) {
+	if u.Scheme != "oci" || u.Host == "" {
+		return download.Credential{}, false, nil
+	}
+	path := string(d)
+	explicit := path != ""
+	if !explicit {
+		path = defaultDockerConfig()
+	}
+	b, err := os.ReadFile(path)
+	switch {
+	case os.IsNotExist(err) && !explicit:
+		return download.Credential{}, false, nil
+	case err != nil:
+		return download.Credential{}, false, fmt.Errorf("could not read docker config: %v", err)
+	}
+	return lookupDockerConfig(ctx, b, u.Host)
+}
+
+// defaultDockerConfig the path of the docker config.json of the current user
+func defaultDockerConfig() string {
+	if dir := os.Getenv("DOCKER_CONFIG"); dir != "" {
+		return filepath.Join(dir, "config.json")
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".docker", "config.json")
+}
+
+// lookupDockerConfig find the credentials for a registry host in the content of a docker
+// config.json: a credential helper for the host wins over credentials stored in the file,
+// which win over the default credentials store
+func lookupDockerConfig(ctx context.Context, b []byte, host string) (download.Credential, bool, error) {
+	var cfg dockerConfigFile
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		return download.Credential{}, false, fmt.Errorf("could not parse docker config: %v", err)
+	}
+	for _, server := range serverNames(host) {
+		if helper, ok := cfg.CredHelpers[server]; ok {
+			return runHelper(ctx, helper, server)
+		}
+	}
+	for key, auth := range cfg.Auths {
+		if !matchesServer(key, host) {
+			continue
+		}
+		switch {
+		case auth.IdentityToken != "":
+			return refreshToken(auth.IdentityToken), true, nil
+		case auth.RegistryToken != "":
+			return bearer(auth.RegistryToken), true, nil
+		case auth.Auth != "":
+			return download.Credential{Credentials: auth.Auth, CredentialsType: "Basic"}, true, nil
+		case auth.Username != "":
+			return basic(auth.Username, auth.Password), true, nil
+		}
+	}
+	if cfg.CredsStore != "" {
+		return runHelper(ctx, cfg.CredsStore, serverNames(host)[0])
+	}
+	return download.Credential{}, false, nil
+}
+
+// serverNames the names under which docker may store the credentials for a host, the one
+// docker itself uses first
+func serverNames(host string) []string {
+	if dockerHubHosts[host] {
+		return []string{dockerHubServer, "docker.io", "index.docker.io", "registry-1.docker.io"}
+	}
+	return []string{host}
+}
+
+// matchesServer whether a key of the auths in a docker config is for the host. Keys may be
+// bare hosts or URLs.
+func matchesServer(key, host string) bool {
+	server := key
+	if u, err := url.Parse(key); err == nil && u.Host != "" {
+		server = u.Host
+	}
+	if dockerHubHosts[host] {
+		return dockerHubHosts[server]
+	}
+	return server == host
+}
+
+// runHelper ask a docker credential helper for the credentials for a server
+func runHelper(ctx context.Context, helper, server string) (download.Credential, bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, helperTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "docker-credential-"+helper, "get")
+	cmd.Stdin = strings.NewReader(server)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		// helpers report that they have nothing for the server on stdout, with a failure
+		if strings.Contains(stdout.String(), "credentials not found") {
+			return download.Credential{}, false, nil
+		}
+		return download.Credential{}, false, fmt.Errorf("credential helper %s failed for %s: %v: %s", helper, server, err, strings.TrimSpace(stderr.String()))
+	}
+	var resp struct {
+		Username string `json:"Username"`
+		Secret   string `json:"Secret"`
+	}
+	if err := json.Unmarshal(stdout.Bytes(), &resp); err != nil {
+		return download.Credential{}, false, fmt.Errorf("could not parse response of credential helper %s: %v", helper, err)
+	}
+	if resp.Username == identityTokenUser {
+		return refreshToken(resp.Secret), true, nil
+	}
+	return basic(resp.Username, resp.Secret), true, nil
+}
+
+// refreshToken credentials for an identity token, which the registry exchanges for access
+// tokens
+func refreshToken(token string) download.Credential {
+	return download.Credential{Credentials: token, CredentialsType: "RefreshToken"}
+}
+
+// basic Basic credentials for a user name and password
+func basic(username, password string) download.Credential {
+	return download.Credential{
+		Credentials:     base64.StdEncoding.EncodeToString([]byte(username + ":" + password)),
+		CredentialsType: "Basic",
+	}
+}
@@ -0,0 +1,86 @@
+package credentials
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/aifoundry-org/storage-manager/pkg/download"
+)
+
+// huggingFaceHost the host of the HuggingFace hub
+const huggingFaceHost = "huggingface.co"
+
+// huggingFaceToken the token saved by the HuggingFace tools, for HuggingFace content at the
+// hub or the configured endpoint. A URL may name any host as its registry, so the token is
+// never sent to other hosts.
+type huggingFaceToken struct {
+	path     string
+	endpoint string
+}
+
+func (h huggingFaceToken) lookup(_ context.Context, u *url.URL) (download.Credential, bool, error) {
+	if u.Scheme != "hf" && u.Scheme != "huggingface" {
+		return download.Credential{}, false, nil
+	}
+	if !h.forHost(u.Host) {
+		return download.Credential{}, false, nil
+	}
+	if token := os.Getenv("HF_TOKEN"); token != "" {
+		return bearer(token), true, nil
+	}
+	path := h.path
+	explicit := path != ""
+	if !explicit {
+		path = defaultHuggingFaceToken()
+	}
+	b, err := os.ReadFile(path)
+	switch {
+	case os.IsNotExist(err) && !explicit:
+		return download.Credential{}, false, nil
+	case err != nil:
+		return download.Credential{}, false, fmt.Errorf("could not read HuggingFace token: %v", err)
+	}
+	token := strings.TrimSpace(string(b))
+	if token == "" {
+		return download.Credential{}, false, nil
+	}
+	return bearer(token), true, nil
+}
+
+// forHost whether the token is for the registry host of a URL: none, which is the configured
+// endpoint, the hub, or the host of the configured endpoint
+func (h huggingFaceToken) forHost(host string) bool {
+	if host == "" || strings.EqualFold(host, huggingFaceHost) {
+		return true
+	}
+	if h.endpoint == "" {
+		return false
+	}
+	endpoint, err := url.Parse(h.endpoint)
+	return err == nil && endpoint.Host != "" && strings.EqualFold(host, endpoint.Host)
+}
+
+// defaultHuggingFaceToken the path where the HuggingFace tools save the token of the current
+// user
+func defaultHuggingFaceToken() string {
+	if path := os.Getenv("HF_TOKEN_PATH"); path != "" {
+		return path
+	}
+	if dir := os.Getenv("HF_HOME"); dir != "" {
+		return filepath.Join(dir, "token")
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".cache", "huggingface", "token")
+}
+
+// bearer Bearer credentials for a token
+func bearer(token string) download.Credential {
+	return download.Credential{Credentials: token, CredentialsType: "Bearer"}
+}
@@ -0,0 +1,72 @@
+package credentials
+
+import (
+	"context"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestHuggingFaceTokenHosts(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(path, []byte("node\n"), 0600); err != nil {
+		t.Fatalf("write token: %v", err)
+	}
+	t.Setenv("HF_TOKEN", "")
+	h := huggingFaceToken{path: path, endpoint: "https://hf-mirror.example.com/"}
+	tests := []struct {
+		url  string
+		want bool
+	}{
+		{"hf:///org/model/file", true},
+		{"huggingface:///org/model/file", true},
+		{"hf://huggingface.co/org/model/file", true},
+		{"hf://HuggingFace.co/org/model/file", true},
+		{"hf://hf-mirror.example.com/org/model/file", true},
+		// any other host in the URL is where the downloader would send the token
+		{"hf://attacker.example.com/org/model/file", false},
+		{"hf://huggingface.co.attacker.example.com/org/model/file", false},
+		{"https://huggingface.co/org/model/resolve/main/file", false},
+	}
+	for _, tt := range tests {
+		u, err := url.Parse(tt.url)
+		if err != nil {
+			t.Fatalf("parse %s: %v", tt.url, err)
+		}
+		cred, ok, err := h.lookup(context.Background(), u)
+		if err != nil {
+			t.Fatalf("lookup %s: %v", tt.url, err)
+		}
+		if ok != tt.want {
+			t.Errorf("lookup %s found a token = %v, want %v", tt.url, ok, tt.want)
+		}
+		if ok && (cred.Credentials != "node" || cred.CredentialsType != "Bearer") {
+			t.Errorf("lookup %s = %+v, want the Bearer token from the file", tt.url, cred)
+		}
+	}
+
+	// without a configured endpoint, only the hub gets the token
+	u, _ := url.Parse("hf://hf-mirror.example.com/org/model/file")
+	if _, ok, _ := (huggingFaceToken{path: path}).lookup(context.Background(), u); ok {
+		t.Errorf("lookup %s found a token without an endpoint configured for the host", u)
+	}
+}
+
+func TestHuggingFaceTokenEnv(t *testing.T) {
+	t.Setenv("HF_TOKEN", "env")
+	h := huggingFaceToken{path: filepath.Join(t.TempDir(), "missing")}
+	for rawURL, want := range map[string]bool{
+		"hf:///org/model/file":                     true,
+		"hf://attacker.example.com/org/model/file": false,
+	} {
+		u, _ := url.Parse(rawURL)
+		cred, ok, err := h.lookup(context.Background(), u)
+		if err != nil {
+			t.Fatalf("lookup %s: %v", rawURL, err)
+		}
+		if ok != want || (ok && cred.Credentials != "env") {
+			t.Errorf("lookup %s = %q, %v, want found %v", rawURL, cred.Credentials, ok, want)
+		}
+	}
+}
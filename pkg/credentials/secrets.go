@@ -0,0 +1,130 @@
+package credentials
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/aifoundry-org/storage-manager/pkg/download"
+)
+
+// files in a secret directory, named the way Kubernetes names the keys of a secret
+const (
+	secretDockerConfig    = ".dockerconfigjson"
+	secretPrefix          = "prefix"
+	secretHost            = "host"
+	secretToken           = "token"
+	secretUsername        = "username"
+	secretPassword        = "password"
+	secretCredentialsType = "credentialsType"
+)
+
+// secretDirs directories holding credentials, e.g. Kubernetes secrets mounted as volumes. Each
+// directory is a secret itself, or holds one subdirectory per secret. A secret is either a
+// docker config in .dockerconfigjson, or a prefix or host file with a token file (Bearer) or
+// username and password files (Basic). A credentialsType file overrides the type.
+type secretDirs []string
+
+func (s secretDirs) lookup(ctx context.Context, u *url.URL) (download.Credential, bool, error) {
+	var (
+		list []Entry
+		errs []error
+	)
+	for _, dir := range s {
+		secrets, err := secretsIn(dir)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		for _, secret := range secrets {
+			// a docker config is only for OCI registries, the same as ~/.docker/config.json
+			if b, err := os.ReadFile(filepath.Join(secret, secretDockerConfig)); err == nil {
+				if u.Scheme != "oci" || u.Host == "" {
+					continue
+				}
+				cred, ok, err := lookupDockerConfig(ctx, b, u.Host)
+				if err != nil {
+					errs = append(errs, fmt.Errorf("secret %s: %v", secret, err))
+				}
+				if ok {
+					return cred, true, errors.Join(errs...)
+				}
+				continue
+			}
+			entry, err := readSecret(secret)
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			list = append(list, entry)
+		}
+	}
+	cred, ok := match(list, u)
+	return cred, ok, errors.Join(errs...)
+}
+
+// secretsIn the secrets in a directory: the directory itself if it holds a secret, else its
+// subdirectories
+func secretsIn(dir string) ([]string, error) {
+	if isSecret(dir) {
+		return []string{dir}, nil
+	}
+	dirEntries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("could not read secret directory %s: %v", dir, err)
+	}
+	var secrets []string
+	for _, e := range dirEntries {
+		// Kubernetes keeps the real files in hidden directories, and links to them
+		if strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
+		path := filepath.Join(dir, e.Name())
+		if info, err := os.Stat(path); err == nil && info.IsDir() && isSecret(path) {
+			secrets = append(secrets, path)
+		}
+	}
+	return secrets, nil
+}
+
+// isSecret whether the directory holds a secret
+func isSecret(dir string) bool {
+	for _, name := range []string{secretDockerConfig, secretPrefix, secretHost} {
+		// a subdirectory of that name is a secret in a directory of secrets
+		if info, err := os.Stat(filepath.Join(dir, name)); err == nil && !info.IsDir() {
+			return true
+		}
+	}
+	return false
+}
+
+// readSecret read the entry in a secret directory that does not hold a docker config
+func readSecret(dir string) (Entry, error) {
+	read := func(name string) string {
+		b, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			return ""
+		}
+		return strings.TrimSpace(string(b))
+	}
+	entry := Entry{Prefix: read(secretPrefix), Host: read(secretHost)}
+	token, username := read(secretToken), read(secretUsername)
+	switch {
+	case token != "":
+		entry.Credentials, entry.CredentialsType = token, "Bearer"
+	case username != "":
+		entry.Credentials = base64.StdEncoding.EncodeToString([]byte(username + ":" + read(secretPassword)))
+		entry.CredentialsType = "Basic"
+	default:
+		return Entry{}, fmt.Errorf("secret %s has neither a %s nor a %s", dir, secretToken, secretUsername)
+	}
+	if t := read(secretCredentialsType); t != "" {
+		entry.CredentialsType = t
+	}
+	return entry, nil
+}
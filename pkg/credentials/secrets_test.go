@@ -0,0 +1,95 @@
+package credentials
+
+import (
+	"context"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeSecret write the files of a secret into dir
+func writeSecret(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatalf("create secret: %v", err)
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0600); err != nil {
+			t.Fatalf("write %s: %v", name, err)
+		}
+	}
+}
+
+func TestSecretDirs(t *testing.T) {
+	root := t.TempDir()
+	// a directory of secrets, the way Kubernetes mounts them
+	writeSecret(t, filepath.Join(root, "all", "org"), map[string]string{
+		secretPrefix: "https://h/org\n",
+		secretToken:  "org-token\n",
+	})
+	writeSecret(t, filepath.Join(root, "all", "host"), map[string]string{
+		secretHost:     "h",
+		secretUsername: "user",
+		secretPassword: "pass",
+	})
+	writeSecret(t, filepath.Join(root, "all", "typed"), map[string]string{
+		secretHost:            "typed.example.com",
+		secretToken:           "identity",
+		secretCredentialsType: "RefreshToken",
+	})
+	writeSecret(t, filepath.Join(root, "all", "registry"), map[string]string{
+		secretDockerConfig: `{"auths":{"registry.example.com":{"auth":"ZG9ja2VyOnB3"}}}`,
+	})
+	// the real files of a Kubernetes secret, which are skipped
+	writeSecret(t, filepath.Join(root, "all", "..data"), map[string]string{
+		secretHost:  "hidden.example.com",
+		secretToken: "hidden",
+	})
+	// a directory that is a secret itself
+	writeSecret(t, filepath.Join(root, "single"), map[string]string{
+		secretPrefix: "https://single.example.com/",
+		secretToken:  "single-token",
+	})
+
+	s := secretDirs{filepath.Join(root, "all"), filepath.Join(root, "single")}
+	tests := []struct {
+		url      string
+		creds    string
+		credType string
+	}{
+		{"https://h/org/model", "org-token", "Bearer"},
+		{"https://h/elsewhere", base64.StdEncoding.EncodeToString([]byte("user:pass")), "Basic"},
+		{"oci://typed.example.com/repo:tag", "identity", "RefreshToken"},
+		{"oci://registry.example.com/repo:tag", "ZG9ja2VyOnB3", "Basic"},
+		{"https://single.example.com/file", "single-token", "Bearer"},
+		// a docker config is only for OCI registries
+		{"https://registry.example.com/file", "", ""},
+		{"https://hidden.example.com/file", "", ""},
+	}
+	for _, tt := range tests {
+		u := mustParse(t, tt.url)
+		cred, ok, err := s.lookup(context.Background(), u)
+		if err != nil {
+			t.Fatalf("lookup %s: %v", tt.url, err)
+		}
+		if ok != (tt.creds != "") || cred.Credentials != tt.creds || cred.CredentialsType != tt.credType {
+			t.Errorf("lookup %s = %+v, %v, want %s %s", tt.url, cred, ok, tt.credType, tt.creds)
+		}
+	}
+}
+
+func TestSecretDirsInvalid(t *testing.T) {
+	root := t.TempDir()
+	writeSecret(t, filepath.Join(root, "empty"), map[string]string{secretHost: "h"})
+	writeSecret(t, filepath.Join(root, "valid"), map[string]string{secretHost: "h", secretToken: "token"})
+	s := secretDirs{root, filepath.Join(root, "missing")}
+	// the secrets that can be read are still used, with the others reported
+	cred, ok, err := s.lookup(context.Background(), mustParse(t, "https://h/file"))
+	if !ok || cred.Credentials != "token" {
+		t.Errorf("lookup = %+v, %v, want the token of the valid secret", cred, ok)
+	}
+	if err == nil {
+		t.Errorf("lookup reported no error for a secret without credentials and a missing directory")
+	}
+}
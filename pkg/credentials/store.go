@@ -0,0 +1,136 @@
+package credentials
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/aifoundry-org/storage-manager/pkg/download"
+)
+
+var _ download.CredentialStore = &Store{}
+
+// Entry credentials for every source whose URL is under Prefix, or whose host is Host. A URL is
+// under a prefix with the same scheme and host, and a path that is the prefix's or continues
+// it after a /; a prefix of only a scheme, such as hf://, covers every URL with that scheme,
+// whatever its host, and hf:/// only those without a host.
+type Entry struct {
+	Prefix          string
+	Host            string
+	Credentials     string
+	CredentialsType string
+}
+
+// Config where the store finds credentials
+type Config struct {
+	// Entries credentials given directly, such as in the configuration file
+	Entries []Entry
+	// SecretDirs directories holding credentials, e.g. Kubernetes secrets mounted as volumes;
+	// see secretDirs for their layout
+	SecretDirs []string
+	// DockerConfig path of a docker config.json; empty for $DOCKER_CONFIG/config.json or
+	// ~/.docker/config.json
+	DockerConfig string
+	// HuggingFaceToken path of a file holding a HuggingFace token; empty for $HF_TOKEN_PATH,
+	// $HF_HOME/token or ~/.cache/huggingface/token. $HF_TOKEN wins over the file.
+	HuggingFaceToken string
+	// HuggingFaceEndpoint base URL of the HuggingFace hub or a mirror of it, to which the
+	// HuggingFace token may be sent as well as to the hub
+	HuggingFaceEndpoint string
+}
+
+// source a place to find credentials
+type source interface {
+	lookup(ctx context.Context, u *url.URL) (download.Credential, bool, error)
+}
+
+// Store finds the credentials for a source URL, in order: the entries given directly, secret
+// directories, the docker config, and the HuggingFace token. The first place that has
+// credentials for the URL wins. Files are read on every lookup, so that credentials that
+// change, such as rotated secrets, are picked up right away.
+type Store struct {
+	sources []source
+}
+
+// New create a store that finds credentials in the places in the config
+func New(cfg Config) *Store {
+	return &Store{sources: []source{
+		entries(cfg.Entries),
+		secretDirs(cfg.SecretDirs),
+		dockerConfig(cfg.DockerConfig),
+		huggingFaceToken{path: cfg.HuggingFaceToken, endpoint: cfg.HuggingFaceEndpoint},
+	}}
+}
+
+// Lookup find the credentials for the source URL
+func (s *Store) Lookup(ctx context.Context, rawURL string) (download.Credential, bool, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return download.Credential{}, false, fmt.Errorf("invalid url %s: %v", rawURL, err)
+	}
+	var errs []error
+	for _, src := range s.sources {
+		cred, ok, err := src.lookup(ctx, u)
+		if err != nil {
+			errs = append(errs, err)
+		}
+		if ok {
+			return cred, true, errors.Join(errs...)
+		}
+	}
+	return download.Credential{}, false, errors.Join(errs...)
+}
+
+// entries credentials given directly. The longest matching prefix wins, and any prefix wins
+// over a host.
+type entries []Entry
+
+func (e entries) lookup(_ context.Context, u *url.URL) (download.Credential, bool, error) {
+	cred, ok := match(e, u)
+	return cred, ok, nil
+}
+
+// match find the entry for the URL, returning whether there is one
+func match(list []Entry, u *url.URL) (download.Credential, bool) {
+	var (
+		best  *Entry
+		score int
+	)
+	for i, entry := range list {
+		var s int
+		switch {
+		case entry.Prefix != "" && underPrefix(u, entry.Prefix):
+			// a prefix always wins over a host
+			s = len(entry.Prefix) + 1
+		case entry.Prefix == "" && entry.Host != "" && strings.EqualFold(entry.Host, u.Host):
+			s = 1
+		}
+		if s > score {
+			best, score = &list[i], s
+		}
+	}
+	if best == nil {
+		return download.Credential{}, false
+	}
+	return download.Credential{Credentials: best.Credentials, CredentialsType: best.CredentialsType}, true
+}
+
+// underPrefix whether the URL is under the prefix, respecting the boundaries of its host and
+// path, so that https://h/org covers neither https://h.example.com nor https://h/org-other
+func underPrefix(u *url.URL, prefix string) bool {
+	p, err := url.Parse(prefix)
+	if err != nil || p.Scheme == "" || !strings.EqualFold(p.Scheme, u.Scheme) {
+		return false
+	}
+	if p.Host == "" && p.Path == "" && p.Opaque == "" {
+		return true
+	}
+	// a prefix without a host, such as hf:///, only covers URLs without one
+	if !strings.EqualFold(p.Host, u.Host) {
+		return false
+	}
+	path := strings.TrimSuffix(p.Path, "/")
+	return path == "" || u.Path == path || strings.HasPrefix(u.Path, path+"/")
+}
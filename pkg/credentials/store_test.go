@@ -0,0 +1,110 @@
+package credentials
+
+import (
+	"context"
+	"net/url"
+	"testing"
+)
+
+func TestUnderPrefix(t *testing.T) {
+	tests := []struct {
+		url    string
+		prefix string
+		want   bool
+	}{
+		{"https://h/org/model", "https://h/org", true},
+		{"https://h/org", "https://h/org", true},
+		{"https://h/org/model", "https://h/org/", true},
+		{"https://h/org-other/model", "https://h/org", false},
+		{"https://h.example.com/org", "https://h", false},
+		{"https://h:8080/org", "https://h", false},
+		{"https://h/org", "https://h", true},
+		{"https://h/org", "http://h", false},
+		{"HTTPS://H/org", "https://h/org", true},
+		{"https://h/Org", "https://h/org", false},
+		{"hf:///org/model/file", "hf://", true},
+		{"hf://attacker.example.com/org/model/file", "hf://", true},
+		{"hf:///org/model/file", "hf:///", true},
+		{"hf://attacker.example.com/org/model/file", "hf:///", false},
+		{"hf:///org/model/file", "hf:///org/", true},
+		{"hf:///other/model/file", "hf:///org/", false},
+		{"hf://huggingface.co/org/model/file", "hf://huggingface.co/", true},
+		{"hf:///org/model/file", "hf://huggingface.co/", false},
+		{"https://h/org", "h/org", false},
+		{"https://h/org", "", false},
+	}
+	for _, tt := range tests {
+		u, err := url.Parse(tt.url)
+		if err != nil {
+			t.Fatalf("parse %s: %v", tt.url, err)
+		}
+		if got := underPrefix(u, tt.prefix); got != tt.want {
+			t.Errorf("underPrefix(%s, %q) = %v, want %v", tt.url, tt.prefix, got, tt.want)
+		}
+	}
+}
+
+func TestMatch(t *testing.T) {
+	list := []Entry{
+		{Host: "h", Credentials: "host"},
+		{Prefix: "https://h/org", Credentials: "org"},
+		{Prefix: "https://h/org/model", Credentials: "model"},
+		{Host: "other.example.com", Credentials: "other"},
+		{Prefix: "hf:///", Credentials: "hub"},
+	}
+	tests := []struct {
+		url  string
+		want string
+	}{
+		// the longest prefix wins, whatever the order of the entries
+		{"https://h/org/model/file", "model"},
+		{"https://h/org/model-2/file", "org"},
+		// a prefix wins over a host
+		{"https://h/org/file", "org"},
+		{"https://h/elsewhere/file", "host"},
+		{"https://H/elsewhere/file", "host"},
+		{"https://Other.Example.com/file", "other"},
+		{"hf:///org/model/file", "hub"},
+		{"hf://attacker.example.com/org/model/file", ""},
+		{"https://unknown.example.com/file", ""},
+	}
+	for _, tt := range tests {
+		u, err := url.Parse(tt.url)
+		if err != nil {
+			t.Fatalf("parse %s: %v", tt.url, err)
+		}
+		cred, ok := match(list, u)
+		if ok != (tt.want != "") || cred.Credentials != tt.want {
+			t.Errorf("match(%s) = %q, %v, want %q", tt.url, cred.Credentials, ok, tt.want)
+		}
+	}
+}
+
+func TestLookupOrder(t *testing.T) {
+	t.Setenv("HF_TOKEN", "node")
+	s := New(Config{
+		Entries:          []Entry{{Prefix: "hf:///org/", Credentials: "entry", CredentialsType: "Bearer"}},
+		DockerConfig:     "/nonexistent/config.json",
+		HuggingFaceToken: "/nonexistent/token",
+	})
+	for rawURL, want := range map[string]string{
+		// the entries win over the HuggingFace token
+		"hf:///org/model/file":   "entry",
+		"hf:///other/model/file": "node",
+	} {
+		cred, ok, err := s.Lookup(context.Background(), rawURL)
+		if !ok || cred.Credentials != want {
+			t.Errorf("lookup %s = %q, %v, %v, want %q", rawURL, cred.Credentials, ok, err, want)
+		}
+	}
+}
+
+// mustParse parse a URL, failing the test if it is invalid
+func mustParse(t *testing.T, rawURL string) *url.URL {
+	t.Helper()
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		t.Fatalf("parse %s: %v", rawURL, err)
+	}
+	return u
+}
@@ -0,0 +1,27 @@
+package disk
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// Stats the size of the filesystem holding a path, and how much of it is free
+type Stats struct {
+	// Total size of the filesystem in bytes
+	Total int64
+	// Free bytes available to unprivileged users
+	Free int64
+}
+
+// Stat get the size and free space of the filesystem holding path
+func Stat(path string) (Stats, error) {
+	var fs syscall.Statfs_t
+	if err := syscall.Statfs(path, &fs); err != nil {
+		return Stats{}, fmt.Errorf("could not stat filesystem of %s: %v", path, err)
+	}
+	bsize := int64(fs.Bsize)
+	return Stats{
+		Total: int64(fs.Blocks) * bsize,
+		Free:  int64(fs.Bavail) * bsize,
+	}, nil
+}
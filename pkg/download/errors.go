@@ -11,3 +11,16 @@ type ErrUnsupportedScheme struct {
 func (e *ErrUnsupportedScheme) Error() string {
 	return fmt.Sprintf("unknown scheme %s", e.Scheme)
 }
+
+var _ error = &NoMatchingManifestError{}
+
+// NoMatchingManifestError an OCI index has no manifest for the platform and artifact type
+// that were asked for
+type NoMatchingManifestError struct {
+	Index     string
+	Selection string
+}
+
+func (e *NoMatchingManifestError) Error() string {
+	return fmt.Sprintf("no manifest in index %s matches %s", e.Index, e.Selection)
+}
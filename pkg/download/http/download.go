@@ -1,46 +1,176 @@
 package http
 
 import (
+	"context"
 	"fmt"
+	"io"
 	"net/http"
 	"net/url"
 
+	"github.com/aifoundry-org/storage-manager/pkg/api"
 	"github.com/aifoundry-org/storage-manager/pkg/download"
+	"github.com/aifoundry-org/storage-manager/pkg/download/retry"
 )
 
-var _ download.Downloader = &downloader{}
+var (
+	_ download.Downloader  = &downloader{}
+	_ download.Revalidator = &downloader{}
+)
 
 type downloader struct {
 	ref       *url.URL
 	creds     string
 	credsType string
+	opts      download.Options
+	// validators what the server sent with the content found by the last Download
+	validators *api.Validators
+}
+
+func New(ref *url.URL, creds, credsType string, opts download.Options) (*downloader, error) {
+	return &downloader{ref: ref, creds: creds, credsType: credsType, opts: opts}, nil
+}
+
+func (d *downloader) Download(ctx context.Context, fn func(blobs []download.Blob) error) error {
+	// Use an HTTP client to send the request. The request is made before the blob is opened,
+	// as the response is the only way to learn its size.
+	client := d.opts.Client()
+	resp, err := d.get(ctx, client, 0, "")
+	if err != nil {
+		return err
+	}
+	var opened bool
+	defer func() {
+		if !opened {
+			resp.Body.Close()
+		}
+	}()
+	d.validators = validators(resp)
+	// resuming only continues the same content, which the server can tell by its validator
+	validator := resp.Header.Get("ETag")
+	if validator == "" {
+		validator = resp.Header.Get("Last-Modified")
+	}
+	resume := func(ctx context.Context, offset int64) (io.ReadCloser, error) {
+		resp, err := d.get(ctx, client, offset, validator)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode == http.StatusPartialContent {
+			return resp.Body, nil
+		}
+		// the server sent all of it, either because it does not support ranges, or because
+		// the content changed
+		if validator != "" {
+			resp.Body.Close()
+			return nil, fmt.Errorf("%s changed while it was downloaded", d.ref.Redacted())
+		}
+		if err := retry.Skip(resp.Body, offset); err != nil {
+			return nil, err
+		}
+		return resp.Body, nil
+	}
+	// the request was made with the context of the download, which covers the whole read
+	open := func(ctx context.Context) (io.ReadCloser, error) {
+		if opened {
+			return nil, fmt.Errorf("%s is already open", d.ref)
+		}
+		opened = true
+		return d.opts.Resume(ctx, d.ref.Host, resp.Body, resume), nil
+	}
+	// the size is -1 if the server does not send a Content-Length
+	return fn([]download.Blob{{Size: resp.ContentLength, Open: open}})
+}
+
+// Validators what the server sent with the content found by the last Download
+func (d *downloader) Validators() *api.Validators {
+	return d.validators
+}
+
+// Modified whether the content at the server no longer matches the validators, asked with a
+// conditional request. Servers that ignore the conditions send the content, whose validators
+// are compared instead; it is not read.
+func (d *downloader) Modified(ctx context.Context, v api.Validators) (bool, error) {
+	if v.Empty() {
+		// nothing to compare the content with
+		return true, nil
+	}
+	req, err := d.request(ctx)
+	if err != nil {
+		return false, err
+	}
+	if v.ETag != "" {
+		req.Header.Set("If-None-Match", v.ETag)
+	}
+	if v.LastModified != "" {
+		req.Header.Set("If-Modified-Since", v.LastModified)
+	}
+	resp, err := d.opts.Client().Do(req)
+	if err != nil {
+		return false, err
+	}
+	if resp.StatusCode == http.StatusNotModified {
+		resp.Body.Close()
+		return false, nil
+	}
+	if err := retry.CheckResponse(resp); err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+	current := validators(resp)
+	switch {
+	case v.ETag != "" && current.ETag != "":
+		return v.ETag != current.ETag, nil
+	case v.LastModified != "" && current.LastModified != "":
+		return v.LastModified != current.LastModified || v.ContentLength != current.ContentLength, nil
+	}
+	return true, nil
 }
 
-func New(ref *url.URL, creds, credsType string) (*downloader, error) {
-	return &downloader{ref, creds, credsType}, nil
+// validators what the server sent to identify the content of the response
+func validators(resp *http.Response) *api.Validators {
+	return &api.Validators{
+		ETag:          resp.Header.Get("ETag"),
+		LastModified:  resp.Header.Get("Last-Modified"),
+		ContentLength: resp.ContentLength,
+	}
 }
 
-func (d *downloader) Download() ([]download.KeyReader, error) {
-	req, err := http.NewRequest("GET", d.ref.String(), nil)
+// request a request for the content, with the credentials
+func (d *downloader) request(ctx context.Context) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", d.ref.String(), nil)
 	if err != nil {
 		return nil, err
 	}
 	// Set the authorization header
-	if d.creds == "" {
+	if d.creds != "" {
 		credsType := d.credsType
 		if credsType == "" {
 			credsType = "Bearer"
 		}
 		req.Header.Set("Authorization", fmt.Sprintf("%s %s", credsType, d.creds))
 	}
-	// Use an HTTP client to send the request
-	client := &http.Client{}
+	return req, nil
+}
+
+// get request the content from offset on. If validator is set, the server only sends part of
+// the content if it still matches.
+func (d *downloader) get(ctx context.Context, client *http.Client, offset int64, validator string) (*http.Response, error) {
+	req, err := d.request(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		if validator != "" {
+			req.Header.Set("If-Range", validator)
+		}
+	}
 	resp, err := client.Do(req)
 	if err != nil {
 		return nil, err
 	}
-	if resp.StatusCode != http.StatusOK {
+	if err := retry.CheckResponse(resp); err != nil {
 		return nil, err
 	}
-	return []download.KeyReader{{Reader: resp.Body}}, nil
+	return resp, nil
 }
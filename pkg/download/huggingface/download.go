@@ -2,6 +2,7 @@ package huggingface
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -11,18 +12,23 @@ import (
 	"strings"
 
 	"github.com/aifoundry-org/storage-manager/pkg/download"
+	"github.com/aifoundry-org/storage-manager/pkg/download/retry"
 )
 
 var _ download.Downloader = &downloader{}
 
+const defaultHost = "huggingface.co"
+
 type downloader struct {
+	endpoint  string
 	creds     string
 	credsType string
 	model     string
 	file      string
+	opts      download.Options
 }
 
-func New(ref *url.URL, creds, credsType string) (*downloader, error) {
+func New(ref *url.URL, creds, credsType string, opts download.Options) (*downloader, error) {
 	// parse the name of the file and the model name from the URL
 	file := path.Base(ref.Path)
 	model := path.Dir(ref.Path)
@@ -33,31 +39,48 @@ func New(ref *url.URL, creds, credsType string) (*downloader, error) {
 	if credsType != "Bearer" {
 		return nil, fmt.Errorf("unsupported credentials type %s", credsType)
 	}
-	return &downloader{model: model, file: file, creds: creds, credsType: credsType}, nil
+	// an explicit registry in the URL wins over the configured endpoint, which may be a mirror
+	endpoint := opts.HuggingFaceEndpoint
+	if ref.Host != "" && ref.Host != defaultHost {
+		endpoint = fmt.Sprintf("https://%s", ref.Host)
+	}
+	if endpoint == "" {
+		endpoint = download.DefaultHuggingFaceEndpoint
+	}
+	endpoint = strings.TrimRight(endpoint, "/")
+	return &downloader{endpoint: endpoint, model: model, file: file, creds: creds, credsType: credsType, opts: opts}, nil
 }
 
-func (d *downloader) Info() (*RepoInfo, error) {
-	u := fmt.Sprintf("https://huggingface.co/api/models/%s/revision/main?blobs=true", d.model)
+// host the host of the endpoint, for logging and metrics
+func (d *downloader) host() string {
+	if u, err := url.Parse(d.endpoint); err == nil {
+		return u.Host
+	}
+	return d.endpoint
+}
+
+func (d *downloader) Info(ctx context.Context) (*RepoInfo, error) {
+	u := fmt.Sprintf("%s/api/models/%s/revision/main?blobs=true", d.endpoint, d.model)
 	// get the info about the repo and its files
-	req, err := http.NewRequest("GET", u, nil)
+	req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
 	if err != nil {
 		return nil, err
 	}
 	// Set the authorization header
-	if d.creds == "" {
+	if d.creds != "" {
 		credsType := d.credsType
 		// we only support Bearer
 		req.Header.Set("Authorization", fmt.Sprintf("%s %s", credsType, d.creds))
 	}
 	// Use an HTTP client to send the request
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	resp, err := d.opts.Client().Do(req)
 	if err != nil {
 		return nil, err
 	}
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("failed to download %s: %s", u, resp.Status)
+	if err := retry.CheckResponse(resp); err != nil {
+		return nil, err
 	}
+	defer resp.Body.Close()
 	var buf bytes.Buffer
 	if _, err := io.Copy(&buf, resp.Body); err != nil {
 		return nil, err
@@ -69,10 +92,10 @@ func (d *downloader) Info() (*RepoInfo, error) {
 	return &info, nil
 }
 
-func (d *downloader) Download() ([]download.KeyReader, error) {
-	info, err := d.Info()
+func (d *downloader) Download(ctx context.Context, fn func(blobs []download.Blob) error) error {
+	info, err := d.Info(ctx)
 	if err != nil {
-		return nil, err
+		return err
 	}
 	// see if our file is in the info
 	var (
@@ -87,26 +110,44 @@ func (d *downloader) Download() ([]download.KeyReader, error) {
 	}
 
 	// get the info about the repo and its files
-	u := fmt.Sprintf("https://huggingface.co/%s/resolve/%s/%s", d.model, info.CommitHash, d.file)
-	req, err := http.NewRequest("GET", u, nil)
-	if err != nil {
-		return nil, err
-	}
-	// Set the authorization header
-	if d.creds == "" {
-		credsType := d.credsType
-		// we only support Bearer
-		req.Header.Set("Authorization", fmt.Sprintf("%s %s", credsType, d.creds))
-	}
-	// Use an HTTP client to send the request
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		return nil, err
+	u := fmt.Sprintf("%s/%s/resolve/%s/%s", d.endpoint, d.model, info.CommitHash, d.file)
+	client := d.opts.Client()
+	// the file is resolved at a commit, so resuming it always continues the same content
+	get := func(ctx context.Context, offset int64) (io.ReadCloser, error) {
+		req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
+		if err != nil {
+			return nil, err
+		}
+		// Set the authorization header
+		if d.creds != "" {
+			credsType := d.credsType
+			// we only support Bearer
+			req.Header.Set("Authorization", fmt.Sprintf("%s %s", credsType, d.creds))
+		}
+		if offset > 0 {
+			req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		}
+		// Use an HTTP client to send the request
+		resp, err := client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		if err := retry.CheckResponse(resp); err != nil {
+			return nil, err
+		}
+		if offset > 0 && resp.StatusCode != http.StatusPartialContent {
+			if err := retry.Skip(resp.Body, offset); err != nil {
+				return nil, err
+			}
+		}
+		return resp.Body, nil
 	}
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("failed to download %s: %s", u, resp.Status)
+	open := func(ctx context.Context) (io.ReadCloser, error) {
+		rc, err := get(ctx, 0)
+		if err != nil {
+			return nil, err
+		}
+		return d.opts.Resume(ctx, d.host(), rc, get), nil
 	}
-
-	return []download.KeyReader{{Key: key, Size: size, Reader: resp.Body}}, nil
+	return fn([]download.Blob{{Key: key, Size: size, Open: open}})
 }
@@ -1,16 +1,54 @@
 package download
 
 import (
+	"context"
 	"io"
+
+	"github.com/aifoundry-org/storage-manager/pkg/api"
 )
 
-// KeyReader represents a key and a reader. If the key is blank, then the receiving system may decide
-// how to calculate a unique key.
-type KeyReader struct {
-	Key    string
-	Size   int64
-	Reader io.ReadCloser
+// Blob a single blob of content. It is not read from its source until it is opened, so
+// nothing is held open while it waits to be written. If the key is blank, then the receiving
+// system may decide how to calculate a unique key.
+type Blob struct {
+	Key string
+	// Size in bytes, 0 or less if it is not known ahead of time
+	Size int64
+	// Open start reading the content; the caller must close it. Reading stops with an error
+	// once the context is canceled.
+	Open func(ctx context.Context) (io.ReadCloser, error)
 }
+
+// Downloader finds the blobs that make up a piece of content
 type Downloader interface {
-	Download() ([]KeyReader, error)
+	// Download find the blobs, and call fn with all of them, the root first. Blobs may only be
+	// opened until fn returns; anything the downloader held for blobs that were not opened is
+	// released afterwards. Canceling the context stops finding blobs, and reading any that
+	// were opened with it.
+	Download(ctx context.Context, fn func(blobs []Blob) error) error
+}
+
+// Refresher is implemented by downloaders whose content may change at the source, such as an
+// image tag, and that can tell whether it did without downloading it
+type Refresher interface {
+	// Current the key of the root of the content at the source now; empty if the content
+	// cannot change, such as an image pinned to a digest
+	Current(ctx context.Context) (string, error)
+}
+
+// Revalidator is implemented by downloaders whose content may change at the source, such as
+// a file at an http URL, and whose source can only tell whether it did given the validators it
+// sent with the content
+type Revalidator interface {
+	// Validators what the source sent with the content found by the last Download; nil if
+	// it was not downloaded
+	Validators() *api.Validators
+	// Modified whether the content at the source no longer matches the validators
+	Modified(ctx context.Context, v api.Validators) (bool, error)
+}
+
+// Verifier is implemented by downloaders that verify the signatures of the content they find
+type Verifier interface {
+	// Verification the signatures verified by the last Download, nil if it verified none
+	Verification() *api.Verification
 }
@@ -0,0 +1,140 @@
+package oci
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/aifoundry-org/storage-manager/pkg/download/retry"
+
+	"oras.land/oras-go/v2/registry/remote"
+	"oras.land/oras-go/v2/registry/remote/auth"
+)
+
+// maxTokenCaches how many token caches are kept before they are all dropped, so that rotated
+// credentials do not pile up
+const maxTokenCaches = 256
+
+var (
+	tokenCachesMu sync.Mutex
+	// tokenCaches the token caches, one for each registry host and set of credentials, so that
+	// pulls reuse the tokens of earlier ones, but never the tokens of other credentials
+	tokenCaches = map[string]auth.Cache{}
+)
+
+// tokenCache the token cache for the credentials at the registry host; the empty credential is
+// anonymous
+func tokenCache(host string, cred auth.Credential) auth.Cache {
+	h := sha256.New()
+	for _, s := range []string{host, cred.Username, cred.Password, cred.RefreshToken, cred.AccessToken} {
+		h.Write([]byte(s))
+		h.Write([]byte{0})
+	}
+	key := hex.EncodeToString(h.Sum(nil))
+
+	tokenCachesMu.Lock()
+	defer tokenCachesMu.Unlock()
+	if cache, ok := tokenCaches[key]; ok {
+		return cache
+	}
+	if len(tokenCaches) >= maxTokenCaches {
+		tokenCaches = map[string]auth.Cache{}
+	}
+	cache := auth.NewCache()
+	tokenCaches[key] = cache
+	return cache
+}
+
+// parseCredential the registry credential for credentials of a source. Bearer credentials are
+// an access token, which is sent as it is; RefreshToken credentials, also called IdentityToken,
+// are exchanged for access tokens, as docker does with identity tokens.
+func parseCredential(creds, credsType string) (auth.Credential, error) {
+	switch strings.ToLower(credsType) {
+	case "basic":
+		decodedCreds, err := base64.StdEncoding.DecodeString(creds)
+		if err != nil {
+			return auth.EmptyCredential, fmt.Errorf("could not decode basic credentials: %v", err)
+		}
+		username, password, ok := strings.Cut(string(decodedCreds), ":")
+		if !ok {
+			return auth.EmptyCredential, errors.New("invalid basic credentials: missing ':' between username and password")
+		}
+		return auth.Credential{Username: username, Password: password}, nil
+	case "bearer", "":
+		return auth.Credential{AccessToken: creds}, nil
+	case "refreshtoken", "identitytoken":
+		return auth.Credential{RefreshToken: creds}, nil
+	default:
+		return auth.EmptyCredential, fmt.Errorf("unsupported credentials type: %s", credsType)
+	}
+}
+
+var _ remote.Client = &registryClient{}
+
+// registryClient sends the requests to one registry host anonymously until the registry
+// refuses them, and with the credentials from then on. Public content so never needs
+// credentials, and credentials that are wrong for it, such as expired ones in a docker config,
+// do not break it.
+type registryClient struct {
+	anonymous *auth.Client
+	// authenticated nil if there are no credentials for the host
+	authenticated *auth.Client
+	// useCredentials set once the registry refused an anonymous request
+	useCredentials atomic.Bool
+}
+
+// newRegistryClient create a client for the registry host that sends requests with client,
+// and with the credential if ok
+func newRegistryClient(host string, client *http.Client, cred auth.Credential, ok bool) *registryClient {
+	c := &registryClient{
+		anonymous: &auth.Client{
+			Client: client,
+			Header: auth.DefaultClient.Header,
+			Cache:  tokenCache(host, auth.EmptyCredential),
+		},
+	}
+	if ok {
+		c.authenticated = &auth.Client{
+			Client: client,
+			Header: auth.DefaultClient.Header,
+			Cache:  tokenCache(host, cred),
+			// the client only ever talks to the one host, or to the token service it names
+			Credential: func(context.Context, string) (auth.Credential, error) {
+				return cred, nil
+			},
+		}
+	}
+	return c
+}
+
+// Do send the request, falling back to the credentials if the registry refuses it anonymously.
+// Downloads only send requests without a body, so they can always be sent again.
+func (c *registryClient) Do(req *http.Request) (*http.Response, error) {
+	if c.authenticated == nil {
+		return c.anonymous.Do(req)
+	}
+	if c.useCredentials.Load() {
+		return c.authenticated.Do(req)
+	}
+	resp, err := c.anonymous.Do(req)
+	switch {
+	case err != nil:
+		// the registry, or its token service, refused to authenticate anonymously
+		if code := retry.StatusCode(err); code != http.StatusUnauthorized && code != http.StatusForbidden {
+			return nil, err
+		}
+	case resp.StatusCode == http.StatusUnauthorized, resp.StatusCode == http.StatusForbidden:
+		resp.Body.Close()
+	default:
+		return resp, nil
+	}
+	c.useCredentials.Store(true)
+	return c.authenticated.Do(req)
+}
@@ -0,0 +1,87 @@
+package oci
+
+import (
+	"context"
+	"encoding/base64"
+	"net/http"
+	"testing"
+
+	"github.com/aifoundry-org/storage-manager/pkg/download"
+	"github.com/aifoundry-org/storage-manager/pkg/download/retry"
+)
+
+// basicCreds Basic credentials for the user and password
+func basicCreds(user, password string) string {
+	return base64.StdEncoding.EncodeToString([]byte(user + ":" + password))
+}
+
+// pull download the v1 image from the fake registry at host with the credentials
+func pull(t *testing.T, host, creds string) error {
+	t.Helper()
+	credsType := ""
+	if creds != "" {
+		credsType = "Basic"
+	}
+	d := newTestDownloader(t, host, ":v1", creds, credsType, download.Options{})
+	return d.Download(context.Background(), func([]download.Blob) error { return nil })
+}
+
+func TestAnonymousFirst(t *testing.T) {
+	r, host := newFakeRegistry(t)
+	r.pushImage(t, "v1", "weights")
+	// credentials that would not work, which a public registry never sees
+	if err := pull(t, host, basicCreds("alice", "expired")); err != nil {
+		t.Fatalf("pull: %v", err)
+	}
+	if r.authorized != 0 || len(r.tokenRequests) != 0 {
+		t.Errorf("public content was pulled with %d authorized requests and token requests %v, want none", r.authorized, r.tokenRequests)
+	}
+}
+
+func TestCredentialsAfterAnonymousDenied(t *testing.T) {
+	for _, anonymousTokens := range []bool{false, true} {
+		r, host := newFakeRegistry(t)
+		r.pushImage(t, "v1", "weights")
+		r.passwords = map[string]string{"alice": "secret"}
+		// the token service refuses anonymous requests itself, or gives them tokens that the
+		// registry refuses
+		r.anonymousTokens = anonymousTokens
+
+		err := pull(t, host, "")
+		if code := retry.StatusCode(err); code != http.StatusUnauthorized {
+			t.Errorf("anonymous tokens %v: pull without credentials = %v, want 401", anonymousTokens, err)
+		}
+		if err := pull(t, host, basicCreds("alice", "secret")); err != nil {
+			t.Fatalf("anonymous tokens %v: pull with credentials: %v", anonymousTokens, err)
+		}
+		if r.tokenRequests[""] == 0 || r.tokenRequests["alice"] != 1 {
+			t.Errorf("anonymous tokens %v: token requests %v, want anonymous ones and one for alice", anonymousTokens, r.tokenRequests)
+		}
+	}
+}
+
+func TestTokenCachePerCredential(t *testing.T) {
+	r, host := newFakeRegistry(t)
+	r.pushImage(t, "v1", "weights")
+	r.passwords = map[string]string{"alice": "secret", "bob": "secret"}
+
+	for i := 0; i < 2; i++ {
+		if err := pull(t, host, basicCreds("alice", "secret")); err != nil {
+			t.Fatalf("pull as alice: %v", err)
+		}
+	}
+	// later pulls reuse the token of earlier ones
+	if r.tokenRequests["alice"] != 1 {
+		t.Errorf("alice requested %d tokens for two pulls, want 1", r.tokenRequests["alice"])
+	}
+	// but never the tokens of other credentials
+	if err := pull(t, host, basicCreds("bob", "wrong")); retry.StatusCode(err) != http.StatusUnauthorized {
+		t.Errorf("pull with a wrong password = %v, want 401", err)
+	}
+	if err := pull(t, host, basicCreds("bob", "secret")); err != nil {
+		t.Fatalf("pull as bob: %v", err)
+	}
+	if r.tokenRequests["bob"] != 2 {
+		t.Errorf("bob requested %d tokens, want one for each set of credentials", r.tokenRequests["bob"])
+	}
+}
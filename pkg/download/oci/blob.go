@@ -7,79 +7,118 @@ import (
 	"fmt"
 	"io"
 
+	"github.com/aifoundry-org/storage-manager/pkg/download"
+	"github.com/aifoundry-org/storage-manager/pkg/download/retry"
+
 	dockermanifest "github.com/docker/distribution/manifest/manifestlist"
+	dockerschema2 "github.com/docker/distribution/manifest/schema2"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"oras.land/oras-go/v2/registry/remote"
 )
 
-// pullBlobAndList pulls down a blob based on the provided descriptor.
+// maxManifestSize the largest index or manifest that is read into memory to find its children
+const maxManifestSize = 4 << 20
+
+// isManifest whether the descriptor is for an index or manifest, which lists other blobs
+func isManifest(desc ocispec.Descriptor) bool {
+	switch desc.MediaType {
+	case dockermanifest.MediaTypeManifestList, ocispec.MediaTypeImageIndex,
+		dockerschema2.MediaTypeManifest, ocispec.MediaTypeImageManifest:
+		return true
+	}
+	return false
+}
+
+// isIndex whether the descriptor is for an index or manifest list, which lists manifests
+func isIndex(desc ocispec.Descriptor) bool {
+	return desc.MediaType == dockermanifest.MediaTypeManifestList || desc.MediaType == ocispec.MediaTypeImageIndex
+}
+
+// listBlob describes a blob based on the provided descriptor.
 // - if the descriptor is an index, it will parse the index and return a list of children descriptors.
 // - if the descriptor is a manifest, it will parse the manifest return the list of config and layers.
-func pullBlobAndList(desc ocispec.Descriptor, repo *remote.Repository) (io.ReadCloser, []ocispec.Descriptor, error) {
-	var (
-		rc       io.ReadCloser
-		children []ocispec.Descriptor
-	)
-	ctx := context.Background()
-	// get a readcloser for the content
-	blobRC, err := repo.Fetch(ctx, desc)
+// Indexes and manifests are small, and are read right away to find their children; anything
+// else is only fetched when the blob is opened.
+func listBlob(ctx context.Context, desc ocispec.Descriptor, repo *remote.Repository, opts download.Options) (download.Blob, []ocispec.Descriptor, error) {
+	blob := download.Blob{Key: desc.Digest.String(), Size: desc.Size}
+	if !isManifest(desc) {
+		fetch := func(ctx context.Context, offset int64) (io.ReadCloser, error) {
+			rc, err := repo.Fetch(ctx, desc)
+			if err != nil {
+				return nil, fmt.Errorf("could not fetch %s: %w", desc.Digest, err)
+			}
+			if offset == 0 {
+				return rc, nil
+			}
+			// registries that support ranges return content that can seek to the offset
+			if seeker, ok := rc.(io.Seeker); ok {
+				if _, err := seeker.Seek(offset, io.SeekStart); err != nil {
+					rc.Close()
+					return nil, fmt.Errorf("could not seek %s to offset %d: %w", desc.Digest, offset, err)
+				}
+				return rc, nil
+			}
+			if err := retry.Skip(rc, offset); err != nil {
+				return nil, err
+			}
+			return rc, nil
+		}
+		blob.Open = func(ctx context.Context) (io.ReadCloser, error) {
+			rc, err := fetch(ctx, 0)
+			if err != nil {
+				return nil, err
+			}
+			return opts.Resume(ctx, repo.Reference.Registry, rc, fetch), nil
+		}
+		return blob, nil, nil
+	}
+	if desc.Size > maxManifestSize {
+		return blob, nil, fmt.Errorf("manifest %s is too large: %d bytes", desc.Digest, desc.Size)
+	}
+	rc, err := repo.Fetch(ctx, desc)
 	if err != nil {
-		return nil, nil, fmt.Errorf("could not fetch content: %v", err)
+		return blob, nil, fmt.Errorf("could not fetch content: %w", err)
+	}
+	defer rc.Close()
+	b, err := io.ReadAll(io.LimitReader(rc, maxManifestSize))
+	if err != nil {
+		return blob, nil, fmt.Errorf("could not read content: %v", err)
+	}
+	blob.Open = func(context.Context) (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(b)), nil
 	}
 
-	// if it is an index or a manifest, parse it and get its children
+	var children []ocispec.Descriptor
 	switch desc.MediaType {
 	case dockermanifest.MediaTypeManifestList:
-		b, err := io.ReadAll(blobRC)
-		if err != nil {
-			return nil, nil, fmt.Errorf("could not read content: %v", err)
-		}
 		var list dockermanifest.ManifestList
 		if err := json.Unmarshal(b, &list); err != nil {
-			return nil, nil, fmt.Errorf("could not unmarshal list: %v", err)
+			return blob, nil, fmt.Errorf("could not unmarshal list: %v", err)
 		}
-		// add to the stuff to read
-		rc = io.NopCloser(bytes.NewReader(b))
-		manifests := list.Manifests
-		for _, m := range manifests {
+		for _, m := range list.Manifests {
 			b, err := json.Marshal(m)
 			if err != nil {
-				return nil, nil, fmt.Errorf("could not marshal manifest: %v", err)
+				return blob, nil, fmt.Errorf("could not marshal manifest: %v", err)
 			}
 			var child ocispec.Descriptor
 			if err := json.Unmarshal(b, &child); err != nil {
-				return nil, nil, fmt.Errorf("could not unmarshal manifest: %v", err)
+				return blob, nil, fmt.Errorf("could not unmarshal manifest: %v", err)
 			}
 			children = append(children, child)
-
 		}
 	case ocispec.MediaTypeImageIndex:
-		b, err := io.ReadAll(blobRC)
-		if err != nil {
-			return nil, nil, fmt.Errorf("could not read content: %v", err)
-		}
 		var index ocispec.Index
 		if err := json.Unmarshal(b, &index); err != nil {
-			return nil, nil, fmt.Errorf("could not unmarshal index: %v", err)
+			return blob, nil, fmt.Errorf("could not unmarshal index: %v", err)
 		}
-		// add to the stuff to read
-		rc = io.NopCloser(bytes.NewReader(b))
 		children = index.Manifests
-	case ocispec.MediaTypeImageManifest:
-		b, err := io.ReadAll(blobRC)
-		if err != nil {
-			return nil, nil, fmt.Errorf("could not read content: %v", err)
-		}
+	case ocispec.MediaTypeImageManifest, dockerschema2.MediaTypeManifest:
+		// a docker manifest has the same config and layers as an OCI one
 		var image ocispec.Manifest
 		if err := json.Unmarshal(b, &image); err != nil {
-			return nil, nil, fmt.Errorf("could not unmarshal image: %v", err)
+			return blob, nil, fmt.Errorf("could not unmarshal image: %v", err)
 		}
-		// add to the stuff to read
-		rc = io.NopCloser(bytes.NewReader(b))
-		children = image.Layers
-		children = append(children, image.Config)
-	default:
-		rc = blobRC
+		children = append(image.Layers, image.Config)
 	}
-	return rc, children, nil
+	return blob, children, nil
 }
@@ -2,89 +2,189 @@ package oci
 
 import (
 	"context"
-	"encoding/base64"
 	"fmt"
 	"net/url"
+	"slices"
 	"strings"
 
+	"github.com/aifoundry-org/storage-manager/pkg/api"
 	"github.com/aifoundry-org/storage-manager/pkg/download"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 
+	"oras.land/oras-go/v2/registry"
 	"oras.land/oras-go/v2/registry/remote"
 	"oras.land/oras-go/v2/registry/remote/auth"
 )
 
-var _ download.Downloader = &downloader{}
+var (
+	_ download.Downloader = &downloader{}
+	_ download.Refresher  = &downloader{}
+)
 
 type downloader struct {
-	repo      *remote.Repository
-	ref       string
-	creds     string
-	credsType string
+	// repos the repositories to try, in order: any mirrors, then the registry itself
+	repos []*remote.Repository
+	repo  *remote.Repository
+	ref   string
+	// pinned whether the reference is a digest, so that the content never changes
+	pinned bool
+	// cred the credentials of the source, for the registry itself; mirrors get their own from
+	// the credential store
+	cred    auth.Credential
+	hasCred bool
+	// selector which manifests of an index are pulled
+	selector selector
+	// verified whether the signatures of the content must be verified before it is cached
+	verified     bool
+	verification *api.Verification
+	opts         download.Options
 }
 
-func New(ref *url.URL, creds, credsType string) (*downloader, error) {
-	parts := strings.SplitN(ref.Path, ":", 2)
-	repoName := parts[0]
-	// trim leading / off repoName, just in case
-	repoName = strings.TrimLeft(repoName, "/")
-	refName := "latest"
-	if len(parts) == 2 {
-		refName = parts[1]
-	}
-	repo, err := remote.NewRepository(fmt.Sprintf("%s/%s", ref.Host, repoName))
+func New(ref *url.URL, creds, credsType string, opts download.Options) (*downloader, error) {
+	// the reference is a tag, a digest, or a tag and a digest, in which case the digest wins
+	parsed, err := registry.ParseReference(ref.Host + "/" + strings.TrimLeft(ref.Path, "/"))
 	if err != nil {
-		return nil, fmt.Errorf("could not create repository: %v", err)
+		return nil, fmt.Errorf("invalid reference %s: %v", ref, err)
+	}
+	if parsed.Reference == "" {
+		parsed.Reference = "latest"
+	}
+	var repos []*remote.Repository
+	for _, host := range append(opts.RegistryMirrors[ref.Host], ref.Host) {
+		repo, err := remote.NewRepository(fmt.Sprintf("%s/%s", host, parsed.Repository))
+		if err != nil {
+			return nil, fmt.Errorf("could not create repository: %v", err)
+		}
+		repo.PlainHTTP = slices.Contains(opts.RegistryInsecure, host)
+		repos = append(repos, repo)
+	}
+	sel, err := newSelector(opts)
+	if err != nil {
+		return nil, err
+	}
+	d := &downloader{
+		repos:    repos,
+		repo:     repos[len(repos)-1],
+		ref:      parsed.Reference,
+		pinned:   parsed.ValidateReferenceAsDigest() == nil,
+		selector: sel,
+		verified: opts.Verify.Applies(ref.String()),
+		opts:     opts,
 	}
 	if creds != "" {
-		authClient := auth.DefaultClient
-		authCreds := auth.Credential{}
-		credsType = strings.ToLower(credsType)
-		switch credsType {
-		case "basic":
-			decodedCreds, err := base64.StdEncoding.DecodeString(creds)
-			if err != nil {
-				return nil, fmt.Errorf("could not decode basic credentials: %v", err)
-			}
-			parts := strings.SplitN(string(decodedCreds), ":", 2)
-			if len(parts) != 2 {
-				return nil, fmt.Errorf("invalid basic credentials: %s", string(decodedCreds))
-			}
-			authCreds.Username = parts[0]
-			authCreds.Password = parts[1]
-		case "bearer":
-			authCreds.AccessToken = creds
-		default:
-			return nil, fmt.Errorf("unsupported credentials type: %s", credsType)
+		cred, err := parseCredential(creds, credsType)
+		if err != nil {
+			return nil, err
+		}
+		d.cred, d.hasCred = cred, true
+	}
+	return d, nil
+}
+
+// connect give each repository a client of its own, which retries failed requests and
+// authenticates to its host as needed
+func (d *downloader) connect(ctx context.Context) {
+	client := d.opts.Client()
+	for i, repo := range d.repos {
+		cred, ok := d.cred, d.hasCred
+		if i != len(d.repos)-1 {
+			cred, ok = d.mirrorCredential(ctx, repo)
+		}
+		repo.Client = newRegistryClient(repo.Reference.Registry, client, cred, ok)
+	}
+}
+
+// mirrorCredential the credentials for a mirror, from the credential store
+func (d *downloader) mirrorCredential(ctx context.Context, repo *remote.Repository) (auth.Credential, bool) {
+	if d.opts.Credentials == nil {
+		return auth.EmptyCredential, false
+	}
+	mirrorURL := fmt.Sprintf("oci://%s/%s", repo.Reference.Registry, repo.Reference.Repository)
+	found, ok, err := d.opts.Credentials.Lookup(ctx, mirrorURL)
+	if err != nil && d.opts.Logger != nil {
+		d.opts.Logger.Warnf("could not look up credentials for %s: %v", mirrorURL, err)
+	}
+	if !ok {
+		return auth.EmptyCredential, false
+	}
+	cred, err := parseCredential(found.Credentials, found.CredentialsType)
+	if err != nil {
+		if d.opts.Logger != nil {
+			d.opts.Logger.Warnf("invalid credentials for %s: %v", mirrorURL, err)
 		}
-		authClient.Credential = auth.StaticCredential(repo.Reference.Registry, authCreds)
+		return auth.EmptyCredential, false
+	}
+	return cred, true
+}
+
+// resolve the reference to the descriptor of the root, from the first repository that has
+// it, which is used for the rest of the download
+func (d *downloader) resolve(ctx context.Context) (ocispec.Descriptor, error) {
+	d.connect(ctx)
+	var (
+		descriptor ocispec.Descriptor
+		err        error
+	)
+	for _, repo := range d.repos {
+		descriptor, err = repo.Resolve(ctx, d.ref)
+		if err == nil {
+			d.repo = repo
+			return descriptor, nil
+		}
+	}
+	return descriptor, fmt.Errorf("could not resolve reference: %w", err)
+}
+
+// Current the key of the root the tag points to in the registry now, with a HEAD request
+// for the manifest. A reference pinned to a digest never changes, and is not looked up.
+func (d *downloader) Current(ctx context.Context) (string, error) {
+	if d.pinned {
+		return "", nil
 	}
-	return &downloader{repo: repo, ref: refName, creds: creds, credsType: credsType}, nil
+	descriptor, err := d.resolve(ctx)
+	if err != nil {
+		return "", err
+	}
+	return descriptor.Digest.String(), nil
 }
 
-func (d *downloader) Download() ([]download.KeyReader, error) {
-	var readers []download.KeyReader
-	ctx := context.Background()
-	// resolve the tag to get the descriptor
-	descriptor, err := d.repo.Resolve(ctx, d.ref)
+func (d *downloader) Download(ctx context.Context, fn func(blobs []download.Blob) error) error {
+	descriptor, err := d.resolve(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("could not resolve reference: %v", err)
+		return err
+	}
+	if d.verified {
+		if d.verification, err = d.verify(ctx, d.repo, descriptor); err != nil {
+			return err
+		}
 	}
 
 	// the root descriptor always is first
+	var blobs []download.Blob
 	children := []ocispec.Descriptor{descriptor}
-
+	seen := map[string]bool{}
 	for len(children) != 0 {
 		var newChildren []ocispec.Descriptor
 		for _, desc := range children {
-			rc, addChildren, err := pullBlobAndList(desc, d.repo)
+			// blobs shared by several manifests, such as a config, are only listed once
+			if seen[desc.Digest.String()] {
+				continue
+			}
+			seen[desc.Digest.String()] = true
+			blob, addChildren, err := listBlob(ctx, desc, d.repo, d.opts)
 			if err != nil {
-				return nil, fmt.Errorf("could not pull blob and list: %v", err)
+				return fmt.Errorf("could not list blob: %w", err)
+			}
+			// the index itself is kept, but only the manifests that were asked for
+			if isIndex(desc) {
+				if addChildren, err = d.selector.selectManifests(desc, addChildren); err != nil {
+					return err
+				}
 			}
-			readers = append(readers, download.KeyReader{Key: desc.Digest.String(), Size: desc.Size, Reader: rc})
+			blobs = append(blobs, blob)
 			newChildren = append(newChildren, addChildren...)
 		}
 		children = newChildren
 	}
-	return readers, nil
+	return fn(blobs)
 }
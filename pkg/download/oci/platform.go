@@ -0,0 +1,198 @@
+package oci
+
+import (
+	"fmt"
+	"runtime"
+	"runtime/debug"
+	"slices"
+	"strings"
+
+	"github.com/aifoundry-org/storage-manager/pkg/download"
+
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// allPlatforms the platform that selects every manifest of an index
+const allPlatforms = "all"
+
+// platform the os, architecture and variant of a manifest
+type platform struct {
+	OS           string
+	Architecture string
+	Variant      string
+}
+
+func (p platform) String() string {
+	if p.Variant == "" {
+		return p.OS + "/" + p.Architecture
+	}
+	return p.OS + "/" + p.Architecture + "/" + p.Variant
+}
+
+// hostPlatform the platform the storage manager runs on
+func hostPlatform() platform {
+	return normalize(platform{OS: runtime.GOOS, Architecture: runtime.GOARCH, Variant: hostVariant()})
+}
+
+// hostVariant the variant of the architecture the storage manager runs on: for arm, the
+// version it was built for, which is at most that of the host
+func hostVariant() string {
+	if runtime.GOARCH != "arm" {
+		return ""
+	}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range info.Settings {
+			// such as 7 or 7,hardfloat
+			if setting.Key == "GOARM" && setting.Value != "" {
+				return "v" + strings.SplitN(setting.Value, ",", 2)[0]
+			}
+		}
+	}
+	return "v7"
+}
+
+// SelectedPlatform the platform whose manifests of an index the options pull, as
+// os/arch[/variant], or all
+func SelectedPlatform(opts download.Options) string {
+	s, err := newSelector(opts)
+	if err != nil {
+		return opts.Platform
+	}
+	if s.all {
+		return allPlatforms
+	}
+	return s.platform.String()
+}
+
+// parsePlatform parse a platform given as os/arch[/variant], such as linux/arm64/v8
+func parsePlatform(s string) (platform, error) {
+	parts := strings.Split(strings.ToLower(s), "/")
+	if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || parts[1] == "" {
+		return platform{}, fmt.Errorf("invalid platform %s, must be os/arch[/variant]", s)
+	}
+	p := platform{OS: parts[0], Architecture: parts[1]}
+	if len(parts) == 3 {
+		p.Variant = parts[2]
+	}
+	return normalize(p), nil
+}
+
+// normalize use the names of architectures and variants that images use, e.g. amd64 for
+// x86_64; arm64 is v8 unless it says otherwise, which is left out
+func normalize(p platform) platform {
+	switch p.Architecture {
+	case "x86_64", "x86-64":
+		p.Architecture = "amd64"
+	case "aarch64":
+		p.Architecture = "arm64"
+	case "armhf":
+		p.Architecture, p.Variant = "arm", "v7"
+	case "armel":
+		p.Architecture, p.Variant = "arm", "v6"
+	}
+	if p.Architecture == "arm64" && p.Variant == "v8" {
+		p.Variant = ""
+	}
+	return p
+}
+
+// armVariants the variants of arm, each of which runs those after it
+var armVariants = []string{"v8", "v7", "v6", "v5"}
+
+// rank how well a manifest for spec runs on the platform, lower being better, or false if it
+// does not. Without a variant, the platform runs any variant of its architecture equally; an
+// arm platform runs its own variant best, and older ones after it.
+func (p platform) rank(spec *ocispec.Platform) (int, bool) {
+	other := normalize(platform{OS: spec.OS, Architecture: spec.Architecture, Variant: spec.Variant})
+	if p.OS != other.OS || p.Architecture != other.Architecture {
+		return 0, false
+	}
+	if p.Variant == "" || p.Variant == other.Variant {
+		return 0, true
+	}
+	if p.Architecture != "arm" {
+		return 0, false
+	}
+	i := slices.Index(armVariants, p.Variant)
+	if i < 0 {
+		return 0, false
+	}
+	if other.Variant == "" {
+		// an arm manifest without a variant runs anywhere, but is the last choice
+		return len(armVariants), true
+	}
+	if j := slices.Index(armVariants[i:], other.Variant); j >= 0 {
+		return j, true
+	}
+	return 0, false
+}
+
+// selector which manifests of an index are pulled
+type selector struct {
+	// all every platform
+	all          bool
+	platform     platform
+	artifactType string
+}
+
+// newSelector the selector for the platform and artifact type of the options
+func newSelector(opts download.Options) (selector, error) {
+	s := selector{artifactType: opts.ArtifactType}
+	switch opts.Platform {
+	case allPlatforms:
+		s.all = true
+	case "":
+		s.platform = hostPlatform()
+	default:
+		p, err := parsePlatform(opts.Platform)
+		if err != nil {
+			return s, err
+		}
+		s.platform = p
+	}
+	return s, nil
+}
+
+func (s selector) String() string {
+	desc := allPlatforms + " platforms"
+	if !s.all {
+		desc = "platform " + s.platform.String()
+	}
+	if s.artifactType != "" {
+		desc += " and artifact type " + s.artifactType
+	}
+	return desc
+}
+
+// selectManifests the manifests of the index to pull: those of the artifact type, if there
+// is one, and of those with a platform, only the one that runs best on the platform, the first
+// of them if several run as well. Manifests without a platform, such as those of artifacts,
+// are always kept.
+func (s selector) selectManifests(index ocispec.Descriptor, manifests []ocispec.Descriptor) ([]ocispec.Descriptor, error) {
+	var (
+		selected []ocispec.Descriptor
+		best     = -1
+		bestRank int
+	)
+	for _, m := range manifests {
+		if s.artifactType != "" && m.ArtifactType != s.artifactType && m.MediaType != s.artifactType {
+			continue
+		}
+		if m.Platform != nil && !s.all {
+			rank, ok := s.platform.rank(m.Platform)
+			if !ok || (best >= 0 && rank >= bestRank) {
+				continue
+			}
+			if best >= 0 {
+				// replace the manifest that ran less well
+				selected = slices.Delete(selected, best, best+1)
+			}
+			best, bestRank = len(selected), rank
+		}
+		selected = append(selected, m)
+	}
+	if len(selected) == 0 && len(manifests) != 0 {
+		return nil, &download.NoMatchingManifestError{Index: index.Digest.String(), Selection: s.String()}
+	}
+	return selected, nil
+}
@@ -0,0 +1,158 @@
+package oci
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+
+	"github.com/aifoundry-org/storage-manager/pkg/download"
+
+	dockermanifest "github.com/docker/distribution/manifest/manifestlist"
+	dockerschema2 "github.com/docker/distribution/manifest/schema2"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// manifestFor a manifest descriptor for the platform, given as os/arch[/variant], and artifact
+// type
+func manifestFor(t *testing.T, name, plat, artifactType string) ocispec.Descriptor {
+	t.Helper()
+	desc := ocispec.Descriptor{MediaType: ocispec.MediaTypeImageManifest, ArtifactType: artifactType, Annotations: map[string]string{"name": name}}
+	if plat != "" {
+		p, err := parsePlatform(plat)
+		if err != nil {
+			t.Fatalf("parse platform: %v", err)
+		}
+		desc.Platform = &ocispec.Platform{OS: p.OS, Architecture: p.Architecture, Variant: p.Variant}
+	}
+	return desc
+}
+
+func TestSelectManifests(t *testing.T) {
+	manifests := []ocispec.Descriptor{
+		manifestFor(t, "amd64", "linux/amd64", ""),
+		manifestFor(t, "arm-v5", "linux/arm/v5", ""),
+		manifestFor(t, "arm-v6", "linux/arm/v6", ""),
+		manifestFor(t, "arm-v7", "linux/arm/v7", ""),
+		manifestFor(t, "arm64", "linux/arm64/v8", ""),
+		manifestFor(t, "windows", "windows/amd64", ""),
+		manifestFor(t, "model", "", "application/vnd.example.model"),
+		manifestFor(t, "model-amd64", "linux/amd64", "application/vnd.example.model"),
+	}
+	tests := []struct {
+		platform     string
+		artifactType string
+		want         []string
+	}{
+		{"linux/amd64", "", []string{"amd64", "model"}},
+		{"linux/x86_64", "", []string{"amd64", "model"}},
+		{"linux/arm64", "", []string{"arm64", "model"}},
+		{"linux/aarch64/v8", "", []string{"arm64", "model"}},
+		// an exact variant wins wherever it is
+		{"linux/arm/v7", "", []string{"arm-v7", "model"}},
+		{"linux/armhf", "", []string{"arm-v7", "model"}},
+		// then the newest that runs
+		{"linux/arm/v8", "", []string{"arm-v7", "model"}},
+		{"linux/arm/v6", "", []string{"arm-v6", "model"}},
+		// without a variant, the first of any
+		{"linux/arm", "", []string{"arm-v5", "model"}},
+		{"windows/amd64", "", []string{"windows", "model"}},
+		{"all", "", []string{"amd64", "arm-v5", "arm-v6", "arm-v7", "arm64", "windows", "model", "model-amd64"}},
+		{"linux/amd64", "application/vnd.example.model", []string{"model", "model-amd64"}},
+		{"linux/arm64", "application/vnd.example.model", []string{"model"}},
+		{"all", ocispec.MediaTypeImageManifest, []string{"amd64", "arm-v5", "arm-v6", "arm-v7", "arm64", "windows", "model", "model-amd64"}},
+	}
+	for _, tt := range tests {
+		s, err := newSelector(download.Options{Platform: tt.platform, ArtifactType: tt.artifactType})
+		if err != nil {
+			t.Fatalf("new selector for %s: %v", tt.platform, err)
+		}
+		selected, err := s.selectManifests(ocispec.Descriptor{}, manifests)
+		if err != nil {
+			t.Fatalf("select for %s %s: %v", tt.platform, tt.artifactType, err)
+		}
+		var got []string
+		for _, m := range selected {
+			got = append(got, m.Annotations["name"])
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("select for %s %s = %v, want %v", tt.platform, tt.artifactType, got, tt.want)
+		}
+	}
+}
+
+func TestSelectManifestsNoMatch(t *testing.T) {
+	s, err := newSelector(download.Options{Platform: "linux/riscv64"})
+	if err != nil {
+		t.Fatalf("new selector: %v", err)
+	}
+	manifests := []ocispec.Descriptor{manifestFor(t, "amd64", "linux/amd64", ""), manifestFor(t, "arm-v7", "linux/arm/v7", "")}
+	_, err = s.selectManifests(ocispec.Descriptor{}, manifests)
+	var noMatch *download.NoMatchingManifestError
+	if !errors.As(err, &noMatch) {
+		t.Errorf("select = %v, want a NoMatchingManifestError", err)
+	}
+	// an arm v6 host cannot run v7
+	s, _ = newSelector(download.Options{Platform: "linux/arm/v6"})
+	if _, err := s.selectManifests(ocispec.Descriptor{}, manifests); !errors.As(err, &noMatch) {
+		t.Errorf("select for linux/arm/v6 = %v, want a NoMatchingManifestError", err)
+	}
+}
+
+func TestSelectedPlatform(t *testing.T) {
+	for platform, want := range map[string]string{
+		"":               hostPlatform().String(),
+		"all":            "all",
+		"linux/x86_64":   "linux/amd64",
+		"Linux/ARM64/v8": "linux/arm64",
+		"linux/arm/v6":   "linux/arm/v6",
+		"not a platform": "not a platform",
+		"linux/armhf":    "linux/arm/v7",
+	} {
+		if got := SelectedPlatform(download.Options{Platform: platform}); got != want {
+			t.Errorf("SelectedPlatform(%q) = %q, want %q", platform, got, want)
+		}
+	}
+}
+
+func TestDownloadDockerManifestList(t *testing.T) {
+	r, host := newFakeRegistry(t)
+	images := map[string][]ocispec.Descriptor{}
+	list := dockermanifest.ManifestList{}
+	list.SchemaVersion = 2
+	list.MediaType = dockermanifest.MediaTypeManifestList
+	for _, arch := range []string{"amd64", "arm64"} {
+		config := r.pushBlob(dockerschema2.MediaTypeImageConfig, []byte(`{"architecture":"`+arch+`","os":"linux"}`))
+		layer := r.pushBlob(dockerschema2.MediaTypeLayer, []byte("layer for "+arch))
+		m := ocispec.Manifest{MediaType: dockerschema2.MediaTypeManifest, Config: config, Layers: []ocispec.Descriptor{layer}}
+		m.SchemaVersion = 2
+		desc := r.pushManifest(t, dockerschema2.MediaTypeManifest, m, "")
+		images[arch] = []ocispec.Descriptor{desc, config, layer}
+		entry := dockermanifest.ManifestDescriptor{Platform: dockermanifest.PlatformSpec{OS: "linux", Architecture: arch}}
+		entry.MediaType, entry.Digest, entry.Size = desc.MediaType, desc.Digest, desc.Size
+		list.Manifests = append(list.Manifests, entry)
+	}
+	index := r.pushManifest(t, dockermanifest.MediaTypeManifestList, list, "v1")
+
+	d := newTestDownloader(t, host, ":v1", "", "", download.Options{Platform: "linux/arm64"})
+	var keys []string
+	err := d.Download(context.Background(), func(blobs []download.Blob) error {
+		for _, b := range blobs {
+			keys = append(keys, b.Key)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("download: %v", err)
+	}
+	// the list, and the docker manifest for the platform with its config and layers
+	want := []string{index.Digest.String()}
+	for _, desc := range images["arm64"] {
+		want = append(want, desc.Digest.String())
+	}
+	slices.Sort(keys)
+	slices.Sort(want)
+	if !slices.Equal(keys, want) {
+		t.Errorf("downloaded %v, want %v", keys, want)
+	}
+}
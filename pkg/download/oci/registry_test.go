@@ -0,0 +1,248 @@
+package oci
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aifoundry-org/storage-manager/pkg/download"
+
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// fakeRepository the one repository of the fake registry
+const fakeRepository = "models/model"
+
+// fakeRegistry an in-process OCI registry for a single repository, with the parts of the
+// distribution API that pulls use: manifests by tag or digest, blobs, and referrers
+type fakeRegistry struct {
+	mu        sync.Mutex
+	manifests map[digest.Digest]ocispec.Descriptor
+	blobs     map[digest.Digest][]byte
+	tags      map[string]digest.Digest
+	// noReferrers whether the referrers API is missing, as on older registries
+	noReferrers bool
+
+	// url the base URL of the registry, for its token service
+	url string
+	// passwords the users that may pull, with their passwords; none for a public registry
+	passwords map[string]string
+	// anonymousTokens whether the token service gives tokens to anonymous requests, which
+	// the registry then refuses, rather than refusing them itself
+	anonymousTokens bool
+	// tokens the users the tokens were given to
+	tokens map[string]string
+	// tokenRequests the requests for tokens, by user, empty for anonymous ones
+	tokenRequests map[string]int
+	// authorized the requests for content sent with an Authorization header
+	authorized int
+}
+
+// newFakeRegistry start a fake registry, returning it and its host
+func newFakeRegistry(t *testing.T) (*fakeRegistry, string) {
+	r := &fakeRegistry{
+		manifests:     map[digest.Digest]ocispec.Descriptor{},
+		blobs:         map[digest.Digest][]byte{},
+		tags:          map[string]digest.Digest{},
+		tokens:        map[string]string{},
+		tokenRequests: map[string]int{},
+	}
+	srv := httptest.NewServer(r)
+	t.Cleanup(srv.Close)
+	r.url = srv.URL
+	u, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatalf("parse server url: %v", err)
+	}
+	return r, u.Host
+}
+
+// pushBlob store a blob, returning its descriptor
+func (r *fakeRegistry) pushBlob(mediaType string, b []byte) ocispec.Descriptor {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	d := digest.FromBytes(b)
+	r.blobs[d] = b
+	return ocispec.Descriptor{MediaType: mediaType, Digest: d, Size: int64(len(b))}
+}
+
+// pushManifest store a manifest or index, tagged with tag if it is not empty, returning its
+// descriptor
+func (r *fakeRegistry) pushManifest(t *testing.T, mediaType string, v any, tag string) ocispec.Descriptor {
+	t.Helper()
+	b, err := json.Marshal(v)
+	if err != nil {
+		t.Fatalf("marshal manifest: %v", err)
+	}
+	desc := r.pushBlob(mediaType, b)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.manifests[desc.Digest] = desc
+	if tag != "" {
+		r.tags[tag] = desc.Digest
+	}
+	return desc
+}
+
+// pushImage store an image of a config and a layer, tagged with tag, returning its descriptor
+func (r *fakeRegistry) pushImage(t *testing.T, tag string, layer string) ocispec.Descriptor {
+	t.Helper()
+	m := ocispec.Manifest{
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    r.pushBlob(ocispec.MediaTypeImageConfig, []byte(`{"architecture":"amd64","os":"linux"}`)),
+		Layers:    []ocispec.Descriptor{r.pushBlob(ocispec.MediaTypeImageLayer, []byte(layer))},
+	}
+	m.SchemaVersion = 2
+	return r.pushManifest(t, ocispec.MediaTypeImageManifest, m, tag)
+}
+
+func (r *fakeRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.URL.Path == "/token" {
+		r.serveToken(w, req)
+		return
+	}
+	if !r.authorize(w, req) {
+		return
+	}
+	if req.URL.Path == "/v2/" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	prefix := "/v2/" + fakeRepository + "/"
+	if !strings.HasPrefix(req.URL.Path, prefix) {
+		http.NotFound(w, req)
+		return
+	}
+	kind, ref, ok := strings.Cut(strings.TrimPrefix(req.URL.Path, prefix), "/")
+	if !ok || (req.Method != http.MethodGet && req.Method != http.MethodHead) {
+		http.NotFound(w, req)
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	switch kind {
+	case "manifests":
+		d, ok := r.tags[ref]
+		if !ok {
+			d = digest.Digest(ref)
+		}
+		desc, ok := r.manifests[d]
+		if !ok {
+			http.NotFound(w, req)
+			return
+		}
+		r.serve(w, req, desc.MediaType, r.blobs[d])
+	case "blobs":
+		b, ok := r.blobs[digest.Digest(ref)]
+		if !ok {
+			http.NotFound(w, req)
+			return
+		}
+		r.serve(w, req, "application/octet-stream", b)
+	case "referrers":
+		if r.noReferrers {
+			http.NotFound(w, req)
+			return
+		}
+		index := ocispec.Index{MediaType: ocispec.MediaTypeImageIndex, Manifests: []ocispec.Descriptor{}}
+		index.SchemaVersion = 2
+		for d, desc := range r.manifests {
+			var m ocispec.Manifest
+			if err := json.Unmarshal(r.blobs[d], &m); err != nil || m.Subject == nil || m.Subject.Digest.String() != ref {
+				continue
+			}
+			desc.ArtifactType, desc.Annotations = m.ArtifactType, m.Annotations
+			if desc.ArtifactType == "" {
+				desc.ArtifactType = m.Config.MediaType
+			}
+			index.Manifests = append(index.Manifests, desc)
+		}
+		b, _ := json.Marshal(index)
+		r.serve(w, req, ocispec.MediaTypeImageIndex, b)
+	default:
+		http.NotFound(w, req)
+	}
+}
+
+// authorize check the token of a request if the registry is not public, asking for one if it
+// has none, returning whether the request may go on
+func (r *fakeRegistry) authorize(w http.ResponseWriter, req *http.Request) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if req.Header.Get("Authorization") != "" {
+		r.authorized++
+	}
+	if len(r.passwords) == 0 {
+		return true
+	}
+	token, ok := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+	if user := r.tokens[token]; ok && user != "" {
+		return true
+	}
+	w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="fake",scope="repository:%s:pull"`, r.url, fakeRepository))
+	writeRegistryError(w, http.StatusUnauthorized, "UNAUTHORIZED", "authentication required")
+	return false
+}
+
+// serveToken give a token to a user with the right password, and to anonymous requests if
+// the registry allows it
+func (r *fakeRegistry) serveToken(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	user, password, ok := req.BasicAuth()
+	r.tokenRequests[user]++
+	switch {
+	case !ok && r.anonymousTokens:
+		// a token that allows nothing
+		user = ""
+	case !ok || r.passwords[user] == "" || r.passwords[user] != password:
+		writeRegistryError(w, http.StatusUnauthorized, "UNAUTHORIZED", "access denied")
+		return
+	}
+	token := fmt.Sprintf("token-%d", len(r.tokens))
+	r.tokens[token] = user
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]string{"token": token})
+}
+
+// writeRegistryError write an error response of the distribution API
+func writeRegistryError(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(map[string]any{"errors": []map[string]string{{"code": code, "message": message}}})
+}
+
+// serve write content of the media type, with its digest
+func (r *fakeRegistry) serve(w http.ResponseWriter, req *http.Request, mediaType string, b []byte) {
+	w.Header().Set("Content-Type", mediaType)
+	w.Header().Set("Docker-Content-Digest", digest.FromBytes(b).String())
+	w.Header().Set("Content-Length", strconv.Itoa(len(b)))
+	http.ServeContent(w, req, "", time.Time{}, bytes.NewReader(b))
+}
+
+// newTestDownloader a downloader for the reference in the fake registry at host, with the
+// credentials if they are not empty
+func newTestDownloader(t *testing.T, host, ref, creds, credsType string, opts download.Options) *downloader {
+	t.Helper()
+	opts.RegistryInsecure = append(opts.RegistryInsecure, host)
+	// fail fast rather than wait out the backoff of the default policy
+	opts.Retry.MaxAttempts = 1
+	u, err := url.Parse("oci://" + host + "/" + fakeRepository + ref)
+	if err != nil {
+		t.Fatalf("parse reference: %v", err)
+	}
+	d, err := New(u, creds, credsType, opts)
+	if err != nil {
+		t.Fatalf("new downloader: %v", err)
+	}
+	return d
+}
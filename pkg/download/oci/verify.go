@@ -0,0 +1,139 @@
+package oci
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/aifoundry-org/storage-manager/pkg/api"
+	"github.com/aifoundry-org/storage-manager/pkg/download"
+	"github.com/aifoundry-org/storage-manager/pkg/verify"
+
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"oras.land/oras-go/v2/content"
+	"oras.land/oras-go/v2/registry/remote"
+)
+
+var _ download.Verifier = &downloader{}
+
+// Verification the signatures verified by the last Download
+func (d *downloader) Verification() *api.Verification {
+	return d.verification
+}
+
+// verify check that the root is signed by one of the keys of the policy, before any of the
+// content is cached. Signatures are found as referrers, through the referrers API or its tag
+// schema, and under the tag cosign uses for registries without referrers.
+func (d *downloader) verify(ctx context.Context, repo *remote.Repository, root ocispec.Descriptor) (*api.Verification, error) {
+	keys, err := d.opts.Verify.Keys()
+	if err != nil {
+		return nil, err
+	}
+	var (
+		signatures []api.Signature
+		reasons    []string
+	)
+	check := func(desc ocispec.Descriptor, format string, fn func(context.Context, *remote.Repository, ocispec.Descriptor, ocispec.Descriptor, []verify.Key) (verify.Key, error)) {
+		key, err := fn(ctx, repo, desc, root, keys)
+		if err != nil {
+			reasons = append(reasons, fmt.Sprintf("%s signature %s: %v", format, desc.Digest, err))
+			return
+		}
+		signatures = append(signatures, api.Signature{Format: format, Digest: desc.Digest.String(), Key: key.Name})
+	}
+	err = repo.Referrers(ctx, root, "", func(referrers []ocispec.Descriptor) error {
+		for _, referrer := range referrers {
+			switch referrer.ArtifactType {
+			case verify.CosignArtifactType:
+				check(referrer, "cosign", verifyCosign)
+			case verify.NotationArtifactType:
+				check(referrer, "notation", verifyNotation)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		reasons = append(reasons, fmt.Sprintf("could not list referrers: %v", err))
+	}
+	if desc, err := repo.Resolve(ctx, verify.CosignTag(root.Digest)); err == nil {
+		check(desc, "cosign", verifyCosign)
+	}
+	if len(signatures) == 0 {
+		return nil, &verify.Error{Digest: root.Digest.String(), Reasons: reasons}
+	}
+	return &api.Verification{Digest: root.Digest.String(), Signatures: signatures, VerifiedAt: time.Now()}, nil
+}
+
+// verifyCosign verify a cosign signature manifest, any of whose payloads may be signed by
+// one of the keys
+func verifyCosign(ctx context.Context, repo *remote.Repository, desc, subject ocispec.Descriptor, keys []verify.Key) (verify.Key, error) {
+	manifest, err := fetchManifest(ctx, repo, desc)
+	if err != nil {
+		return verify.Key{}, err
+	}
+	err = fmt.Errorf("no %s layer", verify.CosignPayloadMediaType)
+	for _, layer := range manifest.Layers {
+		signature, ok := layer.Annotations[verify.CosignSignatureAnnotation]
+		if layer.MediaType != verify.CosignPayloadMediaType || !ok {
+			continue
+		}
+		var payload []byte
+		if payload, err = fetchSmall(ctx, repo, layer); err != nil {
+			continue
+		}
+		var key verify.Key
+		if key, err = verify.VerifyCosign(payload, signature, subject.Digest, keys); err == nil {
+			return key, nil
+		}
+	}
+	return verify.Key{}, err
+}
+
+// verifyNotation verify a notation signature manifest, whose only layer is the envelope
+func verifyNotation(ctx context.Context, repo *remote.Repository, desc, subject ocispec.Descriptor, keys []verify.Key) (verify.Key, error) {
+	manifest, err := fetchManifest(ctx, repo, desc)
+	if err != nil {
+		return verify.Key{}, err
+	}
+	if len(manifest.Layers) != 1 {
+		return verify.Key{}, fmt.Errorf("notation signature has %d layers, not 1", len(manifest.Layers))
+	}
+	envelope, err := fetchSmall(ctx, repo, manifest.Layers[0])
+	if err != nil {
+		return verify.Key{}, err
+	}
+	return verify.VerifyNotation(envelope, manifest.Layers[0].MediaType, subject, keys, time.Now())
+}
+
+// fetchManifest fetch and parse the manifest of a signature
+func fetchManifest(ctx context.Context, repo *remote.Repository, desc ocispec.Descriptor) (ocispec.Manifest, error) {
+	var manifest ocispec.Manifest
+	b, err := fetchSmall(ctx, repo, desc)
+	if err != nil {
+		return manifest, err
+	}
+	if err := json.Unmarshal(b, &manifest); err != nil {
+		return manifest, fmt.Errorf("could not unmarshal manifest: %v", err)
+	}
+	return manifest, nil
+}
+
+// fetchSmall fetch a blob or manifest of a signature, which is read into memory, checking its
+// digest
+func fetchSmall(ctx context.Context, repo *remote.Repository, desc ocispec.Descriptor) ([]byte, error) {
+	if desc.Size > maxManifestSize {
+		return nil, fmt.Errorf("%s is too large: %d bytes", desc.Digest, desc.Size)
+	}
+	rc, err := repo.Fetch(ctx, desc)
+	if err != nil {
+		return nil, fmt.Errorf("could not fetch %s: %w", desc.Digest, err)
+	}
+	defer rc.Close()
+	b, err := content.ReadAll(io.LimitReader(rc, desc.Size), desc)
+	if err != nil {
+		return nil, fmt.Errorf("could not read %s: %v", desc.Digest, err)
+	}
+	return b, nil
+}
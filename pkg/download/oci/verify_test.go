@@ -0,0 +1,255 @@
+package oci
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aifoundry-org/storage-manager/pkg/download"
+	"github.com/aifoundry-org/storage-manager/pkg/verify"
+
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// signer a key that signs content, with a self-signed certificate for notation
+type signer struct {
+	key  *ecdsa.PrivateKey
+	cert []byte
+}
+
+// newSigner generate a signing key and its certificate
+func newSigner(t *testing.T) *signer {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "signer"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	cert, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("create certificate: %v", err)
+	}
+	return &signer{key: key, cert: cert}
+}
+
+// publicKeyFile write the public key of the signer as a PEM file, returning its path
+func (s *signer) publicKeyFile(t *testing.T) string {
+	t.Helper()
+	der, err := x509.MarshalPKIXPublicKey(&s.key.PublicKey)
+	if err != nil {
+		t.Fatalf("marshal public key: %v", err)
+	}
+	path := filepath.Join(t.TempDir(), "signer.pub")
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0644); err != nil {
+		t.Fatalf("write public key: %v", err)
+	}
+	return path
+}
+
+// cosignPayload a simple signing payload for the subject
+func cosignPayload(subject digest.Digest) []byte {
+	return []byte(`{"critical":{"identity":{"docker-reference":"registry.example.com/models/model"},"image":{"docker-manifest-digest":"` +
+		subject.String() + `"},"type":"cosign container image signature"},"optional":null}`)
+}
+
+// signCosign the cosign signature of the payload, base64-encoded as in its annotation
+func (s *signer) signCosign(t *testing.T, payload []byte) string {
+	t.Helper()
+	hash := sha256.Sum256(payload)
+	sig, err := ecdsa.SignASN1(rand.Reader, s.key, hash[:])
+	if err != nil {
+		t.Fatalf("sign: %v", err)
+	}
+	return base64.StdEncoding.EncodeToString(sig)
+}
+
+// pushCosign store a cosign signature manifest of the payload with the signature, as a
+// referrer of subject if it is not nil, tagged with tag if it is not empty
+func (r *fakeRegistry) pushCosign(t *testing.T, payload []byte, signature string, subject *ocispec.Descriptor, tag string) {
+	t.Helper()
+	layer := r.pushBlob(verify.CosignPayloadMediaType, payload)
+	layer.Annotations = map[string]string{verify.CosignSignatureAnnotation: signature}
+	m := ocispec.Manifest{
+		MediaType:    ocispec.MediaTypeImageManifest,
+		ArtifactType: verify.CosignArtifactType,
+		Config:       r.pushBlob(ocispec.MediaTypeEmptyJSON, []byte("{}")),
+		Layers:       []ocispec.Descriptor{layer},
+		Subject:      subject,
+	}
+	m.SchemaVersion = 2
+	r.pushManifest(t, ocispec.MediaTypeImageManifest, m, tag)
+}
+
+// notationEnvelope a JWS notation signature envelope for target, signed with the algorithm;
+// tamper changes the payload after it is signed
+func (s *signer) notationEnvelope(t *testing.T, target ocispec.Descriptor, alg string, tamper bool) []byte {
+	t.Helper()
+	protected, err := json.Marshal(map[string]any{
+		"alg":                   alg,
+		"cty":                   "application/vnd.cncf.notary.payload.v1+json",
+		"io.cncf.notary.expiry": time.Now().Add(time.Hour).Format(time.RFC3339),
+	})
+	if err != nil {
+		t.Fatalf("marshal protected header: %v", err)
+	}
+	payload, err := json.Marshal(map[string]any{"targetArtifact": target})
+	if err != nil {
+		t.Fatalf("marshal payload: %v", err)
+	}
+	enc := base64.RawURLEncoding
+	signed := enc.EncodeToString(protected) + "." + enc.EncodeToString(payload)
+	hash := sha256.Sum256([]byte(signed))
+	r, sv, err := ecdsa.Sign(rand.Reader, s.key, hash[:])
+	if err != nil {
+		t.Fatalf("sign: %v", err)
+	}
+	sig := make([]byte, 64)
+	r.FillBytes(sig[:32])
+	sv.FillBytes(sig[32:])
+	if tamper {
+		target.Annotations = map[string]string{"tampered": "true"}
+		if payload, err = json.Marshal(map[string]any{"targetArtifact": target}); err != nil {
+			t.Fatalf("marshal payload: %v", err)
+		}
+	}
+	env, err := json.Marshal(map[string]any{
+		"payload":   enc.EncodeToString(payload),
+		"protected": enc.EncodeToString(protected),
+		"header":    map[string]any{"x5c": []string{base64.StdEncoding.EncodeToString(s.cert)}},
+		"signature": enc.EncodeToString(sig),
+	})
+	if err != nil {
+		t.Fatalf("marshal envelope: %v", err)
+	}
+	return env
+}
+
+// pushNotation store a notation signature manifest of the envelope as a referrer of subject
+func (r *fakeRegistry) pushNotation(t *testing.T, envelope []byte, subject ocispec.Descriptor) {
+	t.Helper()
+	m := ocispec.Manifest{
+		MediaType:    ocispec.MediaTypeImageManifest,
+		ArtifactType: verify.NotationArtifactType,
+		Config:       r.pushBlob(ocispec.MediaTypeEmptyJSON, []byte("{}")),
+		Layers:       []ocispec.Descriptor{r.pushBlob(verify.NotationJWSMediaType, envelope)},
+		Subject:      &subject,
+	}
+	m.SchemaVersion = 2
+	r.pushManifest(t, ocispec.MediaTypeImageManifest, m, "")
+}
+
+func TestVerify(t *testing.T) {
+	signing, other := newSigner(t), newSigner(t)
+	tests := []struct {
+		name string
+		// sign attaches the signatures of the image root, or of other content, to the registry
+		sign func(t *testing.T, r *fakeRegistry, root, unrelated ocispec.Descriptor)
+		// reason part of why verification failed; empty if it succeeds
+		reason string
+	}{
+		{"cosign", func(t *testing.T, r *fakeRegistry, root, _ ocispec.Descriptor) {
+			payload := cosignPayload(root.Digest)
+			r.pushCosign(t, payload, signing.signCosign(t, payload), &root, "")
+		}, ""},
+		{"cosign tag", func(t *testing.T, r *fakeRegistry, root, _ ocispec.Descriptor) {
+			r.noReferrers = true
+			payload := cosignPayload(root.Digest)
+			r.pushCosign(t, payload, signing.signCosign(t, payload), nil, verify.CosignTag(root.Digest))
+		}, ""},
+		{"notation", func(t *testing.T, r *fakeRegistry, root, _ ocispec.Descriptor) {
+			r.pushNotation(t, signing.notationEnvelope(t, root, "ES256", false), root)
+		}, ""},
+		{"cosign wrong key", func(t *testing.T, r *fakeRegistry, root, _ ocispec.Descriptor) {
+			payload := cosignPayload(root.Digest)
+			r.pushCosign(t, payload, other.signCosign(t, payload), &root, "")
+		}, "does not match any of the public keys"},
+		{"notation wrong key", func(t *testing.T, r *fakeRegistry, root, _ ocispec.Descriptor) {
+			r.pushNotation(t, other.notationEnvelope(t, root, "ES256", false), root)
+		}, "does not hold any of the public keys"},
+		{"cosign other subject", func(t *testing.T, r *fakeRegistry, root, unrelated ocispec.Descriptor) {
+			payload := cosignPayload(unrelated.Digest)
+			r.pushCosign(t, payload, signing.signCosign(t, payload), &root, "")
+		}, "cosign payload is for sha256:"},
+		{"notation other subject", func(t *testing.T, r *fakeRegistry, root, unrelated ocispec.Descriptor) {
+			r.pushNotation(t, signing.notationEnvelope(t, unrelated, "ES256", false), root)
+		}, "notation signature is for"},
+		{"cosign tampered payload", func(t *testing.T, r *fakeRegistry, root, _ ocispec.Descriptor) {
+			payload := cosignPayload(root.Digest)
+			signature := signing.signCosign(t, payload)
+			tampered := []byte(strings.Replace(string(payload), "registry.example.com", "attacker.example.com", 1))
+			r.pushCosign(t, tampered, signature, &root, "")
+		}, "does not match any of the public keys"},
+		{"notation tampered payload", func(t *testing.T, r *fakeRegistry, root, _ ocispec.Descriptor) {
+			r.pushNotation(t, signing.notationEnvelope(t, root, "ES256", true), root)
+		}, "does not match its signing certificate"},
+		{"notation unsupported algorithm", func(t *testing.T, r *fakeRegistry, root, _ ocispec.Descriptor) {
+			r.pushNotation(t, signing.notationEnvelope(t, root, "HS256", false), root)
+		}, "unsupported notation signature algorithm HS256"},
+		{"no signature", func(*testing.T, *fakeRegistry, ocispec.Descriptor, ocispec.Descriptor) {}, "no signature found"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, host := newFakeRegistry(t)
+			root := r.pushImage(t, "v1", "weights")
+			unrelated := r.pushImage(t, "v2", "other weights")
+			tt.sign(t, r, root, unrelated)
+
+			keyFile := signing.publicKeyFile(t)
+			d := newTestDownloader(t, host, ":v1", "", "", download.Options{
+				Verify: verify.Policy{PublicKeys: []string{keyFile}},
+			})
+			var called bool
+			err := d.Download(context.Background(), func([]download.Blob) error {
+				called = true
+				return nil
+			})
+			if tt.reason == "" {
+				if err != nil {
+					t.Fatalf("download: %v", err)
+				}
+				v := d.Verification()
+				if v == nil || v.Digest != root.Digest.String() || len(v.Signatures) != 1 {
+					t.Fatalf("verification = %+v, want a signature of %s", v, root.Digest)
+				}
+				if format := strings.Fields(tt.name)[0]; v.Signatures[0].Format != format || v.Signatures[0].Key != keyFile {
+					t.Errorf("signature = %+v, want a %s signature by %s", v.Signatures[0], format, keyFile)
+				}
+				if !called {
+					t.Errorf("the blobs were not written although verification succeeded")
+				}
+				return
+			}
+			// nothing may be cached from content that does not verify
+			if called {
+				t.Errorf("the blobs were written although verification failed")
+			}
+			var verr *verify.Error
+			if !errors.As(err, &verr) {
+				t.Fatalf("download = %v, want a verification error", err)
+			}
+			if !strings.Contains(err.Error(), tt.reason) {
+				t.Errorf("download = %v, want it to fail with %q", err, tt.reason)
+			}
+		})
+	}
+}
@@ -1,6 +1,7 @@
 package ollama
 
 import (
+	"context"
 	"fmt"
 	"net/url"
 
@@ -18,10 +19,10 @@ type downloader struct {
 	credsType string
 }
 
-func New(ref *url.URL, creds, credsType string) (*downloader, error) {
+func New(ref *url.URL, creds, credsType string, _ download.Options) (*downloader, error) {
 	return nil, fmt.Errorf("not implemented")
 }
 
-func (d *downloader) Download() ([]download.KeyReader, error) {
-	return nil, nil
+func (d *downloader) Download(_ context.Context, fn func(blobs []download.Blob) error) error {
+	return fmt.Errorf("not implemented")
 }
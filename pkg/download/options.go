@@ -0,0 +1,155 @@
+package download
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/aifoundry-org/storage-manager/pkg/download/retry"
+	"github.com/aifoundry-org/storage-manager/pkg/verify"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultHuggingFaceEndpoint the endpoint used for HuggingFace content when no mirror is configured
+const DefaultHuggingFaceEndpoint = "https://huggingface.co"
+
+// Options settings shared by the downloaders
+type Options struct {
+	// HuggingFaceEndpoint base URL of the HuggingFace hub, or a mirror of it
+	HuggingFaceEndpoint string
+	// RegistryMirrors for each OCI registry host, mirror hosts to try, in order, before the registry itself
+	RegistryMirrors map[string][]string
+	// RegistryInsecure OCI registry and mirror hosts that are contacted over plain HTTP, such as
+	// local registries
+	RegistryInsecure []string
+	// Platform the platform of the manifest to pull from an OCI index, as os/arch[/variant], or
+	// all for every manifest; empty for the platform of the host
+	Platform string
+	// ArtifactType only pull the manifests of an OCI index with this artifact type or media
+	// type; empty for any
+	ArtifactType string
+	// Refresh when OCI content in the cache pulled by tag is checked for changes
+	Refresh RefreshPolicy
+	// HTTPRefresh when http content in the cache is checked for changes
+	HTTPRefresh RefreshPolicy
+	// Verify which OCI content must be signed before it is cached, and by whom
+	Verify verify.Policy
+	// Credentials where to find credentials for sources that do not provide their own
+	Credentials CredentialStore
+	// Retry how requests to sources that fail transiently are retried
+	Retry retry.Policy
+	// Logger for messages from the downloaders, such as retries; nil logs nothing
+	Logger *log.Logger
+}
+
+// Client an http client for requests to sources, which retries them following the policy
+func (o Options) Client() *http.Client {
+	return retry.NewClient(o.Retry, o.Logger)
+}
+
+// Resume read a blob opened as rc from host, opening it again with open where reading
+// stopped if it fails transiently
+func (o Options) Resume(ctx context.Context, host string, rc io.ReadCloser, open retry.OpenFunc) io.ReadCloser {
+	return o.Retry.Resume(ctx, host, rc, open, o.Logger)
+}
+
+// refresh policies
+const (
+	// RefreshNever content in the cache is used as it is, however old
+	RefreshNever = "never"
+	// RefreshAlways the source is checked every time the content is pulled
+	RefreshAlways = "always"
+	// RefreshIfOlderThan the source is checked when the content is pulled, if it was last
+	// checked longer ago than the maximum age
+	RefreshIfOlderThan = "if-older-than"
+)
+
+// RefreshPolicy when content in the cache whose source may change is checked for changes
+type RefreshPolicy struct {
+	// Policy one of the Refresh constants; empty for RefreshNever
+	Policy string
+	// MaxAge how long ago the content may have been checked, for RefreshIfOlderThan
+	MaxAge time.Duration
+}
+
+// Validate check that the policy is one that is known
+func (r RefreshPolicy) Validate() error {
+	switch r.Policy {
+	case "", RefreshNever, RefreshAlways:
+		return nil
+	case RefreshIfOlderThan:
+		if r.MaxAge <= 0 {
+			return fmt.Errorf("refresh policy %s needs a maximum age", r.Policy)
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown refresh policy %s, must be %s, %s or %s", r.Policy, RefreshNever, RefreshAlways, RefreshIfOlderThan)
+}
+
+// Due whether content last checked at checkedAt must be checked now. Content that was never
+// checked is due whenever the policy checks at all.
+func (r RefreshPolicy) Due(checkedAt, now time.Time) bool {
+	switch r.Policy {
+	case RefreshAlways:
+		return true
+	case RefreshIfOlderThan:
+		return now.Sub(checkedAt) > r.MaxAge
+	}
+	return false
+}
+
+// RefreshFor the refresh policy for content from the URL
+func (o Options) RefreshFor(url string) RefreshPolicy {
+	switch {
+	case strings.HasPrefix(url, "oci://"):
+		return o.Refresh
+	case strings.HasPrefix(url, "http://"), strings.HasPrefix(url, "https://"):
+		return o.HTTPRefresh
+	}
+	return RefreshPolicy{}
+}
+
+// ForSource the options for pulling the source, with its own platform and artifact type
+// instead of the configured ones, if it has them
+func (o Options) ForSource(source ContentSource) Options {
+	if source.Platform != "" {
+		o.Platform = source.Platform
+	}
+	if source.ArtifactType != "" {
+		o.ArtifactType = source.ArtifactType
+	}
+	return o
+}
+
+// Credential credentials for a source, with their type, such as Bearer or Basic
+type Credential struct {
+	Credentials     string
+	CredentialsType string
+}
+
+// CredentialStore finds the credentials for sources that do not provide their own
+type CredentialStore interface {
+	// Lookup find the credentials for the source URL. Places that could not be read are
+	// reported in err, even if the credentials were found elsewhere.
+	Lookup(ctx context.Context, url string) (cred Credential, ok bool, err error)
+}
+
+// WithCredentials return the source with the credentials from the store for its URL filled
+// in, if it has no credentials of its own
+func (o Options) WithCredentials(ctx context.Context, source ContentSource) (ContentSource, error) {
+	if source.Credentials != "" || o.Credentials == nil {
+		return source, nil
+	}
+	cred, ok, err := o.Credentials.Lookup(ctx, source.URL)
+	if ok {
+		source.Credentials = cred.Credentials
+		if source.CredentialsType == "" {
+			source.CredentialsType = cred.CredentialsType
+		}
+	}
+	return source, err
+}
@@ -10,21 +10,22 @@ import (
 	"github.com/aifoundry-org/storage-manager/pkg/download/ollama"
 )
 
-func Parse(source download.ContentSource) (download.Downloader, error) {
+// Parse get the downloader for the source, based on the scheme of its URL
+func Parse(source download.ContentSource, opts download.Options) (download.Downloader, error) {
 	u, err := url.Parse(source.URL)
 	if err != nil {
 		return nil, err
 	}
 	switch u.Scheme {
 	case "http", "https":
-		return http.New(u, source.Credentials, source.CredentialsType)
+		return http.New(u, source.Credentials, source.CredentialsType, opts)
 	case "oci":
-		return oci.New(u, source.Credentials, source.CredentialsType)
+		return oci.New(u, source.Credentials, source.CredentialsType, opts.ForSource(source))
 	case "hf", "huggingface":
-		return huggingface.New(u, source.Credentials, source.CredentialsType)
+		return huggingface.New(u, source.Credentials, source.CredentialsType, opts)
 	case "ollama":
-		return ollama.New(u, source.Credentials, source.CredentialsType)
+		return ollama.New(u, source.Credentials, source.CredentialsType, opts)
 	default:
-		return nil, &download.ErrUnsupportedScheme{}
+		return nil, &download.ErrUnsupportedScheme{Scheme: u.Scheme}
 	}
 }
@@ -0,0 +1,135 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"syscall"
+	"time"
+
+	"oras.land/oras-go/v2/registry/remote/auth"
+	"oras.land/oras-go/v2/registry/remote/errcode"
+)
+
+// Class what kind of failure an error from a source is, and so whether it is worth retrying
+type Class int
+
+const (
+	// ClassPermanent the request will fail the same way again
+	ClassPermanent Class = iota
+	// ClassRetryable the failure is transient, such as a connection reset or a 503
+	ClassRetryable
+	// ClassAuth the credentials are missing, or not allowed to read the content
+	ClassAuth
+	// ClassNotFound the source does not have the content
+	ClassNotFound
+)
+
+func (c Class) String() string {
+	switch c {
+	case ClassRetryable:
+		return "retryable"
+	case ClassAuth:
+		return "auth"
+	case ClassNotFound:
+		return "not found"
+	default:
+		return "permanent"
+	}
+}
+
+// StatusError a source responded with an unsuccessful status
+type StatusError struct {
+	URL        string
+	StatusCode int
+	Status     string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("failed to download %s: %s", e.URL, e.Status)
+}
+
+// CheckResponse return a *StatusError if the response is not successful, closing its body
+func CheckResponse(resp *http.Response) error {
+	if resp.StatusCode >= http.StatusOK && resp.StatusCode < http.StatusMultipleChoices {
+		return nil
+	}
+	resp.Body.Close()
+	return &StatusError{URL: resp.Request.URL.Redacted(), StatusCode: resp.StatusCode, Status: resp.Status}
+}
+
+// Classify tell what kind of failure an error from a source is. Errors from canceling are
+// permanent, as trying again would fail the same way.
+func Classify(err error) Class {
+	if err == nil {
+		return ClassPermanent
+	}
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return ClassPermanent
+	}
+	if code := StatusCode(err); code != 0 {
+		return classifyStatus(code)
+	}
+	if errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.EPIPE) {
+		return ClassRetryable
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return ClassRetryable
+	}
+	return ClassPermanent
+}
+
+// StatusCode the status a source responded with, if err is from an unsuccessful response,
+// else 0
+func StatusCode(err error) int {
+	var (
+		statusErr   *StatusError
+		responseErr *errcode.ErrorResponse
+	)
+	switch {
+	case errors.As(err, &statusErr):
+		return statusErr.StatusCode
+	case errors.As(err, &responseErr):
+		return responseErr.StatusCode
+	case errors.Is(err, auth.ErrBasicCredentialNotFound):
+		// the registry asked for credentials, and there were none
+		return http.StatusUnauthorized
+	}
+	return 0
+}
+
+// classifyStatus tell what kind of failure a response status is
+func classifyStatus(code int) Class {
+	switch code {
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return ClassAuth
+	case http.StatusNotFound, http.StatusGone:
+		return ClassNotFound
+	case http.StatusRequestTimeout, http.StatusTooManyRequests,
+		http.StatusInternalServerError, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return ClassRetryable
+	}
+	return ClassPermanent
+}
+
+// retryAfter how long the response asks to wait before trying again, given either in seconds
+// or as a date, 0 if it does not say
+func retryAfter(resp *http.Response, now time.Time) time.Duration {
+	value := resp.Header.Get("Retry-After")
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if at, err := http.ParseTime(value); err == nil && at.After(now) {
+		return at.Sub(now)
+	}
+	return 0
+}
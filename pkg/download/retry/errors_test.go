@@ -0,0 +1,58 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"syscall"
+	"testing"
+
+	"oras.land/oras-go/v2/registry/remote/auth"
+	"oras.land/oras-go/v2/registry/remote/errcode"
+)
+
+func TestClassify(t *testing.T) {
+	status := func(code int) error {
+		return fmt.Errorf("download: %w", &StatusError{URL: "https://example.com", StatusCode: code, Status: http.StatusText(code)})
+	}
+	tests := []struct {
+		name string
+		err  error
+		want Class
+	}{
+		{"nil", nil, ClassPermanent},
+		{"canceled", fmt.Errorf("read: %w", context.Canceled), ClassPermanent},
+		{"deadline", context.DeadlineExceeded, ClassPermanent},
+		{"408", status(http.StatusRequestTimeout), ClassRetryable},
+		{"429", status(http.StatusTooManyRequests), ClassRetryable},
+		{"500", status(http.StatusInternalServerError), ClassRetryable},
+		{"502", status(http.StatusBadGateway), ClassRetryable},
+		{"503", status(http.StatusServiceUnavailable), ClassRetryable},
+		{"504", status(http.StatusGatewayTimeout), ClassRetryable},
+		{"501", status(http.StatusNotImplemented), ClassPermanent},
+		{"400", status(http.StatusBadRequest), ClassPermanent},
+		{"401", status(http.StatusUnauthorized), ClassAuth},
+		{"403", status(http.StatusForbidden), ClassAuth},
+		{"404", status(http.StatusNotFound), ClassNotFound},
+		{"410", status(http.StatusGone), ClassNotFound},
+		{"registry 503", fmt.Errorf("resolve: %w", &errcode.ErrorResponse{StatusCode: http.StatusServiceUnavailable}), ClassRetryable},
+		{"registry 404", &errcode.ErrorResponse{StatusCode: http.StatusNotFound}, ClassNotFound},
+		{"no credentials", fmt.Errorf("auth: %w", auth.ErrBasicCredentialNotFound), ClassAuth},
+		{"cut off", fmt.Errorf("copy: %w", io.ErrUnexpectedEOF), ClassRetryable},
+		{"reset", &net.OpError{Op: "read", Net: "tcp", Err: os.NewSyscallError("read", syscall.ECONNRESET)}, ClassRetryable},
+		{"refused", fmt.Errorf("dial: %w", syscall.ECONNREFUSED), ClassRetryable},
+		{"broken pipe", syscall.EPIPE, ClassRetryable},
+		{"dns", &net.DNSError{Err: "no such host", Name: "example.invalid", IsNotFound: true}, ClassRetryable},
+		{"other", errors.New("invalid manifest"), ClassPermanent},
+		{"eof", io.EOF, ClassPermanent},
+	}
+	for _, tt := range tests {
+		if got := Classify(tt.err); got != tt.want {
+			t.Errorf("Classify(%s: %v) = %s, want %s", tt.name, tt.err, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// OpenFunc open content for reading from offset on
+type OpenFunc func(ctx context.Context, offset int64) (io.ReadCloser, error)
+
+// Resume read content that was opened as rc, and when reading it fails transiently, such as
+// when the connection is reset, open it again with open where reading stopped, rather than
+// starting over. Each time reading fails without having read anything since the last failure
+// counts as an attempt of the policy. host is only used for logging and metrics.
+func (p Policy) Resume(ctx context.Context, host string, rc io.ReadCloser, open OpenFunc, logger *log.Logger) io.ReadCloser {
+	return &resumer{ctx: ctx, host: host, policy: p.withDefaults(), open: open, rc: rc, logger: logger}
+}
+
+// Skip discard the first n bytes of rc, for sources that cannot start reading at an offset
+func Skip(rc io.ReadCloser, n int64) error {
+	if n <= 0 {
+		return nil
+	}
+	if _, err := io.CopyN(io.Discard, rc, n); err != nil {
+		rc.Close()
+		return fmt.Errorf("could not skip to offset %d: %v", n, err)
+	}
+	return nil
+}
+
+// resumer reads content, opening it again where it stopped if reading fails transiently
+type resumer struct {
+	ctx    context.Context
+	host   string
+	policy Policy
+	open   OpenFunc
+	logger *log.Logger
+
+	rc     io.ReadCloser
+	offset int64
+	// attempt how many times in a row reading failed without making progress
+	attempt int
+}
+
+func (r *resumer) Read(b []byte) (int, error) {
+	for {
+		if r.rc == nil {
+			if err := r.reopen(); err != nil {
+				return 0, err
+			}
+		}
+		n, err := r.rc.Read(b)
+		r.offset += int64(n)
+		if n > 0 {
+			r.attempt = 0
+		}
+		if err == nil || errors.Is(err, io.EOF) || !r.retry(err) {
+			return n, err
+		}
+		r.rc.Close()
+		r.rc = nil
+		if n > 0 {
+			return n, nil
+		}
+	}
+}
+
+// retry whether reading again is worth it after err, counting the attempt if it is
+func (r *resumer) retry(err error) bool {
+	if r.ctx.Err() != nil || Classify(err) != ClassRetryable || r.attempt+1 >= r.policy.MaxAttempts {
+		return false
+	}
+	r.attempt++
+	retries.Inc(r.host, "resume")
+	if r.logger != nil {
+		r.logger.Warnf("reading from %s failed at offset %d (%v), attempt %d of %d, resuming", r.host, r.offset, err, r.attempt, r.policy.MaxAttempts)
+	}
+	return true
+}
+
+// reopen wait for the backoff, and open the content again at the offset reached so far
+func (r *resumer) reopen() error {
+	for {
+		if err := sleep(r.ctx, r.policy.Backoff(r.attempt)); err != nil {
+			return err
+		}
+		rc, err := r.open(r.ctx, r.offset)
+		if err == nil {
+			r.rc = rc
+			return nil
+		}
+		if !r.retry(err) {
+			return fmt.Errorf("could not resume at offset %d: %w", r.offset, err)
+		}
+	}
+}
+
+func (r *resumer) Close() error {
+	if r.rc == nil {
+		return nil
+	}
+	return r.rc.Close()
+}
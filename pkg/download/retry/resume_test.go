@@ -0,0 +1,171 @@
+package retry
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// droppingServer serves content, dropping the connection halfway through the body of the
+// first drops responses, optionally honoring Range requests
+type droppingServer struct {
+	content []byte
+	ranges  bool
+
+	mu    sync.Mutex
+	drops int
+	// offsets the offsets asked for, in order
+	offsets []int64
+}
+
+func (s *droppingServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var offset int64
+	if v, ok := strings.CutPrefix(r.Header.Get("Range"), "bytes="); ok {
+		offset, _ = strconv.ParseInt(strings.TrimSuffix(v, "-"), 10, 64)
+	}
+	s.mu.Lock()
+	s.offsets = append(s.offsets, offset)
+	drop := s.drops > 0
+	s.drops--
+	s.mu.Unlock()
+
+	body := s.content
+	if s.ranges && offset > 0 {
+		body = body[offset:]
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", offset, len(s.content)-1, len(s.content)))
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		w.WriteHeader(http.StatusPartialContent)
+	} else {
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	}
+	if !drop {
+		_, _ = w.Write(body)
+		return
+	}
+	_, _ = w.Write(body[:len(body)/2])
+	w.(http.Flusher).Flush()
+	conn, _, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		return
+	}
+	conn.Close()
+}
+
+// openFunc open the content at the server from an offset, the way downloaders do
+func openFunc(url string) OpenFunc {
+	return func(ctx context.Context, offset int64) (io.ReadCloser, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			return nil, err
+		}
+		if offset > 0 {
+			req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		if err := CheckResponse(resp); err != nil {
+			return nil, err
+		}
+		if resp.StatusCode == http.StatusPartialContent {
+			return resp.Body, nil
+		}
+		// the server ignored the range, and sends everything again
+		if err := Skip(resp.Body, offset); err != nil {
+			return nil, err
+		}
+		return resp.Body, nil
+	}
+}
+
+func TestResume(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789abcdef"), 64<<10)
+	for _, ranges := range []bool{true, false} {
+		s := &droppingServer{content: content, ranges: ranges, drops: 2}
+		srv := httptest.NewServer(s)
+		open := openFunc(srv.URL)
+		rc, err := open(context.Background(), 0)
+		if err != nil {
+			t.Fatalf("open: %v", err)
+		}
+		p := Policy{MaxAttempts: 3, InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond}
+		r := p.Resume(context.Background(), "test", rc, open, nil)
+		got, err := io.ReadAll(r)
+		r.Close()
+		srv.Close()
+		if err != nil {
+			t.Fatalf("ranges %v: read: %v", ranges, err)
+		}
+		if !bytes.Equal(got, content) {
+			t.Fatalf("ranges %v: read %d bytes that differ from the %d served", ranges, len(got), len(content))
+		}
+		// each request continues where the one before it was cut off
+		want := []int64{0, int64(len(content) / 2), int64(len(content)/2 + len(content)/4)}
+		if !ranges {
+			// the server sends everything every time, of which only half arrives
+			want = []int64{0, int64(len(content) / 2), int64(len(content) / 2)}
+		}
+		if fmt.Sprint(s.offsets) != fmt.Sprint(want) {
+			t.Errorf("ranges %v: offsets asked for %v, want %v", ranges, s.offsets, want)
+		}
+	}
+}
+
+func TestResumeProgress(t *testing.T) {
+	content := bytes.Repeat([]byte("x"), 1<<20)
+	// every response is cut off, but each makes progress, which resets the attempts
+	s := &droppingServer{content: content, ranges: true, drops: 5}
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+	open := openFunc(srv.URL)
+	rc, err := open(context.Background(), 0)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	p := Policy{MaxAttempts: 2, InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond}
+	got, err := io.ReadAll(p.Resume(context.Background(), "test", rc, open, nil))
+	if err != nil || len(got) != len(content) {
+		t.Fatalf("read %d bytes, %v, want all %d as every attempt made progress", len(got), err, len(content))
+	}
+}
+
+func TestResumeGivesUp(t *testing.T) {
+	s := &droppingServer{content: bytes.Repeat([]byte("x"), 1<<20), drops: 1}
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+	// opening again fails every time
+	failing := func(ctx context.Context, offset int64) (io.ReadCloser, error) {
+		return nil, &StatusError{URL: srv.URL, StatusCode: http.StatusServiceUnavailable, Status: "503 Service Unavailable"}
+	}
+	p := Policy{MaxAttempts: 2, InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond}
+	rc, err := openFunc(srv.URL)(context.Background(), 0)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	_, err = io.ReadAll(p.Resume(context.Background(), "test", rc, failing, nil))
+	if StatusCode(err) != http.StatusServiceUnavailable {
+		t.Errorf("read = %v, want the 503 of the last attempt", err)
+	}
+}
+
+func TestSkip(t *testing.T) {
+	rc := io.NopCloser(strings.NewReader("0123456789"))
+	if err := Skip(rc, 4); err != nil {
+		t.Fatalf("skip: %v", err)
+	}
+	if rest, _ := io.ReadAll(rc); string(rest) != "456789" {
+		t.Errorf("read %q after skipping 4 bytes, want 456789", rest)
+	}
+	if err := Skip(io.NopCloser(strings.NewReader("short")), 10); err == nil {
+		t.Errorf("skipping past the end of the content did not fail")
+	}
+}
@@ -0,0 +1,165 @@
+package retry
+
+import (
+	"context"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/aifoundry-org/storage-manager/pkg/metrics"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// DefaultMaxAttempts how many times a request is tried, unless set otherwise
+	DefaultMaxAttempts = 5
+	// DefaultInitialBackoff how long to wait before the first retry, unless set otherwise
+	DefaultInitialBackoff = time.Second
+	// DefaultMaxBackoff the longest wait between retries, unless set otherwise
+	DefaultMaxBackoff = 30 * time.Second
+	// maxRetryAfter the longest a source may ask us to wait before trying again; a source that
+	// asks for longer gets its response returned as is
+	maxRetryAfter = 5 * time.Minute
+)
+
+// retries the retries of requests to sources, by host and the reason, which is the status of
+// the response, "network" for a failed request, or "resume" for a download that was cut off
+var retries = metrics.NewCounter("storage_manager_download_retries_total",
+	"Retries of requests to content sources.", "host", "reason")
+
+// Policy how often and how long to retry failed requests to sources. The zero value uses the
+// defaults.
+type Policy struct {
+	// MaxAttempts how many times a request is tried, including the first; 1 does not retry
+	MaxAttempts int
+	// InitialBackoff how long to wait before the first retry; each retry waits twice as long as
+	// the previous one, up to MaxBackoff
+	InitialBackoff time.Duration
+	// MaxBackoff the longest wait between retries
+	MaxBackoff time.Duration
+}
+
+// withDefaults the policy with the defaults filled in for unset values
+func (p Policy) withDefaults() Policy {
+	if p.MaxAttempts <= 0 {
+		p.MaxAttempts = DefaultMaxAttempts
+	}
+	if p.InitialBackoff <= 0 {
+		p.InitialBackoff = DefaultInitialBackoff
+	}
+	if p.MaxBackoff <= 0 {
+		p.MaxBackoff = DefaultMaxBackoff
+	}
+	return p
+}
+
+// Backoff how long to wait before retrying after the given failed attempt, counting from 1.
+// The wait doubles with every attempt, and is jittered so that many clients failing at the
+// same time do not all retry at the same time.
+func (p Policy) Backoff(attempt int) time.Duration {
+	p = p.withDefaults()
+	d := p.InitialBackoff
+	for i := 1; i < attempt && d < p.MaxBackoff; i++ {
+		d *= 2
+	}
+	d = min(d, p.MaxBackoff)
+	return d/2 + rand.N(d/2+1)
+}
+
+// sleep wait for d, or until the context is done
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// Transport an http.RoundTripper that retries requests that failed transiently: those that
+// could not be sent, and those answered with a status such as 429 or 503. A Retry-After in the
+// response is honored instead of the backoff. Requests with a body are only retried if the
+// body can be read again.
+type Transport struct {
+	// Base the transport that sends the requests, http.DefaultTransport if nil
+	Base   http.RoundTripper
+	Policy Policy
+	Logger *log.Logger
+}
+
+// NewClient create an http client that retries requests following the policy
+func NewClient(policy Policy, logger *log.Logger) *http.Client {
+	return &http.Client{Transport: &Transport{Policy: policy, Logger: logger}}
+}
+
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	base := t.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	policy := t.Policy.withDefaults()
+	if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+		return base.RoundTrip(req)
+	}
+	ctx := req.Context()
+	for attempt := 1; ; attempt++ {
+		if attempt > 1 && req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req = req.Clone(ctx)
+			req.Body = body
+		}
+		resp, err := base.RoundTrip(req)
+		if attempt >= policy.MaxAttempts {
+			return resp, err
+		}
+
+		var (
+			wait   = policy.Backoff(attempt)
+			reason string
+		)
+		switch {
+		case err != nil:
+			if Classify(err) != ClassRetryable {
+				return resp, err
+			}
+			reason = "network"
+		case classifyStatus(resp.StatusCode) == ClassRetryable:
+			if after := retryAfter(resp, time.Now()); after > 0 {
+				if after > maxRetryAfter {
+					return resp, nil
+				}
+				wait = after
+			}
+			reason = strconv.Itoa(resp.StatusCode)
+			// read what is left so the connection can be reused
+			_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+			resp.Body.Close()
+		default:
+			return resp, nil
+		}
+
+		retries.Inc(req.URL.Host, reason)
+		if t.Logger != nil {
+			t.Logger.Warnf("%s %s failed (%s), attempt %d of %d, retrying in %s", req.Method, req.URL.Redacted(), failure(reason, err), attempt, policy.MaxAttempts, wait.Round(time.Millisecond))
+		}
+		if err := sleep(ctx, wait); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// failure describe why a request failed, for logging
+func failure(reason string, err error) string {
+	if err != nil {
+		return err.Error()
+	}
+	return "status " + reason
+}
@@ -0,0 +1,126 @@
+package retry
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	p := Policy{InitialBackoff: 100 * time.Millisecond, MaxBackoff: time.Second}
+	for attempt := 1; attempt <= 10; attempt++ {
+		full := min(p.InitialBackoff<<(attempt-1), p.MaxBackoff)
+		for i := 0; i < 100; i++ {
+			// jittered down to half of the full backoff at most
+			if d := p.Backoff(attempt); d < full/2 || d > full {
+				t.Fatalf("backoff of attempt %d = %s, want between %s and %s", attempt, d, full/2, full)
+			}
+		}
+	}
+	if d := (Policy{}).Backoff(1); d < DefaultInitialBackoff/2 || d > DefaultInitialBackoff {
+		t.Errorf("backoff of the default policy = %s, want between %s and %s", d, DefaultInitialBackoff/2, DefaultInitialBackoff)
+	}
+	if d := (Policy{}).Backoff(100); d < DefaultMaxBackoff/2 || d > DefaultMaxBackoff {
+		t.Errorf("backoff of a late attempt = %s, want at most %s", d, DefaultMaxBackoff)
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	now := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		value string
+		want  time.Duration
+	}{
+		{"", 0},
+		{"3", 3 * time.Second},
+		{"0", 0},
+		{"-1", 0},
+		{"soon", 0},
+		{now.Add(10 * time.Second).Format(http.TimeFormat), 10 * time.Second},
+		{now.Add(-10 * time.Second).Format(http.TimeFormat), 0},
+	}
+	for _, tt := range tests {
+		resp := &http.Response{Header: http.Header{}}
+		if tt.value != "" {
+			resp.Header.Set("Retry-After", tt.value)
+		}
+		if got := retryAfter(resp, now); got != tt.want {
+			t.Errorf("retryAfter(%q) = %s, want %s", tt.value, got, tt.want)
+		}
+	}
+}
+
+// flakyServer a server that answers the first failures requests with status and the
+// Retry-After, and the rest with 200, counting the requests
+func flakyServer(t *testing.T, failures int, status int, retryAfter string) (*httptest.Server, *atomic.Int32) {
+	var requests atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if int(requests.Add(1)) <= failures {
+			if retryAfter != "" {
+				w.Header().Set("Retry-After", retryAfter)
+			}
+			w.WriteHeader(status)
+			return
+		}
+		_, _ = w.Write([]byte("content"))
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &requests
+}
+
+// get send a request with a client that retries following the policy
+func get(t *testing.T, p Policy, url string) *http.Response {
+	t.Helper()
+	resp, err := NewClient(p, nil).Get(url)
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	resp.Body.Close()
+	return resp
+}
+
+func TestTransport(t *testing.T) {
+	fast := Policy{MaxAttempts: 3, InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond}
+	tests := []struct {
+		name       string
+		failures   int
+		status     int
+		retryAfter string
+		wantStatus int
+		// wantRequests how many requests the server gets
+		wantRequests int32
+	}{
+		{"success", 0, 0, "", http.StatusOK, 1},
+		{"too many requests", 2, http.StatusTooManyRequests, "", http.StatusOK, 3},
+		{"unavailable", 1, http.StatusServiceUnavailable, "", http.StatusOK, 2},
+		{"gives up", 5, http.StatusServiceUnavailable, "", http.StatusServiceUnavailable, 3},
+		{"not found", 1, http.StatusNotFound, "", http.StatusNotFound, 1},
+		{"unauthorized", 1, http.StatusUnauthorized, "", http.StatusUnauthorized, 1},
+		// a source that asks to wait longer than we would gets its response as it is
+		{"retry after too long", 1, http.StatusServiceUnavailable, "600", http.StatusServiceUnavailable, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv, requests := flakyServer(t, tt.failures, tt.status, tt.retryAfter)
+			resp := get(t, fast, srv.URL)
+			if resp.StatusCode != tt.wantStatus || requests.Load() != tt.wantRequests {
+				t.Errorf("status %d after %d requests, want %d after %d", resp.StatusCode, requests.Load(), tt.wantStatus, tt.wantRequests)
+			}
+		})
+	}
+}
+
+func TestTransportHonorsRetryAfter(t *testing.T) {
+	srv, requests := flakyServer(t, 1, http.StatusTooManyRequests, "1")
+	start := time.Now()
+	resp := get(t, Policy{MaxAttempts: 2, InitialBackoff: time.Millisecond}, srv.URL)
+	if resp.StatusCode != http.StatusOK || requests.Load() != 2 {
+		t.Fatalf("status %d after %d requests, want 200 after 2", resp.StatusCode, requests.Load())
+	}
+	// rather than the backoff
+	if elapsed := time.Since(start); elapsed < time.Second {
+		t.Errorf("retried after %s, want the second of the Retry-After", elapsed)
+	}
+}
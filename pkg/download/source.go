@@ -1,7 +1,78 @@
 package download
 
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+)
+
 type ContentSource struct {
 	URL             string `json:"url"`
 	Credentials     string `json:"credentials,omitempty"`
 	CredentialsType string `json:"credentialsType,omitempty"`
+	// TTL how long the content stays in the cache after it is pulled, as a duration such as
+	// 24h; empty to keep it until it is deleted or evicted
+	TTL string `json:"ttl,omitempty"`
+	// ExpiresAt when the content is removed from the cache; an alternative to TTL
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+	// Platform the platform of the manifest to pull from an OCI index, as os/arch[/variant]
+	// such as linux/arm64, or all for every manifest; empty for the configured default
+	Platform string `json:"platform,omitempty"`
+	// ArtifactType only pull the manifests of an OCI index with this artifact type or media
+	// type; empty for any
+	ArtifactType string `json:"artifactType,omitempty"`
+	// Digest the digest the root of the content must have, such as sha256:<hex> or
+	// sha512:<hex>; it may also be given as a fragment of the URL, such as #sha256=<hex>
+	Digest string `json:"digest,omitempty"`
+}
+
+// digestFragment a fragment of a URL that gives a digest, as <algorithm>=<hex>
+var digestFragment = regexp.MustCompile(`^([a-z0-9]+)=([a-f0-9]+)$`)
+
+// ExpectedDigest the digest the root of the content must have, from Digest or the fragment of
+// the URL; empty if neither gives one. Any other fragment, such as #section, is not a digest.
+func (c ContentSource) ExpectedDigest() (digest.Digest, error) {
+	expected := c.Digest
+	if _, fragment, ok := strings.Cut(c.URL, "#"); ok {
+		if m := digestFragment.FindStringSubmatch(fragment); m != nil {
+			fromURL := m[1] + ":" + m[2]
+			if expected != "" && expected != fromURL {
+				return "", fmt.Errorf("digest %s does not match the one in the url, %s", expected, fromURL)
+			}
+			expected = fromURL
+		}
+	}
+	if expected == "" {
+		return "", nil
+	}
+	d, err := digest.Parse(expected)
+	if err != nil {
+		return "", fmt.Errorf("invalid digest %s: %v", expected, err)
+	}
+	switch d.Algorithm() {
+	case digest.SHA256, digest.SHA512:
+		return d, nil
+	}
+	return "", fmt.Errorf("unsupported digest algorithm %s, must be %s or %s", d.Algorithm(), digest.SHA256, digest.SHA512)
+}
+
+// Expiry when the content should be removed from the cache, if pulled at now. The zero time
+// means it does not expire.
+func (c ContentSource) Expiry(now time.Time) (time.Time, error) {
+	switch {
+	case c.TTL != "" && c.ExpiresAt != nil:
+		return time.Time{}, fmt.Errorf("only one of ttl and expiresAt may be given")
+	case c.ExpiresAt != nil:
+		return *c.ExpiresAt, nil
+	case c.TTL != "":
+		ttl, err := time.ParseDuration(c.TTL)
+		if err != nil || ttl <= 0 {
+			return time.Time{}, fmt.Errorf("invalid ttl %s", c.TTL)
+		}
+		return now.Add(ttl), nil
+	}
+	return time.Time{}, nil
 }
@@ -0,0 +1,93 @@
+package events
+
+import (
+	"sync"
+	"time"
+)
+
+// defaultHistory how many of the most recent events are kept
+const defaultHistory = 1000
+
+// Event types
+const (
+	TypeEvicted      = "evicted"
+	TypeDeleted      = "deleted"
+	TypeExpired      = "expired"
+	TypeLeaseExpired = "leaseExpired"
+)
+
+// Event something that happened to the content of the cache
+type Event struct {
+	Time    time.Time `json:"time"`
+	Type    string    `json:"type"`
+	Name    string    `json:"name,omitempty"`
+	Key     string    `json:"key,omitempty"`
+	Size    int64     `json:"size,omitempty"`
+	Message string    `json:"message,omitempty"`
+}
+
+// Bus keeps a history of recent events and passes new ones on to subscribers. It is safe for
+// concurrent use. A nil Bus discards events.
+type Bus struct {
+	mu          sync.Mutex
+	history     []Event
+	size        int
+	subscribers map[chan Event]struct{}
+}
+
+// New create a bus that keeps the most recent events
+func New() *Bus {
+	return &Bus{
+		size:        defaultHistory,
+		subscribers: map[chan Event]struct{}{},
+	}
+}
+
+// Publish record an event and send it to all subscribers. Subscribers that are not keeping up
+// miss the event rather than blocking the publisher.
+func (b *Bus) Publish(e Event) {
+	if b == nil {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.history = append(b.history, e)
+	if len(b.history) > b.size {
+		b.history = b.history[len(b.history)-b.size:]
+	}
+	for ch := range b.subscribers {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
+
+// Recent get the recent events, oldest first
+func (b *Bus) Recent() []Event {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]Event(nil), b.history...)
+}
+
+// Subscribe receive every event published from now on, until cancel is called
+func (b *Bus) Subscribe() (events <-chan Event, cancel func()) {
+	ch := make(chan Event, 64)
+	if b == nil {
+		return ch, func() {}
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.subscribers[ch] = struct{}{}
+	return ch, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		delete(b.subscribers, ch)
+	}
+}
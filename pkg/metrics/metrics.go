@@ -0,0 +1,100 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// MediaType the media type of the text format in which metrics are written, understood by
+// Prometheus and compatible scrapers
+const MediaType = "text/plain; version=0.0.4; charset=utf-8"
+
+var (
+	mu       sync.Mutex
+	counters []*Counter
+)
+
+// Counter a count of things that happened, split by the values of its labels. It is safe for
+// concurrent use.
+type Counter struct {
+	name   string
+	help   string
+	labels []string
+
+	mu     sync.Mutex
+	values map[string]uint64
+}
+
+// NewCounter create a counter with the given labels, and register it to be written with all
+// other metrics
+func NewCounter(name, help string, labels ...string) *Counter {
+	c := &Counter{name: name, help: help, labels: labels, values: map[string]uint64{}}
+	mu.Lock()
+	defer mu.Unlock()
+	counters = append(counters, c)
+	return c
+}
+
+// Inc add one to the count for the label values, given in the order of the labels
+func (c *Counter) Inc(values ...string) {
+	if len(values) != len(c.labels) {
+		panic(fmt.Sprintf("counter %s has %d labels, got %d values", c.name, len(c.labels), len(values)))
+	}
+	pairs := make([]string, len(values))
+	for i, v := range values {
+		pairs[i] = fmt.Sprintf("%s=%q", c.labels[i], v)
+	}
+	key := strings.Join(pairs, ",")
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.values[key]++
+}
+
+// write the counter in the text format
+func (c *Counter) write(w io.Writer) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name); err != nil {
+		return err
+	}
+	keys := make([]string, 0, len(c.values))
+	for key := range c.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		name := c.name
+		if key != "" {
+			name = fmt.Sprintf("%s{%s}", c.name, key)
+		}
+		if _, err := fmt.Fprintf(w, "%s %d\n", name, c.values[key]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Write write every registered metric in the text format
+func Write(w io.Writer) error {
+	mu.Lock()
+	registered := append([]*Counter(nil), counters...)
+	mu.Unlock()
+	for _, c := range registered {
+		if err := c.write(w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Handler serve every registered metric in the text format
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", MediaType)
+		_ = Write(w)
+	})
+}
@@ -0,0 +1,95 @@
+package preload
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/aifoundry-org/storage-manager/pkg/download"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Manifest the declared list of content that must be in the cache. It is read from a yaml or
+// json file.
+type Manifest struct {
+	// Prune remove content from the cache that was pulled for the manifest and is no longer
+	// listed in it
+	Prune   bool    `yaml:"prune" json:"prune,omitempty"`
+	Entries []Entry `yaml:"entries" json:"entries"`
+}
+
+// Entry a single piece of content that must be in the cache
+type Entry struct {
+	URL string `yaml:"url" json:"url"`
+	// CredentialsRef where to find the credentials for the URL, one of env:<VARIABLE> or
+	// file:<path>. The credentials themselves never appear in the manifest.
+	CredentialsRef  string `yaml:"credentialsRef" json:"credentialsRef,omitempty"`
+	CredentialsType string `yaml:"credentialsType" json:"credentialsType,omitempty"`
+	// Pin protect the content from being removed from the cache
+	Pin bool `yaml:"pin" json:"pin,omitempty"`
+	// Platform and ArtifactType which manifests of an OCI index to pull, as in a pull request
+	Platform     string `yaml:"platform" json:"platform,omitempty"`
+	ArtifactType string `yaml:"artifactType" json:"artifactType,omitempty"`
+	// Digest the digest the content must have, as in a pull request
+	Digest string `yaml:"digest" json:"digest,omitempty"`
+}
+
+// ReadManifest read the manifest from a yaml or json file
+func ReadManifest(path string) (*Manifest, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read preload manifest %s: %v", path, err)
+	}
+	// json is a subset of yaml, so the yaml parser reads both
+	var manifest Manifest
+	if err := yaml.Unmarshal(b, &manifest); err != nil {
+		return nil, fmt.Errorf("could not parse preload manifest %s: %v", path, err)
+	}
+	seen := map[string]bool{}
+	for i, entry := range manifest.Entries {
+		if entry.URL == "" {
+			return nil, fmt.Errorf("preload manifest %s entry %d has no url", path, i)
+		}
+		if seen[entry.URL] {
+			return nil, fmt.Errorf("preload manifest %s lists %s more than once", path, entry.URL)
+		}
+		seen[entry.URL] = true
+	}
+	return &manifest, nil
+}
+
+// Source get the content source for the entry, resolving its credentials reference
+func (e Entry) Source() (download.ContentSource, error) {
+	source := download.ContentSource{
+		URL:             e.URL,
+		CredentialsType: e.CredentialsType,
+		Platform:        e.Platform,
+		ArtifactType:    e.ArtifactType,
+		Digest:          e.Digest,
+	}
+	if e.CredentialsRef == "" {
+		return source, nil
+	}
+	kind, ref, ok := strings.Cut(e.CredentialsRef, ":")
+	if !ok {
+		return source, fmt.Errorf("invalid credentials reference %s, must be env:<VARIABLE> or file:<path>", e.CredentialsRef)
+	}
+	switch kind {
+	case "env":
+		creds, ok := os.LookupEnv(ref)
+		if !ok {
+			return source, fmt.Errorf("credentials variable %s is not set", ref)
+		}
+		source.Credentials = creds
+	case "file":
+		b, err := os.ReadFile(ref)
+		if err != nil {
+			return source, fmt.Errorf("could not read credentials file: %v", err)
+		}
+		source.Credentials = strings.TrimSpace(string(b))
+	default:
+		return source, fmt.Errorf("unsupported credentials reference type %s", kind)
+	}
+	return source, nil
+}
@@ -0,0 +1,128 @@
+package preload
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/aifoundry-org/storage-manager/pkg/download"
+)
+
+// writeManifest write a manifest to a file in dir, returning its path
+func writeManifest(t *testing.T, dir, name, content string) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatalf("write manifest: %v", err)
+	}
+	return path
+}
+
+func TestReadManifest(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		content string
+		want    *Manifest
+		err     string
+	}{
+		{"yaml", "preload.yaml", `
+prune: true
+entries:
+  - url: hf:///org/repo/model.gguf
+    pin: true
+  - url: oci://registry.example.com/models/llama:3.2
+    credentialsRef: env:REGISTRY_TOKEN
+    credentialsType: Bearer
+    platform: linux/arm64
+    artifactType: application/vnd.example.model
+    digest: sha256:0123
+`, &Manifest{Prune: true, Entries: []Entry{
+			{URL: "hf:///org/repo/model.gguf", Pin: true},
+			{URL: "oci://registry.example.com/models/llama:3.2", CredentialsRef: "env:REGISTRY_TOKEN", CredentialsType: "Bearer", Platform: "linux/arm64", ArtifactType: "application/vnd.example.model", Digest: "sha256:0123"},
+		}}, ""},
+		{"json", "preload.json", `{"entries": [{"url": "https://example.com/model.gguf", "pin": true}]}`,
+			&Manifest{Entries: []Entry{{URL: "https://example.com/model.gguf", Pin: true}}}, ""},
+		{"empty", "preload.yaml", `entries: []`, &Manifest{Entries: []Entry{}}, ""},
+		{"missing url", "preload.yaml", `
+entries:
+  - url: https://example.com/a
+  - pin: true
+`, nil, "entry 1 has no url"},
+		{"duplicate", "preload.yaml", `
+entries:
+  - url: https://example.com/a
+  - url: https://example.com/b
+  - url: https://example.com/a
+    pin: true
+`, nil, "lists https://example.com/a more than once"},
+		{"invalid", "preload.yaml", `entries: {url: [}`, nil, "could not parse"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := writeManifest(t, t.TempDir(), tt.file, tt.content)
+			got, err := ReadManifest(path)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("got error %v, want one containing %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("read manifest: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+
+	if _, err := ReadManifest(filepath.Join(t.TempDir(), "missing.yaml")); err == nil {
+		t.Errorf("missing manifest: got no error")
+	}
+}
+
+func TestEntrySource(t *testing.T) {
+	t.Setenv("PRELOAD_TEST_TOKEN", "from-env")
+	credsFile := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(credsFile, []byte("from-file\n"), 0o600); err != nil {
+		t.Fatalf("write credentials: %v", err)
+	}
+	tests := []struct {
+		name  string
+		entry Entry
+		creds string
+		err   string
+	}{
+		{"none", Entry{URL: "https://example.com/a"}, "", ""},
+		{"env", Entry{URL: "https://example.com/a", CredentialsRef: "env:PRELOAD_TEST_TOKEN"}, "from-env", ""},
+		{"file", Entry{URL: "https://example.com/a", CredentialsRef: "file:" + credsFile}, "from-file", ""},
+		{"unset env", Entry{URL: "https://example.com/a", CredentialsRef: "env:PRELOAD_TEST_UNSET"}, "", "is not set"},
+		{"missing file", Entry{URL: "https://example.com/a", CredentialsRef: "file:" + credsFile + ".missing"}, "", "could not read credentials file"},
+		{"no kind", Entry{URL: "https://example.com/a", CredentialsRef: "PRELOAD_TEST_TOKEN"}, "", "invalid credentials reference"},
+		{"unknown kind", Entry{URL: "https://example.com/a", CredentialsRef: "vault:token"}, "", "unsupported credentials reference type vault"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entry := tt.entry
+			entry.CredentialsType = "Bearer"
+			entry.Platform = "linux/amd64"
+			source, err := entry.Source()
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("got error %v, want one containing %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("source: %v", err)
+			}
+			want := download.ContentSource{URL: entry.URL, Credentials: tt.creds, CredentialsType: "Bearer", Platform: "linux/amd64"}
+			if source != want {
+				t.Errorf("got %+v, want %+v", source, want)
+			}
+		})
+	}
+}
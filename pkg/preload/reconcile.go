@@ -0,0 +1,295 @@
+package preload
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/aifoundry-org/storage-manager/pkg/api"
+	"github.com/aifoundry-org/storage-manager/pkg/cache"
+	"github.com/aifoundry-org/storage-manager/pkg/cache/metadata"
+	"github.com/aifoundry-org/storage-manager/pkg/pull"
+
+	"github.com/fsnotify/fsnotify"
+	log "github.com/sirupsen/logrus"
+)
+
+// debounce how long to wait for a burst of changes to the manifest to settle before reconciling
+const debounce = 500 * time.Millisecond
+
+// Reconciler keeps the cache in line with a preload manifest
+type Reconciler struct {
+	path   string
+	prune  bool
+	cache  cache.Cache
+	puller *pull.Puller
+	logger *log.Logger
+
+	mu     sync.Mutex
+	meta   *metadata.Store
+	status api.PreloadStatus
+}
+
+// owner the owner of the pins the reconciler places on pinned entries, and of the content it
+// pulls
+const owner = "preload"
+
+// New create a reconciler for the manifest at path, pulling content with puller. If prune is
+// set, content that the reconciler pulled and that is no longer listed in the manifest is
+// removed from the cache, even if the manifest does not ask for it.
+func New(path string, c cache.Cache, puller *pull.Puller, prune bool, logger *log.Logger) *Reconciler {
+	if logger == nil {
+		logger = log.New()
+	}
+	return &Reconciler{
+		path:   path,
+		prune:  prune,
+		cache:  c,
+		puller: puller,
+		logger: logger,
+		status: api.PreloadStatus{Path: path, Entries: []api.PreloadEntry{}},
+	}
+}
+
+// SetMetadata set the store in which entries of the manifest are pinned, and in which the
+// content the reconciler pulls is recorded as its own. Without it nothing is pruned.
+func (r *Reconciler) SetMetadata(meta *metadata.Store) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.meta = meta
+}
+
+// Status get the status of the most recent reconciliation
+func (r *Reconciler) Status() api.PreloadStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	status := r.status
+	status.Entries = append([]api.PreloadEntry(nil), r.status.Entries...)
+	status.Pruned = append([]string(nil), r.status.Pruned...)
+	return status
+}
+
+// Run reconcile the cache against the manifest, and again every time the manifest changes,
+// until the context is canceled.
+func (r *Reconciler) Run(ctx context.Context) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("could not watch preload manifest: %v", err)
+	}
+	defer watcher.Close()
+	// watch the directory rather than the file, so that we see the file being replaced,
+	// as editors and mounted ConfigMaps do
+	dir, name := filepath.Split(r.path)
+	if dir == "" {
+		dir = "."
+	}
+	if err := watcher.Add(dir); err != nil {
+		return fmt.Errorf("could not watch preload manifest directory %s: %v", dir, err)
+	}
+
+	r.reconcile(ctx)
+
+	var timer <-chan time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+			// a mounted ConfigMap swaps its ..data symlink rather than touching the file
+			base := filepath.Base(event.Name)
+			if base != name && base != "..data" {
+				continue
+			}
+			r.logger.Debugf("preload manifest %s changed: %s", r.path, event.Op)
+			timer = time.After(debounce)
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			r.logger.Warnf("error watching preload manifest %s: %v", r.path, err)
+		case <-timer:
+			timer = nil
+			r.reconcile(ctx)
+		}
+	}
+}
+
+// reconcile read the manifest and bring the cache in line with it, recording the results
+func (r *Reconciler) reconcile(ctx context.Context) {
+	r.mu.Lock()
+	r.status.Generation++
+	r.status.Reconciling = true
+	generation := r.status.Generation
+	r.mu.Unlock()
+
+	r.logger.Infof("reconciling cache against preload manifest %s", r.path)
+	entries, pruned, err := r.apply(ctx, generation)
+
+	now := time.Now()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.status.Reconciling = false
+	r.status.LastReconciled = &now
+	r.status.Pruned = pruned
+	r.status.Error = ""
+	if err != nil {
+		r.logger.Errorf("preload manifest %s: %v", r.path, err)
+		r.status.Error = err.Error()
+		return
+	}
+	r.status.Entries = entries
+	r.logger.Infof("reconciled cache against preload manifest %s", r.path)
+}
+
+// apply pull every missing entry of the manifest, and prune unlisted content if requested
+func (r *Reconciler) apply(ctx context.Context, generation int64) ([]api.PreloadEntry, []string, error) {
+	manifest, err := ReadManifest(r.path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	entries := make([]api.PreloadEntry, len(manifest.Entries))
+	for i, entry := range manifest.Entries {
+		entries[i] = api.PreloadEntry{URL: entry.URL, Pin: entry.Pin, State: api.PreloadStatePending}
+	}
+	r.mu.Lock()
+	r.status.Entries = append([]api.PreloadEntry(nil), entries...)
+	r.mu.Unlock()
+
+	listed := map[string]bool{}
+	for i, entry := range manifest.Entries {
+		listed[entry.URL] = true
+		entries[i] = r.ensure(ctx, entry)
+		r.mu.Lock()
+		if r.status.Generation == generation {
+			r.status.Entries[i] = entries[i]
+		}
+		r.mu.Unlock()
+		// shutting down, leave the rest for the next run
+		if err := ctx.Err(); err != nil {
+			return entries, nil, err
+		}
+	}
+	if err := r.pin(manifest); err != nil {
+		return entries, nil, err
+	}
+
+	if !r.prune && !manifest.Prune {
+		return entries, nil, nil
+	}
+	pruned, err := r.pruneUnlisted(ctx, listed)
+	return entries, pruned, err
+}
+
+// ensure make sure a single entry is in the cache
+func (r *Reconciler) ensure(ctx context.Context, entry Entry) api.PreloadEntry {
+	status := api.PreloadEntry{URL: entry.URL, Pin: entry.Pin}
+	exists, err := r.cache.Exists(ctx, entry.URL)
+	if err == nil && exists {
+		// content that is only in the shared tier is copied to the local tier, or else pulled
+		err = cache.Promote(ctx, r.cache, entry.URL)
+	}
+	if err == nil && exists {
+		if key, err := r.cache.Resolve(ctx, entry.URL); err == nil {
+			status.State = api.PreloadStatePresent
+			status.Digest = key
+			return status
+		}
+	}
+	source, err := entry.Source()
+	if err == nil {
+		r.logger.Infof("preload pulling %s", entry.URL)
+		status.Digest, err = r.puller.Pull(ctx, source, nil)
+	}
+	if err != nil {
+		r.logger.Errorf("preload could not pull %s: %v", entry.URL, err)
+		status.State = api.PreloadStateFailed
+		status.Error = err.Error()
+		return status
+	}
+	status.State = api.PreloadStatePulled
+	// only what the reconciler pulled itself is pruned, never what API clients pulled
+	r.mu.Lock()
+	meta := r.meta
+	r.mu.Unlock()
+	if meta != nil {
+		if err := meta.PulledBy(entry.URL, owner); err != nil {
+			r.logger.Warnf("could not record that preload pulled %s: %v", entry.URL, err)
+		}
+	}
+	return status
+}
+
+// pin place our pins on the pinned entries of the manifest, and remove them from everything else
+func (r *Reconciler) pin(manifest *Manifest) error {
+	r.mu.Lock()
+	meta := r.meta
+	r.mu.Unlock()
+	if meta == nil {
+		return nil
+	}
+	pinned := map[string]bool{}
+	for _, entry := range manifest.Entries {
+		if entry.Pin {
+			pinned[entry.URL] = true
+			if err := meta.Pin(entry.URL, owner); err != nil {
+				return fmt.Errorf("could not pin %s: %v", entry.URL, err)
+			}
+		}
+	}
+	for name, e := range meta.All() {
+		if !pinned[name] && slices.Contains(e.Pins, owner) {
+			if err := meta.Unpin(name, owner); err != nil {
+				return fmt.Errorf("could not unpin %s: %v", name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// pruneUnlisted remove every name from the cache that the reconciler pulled and that is not
+// listed, pinned or leased, and clean up the content. Content pulled through the API is left
+// alone, even if it is not listed.
+func (r *Reconciler) pruneUnlisted(ctx context.Context, listed map[string]bool) ([]string, error) {
+	r.mu.Lock()
+	meta := r.meta
+	r.mu.Unlock()
+	if meta == nil {
+		return nil, nil
+	}
+	names, err := r.cache.List(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("could not list cache: %v", err)
+	}
+	var pruned []string
+	for _, name := range names {
+		if listed[name] {
+			continue
+		}
+		e, ok := meta.Get(name)
+		if !ok || !slices.Contains(e.PulledBy, owner) || e.Protected(time.Now()) {
+			continue
+		}
+		r.logger.Infof("preload pruning %s", name)
+		if err := r.cache.Unname(ctx, name); err != nil {
+			return pruned, fmt.Errorf("could not prune %s: %v", name, err)
+		}
+		pruned = append(pruned, name)
+		if err := meta.Delete(name); err != nil {
+			r.logger.Warnf("could not remove metadata for %s: %v", name, err)
+		}
+	}
+	if len(pruned) == 0 {
+		return nil, nil
+	}
+	if err := r.cache.GC(ctx); err != nil {
+		return pruned, fmt.Errorf("could not clean up cache: %v", err)
+	}
+	return pruned, nil
+}
@@ -0,0 +1,259 @@
+package preload
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/aifoundry-org/storage-manager/pkg/api"
+	"github.com/aifoundry-org/storage-manager/pkg/cache"
+	"github.com/aifoundry-org/storage-manager/pkg/cache/metadata"
+	"github.com/aifoundry-org/storage-manager/pkg/cache/ocidir"
+	"github.com/aifoundry-org/storage-manager/pkg/download"
+	"github.com/aifoundry-org/storage-manager/pkg/pull"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// testReconciler a reconciler against a fresh cache, and a server whose every path is a file
+type testReconciler struct {
+	*Reconciler
+	cache  cache.Cache
+	meta   *metadata.Store
+	puller *pull.Puller
+	dir    string
+	url    string
+}
+
+func newTestReconciler(t *testing.T, prune bool) *testReconciler {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "content of "+r.URL.Path)
+	}))
+	t.Cleanup(srv.Close)
+
+	dir := t.TempDir()
+	c, err := ocidir.New(filepath.Join(dir, "cache"), 0)
+	if err != nil {
+		t.Fatalf("new cache: %v", err)
+	}
+	meta, err := metadata.Open(filepath.Join(dir, "cache", metadata.FileName))
+	if err != nil {
+		t.Fatalf("open metadata: %v", err)
+	}
+	logger := log.New()
+	logger.SetOutput(io.Discard)
+	puller := pull.New(c, logger)
+	puller.SetMetadata(meta)
+	r := New(filepath.Join(dir, "preload.yaml"), c, puller, prune, logger)
+	r.SetMetadata(meta)
+	return &testReconciler{Reconciler: r, cache: c, meta: meta, puller: puller, dir: dir, url: srv.URL}
+}
+
+// write the manifest, with entries relative to the server
+func (r *testReconciler) write(t *testing.T, manifest string) {
+	t.Helper()
+	writeManifest(t, r.dir, "preload.yaml", strings.ReplaceAll(manifest, "URL", r.url))
+}
+
+// reconcile once, failing on error
+func (r *testReconciler) run(t *testing.T) api.PreloadStatus {
+	t.Helper()
+	r.reconcile(context.Background())
+	status := r.Status()
+	if status.Error != "" {
+		t.Fatalf("reconcile: %s", status.Error)
+	}
+	return status
+}
+
+// pullAPI pull content the way an API client does
+func (r *testReconciler) pullAPI(t *testing.T, path string) {
+	t.Helper()
+	if _, err := r.puller.Pull(context.Background(), download.ContentSource{URL: r.url + path}, nil); err != nil {
+		t.Fatalf("pull %s: %v", path, err)
+	}
+}
+
+// names the names in the cache, relative to the server
+func (r *testReconciler) names(t *testing.T) []string {
+	t.Helper()
+	names, err := r.cache.List(context.Background())
+	if err != nil {
+		t.Fatalf("list: %v", err)
+	}
+	var paths []string
+	for _, name := range names {
+		paths = append(paths, strings.TrimPrefix(name, r.url))
+	}
+	slices.Sort(paths)
+	return paths
+}
+
+func TestReconcilePulls(t *testing.T) {
+	r := newTestReconciler(t, false)
+	r.pullAPI(t, "/present")
+	r.write(t, `
+entries:
+  - url: URL/a
+  - url: URL/present
+  - url: URL/bad
+    credentialsRef: env:PRELOAD_TEST_UNSET
+`)
+	status := r.run(t)
+	var states []string
+	for _, e := range status.Entries {
+		states = append(states, e.State)
+	}
+	if want := []string{api.PreloadStatePulled, api.PreloadStatePresent, api.PreloadStateFailed}; !slices.Equal(states, want) {
+		t.Errorf("states: got %v, want %v", states, want)
+	}
+	if status.Entries[0].Digest == "" || status.Entries[1].Digest == "" {
+		t.Errorf("digests missing: %+v", status.Entries)
+	}
+	if status.Entries[2].Error == "" {
+		t.Errorf("failed entry has no error")
+	}
+	if got, want := r.names(t), []string{"/a", "/present"}; !slices.Equal(got, want) {
+		t.Errorf("names: got %v, want %v", got, want)
+	}
+
+	// only what the reconciler pulled is its own
+	for path, want := range map[string]bool{"/a": true, "/present": false} {
+		e, _ := r.meta.Get(r.url + path)
+		if got := slices.Contains(e.PulledBy, owner); got != want {
+			t.Errorf("%s pulled by preload: got %v, want %v", path, got, want)
+		}
+	}
+}
+
+func TestReconcilePins(t *testing.T) {
+	r := newTestReconciler(t, false)
+	r.write(t, `
+entries:
+  - url: URL/a
+    pin: true
+  - url: URL/b
+    pin: true
+`)
+	r.run(t)
+	// someone else pins b as well
+	if err := r.meta.Pin(r.url+"/b", "api"); err != nil {
+		t.Fatalf("pin: %v", err)
+	}
+	for _, path := range []string{"/a", "/b"} {
+		if e, _ := r.meta.Get(r.url + path); !slices.Contains(e.Pins, owner) {
+			t.Errorf("%s not pinned by preload: %v", path, e.Pins)
+		}
+	}
+
+	// unpinning one and dropping the other only removes our own pins
+	r.write(t, `
+entries:
+  - url: URL/a
+`)
+	r.run(t)
+	if e, _ := r.meta.Get(r.url + "/a"); len(e.Pins) != 0 {
+		t.Errorf("/a pins: got %v, want none", e.Pins)
+	}
+	if e, _ := r.meta.Get(r.url + "/b"); !slices.Equal(e.Pins, []string{"api"}) {
+		t.Errorf("/b pins: got %v, want [api]", e.Pins)
+	}
+	// without pruning, unlisted content stays
+	if got, want := r.names(t), []string{"/a", "/b"}; !slices.Equal(got, want) {
+		t.Errorf("names: got %v, want %v", got, want)
+	}
+}
+
+func TestReconcilePrune(t *testing.T) {
+	r := newTestReconciler(t, false)
+	r.write(t, `
+entries:
+  - url: URL/a
+  - url: URL/b
+  - url: URL/c
+  - url: URL/pinned
+`)
+	r.run(t)
+	// content that API clients pulled, before or after it was listed, is theirs
+	r.pullAPI(t, "/api")
+	r.pullAPI(t, "/b")
+	if err := r.meta.Pin(r.url+"/pinned", "api"); err != nil {
+		t.Fatalf("pin: %v", err)
+	}
+
+	// the manifest asks for pruning
+	r.write(t, `
+prune: true
+entries:
+  - url: URL/a
+`)
+	status := r.run(t)
+	// b was pulled by the reconciler first, and so is pruned even though an API client pulled
+	// it again; the pinned entry stays
+	wantPruned := []string{r.url + "/b", r.url + "/c"}
+	pruned := slices.Clone(status.Pruned)
+	slices.Sort(pruned)
+	if !slices.Equal(pruned, wantPruned) {
+		t.Errorf("pruned: got %v, want %v", pruned, wantPruned)
+	}
+	if got, want := r.names(t), []string{"/a", "/api", "/pinned"}; !slices.Equal(got, want) {
+		t.Errorf("names: got %v, want %v", got, want)
+	}
+	if _, ok := r.meta.Get(r.url + "/c"); ok {
+		t.Errorf("metadata of pruned /c kept")
+	}
+}
+
+func TestReconcilePruneFlag(t *testing.T) {
+	r := newTestReconciler(t, true)
+	r.write(t, `
+entries:
+  - url: URL/a
+  - url: URL/b
+`)
+	r.run(t)
+	r.pullAPI(t, "/api")
+	r.write(t, `
+entries:
+  - url: URL/b
+`)
+	status := r.run(t)
+	if want := []string{r.url + "/a"}; !slices.Equal(status.Pruned, want) {
+		t.Errorf("pruned: got %v, want %v", status.Pruned, want)
+	}
+	if got, want := r.names(t), []string{"/api", "/b"}; !slices.Equal(got, want) {
+		t.Errorf("names: got %v, want %v", got, want)
+	}
+}
+
+func TestReconcileInvalidManifest(t *testing.T) {
+	r := newTestReconciler(t, true)
+	r.write(t, `
+entries:
+  - url: URL/a
+`)
+	r.run(t)
+	// a broken manifest keeps the previous entries and prunes nothing
+	r.write(t, `
+entries:
+  - url: URL/b
+  - url: URL/b
+`)
+	r.reconcile(context.Background())
+	status := r.Status()
+	if !strings.Contains(status.Error, "more than once") {
+		t.Errorf("error: got %q", status.Error)
+	}
+	if len(status.Entries) != 1 || status.Entries[0].URL != r.url+"/a" {
+		t.Errorf("entries: got %+v", status.Entries)
+	}
+	if got, want := r.names(t), []string{"/a"}; !slices.Equal(got, want) {
+		t.Errorf("names: got %v, want %v", got, want)
+	}
+}
@@ -1,7 +1,9 @@
-package server
+package pull
 
 import (
-	"crypto/sha256"
+	// the algorithms of keys must be linked in to hash content with them
+	_ "crypto/sha256"
+	_ "crypto/sha512"
 	"fmt"
 	"io"
 	"os"
@@ -22,7 +24,10 @@ func (r *removeCloser) Close() error {
 	return os.RemoveAll(r.path)
 }
 
-func downloadAndHash(r io.ReadCloser) (key string, size int64, reader io.ReadCloser, err error) {
+// downloadAndHash stage the content in a temporary file to compute its key, its digest with
+// the algorithm, for caches that cannot ingest content whose key is not known ahead of time.
+// If the copy fails, e.g. because the download was canceled, the staged content is removed.
+func downloadAndHash(r io.ReadCloser, alg digest.Algorithm) (key string, size int64, reader io.ReadCloser, err error) {
 	dir, err := os.MkdirTemp("", "nekko-storage-manager-download")
 	if err != nil {
 		return key, size, nil, err
@@ -30,11 +35,18 @@ func downloadAndHash(r io.ReadCloser) (key string, size int64, reader io.ReadClo
 	p := path.Join(dir, "download")
 	f, err := os.Create(p)
 	if err != nil {
+		os.RemoveAll(dir)
 		return key, size, nil, err
 	}
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.RemoveAll(dir)
+		}
+	}()
 
-	digester := sha256.New()
-	multi := io.MultiWriter(digester, f)
+	digester := alg.Digester()
+	multi := io.MultiWriter(digester.Hash(), f)
 	n, err := io.Copy(multi, r)
 	if err != nil {
 		return key, size, nil, err
@@ -46,6 +58,6 @@ func downloadAndHash(r io.ReadCloser) (key string, size int64, reader io.ReadClo
 	if _, err := f.Seek(0, 0); err != nil {
 		return key, size, nil, fmt.Errorf("could not seek to the beginning of the file: %v", err)
 	}
-	key = digest.NewDigestFromEncoded(digest.SHA256, fmt.Sprintf("%x", digester.Sum(nil))).String()
-	return key, size, &removeCloser{f, dir}, nil
+	key = digester.Digest().String()
+	return key, n, &removeCloser{f, dir}, nil
 }
@@ -0,0 +1,34 @@
+package pull
+
+import "fmt"
+
+var (
+	_ error = &InvalidSourceError{}
+	_ error = &DigestMismatchError{}
+)
+
+// InvalidSourceError the content source could not be turned into a downloader
+type InvalidSourceError struct {
+	URL string
+	Err error
+}
+
+func (e *InvalidSourceError) Error() string {
+	return fmt.Sprintf("invalid source %s: %v", e.URL, e.Err)
+}
+
+func (e *InvalidSourceError) Unwrap() error {
+	return e.Err
+}
+
+// DigestMismatchError the content from the source does not have the digest it was expected to
+type DigestMismatchError struct {
+	URL      string
+	Expected string
+	// Actual the key of the root of the content that was found
+	Actual string
+}
+
+func (e *DigestMismatchError) Error() string {
+	return fmt.Sprintf("content %s is %s, not the expected %s", e.URL, e.Actual, e.Expected)
+}
@@ -0,0 +1,58 @@
+package pull
+
+import (
+	"context"
+	"sync"
+)
+
+// limiter limits the number of concurrent pulls. Unlike a fixed semaphore, its limit can be
+// changed while pulls are running; a limit of 0 or less means no limit.
+type limiter struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	limit   int
+	running int
+}
+
+func newLimiter() *limiter {
+	l := &limiter{}
+	l.cond = sync.NewCond(&l.mu)
+	return l
+}
+
+// SetLimit change the limit, waking any waiting pulls that now fit
+func (l *limiter) SetLimit(limit int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.limit = limit
+	l.cond.Broadcast()
+}
+
+// Acquire wait for a free slot, returning a function to release it, or an error if the
+// context is canceled first
+func (l *limiter) Acquire(ctx context.Context) (func(), error) {
+	// wake up to notice that the context is done
+	stop := context.AfterFunc(ctx, func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		l.cond.Broadcast()
+	})
+	defer stop()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for l.limit > 0 && l.running >= l.limit {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		l.cond.Wait()
+	}
+	l.running++
+	return func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		l.running--
+		// waiters that were canceled leave without taking the slot, so wake them all
+		l.cond.Broadcast()
+	}, nil
+}
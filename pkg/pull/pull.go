@@ -0,0 +1,734 @@
+package pull
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aifoundry-org/storage-manager/pkg/api"
+	"github.com/aifoundry-org/storage-manager/pkg/cache"
+	"github.com/aifoundry-org/storage-manager/pkg/cache/metadata"
+	"github.com/aifoundry-org/storage-manager/pkg/download"
+	"github.com/aifoundry-org/storage-manager/pkg/download/oci"
+	downloadparser "github.com/aifoundry-org/storage-manager/pkg/download/parser"
+
+	"github.com/opencontainers/go-digest"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sync/errgroup"
+)
+
+// ProgressFunc receives progress updates while content is written to the cache.
+type ProgressFunc func(api.Progress)
+
+// Quota makes room in the cache for new content
+type Quota interface {
+	// Reserve make room for size more bytes, in the cache and on disk, holding it until
+	// release is called
+	Reserve(ctx context.Context, size int64) (release func(), err error)
+	// Enforce bring the cache back within its limit
+	Enforce(ctx context.Context) error
+}
+
+// Puller ensures that content from a source is present in a cache, downloading it if needed,
+// and names the root of the content with the source URL.
+type Puller struct {
+	cache   cache.Cache
+	limiter *limiter
+	logger  *log.Logger
+
+	mu    sync.RWMutex
+	opts  download.Options
+	meta  *metadata.Store
+	quota Quota
+	// blobConcurrency how many blobs of a single pull are written at the same time
+	blobConcurrency int
+	// timeout how long a single pull may take, 0 for no limit
+	timeout time.Duration
+	// algorithm the digest algorithm of the keys of content whose key is not known ahead of
+	// time
+	algorithm digest.Algorithm
+}
+
+// DefaultBlobConcurrency how many blobs of a single pull are written at the same time, unless
+// set otherwise
+const DefaultBlobConcurrency = 4
+
+// New create a new Puller for the given cache
+func New(c cache.Cache, logger *log.Logger) *Puller {
+	if logger == nil {
+		logger = log.New()
+	}
+	return &Puller{
+		cache:   c,
+		limiter: newLimiter(),
+		logger:  logger,
+
+		blobConcurrency: DefaultBlobConcurrency,
+		algorithm:       digest.Canonical,
+	}
+}
+
+// SetOptions change the options passed to downloaders for subsequent pulls
+func (p *Puller) SetOptions(opts download.Options) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.opts = opts
+}
+
+// Options get the options passed to downloaders
+func (p *Puller) Options() download.Options {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.opts
+}
+
+// SetMetadata set the store in which access to content is recorded
+func (p *Puller) SetMetadata(meta *metadata.Store) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.meta = meta
+}
+
+// SetQuota set the quota that must make room for new content before it is written
+func (p *Puller) SetQuota(quota Quota) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.quota = quota
+}
+
+// touch record that the content was accessed
+func (p *Puller) touch(name string) {
+	p.mu.RLock()
+	meta := p.meta
+	p.mu.RUnlock()
+	if meta == nil {
+		return
+	}
+	if err := meta.Touch(name); err != nil {
+		p.logger.Warnf("could not record access to %s: %v", name, err)
+	}
+}
+
+// selection which manifests of an OCI index the pull asks for, as platform and artifact type;
+// empty for content that is not an OCI image
+func selection(content download.ContentSource, opts download.Options) string {
+	if !strings.HasPrefix(content.URL, "oci://") {
+		return ""
+	}
+	opts = opts.ForSource(content)
+	// as the downloader matches manifests against it
+	platform := oci.SelectedPlatform(opts)
+	if opts.ArtifactType == "" {
+		return platform
+	}
+	return platform + " " + opts.ArtifactType
+}
+
+// selected whether the content in the cache was pulled with the selection, or may have been
+func (p *Puller) selected(name, sel string) bool {
+	p.mu.RLock()
+	meta := p.meta
+	p.mu.RUnlock()
+	if meta == nil || sel == "" {
+		return true
+	}
+	entry, ok := meta.Get(name)
+	if !ok || len(entry.Selections) == 0 {
+		return true
+	}
+	return slices.Contains(entry.Selections, sel) || slices.Contains(entry.Selections, "all")
+}
+
+// verified whether the signatures of the content in the cache were verified, or may have been
+func (p *Puller) verified(name string) bool {
+	p.mu.RLock()
+	meta := p.meta
+	p.mu.RUnlock()
+	if meta == nil {
+		return true
+	}
+	entry, _ := meta.Get(name)
+	return entry.Verification != nil
+}
+
+// record what is known about the content once the downloader pulled it: the selection it was
+// pulled with, the signatures that were verified and the validators of its source, if any,
+// and that its source was checked at now
+func (p *Puller) record(name, sel string, downloader download.Downloader, now time.Time) error {
+	p.mu.RLock()
+	meta := p.meta
+	p.mu.RUnlock()
+	if meta == nil {
+		return nil
+	}
+	var (
+		verification *api.Verification
+		validators   *api.Validators
+	)
+	if v, ok := downloader.(download.Verifier); ok {
+		verification = v.Verification()
+	}
+	if v, ok := downloader.(download.Revalidator); ok {
+		validators = v.Validators()
+	}
+	return meta.Update(name, func(e *metadata.Entry) {
+		if sel != "" && !slices.Contains(e.Selections, sel) {
+			e.Selections = append(e.Selections, sel)
+		}
+		if verification != nil {
+			e.Verification = verification
+		}
+		if validators != nil {
+			e.Validators = validators
+		}
+		e.CheckedAt = now
+	})
+}
+
+// refreshDue whether the source of the content in the cache must be checked for changes
+func (p *Puller) refreshDue(name string, policy download.RefreshPolicy) bool {
+	p.mu.RLock()
+	meta := p.meta
+	p.mu.RUnlock()
+	var checkedAt time.Time
+	if meta != nil {
+		entry, _ := meta.Get(name)
+		checkedAt = entry.CheckedAt
+	}
+	return policy.Due(checkedAt, time.Now())
+}
+
+// changed whether the source of the content in the cache now has different content, so that
+// it must be pulled again. If the source cannot be checked, the content in the cache is used.
+func (p *Puller) changed(ctx context.Context, content download.ContentSource) bool {
+	p.mu.RLock()
+	opts, meta := p.opts, p.meta
+	p.mu.RUnlock()
+	if opts.Logger == nil {
+		opts.Logger = p.logger
+	}
+	source, err := opts.WithCredentials(ctx, content)
+	if err != nil {
+		p.logger.Warnf("could not look up credentials for %s: %v", content.URL, err)
+	}
+	downloader, err := downloadparser.Parse(source, opts)
+	if err != nil {
+		return false
+	}
+	var modified bool
+	switch d := downloader.(type) {
+	case download.Refresher:
+		modified, err = p.refreshed(ctx, content.URL, d)
+	case download.Revalidator:
+		modified, err = p.revalidated(ctx, content.URL, meta, d)
+	default:
+		return false
+	}
+	if err != nil {
+		p.logger.Warnf("could not check %s for changes, using the content in the cache: %v", content.URL, err)
+		return false
+	}
+	if modified {
+		return true
+	}
+	if meta != nil {
+		if err := meta.Update(content.URL, func(e *metadata.Entry) { e.CheckedAt = time.Now() }); err != nil {
+			p.logger.Warnf("could not record check of %s: %v", content.URL, err)
+		}
+	}
+	return false
+}
+
+// refreshed whether the source now has a different root than the content in the cache
+func (p *Puller) refreshed(ctx context.Context, name string, refresher download.Refresher) (bool, error) {
+	current, err := refresher.Current(ctx)
+	if err != nil {
+		return false, err
+	}
+	key, err := p.cache.Resolve(ctx, name)
+	if err != nil || current == "" {
+		return false, nil
+	}
+	if current != key {
+		p.logger.Infof("%s changed from %s to %s, pulling it again", name, key, current)
+		return true, nil
+	}
+	return false, nil
+}
+
+// revalidated whether the source no longer matches the validators it sent with the content in
+// the cache. Content cached before its validators were recorded is pulled again to record them.
+func (p *Puller) revalidated(ctx context.Context, name string, meta *metadata.Store, revalidator download.Revalidator) (bool, error) {
+	if meta == nil {
+		return false, nil
+	}
+	var validators api.Validators
+	if entry, _ := meta.Get(name); entry.Validators != nil {
+		validators = *entry.Validators
+	}
+	modified, err := revalidator.Modified(ctx, validators)
+	if err != nil {
+		return false, err
+	}
+	if modified {
+		p.logger.Infof("%s changed at its source, pulling it again", name)
+	}
+	return modified, nil
+}
+
+// matches whether the name resolves to content with the expected digest
+func (p *Puller) matches(ctx context.Context, name string, expected digest.Digest) (bool, error) {
+	key, err := p.cache.Resolve(ctx, name)
+	if err != nil {
+		return false, fmt.Errorf("could not resolve %s: %v", name, err)
+	}
+	err = p.check(ctx, name, key, expected)
+	var mismatch *DigestMismatchError
+	if errors.As(err, &mismatch) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// check that the content of the key has the expected digest. Keys of the same algorithm are
+// compared; for any other, the content is read from the cache and hashed.
+func (p *Puller) check(ctx context.Context, name, key string, expected digest.Digest) error {
+	mismatch := &DigestMismatchError{URL: name, Expected: expected.String(), Actual: key}
+	if digest.Digest(key).Algorithm() == expected.Algorithm() {
+		if key != expected.String() {
+			return mismatch
+		}
+		return nil
+	}
+	rc, err := p.cache.Get(ctx, key)
+	if err != nil {
+		return fmt.Errorf("could not read %s: %v", key, err)
+	}
+	defer rc.Close()
+	verifier := expected.Verifier()
+	if _, err := io.Copy(verifier, rc); err != nil {
+		return fmt.Errorf("could not read %s: %v", key, err)
+	}
+	if !verifier.Verified() {
+		return mismatch
+	}
+	return nil
+}
+
+// expire record when the content should be removed from the cache. A zero time leaves any
+// expiry from an earlier pull in place.
+func (p *Puller) expire(name string, at time.Time) error {
+	p.mu.RLock()
+	meta := p.meta
+	p.mu.RUnlock()
+	if meta == nil || at.IsZero() {
+		return nil
+	}
+	return meta.Update(name, func(e *metadata.Entry) {
+		e.ExpiresAt = at
+	})
+}
+
+// SetBlobConcurrency change how many blobs of a single pull are written at the same time,
+// for subsequent pulls. 0 means DefaultBlobConcurrency.
+func (p *Puller) SetBlobConcurrency(n int) {
+	if n <= 0 {
+		n = DefaultBlobConcurrency
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.blobConcurrency = n
+}
+
+// SetTimeout change how long subsequent pulls may take, including waiting for a free slot,
+// before they are canceled. 0 means no limit.
+func (p *Puller) SetTimeout(timeout time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.timeout = timeout
+}
+
+// SetDigestAlgorithm change the digest algorithm of the keys of content whose key is not known
+// ahead of time, such as files downloaded over http, for subsequent pulls. Empty means the
+// canonical algorithm, sha256.
+func (p *Puller) SetDigestAlgorithm(alg digest.Algorithm) {
+	if alg == "" {
+		alg = digest.Canonical
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.algorithm = alg
+}
+
+// SetMaxConcurrent change the number of pulls that may download at the same time. Pulls over
+// the limit wait for a running one to finish. 0 means no limit.
+func (p *Puller) SetMaxConcurrent(n int) {
+	p.limiter.SetLimit(n)
+}
+
+// Pull ensure that the provided content is in the cache, returning the key of its root.
+// progress may be nil. Canceling the context stops the download, and leaves nothing of the
+// content that was not yet written behind in the cache.
+func (p *Puller) Pull(ctx context.Context, content download.ContentSource, progress ProgressFunc) (string, error) {
+	if progress == nil {
+		progress = func(api.Progress) {}
+	}
+	expiresAt, err := content.Expiry(time.Now())
+	if err != nil {
+		return "", &InvalidSourceError{URL: content.URL, Err: err}
+	}
+	expected, err := content.ExpectedDigest()
+	if err != nil {
+		return "", &InvalidSourceError{URL: content.URL, Err: err}
+	}
+	p.mu.RLock()
+	sel := selection(content, p.opts)
+	mustVerify := p.opts.Verify.Applies(content.URL)
+	refresh := p.opts.RefreshFor(content.URL)
+	p.mu.RUnlock()
+	// check if the content is in the cache
+	exists, err := p.cache.Exists(ctx, content.URL)
+	if err != nil {
+		return "", fmt.Errorf("error checking if content %s exists: %v", content.URL, err)
+	}
+	// an index pulled for another platform is pulled again, which only downloads the
+	// manifests that are missing
+	if exists && !p.selected(content.URL, sel) {
+		p.logger.Debugf("pull %s exists, but not for %s", content.URL, sel)
+		exists = false
+	}
+	// content cached before its signatures had to be verified is verified now
+	if exists && mustVerify && !p.verified(content.URL) {
+		p.logger.Debugf("pull %s exists, but was not verified", content.URL)
+		exists = false
+	}
+	// content that must have a digest only needs to be checked against it, however old it is
+	if exists && expected != "" {
+		if exists, err = p.matches(ctx, content.URL, expected); err != nil {
+			return "", err
+		}
+		if !exists {
+			p.logger.Debugf("pull %s exists, but not with digest %s", content.URL, expected)
+		}
+	} else if exists && p.refreshDue(content.URL, refresh) && p.changed(ctx, content) {
+		// a tag may point elsewhere by now, or a file may have been replaced; only the blobs
+		// that changed are downloaded again
+		exists = false
+	}
+	// the same content may be in the cache from another URL, in which case it only needs a
+	// name. Content that must be verified, or whose manifests depend on the platform, is
+	// pulled, which still only downloads what is missing.
+	if !exists && expected != "" && sel == "" && !mustVerify {
+		found, err := p.cache.Exists(ctx, expected.String())
+		if err != nil {
+			return "", fmt.Errorf("error checking if key %s exists: %v", expected, err)
+		}
+		if found {
+			p.logger.Debugf("pull %s found in the cache as %s", content.URL, expected)
+			if err := p.cache.Name(ctx, expected.String(), content.URL); err != nil {
+				return "", fmt.Errorf("error tagging root %s: %v", content.URL, err)
+			}
+			if err := p.record(content.URL, sel, nil, time.Now()); err != nil {
+				return "", fmt.Errorf("could not record pull of %s: %v", content.URL, err)
+			}
+			exists = true
+		}
+	}
+
+	if exists {
+		p.logger.Debugf("pull %s already exists", content.URL)
+		// content that is only in the shared tier is copied to the local tier, to be used
+		if err := cache.Promote(ctx, p.cache, content.URL); err != nil {
+			return "", fmt.Errorf("could not copy %s to the local tier: %v", content.URL, err)
+		}
+		key, err := p.cache.Resolve(ctx, content.URL)
+		if err != nil {
+			return "", fmt.Errorf("could not resolve %s: %v", content.URL, err)
+		}
+		if key == "" {
+			return "", &cache.NotFoundError{Key: content.URL}
+		}
+		if err := p.expire(content.URL, expiresAt); err != nil {
+			return "", fmt.Errorf("could not record expiry of %s: %v", content.URL, err)
+		}
+		p.touch(content.URL)
+		return key, nil
+	}
+	// it does not, so download it
+	p.mu.RLock()
+	opts, quota, concurrency, timeout, algorithm := p.opts, p.quota, p.blobConcurrency, p.timeout, p.algorithm
+	p.mu.RUnlock()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	release, err := p.limiter.Acquire(ctx)
+	if err != nil {
+		return "", fmt.Errorf("error waiting to pull content %s: %w", content.URL, err)
+	}
+	defer release()
+	if opts.Logger == nil {
+		opts.Logger = p.logger
+	}
+	source, err := opts.WithCredentials(ctx, content)
+	if err != nil {
+		// credentials found elsewhere, or none at all, may still do
+		p.logger.Warnf("could not look up credentials for %s: %v", content.URL, err)
+	}
+	downloader, err := downloadparser.Parse(source, opts)
+	if err != nil {
+		return "", &InvalidSourceError{URL: content.URL, Err: err}
+	}
+
+	// blobs are written in parallel, but progress is reported one update at a time
+	var progressMu sync.Mutex
+	report := func(update api.Progress) {
+		progressMu.Lock()
+		defer progressMu.Unlock()
+		progress(update)
+	}
+	// nothing names the blobs until the root is named at the end, so keep them from being
+	// cleaned up in the meantime
+	var (
+		releaseMu sync.Mutex
+		releases  []func()
+	)
+	defer func() {
+		for _, release := range releases {
+			release()
+		}
+	}()
+	keep := func(release func()) {
+		releaseMu.Lock()
+		defer releaseMu.Unlock()
+		releases = append(releases, release)
+	}
+
+	var root string
+	err = downloader.Download(ctx, func(blobs []download.Blob) error {
+		if len(blobs) == 0 {
+			return fmt.Errorf("no content found for %s", content.URL)
+		}
+		// fail before writing anything if the root is known not to have the digest
+		if key := blobs[0].Key; key != "" && expected != "" && digest.Digest(key).Algorithm() == expected.Algorithm() && key != expected.String() {
+			return &DigestMismatchError{URL: content.URL, Expected: expected.String(), Actual: key}
+		}
+		// blobs already in the cache are protected first, so that evicting other content that
+		// shares them to make room cannot remove them after they were left out of what is missing
+		if protector, ok := p.cache.(cache.Protector); ok {
+			for _, blob := range blobs {
+				if blob.Key != "" {
+					keep(protector.Protect(blob.Key))
+				}
+			}
+		}
+		// fail before writing anything if the content whose size is known cannot fit
+		if quota != nil {
+			missing, err := p.missing(ctx, blobs)
+			if err != nil {
+				return err
+			}
+			release, err := quota.Reserve(ctx, missing)
+			if err != nil {
+				return fmt.Errorf("could not make room for %s: %w", content.URL, err)
+			}
+			// the room is held for the pull until its content is written and named
+			keep(release)
+		}
+
+		keys := make([]string, len(blobs))
+		g, ctx := errgroup.WithContext(ctx)
+		g.SetLimit(concurrency)
+		for i, blob := range blobs {
+			// a root that must have a digest is keyed by it, so it is found by that digest
+			alg := algorithm
+			if i == 0 && expected != "" {
+				alg = expected.Algorithm()
+			}
+			g.Go(func() error {
+				// once one blob failed, the rest are not even opened
+				if ctx.Err() != nil {
+					return nil
+				}
+				key, release, err := p.write(ctx, blob, alg, quota, report)
+				if err != nil {
+					return err
+				}
+				keep(release)
+				keys[i] = key
+				return nil
+			})
+		}
+		if err := g.Wait(); err != nil {
+			return err
+		}
+		root = keys[0]
+		return nil
+	})
+	if err != nil {
+		// whatever was interrupted by canceling only reports its own failure
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			err = ctxErr
+		}
+		return "", fmt.Errorf("error pulling content %s: %w", content.URL, err)
+	}
+	// the root is still protected, and is removed by GC if it is not the expected content
+	if expected != "" {
+		if err := p.check(ctx, content.URL, root, expected); err != nil {
+			return "", err
+		}
+	}
+	if err := p.cache.Name(ctx, root, content.URL); err != nil {
+		return "", fmt.Errorf("error tagging root %s: %v", content.URL, err)
+	}
+	if err := p.record(content.URL, sel, downloader, time.Now()); err != nil {
+		return "", fmt.Errorf("could not record pull of %s: %v", content.URL, err)
+	}
+	if err := p.expire(content.URL, expiresAt); err != nil {
+		return "", fmt.Errorf("could not record expiry of %s: %v", content.URL, err)
+	}
+	p.touch(content.URL)
+	return root, nil
+}
+
+// write a single blob into the cache, unless it is already there, returning its key. The
+// blob is only opened once it is written. Blobs whose key is not known ahead of time are
+// keyed by their digest with alg, and protected from GC until release is called.
+func (p *Puller) write(ctx context.Context, blob download.Blob, alg digest.Algorithm, quota Quota, progress ProgressFunc) (key string, release func(), err error) {
+	release = func() {}
+	if blob.Key != "" {
+		exists, err := p.cache.Exists(ctx, blob.Key)
+		if err != nil {
+			return "", nil, fmt.Errorf("error checking if key %s exists: %v", blob.Key, err)
+		}
+		if exists {
+			p.logger.Debugf("pull key %s already exists", blob.Key)
+			progress(api.Progress{Key: blob.Key, Size: blob.Size, Written: blob.Size, Done: true})
+			return blob.Key, release, nil
+		}
+	}
+	rc, err := blob.Open(ctx)
+	if err != nil {
+		return "", nil, fmt.Errorf("could not open %s: %w", blob.Key, err)
+	}
+	reader := &progressReader{
+		ReadCloser: rc,
+		progress:   progress,
+		update:     api.Progress{Key: blob.Key, Size: blob.Size},
+	}
+	defer reader.Close()
+
+	key = blob.Key
+	ingester, _ := p.cache.(cache.Ingester)
+	switch {
+	case key == "" && ingester != nil:
+		// content whose key is not known ahead of time is hashed as it is written into the cache
+		var size int64
+		key, size, release, err = ingester.Ingest(ctx, alg, reader)
+		if err != nil {
+			return "", nil, fmt.Errorf("error putting content into cache: %w", err)
+		}
+		p.logger.Debugf("pull ingested into cache key %s", key)
+		reader.update.Key, reader.update.Size = key, size
+	case key == "":
+		// caches that cannot ingest need the key up front, so the content is staged elsewhere
+		// to hash it first
+		staged, err := p.stage(ctx, reader, alg)
+		if err != nil {
+			return "", nil, err
+		}
+		key, release = staged.Key, staged.release
+		reader.update.Key, reader.update.Size = staged.Key, staged.Size
+	default:
+		p.logger.Debugf("pull putting into cache key %s", key)
+		if err := p.cache.Put(ctx, key, blob.Size, reader); err != nil {
+			return "", nil, fmt.Errorf("error putting into cache key %s: %w", key, err)
+		}
+	}
+	reader.update.Done = true
+	progress(reader.update)
+	// content of unknown size could only be accounted for once it was written
+	if quota != nil && blob.Size <= 0 {
+		if err := quota.Enforce(ctx); err != nil {
+			release()
+			return "", nil, fmt.Errorf("could not make room for key %s: %w", key, err)
+		}
+	}
+	return key, release, nil
+}
+
+// stagedBlob a blob staged to compute its key, and written into the cache
+type stagedBlob struct {
+	Key     string
+	Size    int64
+	release func()
+}
+
+// stage download the content to a temporary file to compute its key with alg, then put it
+// into the cache, protected from GC until release is called
+func (p *Puller) stage(ctx context.Context, r io.Reader, alg digest.Algorithm) (stagedBlob, error) {
+	key, size, staged, err := downloadAndHash(io.NopCloser(r), alg)
+	if err != nil {
+		return stagedBlob{}, fmt.Errorf("error downloading and hashing: %w", err)
+	}
+	defer staged.Close()
+	release := func() {}
+	if protector, ok := p.cache.(cache.Protector); ok {
+		release = protector.Protect(key)
+	}
+	exists, err := p.cache.Exists(ctx, key)
+	if err != nil {
+		release()
+		return stagedBlob{}, fmt.Errorf("error checking if key %s exists: %v", key, err)
+	}
+	if !exists {
+		if err := p.cache.Put(ctx, key, size, staged); err != nil {
+			release()
+			return stagedBlob{}, fmt.Errorf("error putting into cache key %s: %w", key, err)
+		}
+	}
+	return stagedBlob{Key: key, Size: size, release: release}, nil
+}
+
+// missing the total size of the content that is known ahead of time and not yet in the cache
+func (p *Puller) missing(ctx context.Context, blobs []download.Blob) (int64, error) {
+	var missing int64
+	for _, blob := range blobs {
+		if blob.Size <= 0 {
+			continue
+		}
+		if blob.Key != "" {
+			exists, err := p.cache.Exists(ctx, blob.Key)
+			if err != nil {
+				return 0, fmt.Errorf("error checking if key %s exists: %v", blob.Key, err)
+			}
+			if exists {
+				continue
+			}
+		}
+		missing += blob.Size
+	}
+	return missing, nil
+}
+
+// progressReader reports the number of bytes read through it
+type progressReader struct {
+	io.ReadCloser
+	progress ProgressFunc
+	update   api.Progress
+}
+
+func (r *progressReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if n > 0 {
+		r.update.Written += int64(n)
+		r.progress(r.update)
+	}
+	return n, err
+}
@@ -0,0 +1,350 @@
+package quota
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aifoundry-org/storage-manager/pkg/cache"
+	"github.com/aifoundry-org/storage-manager/pkg/cache/metadata"
+	"github.com/aifoundry-org/storage-manager/pkg/disk"
+	"github.com/aifoundry-org/storage-manager/pkg/events"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Limit the maximum size of the cache, either in bytes or as a percentage of the filesystem
+// holding it. The zero Limit means no limit.
+type Limit struct {
+	Bytes   int64
+	Percent float64
+}
+
+var sizeUnits = map[string]int64{
+	"":    1,
+	"B":   1,
+	"K":   1 << 10,
+	"KB":  1000,
+	"KIB": 1 << 10,
+	"M":   1 << 20,
+	"MB":  1000 * 1000,
+	"MIB": 1 << 20,
+	"G":   1 << 30,
+	"GB":  1000 * 1000 * 1000,
+	"GIB": 1 << 30,
+	"T":   1 << 40,
+	"TB":  1000 * 1000 * 1000 * 1000,
+	"TIB": 1 << 40,
+}
+
+// ParseLimit parse a limit, either a size such as 500G, 1.5TiB or 1000000, or a percentage of
+// the filesystem such as 80%. An empty string or 0 means no limit.
+func ParseLimit(s string) (Limit, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return Limit{}, nil
+	}
+	if pct, ok := strings.CutSuffix(s, "%"); ok {
+		p, err := strconv.ParseFloat(strings.TrimSpace(pct), 64)
+		if err != nil || p < 0 || p > 100 {
+			return Limit{}, fmt.Errorf("invalid percentage %s", s)
+		}
+		return Limit{Percent: p}, nil
+	}
+	i := strings.IndexFunc(s, func(r rune) bool { return (r < '0' || r > '9') && r != '.' })
+	number, unit := s, ""
+	if i >= 0 {
+		number, unit = s[:i], strings.ToUpper(strings.TrimSpace(s[i:]))
+	}
+	multiplier, ok := sizeUnits[unit]
+	if !ok {
+		return Limit{}, fmt.Errorf("invalid size unit %s in %s", unit, s)
+	}
+	n, err := strconv.ParseFloat(number, 64)
+	if err != nil || n < 0 {
+		return Limit{}, fmt.Errorf("invalid size %s", s)
+	}
+	return Limit{Bytes: int64(n * float64(multiplier))}, nil
+}
+
+// IsZero whether the limit is no limit at all
+func (l Limit) IsZero() bool {
+	return l.Bytes == 0 && l.Percent == 0
+}
+
+func (l Limit) String() string {
+	if l.Percent != 0 {
+		return fmt.Sprintf("%g%%", l.Percent)
+	}
+	return strconv.FormatInt(l.Bytes, 10)
+}
+
+var _ error = &ExceededError{}
+
+// ExceededError content does not fit in the cache even after evicting everything that may be evicted
+type ExceededError struct {
+	Need  int64
+	Usage int64
+	Max   int64
+	// Reserved bytes reserved by other pulls that are still writing
+	Reserved int64
+}
+
+func (e *ExceededError) Error() string {
+	if e.Reserved > 0 {
+		return fmt.Sprintf("cache quota exceeded: need %d bytes with %d of %d in use and %d reserved by other pulls, and nothing more can be evicted", e.Need, e.Usage, e.Max, e.Reserved)
+	}
+	return fmt.Sprintf("cache quota exceeded: need %d bytes with %d of %d in use, and nothing more can be evicted", e.Need, e.Usage, e.Max)
+}
+
+var _ error = &InsufficientStorageError{}
+
+// InsufficientStorageError content does not fit on the filesystem holding the cache, keeping
+// the reserve free, even after evicting everything that may be evicted
+type InsufficientStorageError struct {
+	Need    int64
+	Free    int64
+	Reserve int64
+	// Reserved bytes reserved by other pulls that are still writing
+	Reserved int64
+}
+
+func (e *InsufficientStorageError) Error() string {
+	if e.Reserved > 0 {
+		return fmt.Sprintf("insufficient storage: need %d bytes with %d free, of which %d are reserved and %d reserved by other pulls", e.Need, e.Free, e.Reserve, e.Reserved)
+	}
+	return fmt.Sprintf("insufficient storage: need %d bytes with %d free, of which %d are reserved", e.Need, e.Free, e.Reserve)
+}
+
+// Policy enforces a maximum size on a cache, by evicting the least recently used names that
+// are not pinned or leased, and cleaning up their content. It also keeps new content from
+// filling the filesystem holding the cache beyond a reserve of free space.
+type Policy struct {
+	cache  cache.Cache
+	sizer  cache.Sizer
+	meta   *metadata.Store
+	dir    string
+	events *events.Bus
+	logger *log.Logger
+
+	// mu serializes evictions, and protects limit, reserve and reserved
+	mu      sync.Mutex
+	limit   Limit
+	reserve Limit
+	// reserved bytes reserved by pulls that are still writing, which count as used, so that
+	// pulls at the same time do not all make room in the same space
+	reserved int64
+}
+
+// New create a policy for a cache, which must be able to report its usage. dir is where the
+// cache keeps its content, and is used to resolve percentage limits.
+func New(c cache.Cache, meta *metadata.Store, dir string, limit Limit, bus *events.Bus, logger *log.Logger) (*Policy, error) {
+	sizer, ok := c.(cache.Sizer)
+	if !ok {
+		return nil, fmt.Errorf("cache cannot report its usage, so a quota cannot be enforced")
+	}
+	if logger == nil {
+		logger = log.New()
+	}
+	return &Policy{
+		cache:  c,
+		sizer:  sizer,
+		meta:   meta,
+		dir:    dir,
+		limit:  limit,
+		events: bus,
+		logger: logger,
+	}, nil
+}
+
+// SetLimit change the limit, which applies from the next Reserve or Enforce
+func (p *Policy) SetLimit(limit Limit) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.limit = limit
+}
+
+// SetReserve change how much of the filesystem holding the cache is kept free, which applies
+// from the next Reserve
+func (p *Policy) SetReserve(reserve Limit) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.reserve = reserve
+}
+
+// Max the maximum size of the cache in bytes, 0 if there is no limit
+func (p *Policy) Max() (int64, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.max()
+}
+
+// Reserve make room for size more bytes in the cache, both within the limit and on the
+// filesystem, evicting if needed, and hold it until release is called, once the content is
+// written. Without a limit nothing is evicted, and content that does not fit on the
+// filesystem returns an *InsufficientStorageError. Content that is being written counts both
+// as reserved and as what it already uses, which errs on making more room.
+func (p *Policy) Reserve(ctx context.Context, size int64) (release func(), err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err := p.evict(ctx, size, p.reserved); err != nil {
+		return nil, err
+	}
+	if size <= 0 {
+		return func() {}, nil
+	}
+	p.reserved += size
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			p.mu.Lock()
+			defer p.mu.Unlock()
+			p.reserved -= size
+		})
+	}, nil
+}
+
+// Enforce bring the cache back within its limit, evicting if needed. Reservations do not
+// count, as only content already in the cache is over the limit.
+func (p *Policy) Enforce(ctx context.Context) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.evict(ctx, 0, 0)
+}
+
+// max must be called with the lock held
+func (p *Policy) max() (int64, error) {
+	return p.bytes(p.limit)
+}
+
+// bytes resolve a limit to bytes, 0 if there is no limit. Must be called with the lock held.
+func (p *Policy) bytes(l Limit) (int64, error) {
+	if l.Percent == 0 {
+		return l.Bytes, nil
+	}
+	stats, err := disk.Stat(p.dir)
+	if err != nil {
+		return 0, err
+	}
+	return int64(float64(stats.Total) * l.Percent / 100), nil
+}
+
+// evict the least recently used names until need more bytes fit, both within the limit and
+// on the filesystem, besides the bytes reserved. Must be called with the lock held.
+func (p *Policy) evict(ctx context.Context, need, reserved int64) error {
+	max, err := p.max()
+	if err != nil {
+		return err
+	}
+	reserve, err := p.bytes(p.reserve)
+	if err != nil {
+		return err
+	}
+	// walking the cache is only worth it if there is a limit to compare against
+	var usage int64
+	if max > 0 {
+		if usage, err = p.sizer.Usage(); err != nil {
+			return err
+		}
+	}
+	// check whether need fits, returning an *ExceededError or *InsufficientStorageError if not
+	check := func(usage int64) error {
+		if max > 0 && usage+reserved+need > max {
+			return &ExceededError{Need: need, Usage: usage, Max: max, Reserved: reserved}
+		}
+		// only new content can fill the filesystem
+		if need <= 0 {
+			return nil
+		}
+		stats, err := disk.Stat(p.dir)
+		if err != nil {
+			return err
+		}
+		if stats.Free-reserve-reserved < need {
+			return &InsufficientStorageError{Need: need, Free: stats.Free, Reserve: reserve, Reserved: reserved}
+		}
+		return nil
+	}
+	fits := check(usage)
+	// without a limit, nothing may be evicted
+	if !full(fits) || max == 0 {
+		return fits
+	}
+
+	candidates, err := p.candidates(ctx)
+	if err != nil {
+		return err
+	}
+	for _, name := range candidates {
+		key, err := p.cache.Resolve(ctx, name)
+		if err != nil {
+			continue
+		}
+		if err := p.cache.Unname(ctx, name); err != nil {
+			return fmt.Errorf("could not evict %s: %v", name, err)
+		}
+		if err := p.cache.GC(ctx); err != nil {
+			return fmt.Errorf("could not clean up after evicting %s: %v", name, err)
+		}
+		if err := p.meta.Delete(name); err != nil {
+			p.logger.Warnf("could not remove metadata for evicted %s: %v", name, err)
+		}
+		newUsage, err := p.sizer.Usage()
+		if err != nil {
+			return err
+		}
+		// the reason is whatever did not fit before this eviction
+		reason := fmt.Sprintf("cache quota of %d bytes", max)
+		var storageErr *InsufficientStorageError
+		if errors.As(fits, &storageErr) {
+			reason = fmt.Sprintf("disk reserve of %d bytes", reserve)
+		}
+		p.logger.Infof("evicted %s (%s), freeing %d bytes to make room for %d bytes", name, key, usage-newUsage, need)
+		p.events.Publish(events.Event{
+			Type:    events.TypeEvicted,
+			Name:    name,
+			Key:     key,
+			Size:    usage - newUsage,
+			Message: reason,
+		})
+		usage = newUsage
+		if fits = check(usage); !full(fits) {
+			return fits
+		}
+	}
+	return fits
+}
+
+// full whether the error is because content does not fit
+func full(err error) bool {
+	var (
+		exceededErr *ExceededError
+		storageErr  *InsufficientStorageError
+	)
+	return errors.As(err, &exceededErr) || errors.As(err, &storageErr)
+}
+
+// candidates the names that may be evicted, least recently used first
+func (p *Policy) candidates(ctx context.Context) ([]string, error) {
+	names, err := p.cache.List(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("could not list cache: %v", err)
+	}
+	var candidates []string
+	now := time.Now()
+	for _, name := range names {
+		if e, ok := p.meta.Get(name); ok && e.Protected(now) {
+			continue
+		}
+		candidates = append(candidates, name)
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return p.meta.LastAccess(candidates[i]).Before(p.meta.LastAccess(candidates[j]))
+	})
+	return candidates, nil
+}
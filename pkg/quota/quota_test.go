@@ -0,0 +1,144 @@
+package quota
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aifoundry-org/storage-manager/pkg/cache"
+	"github.com/aifoundry-org/storage-manager/pkg/cache/metadata"
+	"github.com/aifoundry-org/storage-manager/pkg/cache/ocidir"
+
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// put content under its key, returning its descriptor
+func put(t *testing.T, c cache.Cache, mediaType string, content []byte) ocispec.Descriptor {
+	t.Helper()
+	desc := ocispec.Descriptor{MediaType: mediaType, Digest: digest.FromBytes(content), Size: int64(len(content))}
+	if err := c.Put(context.Background(), desc.Digest.String(), desc.Size, io.NopCloser(bytes.NewReader(content))); err != nil {
+		t.Fatalf("put: %v", err)
+	}
+	return desc
+}
+
+// putImage put an image of the config and a layer of its own, and name it
+func putImage(t *testing.T, c cache.Cache, name string, config ocispec.Descriptor, layer string) (manifest, layerDesc ocispec.Descriptor) {
+	t.Helper()
+	layerDesc = put(t, c, ocispec.MediaTypeImageLayer, []byte(strings.Repeat(layer, 1000)))
+	m := ocispec.Manifest{MediaType: ocispec.MediaTypeImageManifest, Config: config, Layers: []ocispec.Descriptor{layerDesc}}
+	m.SchemaVersion = 2
+	b, err := json.Marshal(m)
+	if err != nil {
+		t.Fatalf("marshal manifest: %v", err)
+	}
+	manifest = put(t, c, ocispec.MediaTypeImageManifest, b)
+	if err := c.Name(context.Background(), manifest.Digest.String(), name); err != nil {
+		t.Fatalf("name: %v", err)
+	}
+	return manifest, layerDesc
+}
+
+func TestEvictKeepsContentInUse(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	c, err := ocidir.New(dir, 0)
+	if err != nil {
+		t.Fatalf("new cache: %v", err)
+	}
+	meta, err := metadata.Open(filepath.Join(dir, "metadata.json"))
+	if err != nil {
+		t.Fatalf("open metadata: %v", err)
+	}
+	// both images share their config
+	config := put(t, c, ocispec.MediaTypeImageConfig, []byte(`{"architecture":"amd64"}`))
+	oldManifest, oldLayer := putImage(t, c, "oci://registry.example.com/repo/img:old", config, "o")
+	newManifest, newLayer := putImage(t, c, "oci://registry.example.com/repo/img:new", config, "n")
+	for _, name := range []string{"oci://registry.example.com/repo/img:old", "oci://registry.example.com/repo/img:new"} {
+		if err := meta.Touch(name); err != nil {
+			t.Fatalf("touch: %v", err)
+		}
+	}
+	usage, err := c.Usage()
+	if err != nil {
+		t.Fatalf("usage: %v", err)
+	}
+
+	// only room for one of the images
+	p, err := New(c, meta, dir, Limit{Bytes: usage - oldLayer.Size}, nil, nil)
+	if err != nil {
+		t.Fatalf("new policy: %v", err)
+	}
+	if err := p.Enforce(ctx); err != nil {
+		t.Fatalf("enforce: %v", err)
+	}
+	for _, tc := range []struct {
+		desc ocispec.Descriptor
+		want bool
+	}{
+		{oldManifest, false},
+		{oldLayer, false},
+		{newManifest, true},
+		{newLayer, true},
+		{config, true},
+	} {
+		exists, err := c.Exists(ctx, tc.desc.Digest.String())
+		if err != nil {
+			t.Fatalf("exists: %v", err)
+		}
+		if exists != tc.want {
+			t.Errorf("%s %s exists = %v after evicting the old image, want %v", tc.desc.MediaType, tc.desc.Digest, exists, tc.want)
+		}
+	}
+}
+
+func TestReserveConcurrent(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	c, err := ocidir.New(dir, 0)
+	if err != nil {
+		t.Fatalf("new cache: %v", err)
+	}
+	meta, err := metadata.Open(filepath.Join(dir, "metadata.json"))
+	if err != nil {
+		t.Fatalf("open metadata: %v", err)
+	}
+	usage, err := c.Usage()
+	if err != nil {
+		t.Fatalf("usage: %v", err)
+	}
+	p, err := New(c, meta, dir, Limit{Bytes: usage + 100}, nil, nil)
+	if err != nil {
+		t.Fatalf("new policy: %v", err)
+	}
+
+	release, err := p.Reserve(ctx, 60)
+	if err != nil {
+		t.Fatalf("first reserve: %v", err)
+	}
+	// the first pull has not written anything yet, but its room is taken
+	var exceeded *ExceededError
+	if _, err := p.Reserve(ctx, 60); !errors.As(err, &exceeded) {
+		t.Fatalf("second reserve: got %v, want an ExceededError", err)
+	}
+	if exceeded.Reserved != 60 {
+		t.Errorf("reserved: got %d, want 60", exceeded.Reserved)
+	}
+	release()
+	// releasing twice does not give back more room than was reserved
+	release()
+	second, err := p.Reserve(ctx, 60)
+	if err != nil {
+		t.Fatalf("reserve after release: %v", err)
+	}
+	defer second()
+	if _, err := p.Reserve(ctx, 60); !errors.As(err, &exceeded) {
+		t.Fatalf("third reserve: got %v, want an ExceededError", err)
+	}
+}
@@ -0,0 +1,31 @@
+package retention
+
+import (
+	"fmt"
+	"strings"
+)
+
+var (
+	_ error = &PinnedError{}
+	_ error = &LeaseNotFoundError{}
+)
+
+// PinnedError content cannot be deleted because it is pinned
+type PinnedError struct {
+	Name string
+	Pins []string
+}
+
+func (e *PinnedError) Error() string {
+	return fmt.Sprintf("%s is pinned by %s", e.Name, strings.Join(e.Pins, ", "))
+}
+
+// LeaseNotFoundError the lease does not exist, or has expired
+type LeaseNotFoundError struct {
+	Name string
+	ID   string
+}
+
+func (e *LeaseNotFoundError) Error() string {
+	return fmt.Sprintf("no lease %s on %s", e.ID, e.Name)
+}
@@ -0,0 +1,341 @@
+package retention
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/aifoundry-org/storage-manager/pkg/cache"
+	"github.com/aifoundry-org/storage-manager/pkg/cache/metadata"
+	"github.com/aifoundry-org/storage-manager/pkg/events"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// DefaultLeaseTTL how long a lease lasts if no TTL is requested
+	DefaultLeaseTTL = 5 * time.Minute
+	// ExpireInterval how often expired leases and content are cleaned up
+	ExpireInterval = 30 * time.Second
+)
+
+// Manager controls how long content is kept in the cache: it places pins and leases that
+// protect content from deletion and eviction, defers the deletion of leased content until the
+// leases end, and cleans up expired leases and content in the background.
+type Manager struct {
+	cache  cache.Cache
+	meta   *metadata.Store
+	events *events.Bus
+	logger *log.Logger
+
+	// mu serializes changes to pins, leases and deletions, and protects protected
+	mu sync.Mutex
+	// protected the functions that release the GC protection of the key of each lease
+	protected map[string]func()
+}
+
+// New create a manager for the cache, restoring the protection of the leases that were live
+// when the metadata was last saved
+func New(c cache.Cache, meta *metadata.Store, bus *events.Bus, logger *log.Logger) *Manager {
+	if logger == nil {
+		logger = log.New()
+	}
+	m := &Manager{
+		cache:     c,
+		meta:      meta,
+		events:    bus,
+		logger:    logger,
+		protected: map[string]func(){},
+	}
+	now := time.Now()
+	for _, e := range meta.All() {
+		for _, l := range e.LiveLeases(now) {
+			m.protect(l)
+		}
+	}
+	return m
+}
+
+// Pin pin the content on behalf of owner, protecting it from deletion and eviction until unpinned
+func (m *Manager) Pin(ctx context.Context, name, owner string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, err := m.resolve(ctx, name); err != nil {
+		return err
+	}
+	return m.meta.Pin(name, owner)
+}
+
+// Unpin remove the pin of owner from the content
+func (m *Manager) Unpin(name, owner string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.meta.Unpin(name, owner)
+}
+
+// Leases get the live leases on the content
+func (m *Manager) Leases(name string) []metadata.Lease {
+	e, _ := m.meta.Get(name)
+	return e.LiveLeases(time.Now())
+}
+
+// Acquire take a lease on the content that lasts for ttl, or DefaultLeaseTTL if ttl is 0
+func (m *Manager) Acquire(ctx context.Context, name string, ttl time.Duration) (metadata.Lease, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key, err := m.resolve(ctx, name)
+	if err != nil {
+		return metadata.Lease{}, err
+	}
+	id, err := newID()
+	if err != nil {
+		return metadata.Lease{}, err
+	}
+	lease := metadata.Lease{ID: id, Key: key, ExpiresAt: time.Now().Add(leaseTTL(ttl))}
+	if err := m.meta.Update(name, func(e *metadata.Entry) {
+		e.Leases = append(e.Leases, lease)
+	}); err != nil {
+		return metadata.Lease{}, err
+	}
+	m.protect(lease)
+	return lease, nil
+}
+
+// Renew extend a live lease to last for ttl from now, or DefaultLeaseTTL if ttl is 0
+func (m *Manager) Renew(name, id string, ttl time.Duration) (metadata.Lease, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var (
+		lease metadata.Lease
+		found bool
+		now   = time.Now()
+	)
+	if err := m.meta.Update(name, func(e *metadata.Entry) {
+		for i, l := range e.Leases {
+			if l.ID == id && l.ExpiresAt.After(now) {
+				e.Leases[i].ExpiresAt = now.Add(leaseTTL(ttl))
+				lease, found = e.Leases[i], true
+			}
+		}
+	}); err != nil {
+		return metadata.Lease{}, err
+	}
+	if !found {
+		return metadata.Lease{}, &LeaseNotFoundError{Name: name, ID: id}
+	}
+	return lease, nil
+}
+
+// Release end a lease early. If the content was deleted while leased and this was its last
+// lease, the content is removed now.
+func (m *Manager) Release(ctx context.Context, name, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var found bool
+	if err := m.meta.Update(name, func(e *metadata.Entry) {
+		e.Leases = slices.DeleteFunc(e.Leases, func(l metadata.Lease) bool {
+			if l.ID == id {
+				found = true
+				return true
+			}
+			return false
+		})
+	}); err != nil {
+		return err
+	}
+	if !found {
+		return &LeaseNotFoundError{Name: name, ID: id}
+	}
+	m.unprotect(id)
+	_, err := m.completeDeletes(ctx)
+	return err
+}
+
+// Delete remove the content from the cache. Pinned content is not removed, and returns a
+// *PinnedError. Leased content is removed once its leases end, in which case deferred is true.
+func (m *Manager) Delete(ctx context.Context, name string) (deferred bool, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e, _ := m.meta.Get(name)
+	if e.Pinned() {
+		return false, &PinnedError{Name: name, Pins: e.Pins}
+	}
+	if len(e.LiveLeases(time.Now())) > 0 {
+		m.logger.Infof("deferring deletion of %s until its leases end", name)
+		return true, m.meta.Update(name, func(e *metadata.Entry) {
+			e.DeletePending = true
+		})
+	}
+	return false, m.remove(ctx, name, events.TypeDeleted)
+}
+
+// Undelete cancel a deletion that is waiting for the leases on the content to end, as when
+// the content is requested again
+func (m *Manager) Undelete(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if e, ok := m.meta.Get(name); !ok || !e.DeletePending {
+		return nil
+	}
+	m.logger.Infof("cancelling deferred deletion of %s", name)
+	return m.meta.Update(name, func(e *metadata.Entry) {
+		e.DeletePending = false
+	})
+}
+
+// Run expire leases and content, and complete the deletions waiting for leases, every
+// interval until the context is canceled
+func (m *Manager) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := m.Expire(ctx); err != nil {
+				m.logger.Errorf("could not expire leases: %v", err)
+			}
+		}
+	}
+}
+
+// Expire drop expired leases, and remove content that has expired or whose deletion was
+// waiting for them
+func (m *Manager) Expire(ctx context.Context) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	var expiredAny bool
+	for name, e := range m.meta.All() {
+		if len(e.Leases) == len(e.LiveLeases(now)) {
+			continue
+		}
+		var expired []string
+		if err := m.meta.Update(name, func(e *metadata.Entry) {
+			e.Leases = slices.DeleteFunc(e.Leases, func(l metadata.Lease) bool {
+				if l.ExpiresAt.After(now) {
+					return false
+				}
+				expired = append(expired, l.ID)
+				return true
+			})
+		}); err != nil {
+			return err
+		}
+		for _, id := range expired {
+			m.logger.Debugf("lease %s on %s expired", id, name)
+			m.unprotect(id)
+			m.events.Publish(events.Event{Type: events.TypeLeaseExpired, Name: name, Message: id})
+			expiredAny = true
+		}
+	}
+	removed, err := m.completeDeletes(ctx)
+	if err != nil {
+		return err
+	}
+	for name, e := range m.meta.All() {
+		if !e.Expired(now) || e.Protected(now) {
+			continue
+		}
+		m.logger.Infof("%s expired at %s", name, e.ExpiresAt.Format(time.RFC3339))
+		if err := m.remove(ctx, name, events.TypeExpired); err != nil {
+			return err
+		}
+		removed++
+	}
+	if removed > 0 || !expiredAny {
+		return nil
+	}
+	// content that was only kept by the expired leases may now be unreferenced
+	if err := m.cache.GC(ctx); err != nil {
+		return fmt.Errorf("could not clean up after expiring leases: %v", err)
+	}
+	return nil
+}
+
+// completeDeletes remove the content whose deletion was deferred and that is no longer
+// leased, returning how many were removed. Must be called with the lock held.
+func (m *Manager) completeDeletes(ctx context.Context) (int, error) {
+	now := time.Now()
+	var removed int
+	for name, e := range m.meta.All() {
+		if !e.DeletePending || e.Protected(now) {
+			continue
+		}
+		if err := m.remove(ctx, name, events.TypeDeleted); err != nil {
+			return removed, err
+		}
+		removed++
+	}
+	return removed, nil
+}
+
+// remove unname the content, clean up anything no longer referenced, and drop its metadata,
+// reporting it as an event of the given type. Must be called with the lock held.
+func (m *Manager) remove(ctx context.Context, name, eventType string) error {
+	key, err := m.cache.Resolve(ctx, name)
+	if err == nil && key != "" {
+		if err := m.cache.Unname(ctx, name); err != nil {
+			return fmt.Errorf("could not remove %s: %v", name, err)
+		}
+	}
+	if err := m.cache.GC(ctx); err != nil {
+		return fmt.Errorf("could not clean up after removing %s: %v", name, err)
+	}
+	if err := m.meta.Delete(name); err != nil {
+		return err
+	}
+	m.logger.Infof("removed %s", name)
+	m.events.Publish(events.Event{Type: eventType, Name: name, Key: key})
+	return nil
+}
+
+// resolve the key of a name, returning a *cache.NotFoundError if it is not in the cache
+func (m *Manager) resolve(ctx context.Context, name string) (string, error) {
+	exists, err := m.cache.Exists(ctx, name)
+	if err != nil {
+		return "", err
+	}
+	if !exists {
+		return "", &cache.NotFoundError{Key: name}
+	}
+	return m.cache.Resolve(ctx, name)
+}
+
+// protect keep the key of a lease from GC, even if the name is later pointed elsewhere.
+// Must be called with the lock held, or before the manager is in use.
+func (m *Manager) protect(l metadata.Lease) {
+	protector, ok := m.cache.(cache.Protector)
+	if !ok {
+		return
+	}
+	m.protected[l.ID] = protector.Protect(l.Key)
+}
+
+// unprotect release the GC protection of a lease. Must be called with the lock held.
+func (m *Manager) unprotect(id string) {
+	if release, ok := m.protected[id]; ok {
+		release()
+		delete(m.protected, id)
+	}
+}
+
+func leaseTTL(ttl time.Duration) time.Duration {
+	if ttl <= 0 {
+		return DefaultLeaseTTL
+	}
+	return ttl
+}
+
+func newID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("could not generate lease id: %v", err)
+	}
+	return hex.EncodeToString(b), nil
+}
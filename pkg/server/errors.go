@@ -0,0 +1,98 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/aifoundry-org/storage-manager/pkg/api"
+	"github.com/aifoundry-org/storage-manager/pkg/cache"
+	"github.com/aifoundry-org/storage-manager/pkg/download"
+	"github.com/aifoundry-org/storage-manager/pkg/download/retry"
+	"github.com/aifoundry-org/storage-manager/pkg/pull"
+	"github.com/aifoundry-org/storage-manager/pkg/quota"
+	"github.com/aifoundry-org/storage-manager/pkg/retention"
+	"github.com/aifoundry-org/storage-manager/pkg/verify"
+)
+
+// apiError describe an error for the response: what kind of failure it is, and the status it
+// is sent with. url is the source URL of the content the request is about, if any.
+func apiError(err error, url string) api.Error {
+	var (
+		sourceErr   *pull.InvalidSourceError
+		notFoundErr *cache.NotFoundError
+		leaseErr    *retention.LeaseNotFoundError
+		pinnedErr   *retention.PinnedError
+		storageErr  *quota.InsufficientStorageError
+		exceededErr *quota.ExceededError
+		manifestErr *download.NoMatchingManifestError
+		verifyErr   *verify.Error
+		digestErr   *pull.DigestMismatchError
+	)
+	e := api.Error{Message: err.Error(), URL: url}
+	switch {
+	case errors.As(err, &sourceErr):
+		e.Status, e.Code = http.StatusBadRequest, api.ErrorCodeInvalidSource
+	case errors.As(err, &notFoundErr), errors.As(err, &leaseErr):
+		e.Status, e.Code = http.StatusNotFound, api.ErrorCodeNotFound
+	case errors.As(err, &manifestErr):
+		e.Status, e.Code = http.StatusNotFound, api.ErrorCodeSourceNotFound
+	case errors.As(err, &verifyErr):
+		e.Status, e.Code = http.StatusForbidden, api.ErrorCodeVerificationFailed
+	case errors.As(err, &digestErr):
+		// the source served something else than what was asked for
+		e.Status, e.Code = http.StatusBadGateway, api.ErrorCodeDigestMismatch
+	case errors.As(err, &pinnedErr):
+		e.Status, e.Code = http.StatusConflict, api.ErrorCodePinned
+	case errors.As(err, &storageErr):
+		// space may be freed by the time it is tried again
+		e.Status, e.Code, e.Retryable = http.StatusInsufficientStorage, api.ErrorCodeInsufficientStorage, true
+	case errors.As(err, &exceededErr):
+		e.Status, e.Code = http.StatusInsufficientStorage, api.ErrorCodeQuotaExceeded
+	case errors.Is(err, context.DeadlineExceeded):
+		e.Status, e.Code, e.Retryable = http.StatusGatewayTimeout, api.ErrorCodeTimeout, true
+	case errors.Is(err, context.Canceled):
+		// the client went away, or the server is stopping
+		e.Status, e.Code, e.Retryable = http.StatusServiceUnavailable, api.ErrorCodeCanceled, true
+	default:
+		e.Status, e.Code, e.Retryable = sourceError(err)
+	}
+	return e
+}
+
+// sourceError the status and code for a failure of the source of the content, or of
+// anything else
+func sourceError(err error) (int, string, bool) {
+	switch retry.Classify(err) {
+	case retry.ClassNotFound:
+		return http.StatusNotFound, api.ErrorCodeSourceNotFound, false
+	case retry.ClassAuth:
+		if retry.StatusCode(err) == http.StatusUnauthorized {
+			return http.StatusUnauthorized, api.ErrorCodeUnauthorized, false
+		}
+		return http.StatusForbidden, api.ErrorCodeForbidden, false
+	case retry.ClassRetryable:
+		return http.StatusBadGateway, api.ErrorCodeSourceUnavailable, true
+	}
+	// the source responded, but not with anything that could be used
+	if retry.StatusCode(err) != 0 {
+		return http.StatusBadGateway, api.ErrorCodeSourceUnavailable, false
+	}
+	return http.StatusInternalServerError, api.ErrorCodeInternal, false
+}
+
+// invalidRequest describe an error for a malformed request
+func invalidRequest(err error) api.Error {
+	return api.Error{Status: http.StatusBadRequest, Code: api.ErrorCodeInvalidRequest, Message: err.Error()}
+}
+
+// sendError send the error as json, with its status
+func (s *Server) sendError(w http.ResponseWriter, e api.Error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(e.Status)
+	if err := json.NewEncoder(w).Encode(e); err != nil {
+		s.logger.Errorf("Failed to encode error response: %v", err)
+	}
+}
@@ -1,108 +1,349 @@
 package server
 
 import (
+	"context"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/aifoundry-org/storage-manager/pkg/api"
 	"github.com/aifoundry-org/storage-manager/pkg/cache"
+	"github.com/aifoundry-org/storage-manager/pkg/cache/metadata"
 	"github.com/aifoundry-org/storage-manager/pkg/download"
-	downloadparser "github.com/aifoundry-org/storage-manager/pkg/download/parser"
+	"github.com/aifoundry-org/storage-manager/pkg/events"
+	"github.com/aifoundry-org/storage-manager/pkg/metrics"
+	"github.com/aifoundry-org/storage-manager/pkg/pull"
+	"github.com/aifoundry-org/storage-manager/pkg/retention"
 
 	"github.com/gorilla/mux"
+	"github.com/opencontainers/go-digest"
 	log "github.com/sirupsen/logrus"
 )
 
+// progressInterval minimum interval between streamed progress updates for a blob of a pull
+const progressInterval = 250 * time.Millisecond
+
+// shutdownTimeout how long requests in flight may take to finish once the server is stopped
+const shutdownTimeout = 30 * time.Second
+
+// unixPrefix prefix of an address that listens on a Unix-domain socket
+const unixPrefix = "unix://"
+
+// blobReadInterval how often the blobs that were read are matched to the names whose root they
+// are, to record access to those names. Matching lists every name, which is only done once for
+// all of the reads in between rather than on every read.
+const blobReadInterval = time.Second
+
+// PreloadStatuser reports the status of reconciling the cache against a preload manifest
+type PreloadStatuser interface {
+	Status() api.PreloadStatus
+}
+
 // Server a server to listen for API requests
 type Server struct {
-	addr   string
-	cache  cache.Cache
-	logger *log.Logger
-}
+	addr    string
+	cache   cache.Cache
+	puller  *pull.Puller
+	preload PreloadStatuser
+	meta    *metadata.Store
+	events  *events.Bus
+	retain  *retention.Manager
+	logger  *log.Logger
 
-type contentResponse struct {
-	URL    string `json:"url"`
-	Digest string `json:"digest"`
+	// readMu protects read
+	readMu sync.Mutex
+	// read the keys of the blobs read since they were last matched to names
+	read map[string]bool
 }
 
-func (s *Server) sendResponse(w http.ResponseWriter, url, digest string) {
-	w.WriteHeader(http.StatusOK)
-	response := contentResponse{
+// content describe the content for a key, including its local path if the cache has one
+func (s *Server) content(url, digest string) api.Content {
+	response := api.Content{
 		URL:    url,
 		Digest: digest,
 	}
+	if pather, ok := s.cache.(cache.Pather); ok {
+		p, err := pather.Path(digest)
+		if err != nil {
+			s.logger.Debugf("cache path %s %v", digest, err)
+		}
+		response.Path = p
+	}
+	if s.meta != nil {
+		if e, ok := s.meta.Get(url); ok {
+			response.Pins = e.Pins
+			response.DeletePending = e.DeletePending
+			response.Verification = e.Verification
+			response.Validators = e.Validators
+			if !e.ExpiresAt.IsZero() {
+				response.ExpiresAt = &e.ExpiresAt
+			}
+			for _, l := range e.LiveLeases(time.Now()) {
+				response.Leases = append(response.Leases, lease(url, l))
+			}
+		}
+	}
+	return response
+}
+
+// lease describe a lease on the content for a url
+func lease(url string, l metadata.Lease) api.Lease {
+	return api.Lease{ID: l.ID, URL: url, Digest: l.Key, ExpiresAt: l.ExpiresAt}
+}
+
+func (s *Server) sendResponse(w http.ResponseWriter, url, digest string) {
+	s.sendJSON(w, s.content(url, digest))
+}
+
+func (s *Server) sendJSON(w http.ResponseWriter, response any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
 	encoder := json.NewEncoder(w)
 	if err := encoder.Encode(response); err != nil {
 		s.logger.Errorf("Failed to encode response: %v", err)
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		// the status was already sent, so there is nothing more to tell the client
 	}
 }
 
 // New create a new server instance with the provided configuration
-func New(addr string, cache cache.Cache, logger *log.Logger) *Server {
+func New(addr string, cache cache.Cache, puller *pull.Puller, logger *log.Logger) *Server {
 	if logger == nil {
 		logger = log.New()
 	}
+	if puller == nil {
+		puller = pull.New(cache, logger)
+	}
 	return &Server{
 		addr:   addr,
 		cache:  cache,
+		puller: puller,
 		logger: logger,
 	}
 }
 
+// SetPreload set the source of the preload status reported by the API
+func (s *Server) SetPreload(preload PreloadStatuser) {
+	s.preload = preload
+}
+
+// SetMetadata set the store in which access to content is recorded
+func (s *Server) SetMetadata(meta *metadata.Store) {
+	s.meta = meta
+}
+
+// SetEvents set the bus whose events are reported by the API
+func (s *Server) SetEvents(bus *events.Bus) {
+	s.events = bus
+}
+
+// SetRetention set the manager of pins and leases. Without one, content cannot be pinned or
+// leased through the API, and is deleted immediately.
+func (s *Server) SetRetention(retain *retention.Manager) {
+	s.retain = retain
+}
+
+// touch record that the content was accessed
+func (s *Server) touch(name string) {
+	if s.meta == nil {
+		return
+	}
+	if err := s.meta.Touch(name); err != nil {
+		s.logger.Warnf("could not record access to %s: %v", name, err)
+	}
+}
+
+// blobRead record that a blob was read, which counts as access to every name whose root it
+// is, once touchReads gets to it
+func (s *Server) blobRead(key string) {
+	if s.meta == nil {
+		return
+	}
+	s.readMu.Lock()
+	defer s.readMu.Unlock()
+	if s.read == nil {
+		s.read = map[string]bool{}
+	}
+	s.read[key] = true
+}
+
+// touchReads record access to the names whose roots were read, every blobReadInterval, until
+// the context is done
+func (s *Server) touchReads(ctx context.Context) {
+	ticker := time.NewTicker(blobReadInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		s.readMu.Lock()
+		read := s.read
+		s.read = nil
+		s.readMu.Unlock()
+		if len(read) == 0 {
+			continue
+		}
+		names, err := s.cache.List(ctx)
+		if err != nil {
+			s.logger.Debugf("could not list names to record access to blobs: %v", err)
+			continue
+		}
+		for _, name := range names {
+			if root, err := s.cache.Resolve(ctx, name); err == nil && read[root] {
+				s.touch(name)
+			}
+		}
+	}
+}
+
 // Start start the server, runs continually, returning only when stopped or an error occurs.
-func (s *Server) Start() error {
+// Canceling the context stops the server: the requests in flight are canceled, including
+// any pulls they are waiting for, and given a short time to finish.
+func (s *Server) Start(ctx context.Context) error {
 	r := mux.NewRouter()
 
+	// List all of the content in the cache.
+	r.HandleFunc("/content/", s.contentListHandler).Methods("GET")
 	// Check if provided URL source exists in the cache or not. URL is base64 encoded and part of the query.
 	r.HandleFunc("/content/{urlencoded}", s.contentGetHandler).Methods("GET")
 	// Delete the provided URL source from the cache, if it exists. If not, return 200 OK.
+	// Pinned content is not deleted; leased content is deleted once its leases end.
 	r.HandleFunc("/content/{urlencoded}", s.contentDeleteHandler).Methods("DELETE")
+	// Pin the content, protecting it from eviction and deletion until unpinned.
+	r.HandleFunc("/content/{urlencoded}/pin", s.pinHandler).Methods("PUT")
+	r.HandleFunc("/content/{urlencoded}/pin", s.unpinHandler).Methods("DELETE")
+	// Take a lease on the content, protecting it from eviction and deletion until it expires.
+	r.HandleFunc("/content/{urlencoded}/leases", s.leaseListHandler).Methods("GET")
+	r.HandleFunc("/content/{urlencoded}/leases", s.leasePostHandler).Methods("POST")
+	// Renew or release a lease.
+	r.HandleFunc("/content/{urlencoded}/leases/{id}", s.leasePutHandler).Methods("PUT")
+	r.HandleFunc("/content/{urlencoded}/leases/{id}", s.leaseDeleteHandler).Methods("DELETE")
 	// Ensure that the provided content is in the cache. If not, download it and store it in the cache.
 	// URL and possible credentials are in the body of the request.
 	r.HandleFunc("/content/", s.contentPostHandler).Methods("POST")
+	// Clean up any unreferenced content in the cache, or report what would be cleaned up.
+	r.HandleFunc("/gc", s.gcHandler).Methods("POST")
+	// Report the status of reconciling the cache against the preload manifest.
+	r.HandleFunc("/preload", s.preloadHandler).Methods("GET")
+	// Read the content of a blob in the cache.
+	r.HandleFunc("/blobs/{key}", s.blobGetHandler).Methods("GET")
+	// Report recent events, optionally following new ones.
+	r.HandleFunc("/events", s.eventsHandler).Methods("GET")
+	// Report metrics, such as retries of downloads, in the Prometheus text format.
+	r.Handle("/metrics", metrics.Handler()).Methods("GET")
 
 	server := &http.Server{
 		Addr:    s.addr,
 		Handler: r,
+		// every request is canceled when the server is stopped
+		BaseContext: func(net.Listener) context.Context {
+			return ctx
+		},
+	}
+
+	listener, err := s.listen()
+	if err != nil {
+		return err
 	}
 
 	// Start HTTPS server with TLS configuration
 	s.logger.Infof("Starting server on %s", server.Addr)
-	if err := server.ListenAndServe(); err != nil {
-		s.logger.Fatalf("Failed to listen and serve: %v", err)
+	if s.meta != nil {
+		go s.touchReads(ctx)
+	}
+	errs := make(chan error, 1)
+	go func() {
+		errs <- server.Serve(listener)
+	}()
+	select {
+	case err := <-errs:
+		return fmt.Errorf("failed to listen and serve: %v", err)
+	case <-ctx.Done():
+	}
+
+	s.logger.Infof("Stopping server on %s", server.Addr)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		return fmt.Errorf("could not stop server: %v", err)
 	}
 	return nil
 }
 
+// listen open a listener on the address, which is either a host:port for tcp or a
+// Unix-domain socket, given as unix:///path/to/socket or an absolute path
+func (s *Server) listen() (net.Listener, error) {
+	network, address := "tcp", s.addr
+	switch {
+	case strings.HasPrefix(s.addr, unixPrefix):
+		network, address = "unix", strings.TrimPrefix(s.addr, unixPrefix)
+	case strings.HasPrefix(s.addr, "/"):
+		network = "unix"
+	}
+	if network == "unix" {
+		// a socket left over from a previous run would prevent us from listening
+		if err := os.Remove(address); err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("could not remove stale socket %s: %v", address, err)
+		}
+	}
+	listener, err := net.Listen(network, address)
+	if err != nil {
+		return nil, fmt.Errorf("could not listen on %s: %v", s.addr, err)
+	}
+	return listener, nil
+}
+
+// contentListHandler list all of the content in the cache
+func (s *Server) contentListHandler(w http.ResponseWriter, r *http.Request) {
+	s.logger.Debug("GET /content/")
+	names, err := s.cache.List(r.Context())
+	if err != nil {
+		s.logger.Debugf("cache list %v", err)
+		s.sendError(w, apiError(err, ""))
+		return
+	}
+	contents := []api.Content{}
+	for _, name := range names {
+		key, err := s.cache.Resolve(r.Context(), name)
+		if err != nil {
+			s.logger.Debugf("cache resolve %s %v", name, err)
+			continue
+		}
+		contents = append(contents, s.content(name, key))
+	}
+	s.sendJSON(w, contents)
+}
+
 // contentGetHandler check if the content is available in the cache
 func (s *Server) contentGetHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	urlencoded := vars["urlencoded"]
 	s.logger.Debugf("GET /content/%s", urlencoded)
-	u, err := base64.StdEncoding.DecodeString(urlencoded)
+	u, err := decodeURL(urlencoded)
 	if err != nil {
 		s.logger.Debugf("GET /content/%s %v", urlencoded, err)
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		s.sendError(w, invalidRequest(err))
 		return
 	}
 	s.logger.Debugf("GET %s", string(u))
 
-	key, err := s.cache.Resolve(string(u))
+	key, err := s.cache.Resolve(r.Context(), string(u))
 	if err != nil {
 		s.logger.Debugf("cache resolve %s %v", u, err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-
-	if key == "" {
-		s.logger.Debugf("key not found %s", u)
-		http.Error(w, fmt.Sprintf("content not found %s %s", urlencoded, u), http.StatusNotFound)
+		s.sendError(w, apiError(err, string(u)))
 		return
 	}
 	s.logger.Debugf("found %s", u)
+	s.touch(string(u))
 	s.sendResponse(w, string(u), key)
 }
 
@@ -111,38 +352,228 @@ func (s *Server) contentDeleteHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	urlencoded := vars["urlencoded"]
 	s.logger.Debugf("DELETE /content/%s", urlencoded)
-	u, err := base64.StdEncoding.DecodeString(urlencoded)
+	u, err := decodeURL(urlencoded)
 	if err != nil {
 		s.logger.Debugf("DELETE /content/%s %v", urlencoded, err)
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		s.sendError(w, invalidRequest(err))
+		return
+	}
+	// with shared, the content is removed from the shared tier too, for every node
+	if r.URL.Query().Get("shared") == "true" {
+		shared, ok := s.cache.(cache.SharedTier)
+		if !ok {
+			s.sendError(w, invalidRequest(fmt.Errorf("the cache has no shared tier")))
+			return
+		}
+		if err := shared.UnnameShared(r.Context(), string(u)); err != nil {
+			s.logger.Debugf("cache unname shared %s %v", u, err)
+			s.sendError(w, apiError(err, string(u)))
+			return
+		}
+	}
+	_, err = s.cache.Resolve(r.Context(), string(u))
+	var notFoundErr *cache.NotFoundError
+	if errors.As(err, &notFoundErr) {
+		s.logger.Debugf("key not present %s", u)
+		w.WriteHeader(http.StatusOK)
 		return
 	}
-	key, err := s.cache.Resolve(string(u))
 	if err != nil {
 		s.logger.Debugf("cache resolve %s %v", u, err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		s.sendError(w, apiError(err, string(u)))
 		return
 	}
-	if key == "" {
-		s.logger.Debugf("key not present %s", u)
-		w.WriteHeader(http.StatusOK)
+	if s.retain != nil {
+		deferred, err := s.retain.Delete(r.Context(), string(u))
+		switch {
+		case err != nil:
+			s.logger.Debugf("cache delete %s %v", u, err)
+			s.sendError(w, apiError(err, string(u)))
+		case deferred:
+			s.logger.Debugf("cache delete %s deferred until leases end", u)
+			w.WriteHeader(http.StatusAccepted)
+		default:
+			s.logger.Debugf("cache delete %s OK", u)
+			w.WriteHeader(http.StatusOK)
+		}
 		return
 	}
-	if err := s.cache.Unname(string(u)); err != nil {
+	if err := s.cache.Unname(r.Context(), string(u)); err != nil {
 		s.logger.Debugf("cache unname %s %v", u, err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		s.sendError(w, apiError(err, string(u)))
 		return
 	}
+	if s.meta != nil {
+		if err := s.meta.Delete(string(u)); err != nil {
+			s.logger.Warnf("could not remove metadata for %s: %v", u, err)
+		}
+	}
 	// and now need to clean up any unreferenced content in the cache
-	if err := s.cache.GC(); err != nil {
+	if err := s.cache.GC(r.Context()); err != nil {
 		s.logger.Debugf("cache GC %v", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		s.sendError(w, apiError(err, ""))
 		return
 	}
 	s.logger.Debugf("cache delete %s OK", u)
 	w.WriteHeader(http.StatusOK)
 }
 
+// pinOwner the owner of pins placed through the API
+const pinOwner = "api"
+
+// pinHandler pin the content, protecting it from eviction and deletion
+func (s *Server) pinHandler(w http.ResponseWriter, r *http.Request) {
+	u, ok := s.retentionURL(w, r)
+	if !ok {
+		return
+	}
+	if err := s.retain.Pin(r.Context(), u, pinOwner); err != nil {
+		s.retentionError(w, r, u, err)
+		return
+	}
+	key, err := s.cache.Resolve(r.Context(), u)
+	if err != nil {
+		s.retentionError(w, r, u, err)
+		return
+	}
+	s.sendResponse(w, u, key)
+}
+
+// unpinHandler remove the pin placed through the API from the content
+func (s *Server) unpinHandler(w http.ResponseWriter, r *http.Request) {
+	u, ok := s.retentionURL(w, r)
+	if !ok {
+		return
+	}
+	if err := s.retain.Unpin(u, pinOwner); err != nil {
+		s.retentionError(w, r, u, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// leaseListHandler list the live leases on the content
+func (s *Server) leaseListHandler(w http.ResponseWriter, r *http.Request) {
+	u, ok := s.retentionURL(w, r)
+	if !ok {
+		return
+	}
+	leases := []api.Lease{}
+	for _, l := range s.retain.Leases(u) {
+		leases = append(leases, lease(u, l))
+	}
+	s.sendJSON(w, leases)
+}
+
+// leasePostHandler take a lease on the content
+func (s *Server) leasePostHandler(w http.ResponseWriter, r *http.Request) {
+	u, ok := s.retentionURL(w, r)
+	if !ok {
+		return
+	}
+	ttl, ok := s.leaseTTL(w, r)
+	if !ok {
+		return
+	}
+	l, err := s.retain.Acquire(r.Context(), u, ttl)
+	if err != nil {
+		s.retentionError(w, r, u, err)
+		return
+	}
+	s.logger.Debugf("%s %s lease %s until %s", r.Method, r.URL.Path, l.ID, l.ExpiresAt)
+	s.sendJSON(w, lease(u, l))
+}
+
+// leasePutHandler renew a lease on the content
+func (s *Server) leasePutHandler(w http.ResponseWriter, r *http.Request) {
+	u, ok := s.retentionURL(w, r)
+	if !ok {
+		return
+	}
+	ttl, ok := s.leaseTTL(w, r)
+	if !ok {
+		return
+	}
+	l, err := s.retain.Renew(u, mux.Vars(r)["id"], ttl)
+	if err != nil {
+		s.retentionError(w, r, u, err)
+		return
+	}
+	s.sendJSON(w, lease(u, l))
+}
+
+// leaseDeleteHandler release a lease on the content
+func (s *Server) leaseDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	u, ok := s.retentionURL(w, r)
+	if !ok {
+		return
+	}
+	if err := s.retain.Release(r.Context(), u, mux.Vars(r)["id"]); err != nil {
+		s.retentionError(w, r, u, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// retentionURL decode the url of the content whose pins or leases are requested, sending an
+// error and returning false if that is not possible
+func (s *Server) retentionURL(w http.ResponseWriter, r *http.Request) (string, bool) {
+	urlencoded := mux.Vars(r)["urlencoded"]
+	s.logger.Debugf("%s %s", r.Method, r.URL.Path)
+	if s.retain == nil {
+		s.sendError(w, api.Error{Status: http.StatusNotImplemented, Code: api.ErrorCodeNotImplemented, Message: "pins and leases are not supported"})
+		return "", false
+	}
+	u, err := decodeURL(urlencoded)
+	if err != nil {
+		s.logger.Debugf("%s %s %v", r.Method, r.URL.Path, err)
+		s.sendError(w, invalidRequest(err))
+		return "", false
+	}
+	return string(u), true
+}
+
+// leaseTTL read the requested duration of a lease from the body, which may be empty
+func (s *Server) leaseTTL(w http.ResponseWriter, r *http.Request) (time.Duration, bool) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		s.sendError(w, invalidRequest(err))
+		return 0, false
+	}
+	var req api.LeaseRequest
+	if len(body) > 0 {
+		if err := json.Unmarshal(body, &req); err != nil {
+			s.sendError(w, invalidRequest(err))
+			return 0, false
+		}
+	}
+	if req.TTL == "" {
+		return 0, true
+	}
+	ttl, err := time.ParseDuration(req.TTL)
+	if err != nil || ttl <= 0 {
+		s.sendError(w, invalidRequest(fmt.Errorf("invalid ttl %s", req.TTL)))
+		return 0, false
+	}
+	return ttl, true
+}
+
+// retentionError send the error from pinning or leasing the content for url
+func (s *Server) retentionError(w http.ResponseWriter, r *http.Request, url string, err error) {
+	s.logger.Debugf("%s %s %v", r.Method, r.URL.Path, err)
+	s.sendError(w, apiError(err, url))
+}
+
+// undelete cancel any deferred deletion of content that was just pulled again
+func (s *Server) undelete(name string) {
+	if s.retain == nil {
+		return
+	}
+	if err := s.retain.Undelete(name); err != nil {
+		s.logger.Warnf("could not cancel deletion of %s: %v", name, err)
+	}
+}
+
 // contentPostHandler ensure that the provided content is in the cache
 func (s *Server) contentPostHandler(w http.ResponseWriter, r *http.Request) {
 	s.logger.Debug("POST /content/")
@@ -150,94 +581,227 @@ func (s *Server) contentPostHandler(w http.ResponseWriter, r *http.Request) {
 	body, err := io.ReadAll(r.Body)
 	if err != nil {
 		s.logger.Debugf("POST /content read body %v", err)
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		s.sendError(w, invalidRequest(err))
 		return
 	}
 	var content download.ContentSource
 	if err := json.Unmarshal(body, &content); err != nil {
 		s.logger.Debugf("POST /content json unmarshal %v", err)
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		s.sendError(w, invalidRequest(err))
+		return
+	}
+
+	// clients that accept a stream get progress updates as the content is written
+	if strings.Contains(r.Header.Get("Accept"), api.MediaTypeNDJSON) {
+		s.pullStream(w, r, content)
 		return
 	}
 
-	// check if the content is in the cache
-	exists, err := s.cache.Exists(content.URL)
+	key, err := s.puller.Pull(r.Context(), content, nil)
 	if err != nil {
-		s.logger.Debugf("POST /content error checking if content %s exists %v", content.URL, err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		s.logger.Debugf("POST /content %s %v", content.URL, err)
+		s.sendError(w, apiError(err, content.URL))
 		return
 	}
+	s.logger.Debugf("POST /content success %s", content.URL)
+	s.undelete(content.URL)
+	s.sendResponse(w, content.URL, key)
+}
 
-	if exists {
-		s.logger.Debugf("POST /content %s already exists", content.URL)
-		key, err := s.cache.Resolve(content.URL)
-		if err != nil {
-			s.logger.Debugf("cache resolve %s %v", content.URL, err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+// pullStream pull the content, streaming progress updates as newline-delimited json, and
+// finishing with the result. The stream starts with the first update, so a pull that fails
+// before writing anything, such as for lack of space, still gets an error status.
+func (s *Server) pullStream(w http.ResponseWriter, r *http.Request, content download.ContentSource) {
+	encoder := json.NewEncoder(w)
+	flusher, _ := w.(http.Flusher)
+	var started bool
+	send := func(result api.PullResult) {
+		if !started {
+			w.Header().Set("Content-Type", api.MediaTypeNDJSON)
+			w.WriteHeader(http.StatusOK)
+			started = true
+		}
+		if err := encoder.Encode(result); err != nil {
+			s.logger.Debugf("POST /content failed to send update: %v", err)
+			return
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+
+	// when each blob was last reported; updates come one at a time, so no lock is needed
+	last := map[string]time.Time{}
+	key, err := s.puller.Pull(r.Context(), content, func(progress api.Progress) {
+		// do not flood the client, send at most a few updates per second per blob
+		if !progress.Done && time.Since(last[progress.Key]) < progressInterval {
+			return
+		}
+		last[progress.Key] = time.Now()
+		send(api.PullResult{Progress: &progress})
+	})
+	if err != nil {
+		s.logger.Debugf("POST /content %s %v", content.URL, err)
+		if !started {
+			s.sendError(w, apiError(err, content.URL))
 			return
 		}
+		e := apiError(err, content.URL)
+		send(api.PullResult{Error: e.Message, ErrorDetail: &e})
+		return
+	}
+	s.logger.Debugf("POST /content success %s", content.URL)
+	s.undelete(content.URL)
+	response := s.content(content.URL, key)
+	send(api.PullResult{Content: &response})
+}
 
-		if key == "" {
-			s.logger.Debugf("key not found %s", content.URL)
-			http.Error(w, fmt.Sprintf("content not found %s", content.URL), http.StatusNotFound)
+// gcHandler clean up any unreferenced content in the cache, or with shared, in its shared
+// tier; with dryRun, report what would be cleaned up
+func (s *Server) gcHandler(w http.ResponseWriter, r *http.Request) {
+	s.logger.Debug("POST /gc")
+	gc := s.cache.GC
+	var unreferenced func(context.Context) ([]cache.Blob, error)
+	if collector, ok := s.cache.(cache.Collector); ok {
+		unreferenced = collector.Unreferenced
+	}
+	if r.URL.Query().Get("shared") == "true" {
+		shared, ok := s.cache.(cache.SharedTier)
+		if !ok {
+			s.sendError(w, invalidRequest(fmt.Errorf("the cache has no shared tier")))
+			return
+		}
+		gc, unreferenced = shared.GCShared, shared.UnreferencedShared
+	}
+	if r.URL.Query().Get("dryRun") == "true" {
+		if unreferenced == nil {
+			s.sendError(w, invalidRequest(fmt.Errorf("the cache cannot report what gc would remove")))
 			return
 		}
+		blobs, err := unreferenced(r.Context())
+		if err != nil {
+			s.logger.Debugf("cache unreferenced %v", err)
+			s.sendError(w, apiError(err, ""))
+			return
+		}
+		report := api.GCReport{Blobs: make([]api.GCBlob, 0, len(blobs))}
+		for _, blob := range blobs {
+			report.Blobs = append(report.Blobs, api.GCBlob{Digest: blob.Key, Size: blob.Size})
+			report.Size += blob.Size
+		}
+		s.sendJSON(w, report)
+		return
+	}
+	if err := gc(r.Context()); err != nil {
+		s.logger.Debugf("cache GC %v", err)
+		s.sendError(w, apiError(err, ""))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// preloadHandler report the status of reconciling the cache against the preload manifest
+func (s *Server) preloadHandler(w http.ResponseWriter, r *http.Request) {
+	s.logger.Debug("GET /preload")
+	if s.preload == nil {
+		s.sendError(w, api.Error{Status: http.StatusNotFound, Code: api.ErrorCodeNotFound, Message: "no preload manifest configured"})
+		return
+	}
+	s.sendJSON(w, s.preload.Status())
+}
 
-		s.sendResponse(w, content.URL, key)
-		s.logger.Debugf("POST /content success %s", content.URL)
+// blobGetHandler send the content of a blob in the cache
+func (s *Server) blobGetHandler(w http.ResponseWriter, r *http.Request) {
+	key := mux.Vars(r)["key"]
+	s.logger.Debugf("GET /blobs/%s", key)
+	if _, err := digest.Parse(key); err != nil {
+		s.sendError(w, invalidRequest(fmt.Errorf("invalid key %s: %v", key, err)))
 		return
 	}
-	// it does not, so download it
-	downloader, err := downloadparser.Parse(content)
+	exists, err := s.cache.Exists(r.Context(), key)
 	if err != nil {
-		s.logger.Debugf("POST /content error getting downloader for %s %v", content.URL, err)
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		s.logger.Debugf("cache exists %s %v", key, err)
+		s.sendError(w, apiError(err, ""))
+		return
+	}
+	if !exists {
+		s.sendError(w, apiError(&cache.NotFoundError{Key: key}, ""))
 		return
 	}
-	downloadReaders, err := downloader.Download()
+	rc, err := s.cache.Get(r.Context(), key)
 	if err != nil {
-		s.logger.Debugf("POST /content error getting readers for content %s %v", content.URL, err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		s.logger.Debugf("cache get %s %v", key, err)
+		s.sendError(w, apiError(err, ""))
 		return
 	}
+	defer rc.Close()
+	s.blobRead(key)
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Docker-Content-Digest", key)
+	if _, err := io.Copy(w, rc); err != nil {
+		s.logger.Debugf("GET /blobs/%s %v", key, err)
+	}
+}
 
-	var savedKeys []string
-	for _, downloadReader := range downloadReaders {
-		// if the key does not exist, we need to download and hash the content, then transfer that in and clear it
-		if downloadReader.Key == "" {
-			key, size, reader, err := downloadAndHash(downloadReader.Reader)
-			if err != nil {
-				s.logger.Debugf("POST /content error downloading and hashing %v", err)
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
-			}
-			downloadReader.Key = key
-			downloadReader.Size = size
-			downloadReader.Reader = reader
+// eventsHandler send the recent events, and if following, every new event as it happens
+func (s *Server) eventsHandler(w http.ResponseWriter, r *http.Request) {
+	s.logger.Debug("GET /events")
+	follow := r.URL.Query().Get("follow") == "true"
+	if !follow {
+		recent := s.events.Recent()
+		if recent == nil {
+			recent = []events.Event{}
 		}
-		savedKeys = append(savedKeys, downloadReader.Key)
-		defer downloadReader.Reader.Close()
-		exists, err := s.cache.Exists(downloadReader.Key)
-		if err != nil {
-			s.logger.Debugf("POST /content error checking if key %s exists %v", downloadReader.Key, err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+		s.sendJSON(w, recent)
+		return
+	}
+	// subscribe before sending the history, so nothing is missed in between
+	ch, cancel := s.events.Subscribe()
+	defer cancel()
+	w.Header().Set("Content-Type", api.MediaTypeNDJSON)
+	w.WriteHeader(http.StatusOK)
+	encoder := json.NewEncoder(w)
+	flusher, _ := w.(http.Flusher)
+	send := func(e events.Event) bool {
+		if err := encoder.Encode(e); err != nil {
+			return false
 		}
-		if exists {
-			s.logger.Debugf("POST /content key %s already exists", downloadReader.Key)
-			continue
+		if flusher != nil {
+			flusher.Flush()
 		}
-		s.logger.Debugf("POST /content putting into cache key %s", downloadReader.Key)
-		if err := s.cache.Put(downloadReader.Key, downloadReader.Size, downloadReader.Reader); err != nil {
-			s.logger.Debugf("POST /content error putting into cache key %s %v", downloadReader.Key, err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+		return true
+	}
+	var last time.Time
+	for _, e := range s.events.Recent() {
+		if !send(e) {
 			return
 		}
+		last = e.Time
 	}
-	if err := s.cache.Name(savedKeys[0], content.URL); err != nil {
-		s.logger.Debugf("POST /content error tagging root %s %v", content.URL, err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case e := <-ch:
+			// skip anything already sent with the history
+			if !e.Time.After(last) {
+				continue
+			}
+			if !send(e) {
+				return
+			}
+		}
+	}
+}
+
+// decodeURL decode a base64-encoded URL from a request path. Both the standard and the
+// URL-safe alphabets are accepted, as the standard one may contain '/'.
+func decodeURL(urlencoded string) ([]byte, error) {
+	u, err := base64.StdEncoding.DecodeString(urlencoded)
+	if err != nil {
+		if u, err := base64.URLEncoding.DecodeString(urlencoded); err == nil {
+			return u, nil
+		}
 	}
-	s.sendResponse(w, content.URL, savedKeys[0])
+	return u, err
 }
@@ -0,0 +1,74 @@
+package verify
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/opencontainers/go-digest"
+)
+
+const (
+	// CosignArtifactType the artifact type of cosign signatures attached as referrers
+	CosignArtifactType = "application/vnd.dev.cosign.artifact.sig.v1+json"
+	// CosignPayloadMediaType the media type of the layers of a cosign signature that hold what
+	// was signed
+	CosignPayloadMediaType = "application/vnd.dev.cosign.simplesigning.v1+json"
+	// CosignSignatureAnnotation the annotation of a payload layer that holds its signature
+	CosignSignatureAnnotation = "dev.cosignproject.cosign/signature"
+)
+
+// CosignTag the tag under which cosign stores the signatures of a digest, for registries
+// without referrers
+func CosignTag(d digest.Digest) string {
+	return fmt.Sprintf("%s-%s.sig", d.Algorithm(), d.Encoded())
+}
+
+// cosignPayload the parts of a cosign simple signing payload that are checked
+type cosignPayload struct {
+	Critical struct {
+		Image struct {
+			DockerManifestDigest string `json:"docker-manifest-digest"`
+		} `json:"image"`
+		Type string `json:"type"`
+	} `json:"critical"`
+}
+
+// VerifyCosign verify a cosign signature, given base64-encoded as in its annotation, of a
+// simple signing payload, returning the key that signed it. The payload must be for subject.
+func VerifyCosign(payload []byte, signature string, subject digest.Digest, keys []Key) (Key, error) {
+	var p cosignPayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		return Key{}, fmt.Errorf("invalid cosign payload: %v", err)
+	}
+	if p.Critical.Image.DockerManifestDigest != subject.String() {
+		return Key{}, fmt.Errorf("cosign payload is for %s, not %s", p.Critical.Image.DockerManifestDigest, subject)
+	}
+	sig, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return Key{}, fmt.Errorf("invalid cosign signature: %v", err)
+	}
+	hash := sha256.Sum256(payload)
+	for _, key := range keys {
+		var ok bool
+		switch public := key.Public.(type) {
+		case *ecdsa.PublicKey:
+			ok = ecdsa.VerifyASN1(public, hash[:], sig)
+		case *rsa.PublicKey:
+			ok = rsa.VerifyPKCS1v15(public, crypto.SHA256, hash[:], sig) == nil ||
+				rsa.VerifyPSS(public, crypto.SHA256, hash[:], sig, nil) == nil
+		case ed25519.PublicKey:
+			ok = ed25519.Verify(public, payload, sig)
+		}
+		if ok {
+			return key, nil
+		}
+	}
+	return Key{}, errors.New("cosign signature does not match any of the public keys")
+}
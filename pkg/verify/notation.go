@@ -0,0 +1,156 @@
+package verify
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const (
+	// NotationArtifactType the artifact type of notation signatures
+	NotationArtifactType = "application/vnd.cncf.notary.signature"
+	// NotationJWSMediaType the media type of a notation signature envelope in JWS
+	NotationJWSMediaType = "application/jose+json"
+)
+
+// jwsEnvelope a notation signature envelope, in the JWS JSON serialization
+type jwsEnvelope struct {
+	Payload   string `json:"payload"`
+	Protected string `json:"protected"`
+	Header    struct {
+		// CertChain the signing certificate first, base64-encoded DER
+		CertChain []string `json:"x5c"`
+	} `json:"header"`
+	Signature string `json:"signature"`
+}
+
+// jwsProtected the parts of the protected header of a notation signature that are checked
+type jwsProtected struct {
+	Algorithm string `json:"alg"`
+	Expiry    string `json:"io.cncf.notary.expiry"`
+}
+
+// notationPayload what a notation signature signs
+type notationPayload struct {
+	TargetArtifact ocispec.Descriptor `json:"targetArtifact"`
+}
+
+// VerifyNotation verify a notation signature envelope of the media type, returning the key
+// that signed it. The signing certificate must hold one of the keys, and the envelope must be
+// for subject and not expired.
+func VerifyNotation(envelope []byte, mediaType string, subject ocispec.Descriptor, keys []Key, now time.Time) (Key, error) {
+	if mediaType != NotationJWSMediaType {
+		return Key{}, fmt.Errorf("unsupported notation signature envelope %s", mediaType)
+	}
+	var env jwsEnvelope
+	if err := json.Unmarshal(envelope, &env); err != nil {
+		return Key{}, fmt.Errorf("invalid notation signature envelope: %v", err)
+	}
+	protectedJSON, err := base64.RawURLEncoding.DecodeString(env.Protected)
+	if err != nil {
+		return Key{}, fmt.Errorf("invalid notation protected header: %v", err)
+	}
+	var protected jwsProtected
+	if err := json.Unmarshal(protectedJSON, &protected); err != nil {
+		return Key{}, fmt.Errorf("invalid notation protected header: %v", err)
+	}
+	if protected.Expiry != "" {
+		expiry, err := time.Parse(time.RFC3339, protected.Expiry)
+		if err != nil {
+			return Key{}, fmt.Errorf("invalid notation signature expiry: %v", err)
+		}
+		if now.After(expiry) {
+			return Key{}, fmt.Errorf("notation signature expired at %s", protected.Expiry)
+		}
+	}
+	payloadJSON, err := base64.RawURLEncoding.DecodeString(env.Payload)
+	if err != nil {
+		return Key{}, fmt.Errorf("invalid notation payload: %v", err)
+	}
+	var payload notationPayload
+	if err := json.Unmarshal(payloadJSON, &payload); err != nil {
+		return Key{}, fmt.Errorf("invalid notation payload: %v", err)
+	}
+	if payload.TargetArtifact.Digest != subject.Digest || payload.TargetArtifact.Size != subject.Size {
+		return Key{}, fmt.Errorf("notation signature is for %s, not %s", payload.TargetArtifact.Digest, subject.Digest)
+	}
+	if len(env.Header.CertChain) == 0 {
+		return Key{}, errors.New("notation signature has no signing certificate")
+	}
+	der, err := base64.StdEncoding.DecodeString(env.Header.CertChain[0])
+	if err != nil {
+		return Key{}, fmt.Errorf("invalid notation signing certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return Key{}, fmt.Errorf("invalid notation signing certificate: %v", err)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(env.Signature)
+	if err != nil {
+		return Key{}, fmt.Errorf("invalid notation signature: %v", err)
+	}
+	signed := []byte(env.Protected + "." + env.Payload)
+	if err := verifyJWS(protected.Algorithm, cert.PublicKey, signed, sig); err != nil {
+		return Key{}, err
+	}
+	// the signature is only as good as the certificate it was made with
+	for _, key := range keys {
+		if key.equal(cert.PublicKey) {
+			return key, nil
+		}
+	}
+	return Key{}, fmt.Errorf("notation signing certificate %s does not hold any of the public keys", cert.Subject)
+}
+
+// verifyJWS verify a JWS signature of signed with the public key, for the JWS algorithms
+// notation uses
+func verifyJWS(alg string, public crypto.PublicKey, signed, sig []byte) error {
+	var hash crypto.Hash
+	switch alg {
+	case "PS256", "ES256":
+		hash = crypto.SHA256
+	case "PS384", "ES384":
+		hash = crypto.SHA384
+	case "PS512", "ES512":
+		hash = crypto.SHA512
+	default:
+		return fmt.Errorf("unsupported notation signature algorithm %s", alg)
+	}
+	h := hash.New()
+	h.Write(signed)
+	digest := h.Sum(nil)
+	switch key := public.(type) {
+	case *rsa.PublicKey:
+		if alg[0] != 'P' {
+			break
+		}
+		if err := rsa.VerifyPSS(key, hash, digest, sig, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash}); err != nil {
+			return errors.New("notation signature does not match its signing certificate")
+		}
+		return nil
+	case *ecdsa.PublicKey:
+		if alg[0] != 'E' {
+			break
+		}
+		// JWS signatures of ECDSA are r and s, each padded to the size of the curve
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if len(sig) != 2*size {
+			return errors.New("notation signature has the wrong length for its signing certificate")
+		}
+		r, s := new(big.Int).SetBytes(sig[:size]), new(big.Int).SetBytes(sig[size:])
+		if !ecdsa.Verify(key, digest, r, s) {
+			return errors.New("notation signature does not match its signing certificate")
+		}
+		return nil
+	}
+	return fmt.Errorf("notation signature algorithm %s does not match its signing certificate", alg)
+}
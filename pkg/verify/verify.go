@@ -0,0 +1,124 @@
+package verify
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Policy which content must be signed, and by whom
+type Policy struct {
+	// PublicKeys PEM files holding the public keys, or certificates, that may sign content;
+	// empty to not verify anything
+	PublicKeys []string
+	// Prefixes only content whose URL starts with one of these must be signed; empty for all
+	Prefixes []string
+}
+
+// Applies whether content from the URL must be signed. Only OCI content can be.
+func (p Policy) Applies(url string) bool {
+	if len(p.PublicKeys) == 0 || !strings.HasPrefix(url, "oci://") {
+		return false
+	}
+	if len(p.Prefixes) == 0 {
+		return true
+	}
+	for _, prefix := range p.Prefixes {
+		if strings.HasPrefix(url, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Key a public key that may sign content, named after the file it was read from
+type Key struct {
+	Name   string
+	Public crypto.PublicKey
+}
+
+// Keys read the public keys of the policy. They are read every time, so that keys that are
+// rotated are picked up right away.
+func (p Policy) Keys() ([]Key, error) {
+	var keys []Key
+	for _, path := range p.PublicKeys {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("could not read public key: %v", err)
+		}
+		found, err := parseKeys(path, b)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, found...)
+	}
+	return keys, nil
+}
+
+// parseKeys parse the public keys and certificates in a PEM file
+func parseKeys(name string, b []byte) ([]Key, error) {
+	var keys []Key
+	for {
+		var block *pem.Block
+		block, b = pem.Decode(b)
+		if block == nil {
+			break
+		}
+		var (
+			public crypto.PublicKey
+			err    error
+		)
+		switch block.Type {
+		case "PUBLIC KEY":
+			public, err = x509.ParsePKIXPublicKey(block.Bytes)
+		case "CERTIFICATE":
+			var cert *x509.Certificate
+			if cert, err = x509.ParseCertificate(block.Bytes); err == nil {
+				public = cert.PublicKey
+			}
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid public key in %s: %v", name, err)
+		}
+		keys = append(keys, Key{Name: name, Public: public})
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no public key or certificate in %s", name)
+	}
+	return keys, nil
+}
+
+// equal whether the key is the same as another public key
+func (k Key) equal(other crypto.PublicKey) bool {
+	switch public := k.Public.(type) {
+	case *ecdsa.PublicKey:
+		return public.Equal(other)
+	case *rsa.PublicKey:
+		return public.Equal(other)
+	case ed25519.PublicKey:
+		return public.Equal(other)
+	}
+	return false
+}
+
+// Error content is not signed by any of the keys
+type Error struct {
+	Digest string
+	// Reasons why each signature that was found did not verify
+	Reasons []string
+}
+
+func (e *Error) Error() string {
+	if len(e.Reasons) == 0 {
+		return fmt.Sprintf("no signature found for %s", e.Digest)
+	}
+	return fmt.Sprintf("no valid signature for %s: %s", e.Digest, strings.Join(e.Reasons, "; "))
+}